@@ -2,70 +2,98 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"github.com/gin-gonic/gin"
 	"github.com/itsjamie/gin-cors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/env"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	odb "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/routes"
 
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-// default settings
-var (
-	ipfsURL    string
-	orbitDbDir string
-)
-
-// parse cli flags
-func init() {
-	flag.StringVar(&ipfsURL, "ipfs-url", "http://localhost:5001", "IPFS URL")
-	flag.StringVar(&orbitDbDir, "orbitdb-dir", "./data/orbitdb", "OrbitDB directory")
-}
-
 // main is the entry point of the program
 func main() {
-	// parse cli flags
-	flag.Parse()
+	// "asteroid-api migrate" upgrades the stored documents instead of serving
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && args[0] == "migrate" {
+		command, args = args[0], args[1:]
+	}
 
-	// verify orbitdb dir exists
-	if _, err := os.Stat(orbitDbDir); os.IsNotExist(err) {
-		log.Printf("OrbitDB directory does not exist: %v\n", err)
-		// create orbitdb dir
-		err = os.MkdirAll(orbitDbDir, 0755)
-		if err != nil {
-			log.Panicf("Error creating OrbitDB directory: %v\n", err)
-			return
-		}
+	// flags, environment variables and config file
+	cfg, err := env.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v\n", err)
 	}
 
 	// main database context
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	log.Println("IPFS URL:", ipfsURL)
-	log.Println("OrbitDB directory:", orbitDbDir)
-	// create a new orbitdb instance
-	cancelODB, err := odb.InitializeOrbitDB(ipfsURL, orbitDbDir)
-	defer cancelODB() // cancel the orbitdb context
 
-	// ODB in PoC uses only one database: "default"
-	defaultDB, err := odb.OpenDatabase(ctx, "default")
-	if err != nil {
-		log.Print(err)
+	stores, defaultDB, indexDB, blobs, closeStores := openStores(ctx, cfg)
+
+	// the note stores of the users only accept notes signed by them
+	note.VerifyUserNotes(stores)
+
+	if command == "migrate" {
+		err = migrate(defaultDB, stores, indexDB)
+		closeStores()
+		if err != nil {
+			log.Fatalf("Error migrating the stores: %v\n", err)
+		}
+		return
+	}
+
+	noteIndex := note.NewIndex(indexDB)
+
+	// split the default store of older versions and move the notes of older user documents into the note index
+	if err := upgradeStores(defaultDB, stores, noteIndex); err != nil {
+		log.Panicf("Error upgrading the stores: %v\n", err)
+	}
+
+	// note events for /notes/stream, including writes replicated from other peers
+	noteFeed := note.NewFeed(stores)
+
+	// replicate the notes of every user, including the users added by other peers
+	stopNoteStores := user.OpenNoteStores(stores)
+
+	// promote the configured admins, e.g. the first one
+	for _, id := range cfg.AdminIDs {
+		if _, err := user.SetAdmin(stores, id, true); err != nil {
+			log.Printf("Cannot promote user %s to admin: %v\n", id, err)
+		}
+	}
+
+	// purge expired notes in the background
+	stopReaper := func() {}
+	if cfg.ReapInterval > 0 {
+		stopReaper = note.StartReaper(stores, noteIndex, blobs, cfg.ReapInterval)
 	}
 
 	// gin server
-	r := gin.Default()
+	r := gin.New()
+	r.Use(jwt.QueryToken(routes.StreamPath), gin.Logger(), gin.Recovery())
 
 	// cors
-	// In PoC, we set the Cross-Origin policies to allow all.
+	// By default, the Cross-Origin policies allow all origins.
 
 	r.Use(cors.Middleware(cors.Config{
-		Origins:         "*",
+		Origins:         cfg.AllowedOrigins(),
 		Methods:         "GET, PUT, POST, DELETE",
-		RequestHeaders:  "Origin, Authorization, Content-Type",
+		RequestHeaders:  "Origin, Authorization, Content-Type, Last-Event-ID",
 		ExposedHeaders:  "",
 		MaxAge:          50 * time.Second,
 		Credentials:     false,
@@ -79,18 +107,179 @@ func main() {
 		})
 	})
 
+	// token signing keys, published at /.well-known/jwks.json unless they are a shared secret
+	jwtKeys := jwt.SecretKeySet([]byte(cfg.JWTSecret))
+	if cfg.JWTAlgorithm != jwt.AlgorithmHS256 {
+		jwtKeys, err = jwt.LoadKeys(cfg.JWTKeys, cfg.JWTAlgorithm)
+		if err != nil {
+			log.Panicf("Error loading the JWT keys: %v\n", err)
+		}
+	}
+
 	// Initialise the auth middleware
 	//   protects the /notes endpoint
-	routes.InitAuth(r, defaultDB)
+	auth := routes.InitAuth(r, stores, noteIndex, noteFeed, blobs, jwt.Config{
+		Keys:       jwtKeys,
+		Timeout:    cfg.TokenTimeout,
+		MaxRefresh: cfg.TokenMaxRefresh,
+	})
 
 	// Initialise User Route Module
-	routes.InitUsers(r, defaultDB)
+	routes.InitUsers(r, stores, noteIndex, auth)
+
+	// run on the configured address, :3000 by default
+	srv := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: r,
+	}
 
-	// run on port 3000
-	err = r.Run(":3000")
+	// streams do not finish on their own, end them when draining
+	srv.RegisterOnShutdown(noteFeed.Close)
+
+	// stop on Ctrl+C and on docker-compose restarts
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = serve(sigCtx, srv, cfg.ShutdownTimeout)
+	stopReaper()
+	stopNoteStores()
+	closeStores()
 
 	// print errors, if there are any with the webserver
 	if err != nil {
-		log.Panicf("Error starting server: %v", err)
+		log.Panicf("Error running server: %v", err)
+	}
+}
+
+// openStores opens the stores of the entity types, the default store of older versions, the note index and
+// the blob store of the configured store type. The returned function flushes and closes them on shutdown.
+func openStores(ctx context.Context, cfg *env.Config) (odb.Stores, odb.Store, odb.Store, *odb.CountedBlobStore, func()) {
+	switch cfg.Store {
+	case "memory":
+		// nothing is persisted, useful for offline development
+		log.Println("Using the in-memory store")
+		blobs := odb.NewMemoryCountedBlobStore()
+		return odb.NewMemoryStores(), odb.NewMemoryStore(), odb.NewMemoryStore(), blobs, func() {}
+	case "orbitdb":
+		cancelODB, stores, db, idx := openOrbitDB(ctx, cfg)
+		closeStores := func() {
+			// close every open database before the client
+			if err := odb.CloseDatabases(); err != nil {
+				log.Printf("Error closing databases: %v\n", err)
+			}
+			cancelODB()
+		}
+		// uploaded files are added to the IPFS node of OrbitDB, notes with the same file share it
+		refs, err := stores.Registry.Open("blob-refs")
+		if err != nil {
+			closeStores()
+			log.Panicf("Error opening the blob references database: %v\n", err)
+		}
+		return stores, db, idx, odb.NewCountedBlobStore(odb.NewIPFSBlobStore(odb.Client.IPFS()), refs), closeStores
+	default:
+		log.Panicf("Unknown store type: %s\n", cfg.Store)
+		return odb.Stores{}, nil, nil, nil, nil
 	}
 }
+
+// serve runs srv until ctx is done, then stops accepting connections and waits up to timeout for in-flight
+// requests to finish. It returns early if the server fails.
+func serve(ctx context.Context, srv *http.Server, timeout time.Duration) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s\n", srv.Addr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down, draining in-flight requests...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Requests did not finish within %s: %v\n", timeout, err)
+		return err
+	}
+
+	return nil
+}
+
+// openOrbitDB connects to or starts the IPFS node and opens the OrbitDB document stores of the entity types,
+// the default store of older versions and the note index
+func openOrbitDB(ctx context.Context, cfg *env.Config) (context.CancelFunc, odb.Stores, odb.Store, odb.Store) {
+	orbitDbDir := cfg.OrbitDBDir
+
+	// verify orbitdb dir exists
+	if _, err := os.Stat(orbitDbDir); os.IsNotExist(err) {
+		log.Printf("OrbitDB directory does not exist: %v\n", err)
+		// create orbitdb dir
+		err = os.MkdirAll(orbitDbDir, 0755)
+		if err != nil {
+			log.Panicf("Error creating OrbitDB directory: %v\n", err)
+		}
+	}
+
+	log.Println("OrbitDB directory:", orbitDbDir)
+
+	// create a new orbitdb instance
+	var cancelODB context.CancelFunc
+	var err error
+
+	switch cfg.IPFSMode {
+	case "embedded":
+		log.Println("IPFS repo:", cfg.IPFSRepo)
+		cancelODB, err = odb.InitializeEmbeddedOrbitDB(cfg.IPFSRepo, orbitDbDir, cfg.SwarmAddrs)
+	case "remote":
+		log.Println("IPFS URL:", cfg.IPFSURL)
+		cancelODB, err = odb.InitializeOrbitDB(cfg.IPFSURL, orbitDbDir)
+	default:
+		log.Panicf("Unknown IPFS mode: %s\n", cfg.IPFSMode)
+	}
+
+	if err != nil {
+		log.Panicf("Error initializing OrbitDB: %v\n", err)
+	}
+
+	// every database is opened once and shared by all requests
+	registry := odb.NewRegistry(ctx)
+
+	// connect the other nodes and replicate their stores
+	err = registry.Replicate(odb.ReplicationConfig{
+		Peers:     cfg.Peers,
+		Addresses: cfg.Replicate,
+		Writers:   cfg.Writers,
+	})
+	if err != nil {
+		cancelODB()
+		log.Panicf("Error setting up the replication: %v\n", err)
+	}
+
+	// users, notes and devices are kept in their own databases
+	stores, err := odb.OpenStores(registry)
+	if err != nil {
+		cancelODB()
+		log.Panicf("Error opening the databases: %v\n", err)
+	}
+
+	// older versions kept users and notes in one database, "default" unless configured otherwise
+	defaultDB, err := registry.Open(cfg.DatabaseName)
+	if err != nil {
+		cancelODB()
+		log.Panicf("Error opening the default database: %v\n", err)
+	}
+
+	// the per-user note index
+	indexDB, err := registry.OpenShared("note-index")
+	if err != nil {
+		cancelODB()
+		log.Panicf("Error opening the note index database: %v\n", err)
+	}
+
+	return cancelODB, stores, defaultDB, indexDB
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address which is not in use
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// slowServer returns a server whose requests take d, and a channel receiving the start of each request
+func slowServer(t *testing.T, d time.Duration) (*http.Server, chan struct{}) {
+	started := make(chan struct{}, 1)
+	return &http.Server{
+		Addr: freeAddr(t),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			time.Sleep(d)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}, started
+}
+
+func TestServe(t *testing.T) {
+	t.Run("should drain in-flight requests on shutdown", func(t *testing.T) {
+		srv, started := slowServer(t, 200*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- serve(ctx, srv, 5*time.Second)
+		}()
+
+		resp := make(chan int, 1)
+		go func() {
+			// the server might not be listening yet
+			for i := 0; i < 50; i++ {
+				r, err := http.Get("http://" + srv.Addr)
+				if err == nil {
+					r.Body.Close()
+					resp <- r.StatusCode
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			resp <- 0
+		}()
+
+		<-started
+		cancel()
+
+		if code := <-resp; code != http.StatusOK {
+			t.Errorf("Expected the in-flight request to finish with %d, but was %d", http.StatusOK, code)
+		}
+
+		if err := <-done; err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	})
+
+	t.Run("should stop waiting after the timeout", func(t *testing.T) {
+		srv, started := slowServer(t, 2*time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- serve(ctx, srv, 100*time.Millisecond)
+		}()
+
+		go func() {
+			for i := 0; i < 50; i++ {
+				r, err := http.Get("http://" + srv.Addr)
+				if err == nil {
+					r.Body.Close()
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		<-started
+		cancel()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("Expected an error for requests exceeding the timeout")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("serve did not return after the timeout")
+		}
+	})
+
+	t.Run("should return listen errors", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+
+		srv := &http.Server{Addr: l.Addr().String()}
+		if err := serve(context.Background(), srv, time.Second); err == nil {
+			t.Errorf("Expected an error for an address in use")
+		}
+	})
+}
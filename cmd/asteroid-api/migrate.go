@@ -0,0 +1,84 @@
+package main
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	odb "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+)
+
+// progressInterval is the number of documents between two progress reports of the migrate command
+const progressInterval = 100
+
+// migrate is the "asteroid-api migrate" command. It splits the default store of older versions, then rewrites
+// the documents of the stores to the latest version of their schema, reporting the progress.
+func migrate(defaultDB odb.Store, stores odb.Stores, indexDB odb.Store) error {
+	if err := upgradeStores(defaultDB, stores, note.NewIndex(indexDB)); err != nil {
+		return err
+	}
+
+	for _, s := range []struct {
+		name string
+		db   odb.Store
+	}{
+		{odb.UsersStore, stores.Users},
+		{odb.NotesStore, stores.Notes},
+		{odb.DevicesStore, stores.Devices},
+		{"note-index", indexDB},
+	} {
+		log.Printf("Migrating the %s store\n", s.name)
+
+		report, err := odb.Migrate(s.db, odb.Schemas(), func(report odb.MigrationReport) {
+			if report.Done%progressInterval == 0 {
+				log.Printf("%s: %d of %d documents, %d migrated\n", s.name, report.Done, report.Total, report.Migrated)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%s: migrated %d of %d documents, %d failed, %d of an unknown type\n",
+			s.name, report.Migrated, report.Total, report.Failed, report.Unknown)
+	}
+
+	return nil
+}
+
+// upgradeStores moves the users and notes of the default store of older versions into their own stores and
+// the devices of older user documents into the devices store. The notes of older user documents are moved
+// into the index. It runs on every start, so documents replicated from peers of older versions are moved too.
+func upgradeStores(defaultDB odb.Store, stores odb.Stores, index note.Index) error {
+	for _, s := range []struct {
+		schema *odb.Schema
+		db     odb.Store
+	}{
+		{user.Schema, stores.Users},
+		{note.Schema, stores.Notes},
+	} {
+		moved, err := odb.Move(defaultDB, s.db, s.schema)
+		if err != nil {
+			return err
+		}
+		if moved > 0 {
+			log.Printf("Moved %d documents of the type %s out of the default store\n", moved, s.schema.Name)
+		}
+	}
+
+	migrated, err := note.MigrateUserNotes(stores.Users, stores.Notes, index)
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Printf("Migrated the notes of %d users to the note index\n", migrated)
+	}
+
+	moved, err := user.MoveDevices(stores)
+	if err != nil {
+		return err
+	}
+	if moved > 0 {
+		log.Printf("Moved the devices of %d users to the devices store\n", moved)
+	}
+
+	return nil
+}
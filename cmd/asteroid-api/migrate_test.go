@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	odb "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+)
+
+// readDocument returns the fields of the document stored under key
+func readDocument(t *testing.T, db odb.Store, key string) map[string]interface{} {
+	resp, err := db.Read(key)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", key, err)
+	}
+
+	item, err := odb.UnmarshalItem(resp["data"].(string))
+	if err != nil {
+		t.Fatalf("Error unmarshalling %s: %v", key, err)
+	}
+
+	return item.(map[string]interface{})
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("should split the default store and upgrade its documents", func(t *testing.T) {
+		defaultDB, stores, indexDB := odb.NewMemoryStore(), odb.NewMemoryStores(), odb.NewMemoryStore()
+
+		uid, noteID := uuid.Generate().String(), uuid.Generate().String()
+		_, _ = defaultDB.Create(map[string]interface{}{
+			"publicKey": "legacy",
+			"createdAt": 1,
+			"notes":     noteID,
+		}, &odb.DatabaseCreateOptions{ID: uid})
+		_, _ = defaultDB.Create(map[string]interface{}{
+			"id":   uuid.Generate().String(),
+			"uid":  uid,
+			"data": "hello",
+		}, &odb.DatabaseCreateOptions{ID: noteID})
+
+		if err := migrate(defaultDB, stores, indexDB); err != nil {
+			t.Fatalf("Error migrating: %v", err)
+		}
+
+		if left := defaultDB.ReadAll(); len(left) != 0 {
+			t.Errorf("Expected the default store to be empty, got %v", left)
+		}
+
+		u := readDocument(t, stores.Users, uid)
+		if odb.DocumentVersion(u) != user.Schema.Version() || u[odb.TypeKey] != user.Schema.Name {
+			t.Errorf("Expected the user to have version %d, got %v", user.Schema.Version(), u)
+		}
+		if u["devices"] != nil || u["notes"] != nil {
+			t.Errorf("Expected the user to have no devices and notes, got %v", u)
+		}
+
+		device := readDocument(t, stores.Devices, uid)
+		if device["uid"] != uid || device["publicKey"] != "legacy" || device[odb.TypeKey] != user.DeviceSchema.Name {
+			t.Errorf("Expected the registered key as primary device, got %v", device)
+		}
+
+		n := readDocument(t, stores.Notes, noteID)
+		if odb.DocumentVersion(n) != note.Schema.Version() || n["id"] != nil {
+			t.Errorf("Expected the note to have version %d and no id, got %v", note.Schema.Version(), n)
+		}
+
+		entry := readDocument(t, indexDB, noteID)
+		if odb.DocumentVersion(entry) != note.IndexSchema.Version() {
+			t.Errorf("Expected the index entry to have version %d, got %v", note.IndexSchema.Version(), entry)
+		}
+	})
+
+	t.Run("should not read a note as a user", func(t *testing.T) {
+		stores := odb.NewMemoryStores()
+
+		n := &note.Note{ID: uuid.Generate(), UID: uuid.Generate(), Data: "hello"}
+		if err := odb.NewRepository[note.Note](stores.Notes, note.Schema).CreateWithKey(n.ID.String(), n); err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+
+		// a note which ended up in the users store, e.g. replicated from a mixed default store
+		_, _ = stores.Users.Create(readDocument(t, stores.Notes, n.ID.String()),
+			&odb.DatabaseCreateOptions{ID: n.ID.String()})
+
+		if _, err := user.Find(stores, n.ID.String()); err == nil {
+			t.Errorf("Expected the note not to be found as a user")
+		}
+	})
+}
@@ -4,29 +4,43 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	sign               = flag.Bool("sign", false, "sign a nonce")
 	gen                = flag.Bool("gen", false, "generate a new key pair")
 	targetLocationDir  = flag.String("targetLocationDir", "./", "target location directory")
-	nonce              = flag.String("nonce", "", "nonce to sign")
+	nonce              = flag.String("nonce", "", "base64 encoded nonce of a challenge to sign")
 	privateKeyFilePath = flag.String("privateKeyFilePath", "./private.pem", "private key file path")
+	encrypt            = flag.Bool("encrypt", false, "encrypt a note into an envelope")
+	decrypt            = flag.Bool("decrypt", false, "decrypt the envelope of a note")
+	publicKeyFilePath  = flag.String("publicKeyFilePath", "./public.pem", "comma separated public key file paths to encrypt for")
+	in                 = flag.String("in", "-", "input file, - for stdin")
+	signNote           = flag.Bool("signNote", false, "sign the JSON draft of a note")
+	noteUID            = flag.String("uid", "", "id of the user owning the note to sign")
+	signDelete         = flag.Bool("signDelete", false, "sign the deletion of a note")
 )
 
 func init() {
 
 }
 
-// SignNonce signs a nonce with the private key.
+// SignNonce signs the base64 encoded nonce of a challenge with the private key, using the
+// signature scheme the server verifies (see user.SignatureScheme).
 func SignNonce(privateKeyFilePath, nonce string) (string, error) {
 	// open private key file
 	privateKeyFile, err := os.Open(privateKeyFilePath)
@@ -44,20 +58,14 @@ func SignNonce(privateKeyFilePath, nonce string) (string, error) {
 	}
 
 	// decode private key from PEM format
-	block, _ := pem.Decode(privateKeyBytes)
-
-	// decode private key to rsa.PrivateKey
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	privateKey, err := parsePrivateKey(privateKeyBytes)
 	if err != nil {
 		fmt.Println(err)
 		return "", err
 	}
 
-	// hashing the message with SHA256
-	hashed := sha256.Sum256([]byte(nonce))
-
 	// sign nonce with private key
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+	signature, err := user.SignNonce(privateKey, nonce)
 
 	if err != nil {
 		fmt.Println(err)
@@ -70,6 +78,237 @@ func SignNonce(privateKeyFilePath, nonce string) (string, error) {
 	return signatureBase64, nil
 }
 
+// parsePrivateKey decodes a PEM encoded PKCS #1 RSA, SEC 1 EC or PKCS #8 private key
+func parsePrivateKey(privateKeyBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse PEM block containing the private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// SignNote completes the draft of a new note of the user uid, the JSON body of POST /notes/ with its note, envelope
+// or blob, and signs it with the private key, see note.Note.Digest. A new id and the current time are set unless
+// the draft has them, and a ttl is turned into expiresAt. A draft of a change, the body of PUT /notes/:id, also
+// has the id, createdAt and expiresAt of the note and its updatedAt. An expiring note is sent with the signature of
+// its note.Note.ExpiryTombstone. It returns the body to send.
+func SignNote(privateKeyFilePath, uid string, draft []byte) (string, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	owner, err := uuid.Parse(uid)
+	if err != nil {
+		return "", fmt.Errorf("invalid user id %q: %v", uid, err)
+	}
+
+	var body struct {
+		ID              string         `json:"id"`
+		CreatedAt       int64          `json:"createdAt"`
+		Note            string         `json:"note,omitempty"`
+		Envelope        *note.Envelope `json:"envelope,omitempty"`
+		Blob            *note.Blob     `json:"blob,omitempty"`
+		TTL             int64          `json:"ttl,omitempty"`
+		ExpiresAt       int64          `json:"expiresAt,omitempty"`
+		UpdatedAt       int64          `json:"updatedAt,omitempty"`
+		Signature       string         `json:"signature"`
+		ExpirySignature string         `json:"expirySignature,omitempty"`
+	}
+	if err := json.Unmarshal(draft, &body); err != nil {
+		return "", fmt.Errorf("invalid note draft: %v", err)
+	}
+
+	if body.ID == "" {
+		body.ID = uuid.Generate().String()
+	}
+	id, err := uuid.Parse(body.ID)
+	if err != nil {
+		return "", fmt.Errorf("invalid note id %q: %v", body.ID, err)
+	}
+
+	if body.CreatedAt == 0 {
+		body.CreatedAt = time.Now().UnixMilli()
+	}
+	if body.TTL > 0 {
+		body.ExpiresAt = body.CreatedAt + body.TTL*1000
+		body.TTL = 0
+	}
+
+	n := &note.Note{
+		ID:        id,
+		UID:       owner,
+		Data:      body.Note,
+		CreatedAt: body.CreatedAt,
+		Blob:      body.Blob,
+		Envelope:  body.Envelope,
+		ExpiresAt: body.ExpiresAt,
+		UpdatedAt: body.UpdatedAt,
+	}
+	signature, err := note.Sign(privateKey, n)
+	if err != nil {
+		return "", err
+	}
+	body.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	// the tombstone an expiring note is replaced by
+	if body.ExpiresAt != 0 {
+		signature, err := note.Sign(privateKey, n.ExpiryTombstone())
+		if err != nil {
+			return "", err
+		}
+		body.ExpirySignature = base64.StdEncoding.EncodeToString(signature)
+	}
+
+	signed, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// SignDelete signs the deletion of a note, given as the JSON response of GET /notes/:id, with the private key: it
+// signs the tombstone of the note deleted now, see note.Note.Tombstone. It returns the body of DELETE /notes/:id.
+func SignDelete(privateKeyFilePath string, noteJSON []byte) (string, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		ID  string `json:"id"`
+		UID string `json:"uid"`
+		note.Blob
+	}
+	if err := json.Unmarshal(noteJSON, &resp); err != nil {
+		return "", fmt.Errorf("invalid note: %v", err)
+	}
+
+	id, err := uuid.Parse(resp.ID)
+	if err != nil {
+		return "", fmt.Errorf("invalid note id %q: %v", resp.ID, err)
+	}
+	owner, err := uuid.Parse(resp.UID)
+	if err != nil {
+		return "", fmt.Errorf("invalid user id %q: %v", resp.UID, err)
+	}
+
+	n := note.Note{ID: id, UID: owner}
+	if resp.CID != "" {
+		n.Blob = &resp.Blob
+	}
+
+	deletedAt := time.Now().UnixMilli()
+	signature, err := note.Sign(privateKey, n.Tombstone(deletedAt))
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"deletedAt": deletedAt,
+		"signature": base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// EncryptNote encrypts plaintext into the JSON of an envelope for the RSA, Ed25519 and ECDSA public keys in the
+// files, which can be sent as the "envelope" of a note
+func EncryptNote(publicKeyFilePaths []string, plaintext []byte) (string, error) {
+	recipients := make([]crypto.PublicKey, 0, len(publicKeyFilePaths))
+	for _, path := range publicKeyFilePaths {
+		publicKeyBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		pub, _, err := user.ParsePublicKey(string(publicKeyBytes))
+		if err != nil {
+			return "", err
+		}
+
+		recipients = append(recipients, pub)
+	}
+
+	envelope, err := note.SealEnvelope(plaintext, recipients)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// DecryptNote decrypts an envelope, or a note response holding one, with the private key in the file
+func DecryptNote(privateKeyFilePath string, envelopeJSON []byte) ([]byte, error) {
+	privateKeyBytes, err := ioutil.ReadFile(privateKeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := parsePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope struct {
+		note.Envelope
+		Note *note.Envelope `json:"envelope"`
+	}
+	if err := json.Unmarshal(envelopeJSON, &envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.Note != nil {
+		return envelope.Note.Open(privateKey)
+	}
+
+	return envelope.Envelope.Open(privateKey)
+}
+
+// readInput reads the file at path, or stdin for -
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return ioutil.ReadFile(path)
+}
+
 // closeFile is a helper function to close a file.
 func closeFile(file *os.File) {
 	err := file.Close()
@@ -174,8 +413,80 @@ func main() {
 		return
 	}
 
+	// sign a note
+	if *signNote {
+		draft, err := readInput(*in)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		body, err := SignNote(*privateKeyFilePath, *noteUID, draft)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(body)
+		return
+	}
+
+	// sign the deletion of a note
+	if *signDelete {
+		noteJSON, err := readInput(*in)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		body, err := SignDelete(*privateKeyFilePath, noteJSON)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(body)
+		return
+	}
+
+	// encrypt a note
+	if *encrypt {
+		plaintext, err := readInput(*in)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		envelope, err := EncryptNote(strings.Split(*publicKeyFilePath, ","), plaintext)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(envelope)
+		return
+	}
+
+	// decrypt a note
+	if *decrypt {
+		envelope, err := readInput(*in)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		plaintext, err := DecryptNote(*privateKeyFilePath, envelope)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Print(string(plaintext))
+		return
+	}
+
 	// print usage
 	fmt.Println("Usage:")
 	fmt.Println("  rsa-keygen -gen -targetLocationDir <targetLocationDir>")
 	fmt.Println("  rsa-keygen -sign -nonce <nonce> -privateKeyFilePath <privateKeyFilePath>")
+	fmt.Println("  rsa-keygen -signNote -uid <uid> -privateKeyFilePath <privateKeyFilePath> -in <file>")
+	fmt.Println("  rsa-keygen -signDelete -privateKeyFilePath <privateKeyFilePath> -in <file>")
+	fmt.Println("  rsa-keygen -encrypt -publicKeyFilePath <publicKeyFilePath,...> -in <file>")
+	fmt.Println("  rsa-keygen -decrypt -privateKeyFilePath <privateKeyFilePath> -in <file>")
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/routes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// do sends a request to the router and decodes the JSON response into v
+func do(t *testing.T, r http.Handler, req *http.Request, v interface{}) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("Error parsing response %v: %v", w.Body, err)
+		}
+	}
+
+	return w.Code
+}
+
+// TestKeygenLogin generates a key pair, registers it, signs a challenge with the keygen tool and logs in
+func TestKeygenLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	db := orbitdb.NewMemoryStores()
+	note.VerifyUserNotes(db)
+	index := note.NewIndex(orbitdb.NewMemoryStore())
+	auth := routes.InitAuth(r, db, index, note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), jwt.Config{
+		Secret:     []byte("test secret key, do not use in production"),
+		Timeout:    time.Hour,
+		MaxRefresh: time.Hour,
+	})
+	routes.InitUsers(r, db, index, auth)
+
+	dir := t.TempDir()
+	publicKey, _, err := GenerateKeys(dir)
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	// register
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "public.pem")
+	_, _ = part.Write([]byte(publicKey))
+	_ = writer.Close()
+
+	req, _ := http.NewRequest("POST", "/users/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var registered struct {
+		ID string `json:"_id"`
+	}
+	if code := do(t, r, req, &registered); code != http.StatusOK {
+		t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+	}
+
+	// challenge
+	req, _ = http.NewRequest("GET", "/auth/challenge?id="+registered.ID, nil)
+
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if code := do(t, r, req, &challenge); code != http.StatusOK {
+		t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+	}
+
+	signature, err := SignNonce(dir+"/private.pem", challenge.Nonce)
+	if err != nil {
+		t.Fatalf("Error signing nonce: %v", err)
+	}
+
+	var sessionToken string
+
+	t.Run("should reject an unknown signature scheme", func(t *testing.T) {
+		bd, _ := json.Marshal(gin.H{"id": registered.ID, "signature": signature, "scheme": "rsa-pkcs1v15"})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(bd))
+
+		if code := do(t, r, req, nil); code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, code)
+		}
+	})
+
+	t.Run("should log in with the signed challenge", func(t *testing.T) {
+		bd, _ := json.Marshal(gin.H{"id": registered.ID, "signature": signature, "scheme": user.SignatureScheme})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(bd))
+
+		var token struct {
+			Token string `json:"token"`
+		}
+		if code := do(t, r, req, &token); code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+
+		req, _ = http.NewRequest("GET", "/notes/", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		if code := do(t, r, req, nil); code != http.StatusOK {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+
+		sessionToken = token.Token
+	})
+
+	t.Run("should store encrypted notes the server cannot read", func(t *testing.T) {
+		envelope, err := EncryptNote([]string{dir + "/public.pem"}, []byte("end to end"))
+		if err != nil {
+			t.Fatalf("Error encrypting note: %v", err)
+		}
+
+		signed, err := SignNote(dir+"/private.pem", registered.ID, []byte(`{"envelope":`+envelope+`,"ttl":60}`))
+		if err != nil {
+			t.Fatalf("Error signing note: %v", err)
+		}
+
+		req, _ := http.NewRequest("POST", "/notes/", strings.NewReader(signed))
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		if code := do(t, r, req, &created); code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+
+		req, _ = http.NewRequest("GET", "/notes/"+created.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if strings.Contains(w.Body.String(), "end to end") {
+			t.Errorf("Expected the server to only know the ciphertext, got %v", w.Body)
+		}
+
+		plaintext, err := DecryptNote(dir+"/private.pem", w.Body.Bytes())
+		if err != nil || string(plaintext) != "end to end" {
+			t.Errorf("Expected the note to decrypt, got %s %v", plaintext, err)
+		}
+	})
+
+	t.Run("should create and delete notes of uploaded files", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "notes.txt")
+		_, _ = part.Write([]byte("uploaded"))
+		_ = writer.Close()
+
+		req, _ := http.NewRequest("POST", "/notes/files", body)
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		var blob json.RawMessage
+		if code := do(t, r, req, &blob); code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+
+		signed, err := SignNote(dir+"/private.pem", registered.ID, []byte(`{"blob":`+string(blob)+`}`))
+		if err != nil {
+			t.Fatalf("Error signing note: %v", err)
+		}
+
+		req, _ = http.NewRequest("POST", "/notes/", strings.NewReader(signed))
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+
+		var created json.RawMessage
+		if code := do(t, r, req, &created); code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+
+		deletion, err := SignDelete(dir+"/private.pem", created)
+		if err != nil {
+			t.Fatalf("Error signing deletion: %v", err)
+		}
+
+		var id struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(created, &id)
+
+		req, _ = http.NewRequest("DELETE", "/notes/"+id.ID, strings.NewReader(deletion))
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+		if code := do(t, r, req, nil); code != http.StatusOK {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusOK, code)
+		}
+	})
+}
@@ -0,0 +1,387 @@
+package env
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	log.SetPrefix("[env/config] ")
+}
+
+// EnvPrefix is the prefix of the environment variables of every setting, e.g. ASTEROID_LISTEN_ADDR for -listen-addr
+const EnvPrefix = "ASTEROID_"
+
+// legacyEnv maps settings to the environment variables used by older Dockerfiles and docker-compose files
+var legacyEnv = map[string]string{
+	"ipfs-url":    "IPFS_API_URL",
+	"orbitdb-dir": "ORBIT_DB_LOCATION",
+}
+
+// Config holds the settings of the API server
+type Config struct {
+	// ListenAddr is the host:port the HTTP server listens on
+	ListenAddr string
+	// IPFSURL is the HTTP API of the IPFS daemon in remote mode
+	IPFSURL string
+	// IPFSMode is either "remote" or "embedded"
+	IPFSMode string
+	// DataDir is the base directory of IPFSRepo and OrbitDBDir, unless they are set explicitly
+	DataDir    string
+	IPFSRepo   string
+	OrbitDBDir string
+	// Store is either "orbitdb" or "memory"
+	Store string
+	// DatabaseName is the name of the OrbitDB document store of older versions holding users and notes. Its
+	// documents are moved into the users, notes and devices stores on startup.
+	DatabaseName string
+	// JWTAlgorithm is the signing algorithm of the tokens: EdDSA, RS256 or HS256
+	JWTAlgorithm string
+	// JWTKeys are the PEM private key files of EdDSA and RS256. The first one signs, the others only verify tokens
+	// issued before a key rollover. The first one is generated if it does not exist.
+	JWTKeys []string
+	// JWTSecret is the HMAC key of HS256. A random secret is generated if it is empty.
+	JWTSecret       string
+	TokenTimeout    time.Duration
+	TokenMaxRefresh time.Duration
+	// ShutdownTimeout is the time in-flight requests get to finish on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration
+	// ReapInterval is how often expired notes are purged, 0 disables purging
+	ReapInterval time.Duration
+	// CORSOrigins are the allowed origins, "*" allows all
+	CORSOrigins []string
+	// AdminIDs are the ids of the users promoted to admins at startup, e.g. to bootstrap the first admin
+	AdminIDs []string
+	// SwarmAddrs are the multiaddrs the embedded IPFS node listens on for peers
+	SwarmAddrs []string
+	// Peers are the multiaddrs, including their /p2p/ id, of the peers connected at startup
+	Peers []string
+	// Replicate are the OrbitDB addresses of stores of other nodes opened at startup. A store named like one of
+	// the stores of this node, e.g. users, is used instead of it.
+	Replicate []string
+	// Writers are the OrbitDB identities of the other nodes which may write to the shared stores
+	Writers []string
+	// File is the config file the settings were read from, if any
+	File string
+}
+
+// Load reads the configuration. Settings are taken from, in order of precedence, the command line arguments,
+// environment variables, the config file given with -config or ASTEROID_CONFIG, and the defaults.
+// The config file is YAML or TOML, depending on its extension, and uses the flag names as keys.
+func Load(args []string) (*Config, error) {
+	cfg := &Config{}
+	fs := flagSet(cfg)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// settings given on the command line take precedence
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(f.Name)
+		if err != nil || set[f.Name] || !ok {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), err)
+			return
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.File != "" {
+		values, err := readFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, value := range values {
+			if fs.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("unknown setting %q in %s", name, cfg.File)
+			}
+			if set[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s in %s: %v", value, name, cfg.File, err)
+			}
+		}
+	}
+
+	if cfg.IPFSRepo == "" {
+		cfg.IPFSRepo = filepath.Join(cfg.DataDir, "ipfs")
+	}
+	if cfg.OrbitDBDir == "" {
+		cfg.OrbitDBDir = filepath.Join(cfg.DataDir, "orbitdb")
+	}
+	if len(cfg.JWTKeys) == 0 {
+		cfg.JWTKeys = []string{filepath.Join(cfg.DataDir, "jwt.pem")}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.JWTSecret == "" {
+		if cfg.JWTAlgorithm == "HS256" {
+			log.Println("No JWT secret configured, generating a random one. Tokens become invalid on restart.")
+		}
+		cfg.JWTSecret, err = randomSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// Default returns the configuration without any flags, environment variables or config file
+func Default() *Config {
+	cfg := &Config{}
+	_ = flagSet(cfg)
+	cfg.IPFSRepo = filepath.Join(cfg.DataDir, "ipfs")
+	cfg.OrbitDBDir = filepath.Join(cfg.DataDir, "orbitdb")
+	cfg.JWTKeys = []string{filepath.Join(cfg.DataDir, "jwt.pem")}
+	return cfg
+}
+
+// flagSet registers the settings of cfg as flags and sets their defaults
+func flagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("asteroid-api", flag.ContinueOnError)
+
+	fs.StringVar(&cfg.File, "config", "", "YAML or TOML config file")
+	fs.StringVar(&cfg.ListenAddr, "listen-addr", ":3000", "address the HTTP server listens on")
+	fs.StringVar(&cfg.IPFSURL, "ipfs-url", "http://localhost:5001", "IPFS URL")
+	fs.StringVar(&cfg.IPFSMode, "ipfs-mode", "remote", "IPFS mode: remote (connect to ipfs-url) or embedded")
+	fs.StringVar(&cfg.DataDir, "data-dir", "./data", "base directory of ipfs-repo and orbitdb-dir")
+	fs.StringVar(&cfg.IPFSRepo, "ipfs-repo", "", "IPFS repo directory of the embedded node (default <data-dir>/ipfs)")
+	fs.StringVar(&cfg.OrbitDBDir, "orbitdb-dir", "", "OrbitDB directory (default <data-dir>/orbitdb)")
+	fs.StringVar(&cfg.Store, "store", "orbitdb", "storage backend: orbitdb or memory")
+	fs.StringVar(&cfg.DatabaseName, "db-name", "default", "name of the OrbitDB document store of older versions, which is split into the users, notes and devices stores")
+	fs.StringVar(&cfg.JWTAlgorithm, "jwt-algorithm", "EdDSA", "signing algorithm of the tokens: EdDSA, RS256 or HS256")
+	fs.Var((*listValue)(&cfg.JWTKeys), "jwt-keys", "comma separated PEM private keys of the tokens, the first one signs (default <data-dir>/jwt.pem)")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret", "", "HMAC secret of HS256 tokens, at least 32 bytes (default random)")
+	fs.DurationVar(&cfg.TokenTimeout, "token-timeout", 7*24*time.Hour, "lifetime of a token")
+	fs.DurationVar(&cfg.TokenMaxRefresh, "token-max-refresh", 7*24*time.Hour, "time a token can be refreshed after it expired")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time in-flight requests get to finish on shutdown")
+	fs.DurationVar(&cfg.ReapInterval, "reap-interval", time.Minute, "how often expired notes are purged, 0 disables purging")
+	fs.Var((*listValue)(&cfg.CORSOrigins), "cors-origins", "comma separated allowed CORS origins (default *)")
+	fs.Var((*listValue)(&cfg.AdminIDs), "admin-ids", "comma separated ids of users promoted to admins at startup")
+	fs.Var((*listValue)(&cfg.SwarmAddrs), "swarm-addrs", "comma separated multiaddrs the embedded IPFS node listens on (default /ip4/127.0.0.1/tcp/0)")
+	fs.Var((*listValue)(&cfg.Peers), "peers", "comma separated multiaddrs of the peers to connect at startup, ending with /p2p/<peer id>")
+	fs.Var((*listValue)(&cfg.Replicate), "replicate", "comma separated OrbitDB addresses of the stores of other nodes to replicate")
+	fs.Var((*listValue)(&cfg.Writers), "writers", "comma separated OrbitDB identities of the other nodes allowed to write to the shared stores")
+
+	return fs
+}
+
+// Validate returns an error for the first invalid setting
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen-addr %q: %v", c.ListenAddr, err)
+	}
+
+	switch c.Store {
+	case "memory":
+	case "orbitdb":
+		switch c.IPFSMode {
+		case "embedded":
+		case "remote":
+			u, err := url.Parse(c.IPFSURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid ipfs-url %q, expected http(s)://host:port", c.IPFSURL)
+			}
+		default:
+			return fmt.Errorf("unknown ipfs-mode %q, expected remote or embedded", c.IPFSMode)
+		}
+	default:
+		return fmt.Errorf("unknown store %q, expected orbitdb or memory", c.Store)
+	}
+
+	if c.DatabaseName == "" || strings.ContainsAny(c.DatabaseName, "/\\") {
+		return fmt.Errorf("invalid db-name %q", c.DatabaseName)
+	}
+
+	switch c.JWTAlgorithm {
+	case "EdDSA", "RS256", "HS256":
+	default:
+		return fmt.Errorf("unknown jwt-algorithm %q, expected EdDSA, RS256 or HS256", c.JWTAlgorithm)
+	}
+
+	if c.JWTSecret != "" && len(c.JWTSecret) < 32 {
+		return errors.New("jwt-secret must be at least 32 bytes long")
+	}
+
+	if c.TokenTimeout <= 0 {
+		return fmt.Errorf("token-timeout must be positive, got %s", c.TokenTimeout)
+	}
+
+	if c.TokenMaxRefresh < 0 {
+		return fmt.Errorf("token-max-refresh must not be negative, got %s", c.TokenMaxRefresh)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown-timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+
+	if c.ReapInterval < 0 {
+		return fmt.Errorf("reap-interval must not be negative, got %s", c.ReapInterval)
+	}
+
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid CORS origin %q, expected scheme://host[:port]", origin)
+		}
+	}
+
+	for _, id := range c.AdminIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return fmt.Errorf("invalid admin id %q: %v", id, err)
+		}
+	}
+
+	for _, addr := range c.SwarmAddrs {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			return fmt.Errorf("invalid swarm address %q: %v", addr, err)
+		}
+	}
+
+	for _, addr := range c.Peers {
+		if _, err := peer.AddrInfoFromString(addr); err != nil {
+			return fmt.Errorf("invalid peer %q, expected a multiaddr ending with /p2p/<peer id>: %v", addr, err)
+		}
+	}
+
+	for _, addr := range c.Replicate {
+		// /orbitdb/<manifest cid>/<name>
+		parts := strings.Split(addr, "/")
+		if len(parts) != 4 || parts[0] != "" || parts[1] != "orbitdb" || parts[3] == "" {
+			return fmt.Errorf("invalid store address %q, expected /orbitdb/<cid>/<name>", addr)
+		}
+		if _, err := cid.Decode(parts[2]); err != nil {
+			return fmt.Errorf("invalid store address %q: %v", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// AllowedOrigins returns the CORS origins in the format of gin-cors
+func (c *Config) AllowedOrigins() string {
+	if len(c.CORSOrigins) == 0 {
+		return "*"
+	}
+	return strings.Join(c.CORSOrigins, ", ")
+}
+
+// lookupEnv returns the environment variable of a setting, falling back to its legacy name
+func lookupEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(envName(name)); ok {
+		return value, true
+	}
+	if legacy, ok := legacyEnv[name]; ok {
+		return os.LookupEnv(legacy)
+	}
+	return "", false
+}
+
+// envName returns the environment variable of a setting
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readFile reads a flat YAML or TOML config file into flag values
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("unexpected section %q in %s", name, path)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+// randomSecret generates a 32 byte secret
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// listValue is a comma separated flag value
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
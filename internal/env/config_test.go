@@ -0,0 +1,171 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes a config file into a temporary directory
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("error writing config file %v\n", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+
+	t.Run("should use the defaults", func(t *testing.T) {
+		cfg, err := Load(nil)
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if cfg.ListenAddr != ":3000" || cfg.DatabaseName != "default" || cfg.TokenTimeout != 7*24*time.Hour {
+			t.Errorf("unexpected defaults %+v", cfg)
+		}
+
+		if cfg.OrbitDBDir != filepath.Join("data", "orbitdb") || cfg.IPFSRepo != filepath.Join("data", "ipfs") {
+			t.Errorf("directories should default to the data dir, got %s and %s", cfg.OrbitDBDir, cfg.IPFSRepo)
+		}
+
+		if len(cfg.JWTSecret) != 32 {
+			t.Errorf("a random secret should be generated")
+		}
+
+		if cfg.JWTAlgorithm != "EdDSA" || len(cfg.JWTKeys) != 1 || cfg.JWTKeys[0] != filepath.Join("data", "jwt.pem") {
+			t.Errorf("tokens should be signed with an EdDSA key in the data dir, got %s %v", cfg.JWTAlgorithm, cfg.JWTKeys)
+		}
+
+		if cfg.AllowedOrigins() != "*" {
+			t.Errorf("all origins should be allowed by default")
+		}
+	})
+
+	t.Run("should read environment variables", func(t *testing.T) {
+		t.Setenv("ASTEROID_LISTEN_ADDR", ":8080")
+		t.Setenv("IPFS_API_URL", "http://asteroid-ipfs:5001")
+		t.Setenv("ORBIT_DB_LOCATION", "/data/orbitdb")
+		t.Setenv("ASTEROID_CORS_ORIGINS", "https://a.example, https://b.example")
+
+		cfg, err := Load(nil)
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if cfg.ListenAddr != ":8080" || cfg.IPFSURL != "http://asteroid-ipfs:5001" || cfg.OrbitDBDir != "/data/orbitdb" {
+			t.Errorf("environment variables were not applied %+v", cfg)
+		}
+
+		if cfg.AllowedOrigins() != "https://a.example, https://b.example" {
+			t.Errorf("unexpected origins %s", cfg.AllowedOrigins())
+		}
+	})
+
+	t.Run("should prefer flags over environment variables and the config file", func(t *testing.T) {
+		path := writeFile(t, "asteroid.yaml", "listen-addr: \":7000\"\ndb-name: from-file\n")
+		t.Setenv("ASTEROID_LISTEN_ADDR", ":8080")
+
+		cfg, err := Load([]string{"-config", path, "-listen-addr", ":9090"})
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if cfg.ListenAddr != ":9090" {
+			t.Errorf("flag should take precedence, got %s", cfg.ListenAddr)
+		}
+
+		if cfg.DatabaseName != "from-file" {
+			t.Errorf("config file should be applied, got %s", cfg.DatabaseName)
+		}
+	})
+
+	t.Run("should read YAML files", func(t *testing.T) {
+		path := writeFile(t, "asteroid.yml", `
+jwt-secret: `+secret+`
+token-timeout: 1h
+cors-origins:
+  - https://a.example
+  - https://b.example
+`)
+
+		cfg, err := Load([]string{"-config", path})
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if cfg.JWTSecret != secret || cfg.TokenTimeout != time.Hour || len(cfg.CORSOrigins) != 2 {
+			t.Errorf("YAML file was not applied %+v", cfg)
+		}
+	})
+
+	t.Run("should read TOML files", func(t *testing.T) {
+		t.Setenv("ASTEROID_CONFIG", writeFile(t, "asteroid.toml", `
+store = "memory"
+data-dir = "/var/lib/asteroid"
+token-max-refresh = "30m"
+`))
+
+		cfg, err := Load(nil)
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if cfg.Store != "memory" || cfg.OrbitDBDir != "/var/lib/asteroid/orbitdb" || cfg.TokenMaxRefresh != 30*time.Minute {
+			t.Errorf("TOML file was not applied %+v", cfg)
+		}
+	})
+
+	t.Run("should read the replication settings", func(t *testing.T) {
+		peer := "/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf"
+		store := "/orbitdb/bafyreieecfmbj7aoa3vtqmgwcbfdo4tinulepvj3bj7fz7nmytjsnl3qgq/users"
+
+		cfg, err := Load([]string{"-peers", peer, "-replicate", store, "-writers", "first,second"})
+		if err != nil {
+			t.Fatalf("error loading the config %v\n", err)
+		}
+
+		if len(cfg.Peers) != 1 || cfg.Peers[0] != peer || len(cfg.Replicate) != 1 || len(cfg.Writers) != 2 {
+			t.Errorf("replication settings were not applied %+v", cfg)
+		}
+	})
+
+	t.Run("should reject unknown settings", func(t *testing.T) {
+		path := writeFile(t, "asteroid.yaml", "listen-port: 3000\n")
+
+		if _, err := Load([]string{"-config", path}); err == nil {
+			t.Errorf("unknown setting should be rejected")
+		}
+	})
+
+	t.Run("should reject invalid settings", func(t *testing.T) {
+		invalid := [][]string{
+			{"-listen-addr", "3000"},
+			{"-ipfs-url", "localhost:5001"},
+			{"-ipfs-mode", "local"},
+			{"-store", "sql"},
+			{"-db-name", "../users"},
+			{"-jwt-secret", "secret key"},
+			{"-jwt-algorithm", "ES256"},
+			{"-token-timeout", "0s"},
+			{"-shutdown-timeout", "-1s"},
+			{"-reap-interval", "-1m"},
+			{"-cors-origins", "example.com"},
+			{"-admin-ids", "admin"},
+			{"-swarm-addrs", "127.0.0.1:4001"},
+			{"-peers", "/ip4/127.0.0.1/tcp/4001"},
+			{"-replicate", "/orbitdb/users"},
+			{"-replicate", "/orbitdb/not-a-cid/users"},
+		}
+
+		for _, args := range invalid {
+			if _, err := Load(args); err == nil {
+				t.Errorf("%v should be rejected", args)
+			}
+		}
+	})
+}
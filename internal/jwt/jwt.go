@@ -2,10 +2,15 @@ package jwt
 
 import (
 	"encoding/base64"
+	"errors"
 	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/docker/distribution/uuid"
 	"github.com/gin-gonic/gin"
+	jwtgo "github.com/golang-jwt/jwt/v4"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"log"
+	"net/http"
 	"time"
 )
 
@@ -17,17 +22,62 @@ func init() {
 type Login struct {
 	ID        string `json:"id" form:"id" binding:"required"`
 	Signature string `json:"signature" form:"signature" binding:"required"`
+	// Scheme is the signature scheme of Signature. It defaults to user.SignatureScheme.
+	Scheme string `json:"scheme" form:"scheme"`
+	// DeviceID is the device that signed the nonce. Without it, all active devices of the user are tried.
+	DeviceID string `json:"deviceId" form:"deviceId"`
 }
 
 // User is the user struct for the JWT
 type User struct {
 	ID        string
-	Notes     string
 	PublicKey string
+	// DeviceID is the device the user logged in with
+	DeviceID string
+	// KeyID is the user.KeyID of the device key the user logged in with
+	KeyID string
+	// SessionID identifies the login, it is kept when the token is refreshed
+	SessionID string
+	// SessionVersion is the user.User SessionVersion at the login
+	SessionVersion int64
+	// Roles are the roles of the user at the login, see user.User Roles
+	Roles []string
 }
 
-// Authenticator is a function that takes a context and returns an identity and/or an error
-func Authenticator(c *gin.Context) (interface{}, error) {
+// HasRole reports whether the token carries the role. Tokens issued before roles existed only have user.RoleUser.
+func (u User) HasRole(role string) bool {
+	if u.Roles == nil {
+		return role == user.RoleUser
+	}
+
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceKey is the claim holding the device of a token
+var DeviceKey = "device"
+
+// KeyIDKey is the claim holding the key id of the device key a token was issued for
+var KeyIDKey = "key"
+
+// SessionKey is the claim holding the session id of a token, which can be revoked with a logout
+var SessionKey = "jti"
+
+// SessionVersionKey is the claim holding the session version of the user at the login
+var SessionVersionKey = "sv"
+
+// RolesKey is the claim holding the roles of the user
+var RolesKey = "roles"
+
+// requiredRolesKey is the context key of the roles Require sets for the Authorizator
+const requiredRolesKey = "asteroid-required-roles"
+
+// Authenticator is a function that takes a context and the user store and returns an identity and/or an error
+func Authenticator(c *gin.Context, db orbitdb.Stores) (interface{}, error) {
 	var login Login
 
 	// bind the JSON input to the Login struct
@@ -37,6 +87,10 @@ func Authenticator(c *gin.Context) (interface{}, error) {
 
 	uid := login.ID
 
+	if err := user.CheckScheme(login.Scheme); err != nil {
+		return nil, err
+	}
+
 	// decode the signature
 	sgntr, err := base64.StdEncoding.DecodeString(login.Signature)
 
@@ -50,62 +104,164 @@ func Authenticator(c *gin.Context) (interface{}, error) {
 
 	log.Printf("Authenticating user: %s\n", uid)
 
-	// find the user
-	usr, err := user.Find(uid)
-	if err != nil {
-		log.Println("Error finding user:", err)
+	// check the signature against the user's nonce and consume the nonce
+	usr, device, err := user.AuthenticateDevice(db, uid, login.DeviceID, sgntr)
+	if errors.Is(err, user.ErrNonceUsed) || errors.Is(err, user.ErrNonceExpired) {
 		return nil, err
 	}
-
-	// check signature against user's nonce
-	err = usr.VerifyUser(sgntr)
-
-	// update nonce
-	err = usr.RefreshNonce()
 	if err != nil {
-		log.Println("Error refreshing nonce:", err)
-		return nil, err
+		log.Println("Error authenticating user:", err)
+		return nil, jwt.ErrFailedAuthentication
 	}
 
 	// if no error, return the user
+	keyID, err := device.KeyID()
+	if err != nil {
+		return nil, jwt.ErrFailedAuthentication
+	}
+
 	return &User{
-		ID:        usr.ID.String(),
-		Notes:     usr.Notes,
-		PublicKey: usr.PublicKey,
+		ID:             usr.ID.String(),
+		PublicKey:      device.PublicKey,
+		DeviceID:       device.ID.String(),
+		KeyID:          keyID,
+		SessionID:      uuid.Generate().String(),
+		SessionVersion: usr.SessionVersion,
+		Roles:          usr.Roles(),
 	}, nil
 }
 
+// Authorizator rejects tokens of revoked sessions, of devices that have been revoked and of keys that have been
+// rotated. The token and the user both need the roles of the route, see Require.
+func Authorizator(data interface{}, db orbitdb.Stores, roles ...string) bool {
+	u, ok := data.(*User)
+	if !ok {
+		return false
+	}
+
+	usr, err := user.Find(db, u.ID)
+	if err != nil {
+		return false
+	}
+
+	if usr.SessionRevoked(u.SessionID, u.SessionVersion) {
+		return false
+	}
+
+	// the roles of the user may have changed since the login
+	for _, role := range roles {
+		if !u.HasRole(role) || !usr.HasRole(role) {
+			return false
+		}
+	}
+
+	// tokens issued before devices existed belong to the registered key
+	deviceID := u.DeviceID
+	if deviceID == "" {
+		deviceID = u.ID
+	}
+
+	device, err := usr.Device(deviceID)
+	if err != nil || !device.Active() {
+		return false
+	}
+
+	// tokens issued before key ids were recorded are valid until the first rotation
+	if u.KeyID == "" {
+		return device.RotatedAt == 0
+	}
+
+	keyID, err := device.KeyID()
+	return err == nil && keyID == u.KeyID
+}
+
 // IdentityKey is the key used to store the identity key in the GinJWTMiddleware.
 var IdentityKey = "_id"
 
-// AsteroidJWTMiddleware is the middleware for the JWT
-func AsteroidJWTMiddleware() (*jwt.GinJWTMiddleware, error) {
-	secret := []byte("secret key") // TODO: change to env variable for production!
-	return jwt.New(&jwt.GinJWTMiddleware{
+// identity returns the User of the claims of a token
+func identity(claims map[string]interface{}) *User {
+	id, _ := claims[IdentityKey].(string)
+	deviceID, _ := claims[DeviceKey].(string)
+	keyID, _ := claims[KeyIDKey].(string)
+	sessionID, _ := claims[SessionKey].(string)
+	sessionVersion, _ := claims[SessionVersionKey].(float64)
+
+	var roles []string
+	if raw, ok := claims[RolesKey].([]interface{}); ok {
+		roles = make([]string, 0, len(raw))
+		for _, role := range raw {
+			if r, ok := role.(string); ok {
+				roles = append(roles, r)
+			}
+		}
+	}
+
+	return &User{
+		ID:             id,
+		DeviceID:       deviceID,
+		KeyID:          keyID,
+		SessionID:      sessionID,
+		SessionVersion: int64(sessionVersion),
+		Roles:          roles,
+	}
+}
+
+// requiredRoles returns the roles Require set for the route of c
+func requiredRoles(c *gin.Context) []string {
+	roles, _ := c.Get(requiredRolesKey)
+	required, _ := roles.([]string)
+	return required
+}
+
+// Config holds the signing keys and lifetimes of the tokens
+type Config struct {
+	// Keys sign and verify the tokens. Without keys, the tokens are signed with Secret.
+	Keys       *KeySet
+	Secret     []byte
+	Timeout    time.Duration
+	MaxRefresh time.Duration
+}
+
+// Middleware is the gin-jwt middleware, with the tokens signed by a KeySet and sessions that can be revoked
+type Middleware struct {
+	*jwt.GinJWTMiddleware
+	Keys *KeySet
+	DB   orbitdb.Stores
+}
+
+// AsteroidJWTMiddleware is the middleware for the JWT, authenticating users against db
+func AsteroidJWTMiddleware(db orbitdb.Stores, config Config) (*Middleware, error) {
+	keys := config.Keys
+	if keys == nil {
+		keys = SecretKeySet(config.Secret)
+	}
+
+	mw, err := jwt.New(&jwt.GinJWTMiddleware{
 		Realm:      "main",
-		Key:        secret,
-		Timeout:    time.Hour * 24 * 7,
-		MaxRefresh: time.Hour * 24 * 7,
+		Timeout:    config.Timeout,
+		MaxRefresh: config.MaxRefresh,
+		// tokens are verified with the key of their kid header, so tokens of older keys stay valid
+		KeyFunc: keys.Verify,
 		Authenticator: func(c *gin.Context) (interface{}, error) {
-			return Authenticator(c)
+			return Authenticator(c, db)
 		},
 		Authorizator: func(data interface{}, c *gin.Context) bool {
-			// Production: if the user is an admin etc., return false
-			log.Println("Authorizer called...")
-			return true
+			return Authorizator(data, db, requiredRoles(c)...)
 		},
 		IdentityKey: IdentityKey,
 		IdentityHandler: func(context *gin.Context) interface{} {
-			claims := jwt.ExtractClaims(context)
-			return &User{
-				ID: claims[IdentityKey].(string),
-			}
+			return identity(jwt.ExtractClaims(context))
 		},
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
 			// JWT Payload
 			if v, ok := data.(*User); ok {
 				return jwt.MapClaims{
-					IdentityKey: v.ID,
+					IdentityKey:       v.ID,
+					DeviceKey:         v.DeviceID,
+					KeyIDKey:          v.KeyID,
+					SessionKey:        v.SessionID,
+					SessionVersionKey: v.SessionVersion,
+					RolesKey:          v.Roles,
 				}
 			}
 			return jwt.MapClaims{}
@@ -116,8 +272,175 @@ func AsteroidJWTMiddleware() (*jwt.GinJWTMiddleware, error) {
 				"message": message,
 			})
 		},
-		TimeFunc:   time.Now,
-		CookieName: "Asteroid-JWT",
+		// tokens in the query are only taken on the routes of QueryToken
+		TokenLookup: "header: Authorization",
+		TimeFunc:    time.Now,
+		CookieName:  "Asteroid-JWT",
 		// Add more cookie security settings for production ...
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Middleware{GinJWTMiddleware: mw, Keys: keys, DB: db}, nil
+}
+
+// QueryToken takes the token parameter out of the query of every request, so that it does not end up in the access
+// log; it has to run before the logger. Browsers cannot set headers on WebSocket and EventSource requests, so on the
+// routes of paths, the token of the query is used as bearer token. Other routes only take the Authorization header.
+func QueryToken(paths ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		token := query.Get("token")
+		if !query.Has("token") {
+			c.Next()
+			return
+		}
+
+		query.Del("token")
+		c.Request.URL.RawQuery = query.Encode()
+
+		for _, path := range paths {
+			if c.FullPath() == path && token != "" && c.GetHeader("Authorization") == "" {
+				c.Request.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// LoginHandler authenticates the user and responds with a token signed by the current key
+func (mw *Middleware) LoginHandler(c *gin.Context) {
+	data, err := mw.Authenticator(c)
+	if err != nil {
+		mw.unauthorized(c, err)
+		return
+	}
+
+	token, expire, err := mw.TokenGenerator(data)
+	if err != nil {
+		mw.unauthorized(c, jwt.ErrFailedTokenCreation)
+		return
+	}
+
+	mw.LoginResponse(c, http.StatusOK, token, expire)
+}
+
+// RefreshHandler responds with a new token for a token within MaxRefresh, signed by the current key. Tokens the
+// Authorizator rejects, e.g. of revoked sessions, are not refreshed.
+func (mw *Middleware) RefreshHandler(c *gin.Context) {
+	claims, err := mw.CheckIfTokenExpire(c)
+	if err != nil {
+		mw.unauthorized(c, err)
+		return
+	}
+
+	if !mw.Authorizator(identity(claims), c) {
+		mw.unauthorized(c, jwt.ErrForbidden)
+		return
+	}
+
+	// refreshed tokens carry the current roles
+	if usr, err := user.Find(mw.DB, identity(claims).ID); err == nil {
+		claims[RolesKey] = usr.Roles()
+	}
+
+	token, expire, err := mw.sign(claims)
+	if err != nil {
+		mw.unauthorized(c, jwt.ErrFailedTokenCreation)
+		return
+	}
+
+	mw.RefreshResponse(c, http.StatusOK, token, expire)
+}
+
+// Require returns the auth middleware for routes which need the roles, e.g. user.RoleAdmin. Tokens without them
+// are rejected with 403.
+func (mw *Middleware) Require(roles ...string) gin.HandlerFunc {
+	auth := mw.MiddlewareFunc()
+	return func(c *gin.Context) {
+		c.Set(requiredRolesKey, roles)
+		auth(c)
+	}
+}
+
+// LogoutHandler revokes the session of the token. It has to be behind MiddlewareFunc.
+func (mw *Middleware) LogoutHandler(c *gin.Context) {
+	u := identity(jwt.ExtractClaims(c))
+	if u.SessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "token has no session id, use /sessions/revoke-all",
+		})
+		return
+	}
+
+	// refreshed tokens of the session can be used for up to Timeout, and refreshed until MaxRefresh after that
+	expiresAt := mw.TimeFunc().Add(mw.Timeout + mw.MaxRefresh).Unix()
+	if err := user.RevokeSession(mw.DB, u.ID, u.SessionID, expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	mw.LogoutResponse(c, http.StatusOK)
+}
+
+// RevokeAllHandler revokes every token of the user, including the one of the request. It has to be behind
+// MiddlewareFunc.
+func (mw *Middleware) RevokeAllHandler(c *gin.Context) {
+	u := identity(jwt.ExtractClaims(c))
+
+	usr, err := user.RevokeAllSessions(mw.DB, u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":           http.StatusOK,
+		"sessionVersion": usr.SessionVersion,
+	})
+}
+
+// TokenGenerator creates a token for the identity data, signed by the current key
+func (mw *Middleware) TokenGenerator(data interface{}) (string, time.Time, error) {
+	claims := jwt.MapClaims{}
+	if mw.PayloadFunc != nil {
+		for key, value := range mw.PayloadFunc(data) {
+			claims[key] = value
+		}
+	}
+
+	return mw.sign(claims)
+}
+
+// sign sets a new expiry on a copy of claims and signs them
+func (mw *Middleware) sign(claims map[string]interface{}) (string, time.Time, error) {
+	signed := jwtgo.MapClaims{}
+	for key, value := range claims {
+		signed[key] = value
+	}
+
+	expire := mw.TimeFunc().Add(mw.Timeout)
+	signed["exp"] = expire.Unix()
+	signed["orig_iat"] = mw.TimeFunc().Unix()
+
+	token, err := mw.Keys.Sign(signed)
+	if err != nil {
+		log.Println("Error signing token:", err)
+		return "", time.Time{}, err
+	}
+
+	return token, expire, nil
+}
+
+// unauthorized aborts the request like the handlers of gin-jwt do
+func (mw *Middleware) unauthorized(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", "JWT realm="+mw.Realm)
+	c.Abort()
+	mw.Unauthorized(c, http.StatusUnauthorized, mw.HTTPStatusMessageFunc(err, c))
 }
@@ -0,0 +1,56 @@
+package jwt
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var authorization, query string
+	r := gin.New()
+	r.Use(QueryToken("/stream"), func(c *gin.Context) {
+		c.Next()
+		query = c.Request.URL.RawQuery
+	})
+	handler := func(c *gin.Context) {
+		authorization = c.GetHeader("Authorization")
+	}
+	r.GET("/stream", handler)
+	r.GET("/notes", handler)
+
+	t.Run("should take the token in the query on the given routes", func(t *testing.T) {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream?token=abc&lastEventId=1", nil))
+
+		if authorization != "Bearer abc" {
+			t.Errorf("Expected the token as bearer token, got %q", authorization)
+		}
+		if query != "lastEventId=1" {
+			t.Errorf("Expected the token to be removed from the query, got %q", query)
+		}
+	})
+
+	t.Run("should keep the Authorization header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stream?token=abc", nil)
+		req.Header.Set("Authorization", "Bearer header")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if authorization != "Bearer header" {
+			t.Errorf("Expected the token of the header, got %q", authorization)
+		}
+	})
+
+	t.Run("should ignore the token in the query on other routes", func(t *testing.T) {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/notes?token=abc", nil))
+
+		if authorization != "" {
+			t.Errorf("Expected no Authorization header, got %q", authorization)
+		}
+		if query != "" {
+			t.Errorf("Expected the token to be removed from the query, got %q", query)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	jwtgo "github.com/golang-jwt/jwt/v4"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// Signing algorithms of the tokens
+const (
+	// AlgorithmHS256 signs with a shared secret, the tokens can only be verified by the API itself
+	AlgorithmHS256 = "HS256"
+	// AlgorithmRS256 signs with an RSA key
+	AlgorithmRS256 = "RS256"
+	// AlgorithmEdDSA signs with an Ed25519 key
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	// ErrUnknownKey is returned for tokens whose kid header matches none of the keys
+	ErrUnknownKey = errors.New("token is signed with an unknown key")
+	// ErrInvalidAlgorithm is returned for tokens whose alg header does not match their key
+	ErrInvalidAlgorithm = errors.New("token algorithm does not match its key")
+)
+
+// SigningKey is a key the tokens are signed with, identified by the kid header of the tokens
+type SigningKey struct {
+	// ID is the user.KeyID of the public key, empty for secrets
+	ID        string
+	Algorithm string
+	// Private is a []byte for HS256, a *rsa.PrivateKey for RS256 and an ed25519.PrivateKey for EdDSA
+	Private interface{}
+}
+
+// KeySet holds the signing keys. The first key signs new tokens, the others only verify the tokens issued before
+// a key rollover, until they expire.
+type KeySet struct {
+	Keys []SigningKey
+}
+
+// SecretKeySet returns a key set signing with the shared secret
+func SecretKeySet(secret []byte) *KeySet {
+	return &KeySet{Keys: []SigningKey{{Algorithm: AlgorithmHS256, Private: secret}}}
+}
+
+// LoadKeys reads the PEM encoded private keys in paths. If the first file does not exist, a new key for algorithm
+// is generated and written to it. The first key signs the tokens, so it has to be a key for algorithm; the keys
+// behind it may be of another algorithm, e.g. after rolling over from RS256 to EdDSA.
+func LoadKeys(paths []string, algorithm string) (*KeySet, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+
+	set := &KeySet{}
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if i == 0 && errors.Is(err, os.ErrNotExist) {
+			key, err := GenerateKey(path, algorithm)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Generated a new %s signing key at %s\n", algorithm, path)
+			set.Keys = append(set.Keys, key)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %v", path, err)
+		}
+		if i == 0 && key.Algorithm != algorithm {
+			return nil, fmt.Errorf("signing key %s is a %s key, expected %s", path, key.Algorithm, algorithm)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+
+	return set, nil
+}
+
+// GenerateKey generates a key for algorithm and writes it PKCS #8 encoded to path
+func GenerateKey(path, algorithm string) (SigningKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return SigningKey{}, fmt.Errorf("cannot generate a key for %s", algorithm)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return SigningKey{}, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return SigningKey{}, err
+	}
+
+	return newSigningKey(private)
+}
+
+// ParseKey parses a PEM encoded PKCS #8 or PKCS #1 private key
+func ParseKey(data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return newSigningKey(key)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return SigningKey{}, errors.New("unsupported key type")
+	}
+
+	return newSigningKey(signer)
+}
+
+// newSigningKey returns the SigningKey of an RSA or Ed25519 private key
+func newSigningKey(private crypto.Signer) (SigningKey, error) {
+	var algorithm string
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		algorithm = AlgorithmRS256
+	case ed25519.PrivateKey:
+		algorithm = AlgorithmEdDSA
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", private)
+	}
+
+	id, err := user.KeyID(private.Public())
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	return SigningKey{ID: id, Algorithm: algorithm, Private: private}, nil
+}
+
+// public returns the key verifying the signatures of k
+func (k SigningKey) public() interface{} {
+	if signer, ok := k.Private.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return k.Private
+}
+
+// Sign signs the claims with the current key
+func (s *KeySet) Sign(claims jwtgo.MapClaims) (string, error) {
+	if len(s.Keys) == 0 {
+		return "", errors.New("no signing keys")
+	}
+
+	key := s.Keys[0]
+	token := jwtgo.NewWithClaims(jwtgo.GetSigningMethod(key.Algorithm), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+
+	return token.SignedString(key.Private)
+}
+
+// Verify returns the key of the kid header of token. It is the KeyFunc of the middleware.
+func (s *KeySet) Verify(token *jwtgo.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range s.Keys {
+		if key.ID != kid {
+			continue
+		}
+
+		// never verify a token with a different algorithm than the key was made for
+		if token.Method.Alg() != key.Algorithm {
+			return nil, ErrInvalidAlgorithm
+		}
+		return key.public(), nil
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// JWKS returns the public keys as JSON Web Key Set, as served at /.well-known/jwks.json. Secrets are not included.
+func (s *KeySet) JWKS() gin.H {
+	keys := make([]gin.H, 0, len(s.Keys))
+
+	for _, key := range s.Keys {
+		switch pub := key.public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "RSA",
+				"kid": key.ID,
+				"use": "sig",
+				"alg": key.Algorithm,
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": key.ID,
+				"use": "sig",
+				"alg": key.Algorithm,
+				"x":   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	return gin.H{"keys": keys}
+}
@@ -0,0 +1,104 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	jwtgo "github.com/golang-jwt/jwt/v4"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeySet(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.pem")
+	newPath := filepath.Join(dir, "new.pem")
+
+	claims := func() jwtgo.MapClaims {
+		return jwtgo.MapClaims{IdentityKey: "user", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	old, err := LoadKeys([]string{oldPath}, AlgorithmEdDSA)
+	if err != nil {
+		t.Fatalf("error generating the key %v\n", err)
+	}
+
+	t.Run("should generate a missing key once", func(t *testing.T) {
+		if info, err := os.Stat(oldPath); err != nil || info.Mode().Perm() != 0600 {
+			t.Fatalf("expected a private key file, got %v", err)
+		}
+
+		loaded, err := LoadKeys([]string{oldPath}, AlgorithmEdDSA)
+		if err != nil {
+			t.Fatalf("error loading the key %v\n", err)
+		}
+		if loaded.Keys[0].ID != old.Keys[0].ID || loaded.Keys[0].Algorithm != AlgorithmEdDSA {
+			t.Errorf("expected the stored key, got %+v", loaded.Keys[0])
+		}
+	})
+
+	t.Run("should reject a signing key of another algorithm", func(t *testing.T) {
+		if _, err := LoadKeys([]string{oldPath}, AlgorithmRS256); err == nil {
+			t.Errorf("expected the EdDSA key to be rejected for RS256")
+		}
+	})
+
+	oldToken, err := old.Sign(claims())
+	if err != nil {
+		t.Fatalf("error signing %v\n", err)
+	}
+
+	// the new key signs, the old one only verifies
+	rolled, err := LoadKeys([]string{newPath, oldPath}, AlgorithmRS256)
+	if err != nil {
+		t.Fatalf("error loading the keys %v\n", err)
+	}
+
+	t.Run("should verify tokens of older keys after a rollover", func(t *testing.T) {
+		newToken, _ := rolled.Sign(claims())
+
+		for _, token := range []string{oldToken, newToken} {
+			if _, err := jwtgo.Parse(token, rolled.Verify); err != nil {
+				t.Errorf("expected the token to be valid, got %v", err)
+			}
+		}
+
+		parsed, _ := jwtgo.Parse(newToken, rolled.Verify)
+		if parsed.Header["kid"] != rolled.Keys[0].ID || parsed.Method.Alg() != AlgorithmRS256 {
+			t.Errorf("expected the new key to sign, got %v", parsed.Header)
+		}
+
+		if _, err := jwtgo.Parse(newToken, old.Verify); err == nil {
+			t.Errorf("expected tokens of unknown keys to be rejected")
+		}
+	})
+
+	t.Run("should reject tokens with another algorithm than their key", func(t *testing.T) {
+		// an HMAC token using the public key as secret
+		token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, claims())
+		token.Header["kid"] = old.Keys[0].ID
+		forged, _ := token.SignedString([]byte(old.Keys[0].public().(ed25519.PublicKey)))
+
+		if _, err := jwtgo.Parse(forged, rolled.Verify); err == nil {
+			t.Errorf("expected the forged token to be rejected")
+		}
+	})
+
+	t.Run("should publish the public keys", func(t *testing.T) {
+		keys := rolled.JWKS()["keys"].([]gin.H)
+		if len(keys) != 2 || keys[0]["kty"] != "RSA" || keys[1]["kty"] != "OKP" {
+			t.Fatalf("expected an RSA and an Ed25519 key, got %v", keys)
+		}
+
+		x, _ := base64.RawURLEncoding.DecodeString(keys[1]["x"].(string))
+		if !ed25519.PublicKey(x).Equal(old.Keys[0].public()) || keys[1]["kid"] != old.Keys[0].ID {
+			t.Errorf("expected the old public key, got %v", keys[1])
+		}
+
+		if len(SecretKeySet([]byte("secret")).JWKS()["keys"].([]gin.H)) != 0 {
+			t.Errorf("secrets must not be published")
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package note
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+)
+
+// Algorithms of an Envelope
+const (
+	// EnvelopeVersion is the version of the envelope format
+	EnvelopeVersion = 1
+	// ContentAlgorithm encrypts the content with a random 256 bit key and a 96 bit nonce
+	ContentAlgorithm = "AES-256-GCM"
+	// KeyWrapAlgorithm encrypts the content key for an RSA public key of the user, with SHA-256 as hash
+	KeyWrapAlgorithm = "RSA-OAEP-256"
+	// KeyWrapX25519 encrypts the content key for an Ed25519 public key of the user, converted to X25519, with an
+	// ephemeral X25519 key, see sealKey
+	KeyWrapX25519 = "X25519-HKDF-SHA256-A256GCM"
+	// KeyWrapECDH encrypts the content key for an ECDSA public key of the user with an ephemeral key on its curve,
+	// see sealKey
+	KeyWrapECDH = "ECDH-HKDF-SHA256-A256GCM"
+)
+
+// Envelope is a note encrypted on the client. The server cannot read it, it only checks that every content key
+// is wrapped for a registered key of the user and stores the envelope as it is.
+type Envelope struct {
+	Version    int          `json:"version"`
+	Algorithm  string       `json:"algorithm"`
+	Nonce      string       `json:"nonce"`      // base64
+	Ciphertext string       `json:"ciphertext"` // base64, including the GCM tag
+	Keys       []WrappedKey `json:"keys"`
+}
+
+// WrappedKey is the content key of an Envelope, encrypted for one public key of the user
+type WrappedKey struct {
+	KeyID      string `json:"keyId"` // see user.KeyID
+	Algorithm  string `json:"algorithm"`
+	WrappedKey string `json:"wrappedKey"` // base64
+}
+
+// Validate checks the structure of the envelope. recipients maps the key ids of the user to their key algorithm;
+// every content key has to be wrapped for one of them, with the key wrap algorithm of its key algorithm.
+func (e *Envelope) Validate(recipients map[string]string) error {
+	if e.Version != EnvelopeVersion {
+		return fmt.Errorf("invalid envelope: unsupported version %d", e.Version)
+	}
+
+	if e.Algorithm != ContentAlgorithm {
+		return fmt.Errorf("invalid envelope: unsupported algorithm %q, use %s", e.Algorithm, ContentAlgorithm)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	if err != nil || len(nonce) != 12 {
+		return fmt.Errorf("invalid envelope: nonce must be 12 base64 encoded bytes")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+	if err != nil || len(ciphertext) < 16 {
+		return fmt.Errorf("invalid envelope: ciphertext must be base64 encoded and include the tag")
+	}
+
+	if len(e.Keys) == 0 {
+		return fmt.Errorf("invalid envelope: no wrapped keys")
+	}
+
+	seen := make(map[string]bool, len(e.Keys))
+	for _, key := range e.Keys {
+		keyAlgorithm, ok := recipients[key.KeyID]
+		if !ok {
+			return fmt.Errorf("invalid envelope: %q is not a key of the user", key.KeyID)
+		}
+
+		if seen[key.KeyID] {
+			return fmt.Errorf("invalid envelope: key %q is wrapped twice", key.KeyID)
+		}
+		seen[key.KeyID] = true
+
+		wrapAlgorithm, ok := keyWraps[keyAlgorithm]
+		if !ok {
+			return fmt.Errorf("invalid envelope: %s keys cannot receive wrapped keys", keyAlgorithm)
+		}
+
+		if key.Algorithm != wrapAlgorithm {
+			return fmt.Errorf("invalid envelope: unsupported key algorithm %q for %s keys, use %s",
+				key.Algorithm, keyAlgorithm, wrapAlgorithm)
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(key.WrappedKey)
+		if err != nil || len(wrapped) == 0 {
+			return fmt.Errorf("invalid envelope: wrapped key of %q must be base64 encoded", key.KeyID)
+		}
+
+		if size, ok := wrappedSizes[keyAlgorithm]; ok && len(wrapped) != size {
+			return fmt.Errorf("invalid envelope: wrapped key of %q must have %d bytes", key.KeyID, size)
+		}
+	}
+
+	return nil
+}
+
+// SealEnvelope encrypts plaintext for the RSA, Ed25519 and ECDSA public keys of a user. Clients seal notes like
+// this, the server never sees the plaintext.
+func SealEnvelope(plaintext []byte, recipients []crypto.PublicKey) (*Envelope, error) {
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{
+		Version:    EnvelopeVersion,
+		Algorithm:  ContentAlgorithm,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}
+
+	for _, pub := range recipients {
+		keyID, err := user.KeyID(pub)
+		if err != nil {
+			return nil, err
+		}
+
+		algorithm, wrapped, err := wrapKey(pub, contentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		envelope.Keys = append(envelope.Keys, WrappedKey{
+			KeyID:      keyID,
+			Algorithm:  algorithm,
+			WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		})
+	}
+
+	return envelope, nil
+}
+
+// Open decrypts the envelope with the RSA, Ed25519 or ECDSA private key of one of its recipients
+func (e *Envelope) Open(key crypto.Signer) ([]byte, error) {
+	keyID, err := user.KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, wrapped := range e.Keys {
+		if wrapped.KeyID != keyID {
+			continue
+		}
+
+		encrypted, err := base64.StdEncoding.DecodeString(wrapped.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+
+		contentKey, err := unwrapKey(key, encrypted)
+		if err != nil {
+			return nil, err
+		}
+
+		gcm, err := newGCM(contentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(e.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+
+		return gcm.Open(nil, nonce, ciphertext, nil)
+	}
+
+	return nil, fmt.Errorf("envelope has no key for %s", keyID)
+}
+
+// newGCM creates the AES-GCM cipher of a content key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,119 @@
+package note
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	laptop, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, phone, _ := ed25519.GenerateKey(rand.Reader)
+	tablet, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	keys := []crypto.Signer{laptop, phone, tablet, server}
+	algorithms := []string{user.KeyAlgorithmRSA, user.KeyAlgorithmEd25519, user.KeyAlgorithmECDSAP256,
+		user.KeyAlgorithmECDSAP384}
+
+	recipients := map[string]string{}
+	publicKeys := make([]crypto.PublicKey, 0, len(keys))
+	for i, key := range keys {
+		id, _ := user.KeyID(key.Public())
+		recipients[id] = algorithms[i]
+		publicKeys = append(publicKeys, key.Public())
+	}
+
+	envelope, err := SealEnvelope([]byte("secret"), publicKeys)
+	if err != nil {
+		t.Fatalf("Error sealing envelope: %v", err)
+	}
+
+	t.Run("should open the envelope with every recipient key", func(t *testing.T) {
+		for _, key := range keys {
+			plaintext, err := envelope.Open(key)
+			if err != nil {
+				t.Fatalf("Error opening envelope with %T: %v", key, err)
+			}
+			if string(plaintext) != "secret" {
+				t.Errorf("expected secret, got %s", plaintext)
+			}
+		}
+
+		if _, err := envelope.Open(stranger); err == nil {
+			t.Errorf("expected other keys to fail")
+		}
+	})
+
+	t.Run("should not open a key wrapped for another key", func(t *testing.T) {
+		_, other, _ := ed25519.GenerateKey(rand.Reader)
+		otherID, _ := user.KeyID(other.Public())
+
+		e := *envelope
+		e.Keys = append([]WrappedKey(nil), envelope.Keys...)
+		e.Keys[1].KeyID = otherID
+		if _, err := e.Open(other); err == nil {
+			t.Errorf("expected the key of another recipient to fail")
+		}
+	})
+
+	t.Run("should accept envelopes for the keys of the user", func(t *testing.T) {
+		if err := envelope.Validate(recipients); err != nil {
+			t.Errorf("expected a valid envelope, got %v", err)
+		}
+	})
+
+	t.Run("should reject malformed envelopes", func(t *testing.T) {
+		strangerID, _ := user.KeyID(stranger.Public())
+		tabletID, _ := user.KeyID(tablet.Public())
+		ecdhKey := func(e *Envelope) *WrappedKey {
+			for i := range e.Keys {
+				if e.Keys[i].KeyID == tabletID {
+					return &e.Keys[i]
+				}
+			}
+			return nil
+		}
+
+		cases := map[string]func(e *Envelope){
+			"version":        func(e *Envelope) { e.Version = 2 },
+			"algorithm":      func(e *Envelope) { e.Algorithm = "AES-128-CBC" },
+			"nonce":          func(e *Envelope) { e.Nonce = "AAAA" },
+			"ciphertext":     func(e *Envelope) { e.Ciphertext = "not base64" },
+			"no keys":        func(e *Envelope) { e.Keys = nil },
+			"unknown key":    func(e *Envelope) { e.Keys[0].KeyID = strangerID },
+			"duplicate key":  func(e *Envelope) { e.Keys[1].KeyID = e.Keys[0].KeyID },
+			"wrap algorithm": func(e *Envelope) { e.Keys[0].Algorithm = "RSA1_5" },
+			"empty wrap":     func(e *Envelope) { e.Keys[0].WrappedKey = "" },
+			"other key type": func(e *Envelope) { e.Keys[0].KeyID = tabletID },
+			"short ECDH wrap": func(e *Envelope) {
+				ecdhKey(e).WrappedKey = ecdhKey(e).WrappedKey[:len(ecdhKey(e).WrappedKey)-8]
+			},
+		}
+
+		for name, change := range cases {
+			e := *envelope
+			e.Keys = append([]WrappedKey(nil), envelope.Keys...)
+			change(&e)
+
+			if err := e.Validate(recipients); err == nil {
+				t.Errorf("%s: expected the envelope to be rejected", name)
+			}
+		}
+
+		// keys of other algorithms cannot receive wrapped keys
+		unsupported := map[string]string{}
+		for id := range recipients {
+			unsupported[id] = "DSA"
+		}
+		if err := envelope.Validate(unsupported); err == nil {
+			t.Errorf("expected keys of other algorithms to be rejected")
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package note
+
+import (
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of an Event
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// EventResync tells a client that it missed events and has to reload its notes
+	EventResync = "resync"
+)
+
+// FeedHistory is the number of events a Feed keeps for clients resuming with a Last-Event-ID
+var FeedHistory = 1024
+
+// subscriberBuffer is the number of events a subscriber can fall behind before it is disconnected
+const subscriberBuffer = 64
+
+// Event is a change of a note
+type Event struct {
+	// ID identifies the event for resuming the feed
+	ID     string
+	Type   string
+	NoteID uuid.UUID
+	UID    uuid.UUID
+	// Note is the changed note, nil for EventDeleted and EventResync
+	Note *Note
+
+	seq uint64
+}
+
+// Feed turns the changes of the note stores, written locally or replicated from other peers, into note events
+// for their owners
+type Feed struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	owners      map[uuid.UUID]uuid.UUID
+	history     []Event
+	subscribers map[*subscriber]struct{}
+	stops       []func()
+	db          orbitdb.Stores
+}
+
+// subscriber receives the events of a user
+type subscriber struct {
+	uid uuid.UUID
+	ch  chan Event
+}
+
+// NewFeed starts following the changes of the notes in db, in the store of the notes of older versions and in
+// the stores of the users, including the ones opened later
+func NewFeed(db orbitdb.Stores) *Feed {
+	f := &Feed{
+		// event IDs of an earlier process cannot be resumed
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		owners:      make(map[uuid.UUID]uuid.UUID),
+		subscribers: make(map[*subscriber]struct{}),
+		db:          db,
+	}
+
+	// the feed ends with the store of the notes of older versions
+	events := f.watch(db.Notes)
+	go func() {
+		for evt := range events {
+			f.handle(evt)
+		}
+		f.Close()
+	}()
+
+	db.UserNotes.OnOpen(func(owner string, store orbitdb.Store) {
+		events := f.watch(store)
+		go func() {
+			for evt := range events {
+				f.handle(evt)
+			}
+		}()
+	})
+
+	return f
+}
+
+// watch starts following the changes of store and returns them. The channel is closed when the feed is closed.
+func (f *Feed) watch(store orbitdb.Store) <-chan orbitdb.Event {
+	events, stop := store.Watch()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subscribers == nil {
+		stop()
+		return events
+	}
+	f.stops = append(f.stops, stop)
+
+	// owners of the existing notes, needed for delete events
+	for _, n := range allNotes(store) {
+		if !n.Deleted() {
+			f.owners[n.ID] = n.UID
+		}
+	}
+
+	return events
+}
+
+// handle turns a store event into a note event
+func (f *Feed) handle(evt orbitdb.Event) {
+	id, err := uuid.Parse(evt.Key)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch evt.Op {
+	case orbitdb.OpPut:
+		n, err := notes(f.db.Notes).DecodeDocument(*evt.Document)
+		if err != nil {
+			// not a note
+			return
+		}
+
+		// a deleted note is replaced by its tombstone
+		if n.Deleted() {
+			if _, ok := f.owners[id]; ok {
+				delete(f.owners, id)
+				f.publish(Event{Type: EventDeleted, NoteID: id, UID: n.UID})
+			}
+			return
+		}
+
+		eventType := EventCreated
+		if _, ok := f.owners[id]; ok {
+			eventType = EventUpdated
+		}
+		f.owners[id] = n.UID
+
+		f.publish(Event{Type: eventType, NoteID: id, UID: n.UID, Note: n})
+	case orbitdb.OpDelete:
+		uid, ok := f.owners[id]
+		if !ok {
+			return
+		}
+
+		// notes of older versions are moved into the store of their owner when they are changed
+		if own, ok := f.db.UserNotes.Lookup(uid.String()); ok {
+			if _, err := own.Read(evt.Key); err == nil {
+				return
+			}
+		}
+		delete(f.owners, id)
+
+		f.publish(Event{Type: EventDeleted, NoteID: id, UID: uid})
+	}
+}
+
+// publish numbers the event, keeps it in the history and sends it to the subscribers of its owner
+func (f *Feed) publish(evt Event) {
+	f.seq++
+	evt.seq = f.seq
+	evt.ID = f.eventID(f.seq)
+
+	f.history = append(f.history, evt)
+	if len(f.history) > FeedHistory {
+		f.history = f.history[len(f.history)-FeedHistory:]
+	}
+
+	for s := range f.subscribers {
+		if s.uid != evt.UID {
+			continue
+		}
+
+		select {
+		case s.ch <- evt:
+		default:
+			// the subscriber reconnects and resumes from its last event
+			log.Printf("Disconnecting a slow subscriber of user %s\n", s.uid)
+			delete(f.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// Subscribe returns the events of the user uid. If lastEventID is set, the events after it are returned first.
+// If they are no longer available, the first event is an EventResync instead. The returned function stops the
+// subscription. The channel is closed when the subscriber falls behind or the feed is closed.
+func (f *Feed) Subscribe(uid uuid.UUID, lastEventID string) ([]Event, <-chan Event, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var backlog []Event
+	if lastEventID != "" {
+		backlog = f.since(uid, lastEventID)
+	}
+
+	s := &subscriber{uid: uid, ch: make(chan Event, subscriberBuffer)}
+	if f.subscribers != nil {
+		f.subscribers[s] = struct{}{}
+	} else {
+		close(s.ch)
+	}
+
+	var once sync.Once
+	return backlog, s.ch, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if _, ok := f.subscribers[s]; ok {
+				delete(f.subscribers, s)
+				close(s.ch)
+			}
+		})
+	}
+}
+
+// since returns the events of the user after lastEventID, or an EventResync if some are missing
+func (f *Feed) since(uid uuid.UUID, lastEventID string) []Event {
+	resync := []Event{{ID: f.eventID(f.seq), Type: EventResync, UID: uid}}
+
+	seq, err := f.parseEventID(lastEventID)
+	if err != nil || seq > f.seq {
+		return resync
+	}
+
+	// the oldest kept event must directly follow lastEventID
+	if len(f.history) > 0 && f.history[0].seq > seq+1 {
+		return resync
+	}
+
+	events := make([]Event, 0)
+	for _, evt := range f.history {
+		if evt.seq > seq && evt.UID == uid {
+			events = append(events, evt)
+		}
+	}
+
+	return events
+}
+
+// Close stops following the stores and closes the channels of all subscribers
+func (f *Feed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subscribers == nil {
+		return
+	}
+
+	for s := range f.subscribers {
+		close(s.ch)
+	}
+	f.subscribers = nil
+
+	for _, stop := range f.stops {
+		stop()
+	}
+}
+
+// eventID formats the ID of the event with the sequence number seq
+func (f *Feed) eventID(seq uint64) string {
+	return f.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventID returns the sequence number of an event ID of this feed
+func (f *Feed) parseEventID(id string) (uint64, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != f.epoch {
+		return 0, fmt.Errorf("unknown event id %s", id)
+	}
+
+	return strconv.ParseUint(parts[1], 10, 64)
+}
@@ -0,0 +1,142 @@
+package note
+
+import (
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for the next event of a subscription
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case evt, ok := <-events:
+		if !ok {
+			t.Fatalf("subscription closed")
+		}
+		return evt
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+	return Event{}
+}
+
+func TestFeed(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+	VerifyUserNotes(db)
+	index := NewIndex(orbitdb.NewMemoryStore())
+	owner, sign := newTestUser(t, db)
+	other, signOther := newTestUser(t, db)
+	uid := owner.ID
+
+	// notes written before the feed started
+	existingDraft := draft(uid, "existing", 0)
+	existing, err := NewNote(db, index, existingDraft, sign(existingDraft))
+	if err != nil {
+		t.Fatalf("Error creating note: %v", err)
+	}
+
+	feed := NewFeed(db)
+	defer feed.Close()
+
+	var lastEventID string
+
+	t.Run("should push created, updated and deleted notes of the user", func(t *testing.T) {
+		_, events, cancel := feed.Subscribe(uid, "")
+		defer cancel()
+
+		hello, notYours := draft(uid, "hello", 0), draft(other.ID, "not yours", 0)
+		n, err := NewNote(db, index, hello, sign(hello))
+		if err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+		if _, err := NewNote(db, index, notYours, signOther(notYours)); err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+		updatedAt := time.Now().UnixMilli()
+		if _, err := UpdateNote(db, uid, n.ID, "hello again", updatedAt, sign(edited(*n, "hello again", updatedAt))); err != nil {
+			t.Fatalf("Error updating note: %v", err)
+		}
+		deletedAt := time.Now().UnixMilli()
+		if err := DeleteNote(db, index, uid, existing.ID, deletedAt, sign(*existing.Tombstone(deletedAt))); err != nil {
+			t.Fatalf("Error deleting note: %v", err)
+		}
+
+		created := nextEvent(t, events)
+		if created.Type != EventCreated || created.Note.Data != "hello" {
+			t.Errorf("expected a created event, got %+v", created)
+		}
+
+		updated := nextEvent(t, events)
+		if updated.Type != EventUpdated || updated.Note.Data != "hello again" {
+			t.Errorf("expected an updated event, got %+v", updated)
+		}
+
+		deleted := nextEvent(t, events)
+		if deleted.Type != EventDeleted || deleted.NoteID != existing.ID {
+			t.Errorf("expected a deleted event, got %+v", deleted)
+		}
+
+		lastEventID = created.ID
+	})
+
+	t.Run("should resume after the last event", func(t *testing.T) {
+		backlog, _, cancel := feed.Subscribe(uid, lastEventID)
+		defer cancel()
+
+		if len(backlog) != 2 || backlog[0].Type != EventUpdated || backlog[1].Type != EventDeleted {
+			t.Errorf("expected the updated and deleted events, got %+v", backlog)
+		}
+	})
+
+	t.Run("should ask for a resync when events are missing", func(t *testing.T) {
+		for _, id := range []string{"unknown", "0-1", feed.eventID(1000)} {
+			backlog, _, cancel := feed.Subscribe(uid, id)
+			cancel()
+
+			if len(backlog) != 1 || backlog[0].Type != EventResync {
+				t.Errorf("expected a resync for %s, got %+v", id, backlog)
+			}
+		}
+	})
+
+	t.Run("should close subscriptions with the feed", func(t *testing.T) {
+		feed := NewFeed(orbitdb.NewMemoryStores())
+		_, events, cancel := feed.Subscribe(uid, "")
+		defer cancel()
+
+		feed.Close()
+
+		if _, ok := <-events; ok {
+			t.Errorf("expected the subscription to be closed")
+		}
+	})
+
+	t.Run("should report notes of older versions moved into the store of their owner as updated", func(t *testing.T) {
+		_, events, cancel := feed.Subscribe(uid, "")
+		defer cancel()
+
+		old := &Note{ID: uuid.Generate(), UID: uid, Data: "old", CreatedAt: 1}
+		if err := notes(db.Notes).CreateWithKey(old.ID.String(), old); err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+		if created := nextEvent(t, events); created.Type != EventCreated {
+			t.Fatalf("expected a created event, got %+v", created)
+		}
+
+		updatedAt := time.Now().UnixMilli()
+		if _, err := UpdateNote(db, uid, old.ID, "signed", updatedAt, sign(edited(*old, "signed", updatedAt))); err != nil {
+			t.Fatalf("Error updating note: %v", err)
+		}
+
+		if updated := nextEvent(t, events); updated.Type != EventUpdated || updated.Note.Data != "signed" {
+			t.Errorf("expected an updated event, got %+v", updated)
+		}
+
+		select {
+		case evt := <-events:
+			t.Errorf("expected no further events, got %+v", evt)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
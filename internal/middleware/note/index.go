@@ -0,0 +1,150 @@
+package note
+
+import (
+	"github.com/docker/distribution/uuid"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"time"
+)
+
+// Index is the per-user note index. Every entry references one note and is stored as its own document,
+// so creating or deleting a note does not rewrite the user document. The entries are kept in memory per user,
+// so listing or counting the notes of a user does not read the notes of all users.
+type Index struct {
+	DB   orbitdb.Store
+	view *orbitdb.View
+}
+
+// IndexEntry references a note of a user
+type IndexEntry struct {
+	ID        uuid.UUID
+	UID       uuid.UUID
+	CreatedAt int64 // unix milliseconds
+	ExpiresAt int64 // unix milliseconds, 0 if the note does not expire
+}
+
+// NewIndex creates a note index on top of db
+func NewIndex(db orbitdb.Store) Index {
+	return Index{
+		DB: db,
+		view: orbitdb.NewView(db, func(doc orbitdb.Document) (string, bool) {
+			uid, ok := doc.Data["uid"].(string)
+			return uid, ok && uid != ""
+		}),
+	}
+}
+
+// Add adds a note of the user uid to the index, which expires at expiresAt in unix milliseconds or never if it
+// is 0
+func (i Index) Add(uid, id uuid.UUID, createdAt, expiresAt int64) error {
+	_, err := i.DB.Create(gin.H{
+		"id":                     id.String(),
+		"uid":                    uid.String(),
+		"createdAt":              createdAt,
+		"expiresAt":              expiresAt,
+		orbitdb.SchemaVersionKey: IndexSchema.Version(),
+	}, &orbitdb.DatabaseCreateOptions{ID: id.String()})
+
+	if err != nil {
+		log.Println("Failed to add note to index")
+		return err
+	}
+
+	i.view.Refresh(id.String())
+	return nil
+}
+
+// Remove removes a note from the index
+func (i Index) Remove(id uuid.UUID) error {
+	err := i.DB.Delete(id.String())
+
+	if err != nil {
+		log.Println("Failed to remove note from index")
+		return err
+	}
+
+	i.view.Refresh(id.String())
+	return nil
+}
+
+// Contains reports whether a note is in the index
+func (i Index) Contains(id uuid.UUID) bool {
+	_, err := i.DB.Read(id.String())
+	return err == nil
+}
+
+// live returns a filter of the entries which have not expired at now
+func live(now time.Time) func(data map[string]interface{}) bool {
+	return func(data map[string]interface{}) bool {
+		expiresAt, _ := data["expiresAt"].(float64)
+		return expiresAt == 0 || int64(expiresAt) > now.UnixMilli()
+	}
+}
+
+// List returns all index entries of the user uid, ordered by creation time
+func (i Index) List(uid uuid.UUID) ([]IndexEntry, error) {
+	entries, _, err := i.Page(uid, -1, "")
+	return entries, err
+}
+
+// Page returns up to limit index entries of the user uid, ordered by creation time and starting after
+// cursor. Expired entries are skipped. The returned cursor continues with the next page and is empty on the
+// last page.
+func (i Index) Page(uid uuid.UUID, limit int, cursor string) ([]IndexEntry, string, error) {
+	page, err := i.view.Page(uid.String(), orbitdb.Query{
+		Limit:  limit,
+		Cursor: cursor,
+		Filter: live(time.Now()),
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]IndexEntry, 0, len(page.Documents))
+	for _, doc := range page.Documents {
+		entry, err := parseIndexEntry(doc)
+		if err != nil {
+			log.Printf("Skipping invalid index entry: %v\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, page.Next, nil
+}
+
+// Count returns the number of notes of the user uid which have not expired
+func (i Index) Count(uid uuid.UUID) (int, error) {
+	return i.view.Count(uid.String(), live(time.Now())), nil
+}
+
+// Counts returns the number of notes which have not expired per user id, users without notes are left out
+func (i Index) Counts() map[string]int {
+	return i.view.Counts(live(time.Now()))
+}
+
+// parseIndexEntry parses a document of the index store
+func parseIndexEntry(doc orbitdb.Document) (IndexEntry, error) {
+	rawID, _ := doc.Data["id"].(string)
+	rawUID, _ := doc.Data["uid"].(string)
+	expiresAt, _ := doc.Data["expiresAt"].(float64)
+
+	id, err := uuid.Parse(rawID)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	uid, err := uuid.Parse(rawUID)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	return IndexEntry{
+		ID:        id,
+		UID:       uid,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: int64(expiresAt),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package note
+
+import (
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	t.Run("should list the notes of a user ordered by creation time", func(t *testing.T) {
+		index := NewIndex(orbitdb.NewMemoryStore())
+		uid := uuid.Generate()
+
+		older, newer, other := uuid.Generate(), uuid.Generate(), uuid.Generate()
+
+		_ = index.Add(uid, newer, 2000, 0)
+		_ = index.Add(uid, older, 1000, 0)
+		_ = index.Add(uuid.Generate(), other, 1500, 0)
+
+		entries, err := index.List(uid)
+		if err != nil {
+			t.Fatalf("Error listing the index: %v", err)
+		}
+
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 entries, got %d", len(entries))
+		}
+
+		if entries[0].ID != older || entries[1].ID != newer {
+			t.Errorf("Expected entries ordered by creation time, got %v", entries)
+		}
+	})
+
+	t.Run("should remove and count notes", func(t *testing.T) {
+		index := NewIndex(orbitdb.NewMemoryStore())
+		uid := uuid.Generate()
+
+		first, second := uuid.Generate(), uuid.Generate()
+		_ = index.Add(uid, first, 1000, 0)
+		_ = index.Add(uid, second, 2000, 0)
+
+		if err := index.Remove(first); err != nil {
+			t.Fatalf("Error removing from the index: %v", err)
+		}
+
+		count, err := index.Count(uid)
+		if err != nil {
+			t.Fatalf("Error counting the index: %v", err)
+		}
+
+		if count != 1 {
+			t.Errorf("Expected 1 note, got %d", count)
+		}
+	})
+
+	t.Run("should skip expired notes", func(t *testing.T) {
+		index := NewIndex(orbitdb.NewMemoryStore())
+		uid := uuid.Generate()
+
+		expired, kept := uuid.Generate(), uuid.Generate()
+		_ = index.Add(uid, expired, 1000, time.Now().Add(-time.Second).UnixMilli())
+		_ = index.Add(uid, kept, 2000, time.Now().Add(time.Hour).UnixMilli())
+
+		entries, _ := index.List(uid)
+		if len(entries) != 1 || entries[0].ID != kept {
+			t.Errorf("Expected only the note that did not expire, got %v", entries)
+		}
+
+		if count, _ := index.Count(uid); count != 1 {
+			t.Errorf("Expected 1 note, got %d", count)
+		}
+	})
+}
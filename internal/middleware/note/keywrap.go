@@ -0,0 +1,201 @@
+package note
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+)
+
+// keyWraps are the algorithms content keys are wrapped with for the key algorithms of the users
+var keyWraps = map[string]string{
+	user.KeyAlgorithmRSA:       KeyWrapAlgorithm,
+	user.KeyAlgorithmEd25519:   KeyWrapX25519,
+	user.KeyAlgorithmECDSAP256: KeyWrapECDH,
+	user.KeyAlgorithmECDSAP384: KeyWrapECDH,
+}
+
+// wrappedSizes are the sizes of the content keys wrapped with ECDH in bytes: the ephemeral public key, followed by
+// the encrypted content key and its GCM tag
+var wrappedSizes = map[string]int{
+	user.KeyAlgorithmEd25519:   curve25519.PointSize + 32 + 16,
+	user.KeyAlgorithmECDSAP256: 1 + 2*32 + 32 + 16,
+	user.KeyAlgorithmECDSAP384: 1 + 2*48 + 32 + 16,
+}
+
+// wrapKey encrypts the content key for the public key pub of a user. It returns the algorithm and the wrapped key.
+func wrapKey(pub crypto.PublicKey, contentKey []byte) (string, []byte, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, contentKey, nil)
+		return KeyWrapAlgorithm, wrapped, err
+	case ed25519.PublicKey:
+		recipient, err := x25519PublicKey(key)
+		if err != nil {
+			return "", nil, err
+		}
+
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(ephemeral); err != nil {
+			return "", nil, err
+		}
+		ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+		if err != nil {
+			return "", nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral, recipient)
+		if err != nil {
+			return "", nil, err
+		}
+
+		wrapped, err := sealKey(KeyWrapX25519, shared, ephemeralPub, recipient, contentKey)
+		return KeyWrapX25519, wrapped, err
+	case *ecdsa.PublicKey:
+		ephemeral, x, y, err := elliptic.GenerateKey(key.Curve, rand.Reader)
+		if err != nil {
+			return "", nil, err
+		}
+
+		shared, _ := key.Curve.ScalarMult(key.X, key.Y, ephemeral)
+		wrapped, err := sealKey(KeyWrapECDH, coordinate(key.Curve, shared), elliptic.Marshal(key.Curve, x, y),
+			elliptic.Marshal(key.Curve, key.X, key.Y), contentKey)
+		return KeyWrapECDH, wrapped, err
+	default:
+		return "", nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// unwrapKey decrypts a content key wrapped for the public key of the private key
+func unwrapKey(key crypto.Signer, wrapped []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k.Decrypt(rand.Reader, wrapped, &rsa.OAEPOptions{Hash: crypto.SHA256})
+	case ed25519.PrivateKey:
+		if len(wrapped) < curve25519.PointSize {
+			return nil, fmt.Errorf("wrapped key is too short")
+		}
+
+		scalar := x25519PrivateKey(k)
+		recipient, err := curve25519.X25519(scalar, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		ephemeralPub := wrapped[:curve25519.PointSize]
+		shared, err := curve25519.X25519(scalar, ephemeralPub)
+		if err != nil {
+			return nil, err
+		}
+
+		return openKey(KeyWrapX25519, shared, ephemeralPub, recipient, wrapped[curve25519.PointSize:])
+	case *ecdsa.PrivateKey:
+		size := 1 + 2*coordinateSize(k.Curve)
+		if len(wrapped) < size {
+			return nil, fmt.Errorf("wrapped key is too short")
+		}
+
+		ephemeralPub := wrapped[:size]
+		x, y := elliptic.Unmarshal(k.Curve, ephemeralPub)
+		if x == nil {
+			return nil, fmt.Errorf("invalid ephemeral key")
+		}
+
+		shared, _ := k.Curve.ScalarMult(x, y, k.D.Bytes())
+		return openKey(KeyWrapECDH, coordinate(k.Curve, shared), ephemeralPub,
+			elliptic.Marshal(k.Curve, k.X, k.Y), wrapped[size:])
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// sealKey encrypts the content key with AES-256-GCM and a key derived from the shared secret of an ECDH key
+// agreement: HKDF-SHA256 of the secret, salted with the ephemeral and the recipient public key, with the
+// algorithm as info. The derived key is used once, so the nonce is zero. The wrapped key is the ephemeral public
+// key followed by the encrypted content key.
+func sealKey(algorithm string, shared, ephemeralPub, recipient, contentKey []byte) ([]byte, error) {
+	gcm, err := agreedGCM(algorithm, shared, ephemeralPub, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(append([]byte(nil), ephemeralPub...), make([]byte, gcm.NonceSize()), contentKey, nil), nil
+}
+
+// openKey decrypts a content key encrypted by sealKey
+func openKey(algorithm string, shared, ephemeralPub, recipient, encrypted []byte) ([]byte, error) {
+	gcm, err := agreedGCM(algorithm, shared, ephemeralPub, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, make([]byte, gcm.NonceSize()), encrypted, nil)
+}
+
+// agreedGCM creates the AES-GCM cipher of the key derived from an ECDH key agreement, see sealKey
+func agreedGCM(algorithm string, shared, ephemeralPub, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte(nil), ephemeralPub...), recipient...)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(algorithm)), key); err != nil {
+		return nil, err
+	}
+
+	return newGCM(key)
+}
+
+// coordinateSize returns the size of a coordinate of curve in bytes
+func coordinateSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+// coordinate encodes a coordinate of curve with a fixed size, big-endian
+func coordinate(curve elliptic.Curve, x *big.Int) []byte {
+	return x.FillBytes(make([]byte, coordinateSize(curve)))
+}
+
+// x25519PublicKey converts an Ed25519 public key to the X25519 public key of the same private key: the Montgomery
+// u-coordinate (1 + y) / (1 - y) of the Edwards point
+func x25519PublicKey(pub ed25519.PublicKey) ([]byte, error) {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// the y-coordinate is little-endian, its top bit is the sign of x
+	encoded := make([]byte, len(pub))
+	for i, b := range pub {
+		encoded[len(pub)-1-i] = b
+	}
+	encoded[0] &= 0x7f
+	y := new(big.Int).SetBytes(encoded)
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Mod(new(big.Int).Sub(one, y), p)
+	if y.Cmp(p) >= 0 || denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, new(big.Int).ModInverse(denominator, p))
+	u.Mod(u, p)
+
+	out := u.FillBytes(make([]byte, curve25519.PointSize))
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// x25519PrivateKey returns the X25519 scalar of an Ed25519 private key, the first half of the SHA-512 hash of its
+// seed, which X25519 clamps
+func x25519PrivateKey(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	return h[:curve25519.ScalarSize]
+}
@@ -0,0 +1,86 @@
+package note
+
+import (
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"strings"
+)
+
+// MigrateUserNotes moves the semicolon-joined "notes" field of older user documents in users into the index
+// of the notes in db. The field is removed from the user documents afterwards. It returns the number of
+// migrated users and can be run repeatedly.
+func MigrateUserNotes(users, db orbitdb.Store, index Index) (int, error) {
+	migrated := 0
+
+	for _, raw := range users.ReadAll() {
+		doc, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		key, _ := doc["_id"].(string)
+		data, _ := doc["data"].(string)
+
+		item, err := orbitdb.UnmarshalItem(data)
+		if err != nil {
+			continue
+		}
+
+		// only user documents carry a public key
+		fields, ok := item.(map[string]interface{})
+		if !ok || fields["publicKey"] == nil {
+			continue
+		}
+
+		notes, ok := fields["notes"].(string)
+		if !ok {
+			continue
+		}
+
+		uid, err := uuid.Parse(key)
+		if err != nil {
+			log.Printf("Skipping user with invalid id %s\n", key)
+			continue
+		}
+
+		// notes without a creation time keep the order of the user document
+		createdAt, _ := fields["createdAt"].(float64)
+		fallback := int64(createdAt) * 1000
+
+		for i, rawID := range strings.Split(notes, ";") {
+			id, err := uuid.Parse(rawID)
+			if err != nil {
+				continue
+			}
+
+			// already indexed
+			if _, err := index.DB.Read(id.String()); err == nil {
+				continue
+			}
+
+			noteCreatedAt := fallback + int64(i)
+			if n, err := getNote(db, id); err == nil && n.CreatedAt != 0 {
+				noteCreatedAt = n.CreatedAt
+			}
+
+			// notes of older versions do not expire
+			err = index.Add(uid, id, noteCreatedAt, 0)
+			if err != nil {
+				return migrated, err
+			}
+		}
+
+		delete(fields, "notes")
+
+		_, err = users.Update(key, fields)
+		if err != nil {
+			log.Printf("Could not remove the notes of user %s\n", key)
+			return migrated, err
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
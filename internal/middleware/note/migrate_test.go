@@ -0,0 +1,66 @@
+package note
+
+import (
+	"github.com/docker/distribution/uuid"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+)
+
+func TestMigrateUserNotes(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+	index := NewIndex(orbitdb.NewMemoryStore())
+
+	uid := uuid.Generate()
+	first, second := uuid.Generate(), uuid.Generate()
+
+	// a user document in the format with semicolon-joined notes
+	_, err := db.Users.Create(gin.H{
+		"id":        uid.String(),
+		"publicKey": "key",
+		"nonce":     "",
+		"isAdmin":   false,
+		"createdAt": 1,
+		"updatedAt": 1,
+		"notes":     ";" + first.String() + ";" + second.String(),
+	}, &orbitdb.DatabaseCreateOptions{ID: uid.String()})
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	t.Run("should move the notes into the index", func(t *testing.T) {
+		migrated, err := MigrateUserNotes(db.Users, db.Notes, index)
+		if err != nil {
+			t.Fatalf("Error migrating: %v", err)
+		}
+
+		if migrated != 1 {
+			t.Errorf("Expected 1 migrated user, got %d", migrated)
+		}
+
+		entries, _ := index.List(uid)
+		if len(entries) != 2 || entries[0].ID != first || entries[1].ID != second {
+			t.Errorf("Expected both notes in their original order, got %v", entries)
+		}
+
+		// the registered key of the user becomes their first device
+		if _, err := user.MoveDevices(db); err != nil {
+			t.Fatalf("Error moving the devices: %v", err)
+		}
+		if _, err := user.Find(db, uid.String()); err != nil {
+			t.Errorf("Expected the user to remain readable: %v", err)
+		}
+	})
+
+	t.Run("should not migrate twice", func(t *testing.T) {
+		migrated, err := MigrateUserNotes(db.Users, db.Notes, index)
+		if err != nil {
+			t.Fatalf("Error migrating: %v", err)
+		}
+
+		if migrated != 0 {
+			t.Errorf("Expected no migrated users, got %d", migrated)
+		}
+	})
+}
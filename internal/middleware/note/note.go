@@ -1,10 +1,11 @@
 package note
 
 import (
-	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/docker/distribution/uuid"
-	"github.com/gin-gonic/gin"
-	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"log"
 	"time"
@@ -12,9 +13,98 @@ import (
 
 // Note is a note entity
 type Note struct {
-	ID   uuid.UUID
-	UID  uuid.UUID
-	Data string // Change it to interface{} for production
+	ID        uuid.UUID `json:"-"`
+	UID       uuid.UUID `json:"-"`
+	Data      string    `json:"data"`      // Change it to interface{} for production
+	CreatedAt int64     `json:"createdAt"` // unix milliseconds
+	// Blob is the file of a note uploaded as a file, nil for text notes
+	Blob *Blob `json:"-"`
+	// Envelope is the content of a note encrypted on the client, nil for plaintext notes
+	Envelope *Envelope `json:"envelope,omitempty"`
+	// ExpiresAt is the time the note is purged in unix milliseconds, 0 if it does not expire
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// UpdatedAt is the time the note was last changed in unix milliseconds, 0 if it never was
+	UpdatedAt int64 `json:"updatedAt,omitempty"`
+	// DeletedAt is the time the note was deleted in unix milliseconds, see Tombstone
+	DeletedAt int64 `json:"deletedAt,omitempty"`
+	// Signature is the Digest of the note signed by its owner, base64 encoded. Notes of older versions are not
+	// signed.
+	Signature string `json:"signature,omitempty"`
+	// ExpirySignature is the Digest of the ExpiryTombstone of an expiring note signed by its owner, base64 encoded.
+	// It is the signature of the tombstone that replaces the note once it expires.
+	ExpirySignature string `json:"expirySignature,omitempty"`
+}
+
+// plainNote is a Note without its JSON methods
+type plainNote Note
+
+// MarshalJSON stores the uid of the note as string and the fields of its blob next to the others
+func (n Note) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainNote
+		UID string `json:"uid"`
+		*Blob
+	}{plainNote(n), n.UID.String(), n.Blob})
+}
+
+// UnmarshalJSON parses the uid and the blob of the note. The id is set by Decoded.
+func (n *Note) UnmarshalJSON(b []byte) error {
+	raw := struct {
+		*plainNote
+		UID string `json:"uid"`
+		*Blob
+	}{plainNote: (*plainNote)(n), Blob: &Blob{}}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	uid, err := uuid.Parse(raw.UID)
+	if err != nil {
+		return fmt.Errorf("invalid note uid %q: %v", raw.UID, err)
+	}
+	n.UID = uid
+
+	n.Blob = nil
+	if raw.Blob.CID != "" {
+		n.Blob = raw.Blob
+	}
+	return nil
+}
+
+// Decoded sets the id of a note read from the entry with the key
+func (n *Note) Decoded(key string) error {
+	id, err := uuid.Parse(key)
+	if err != nil {
+		return fmt.Errorf("invalid note id %q: %v", key, err)
+	}
+	n.ID = id
+	return nil
+}
+
+// notes returns the repository of the notes in db
+func notes(db orbitdb.Store) orbitdb.Repository[Note, *Note] {
+	return orbitdb.NewRepository[Note](db, Schema)
+}
+
+var (
+	// ErrNoteExpired is returned for notes past their expiry, which have not been purged yet
+	ErrNoteExpired = errors.New("note has expired")
+	// ErrNoteExists is returned for new notes with the id of an existing note
+	ErrNoteExists = errors.New("note already exists")
+	// ErrNoteDeleted is returned for notes replaced by their tombstone
+	ErrNoteDeleted = errors.New("note has been deleted")
+	// ErrNoExpirySignature is returned for new expiring notes without the signature of their ExpiryTombstone
+	ErrNoExpirySignature = errors.New("expiring note has no expiry signature")
+)
+
+// Blob describes the file of a note, which is kept in the blob store
+type Blob struct {
+	CID      string `json:"cid"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Filename string `json:"filename"`
+	// SHA256 is the hex encoded SHA-256 hash of the file, which is checked before the file is served
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 // init is called before main
@@ -22,117 +112,317 @@ func init() {
 	log.SetPrefix("[middleware/note/note] ")
 }
 
-// NewNote creates a new note entry in the ODB
-func NewNote(text string, uid uuid.UUID) (*Note, error) {
-	note := &Note{
-		ID:   uuid.Generate(),
-		UID:  uid,
-		Data: text,
-	}
+// NewNote creates the note n of a user in their store and adds it to their index. Since the whole note is signed,
+// the client sets its id and creation time; signature is the Digest of the note signed by the owner.
+func NewNote(db orbitdb.Stores, index Index, n Note, signature []byte) (*Note, error) {
+	return createNote(db, index, &n, signature)
+}
 
-	// give the note a few seconds to be created
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Expired reports whether the note is past its expiry at now
+func (n *Note) Expired(now time.Time) bool {
+	return n.ExpiresAt != 0 && n.ExpiresAt <= now.UnixMilli()
+}
 
-	db, err := orbitdb.OpenDatabase(ctx, "default")
+// Tombstone returns the note that replaces n once it is deleted at deletedAt in unix milliseconds. It keeps the id,
+// the owner and the file of the note, so that every node can release the file.
+func (n *Note) Tombstone(deletedAt int64) *Note {
+	return &Note{ID: n.ID, UID: n.UID, Blob: n.Blob, DeletedAt: deletedAt}
+}
 
-	if err != nil {
-		log.Println("Failed to create note")
-		return nil, err
+// ExpiryTombstone returns the tombstone that replaces n once it expires. Its owner signs it together with the note,
+// so that it can be written without them. It keeps the createdAt and expiresAt of the note and is deleted at
+// expiresAt.
+func (n *Note) ExpiryTombstone() *Note {
+	return &Note{ID: n.ID, UID: n.UID, Blob: n.Blob, CreatedAt: n.CreatedAt, ExpiresAt: n.ExpiresAt, DeletedAt: n.ExpiresAt}
+}
+
+// expiryTombstone reports whether the note is an ExpiryTombstone
+func (n *Note) expiryTombstone() bool {
+	return n.Deleted() && n.CreatedAt != 0 && n.DeletedAt == n.ExpiresAt
+}
+
+// Deleted reports whether the note is a tombstone
+func (n *Note) Deleted() bool {
+	return n.DeletedAt != 0
+}
+
+// SignedAt returns the time the note was signed in unix milliseconds: the time it was deleted, changed or created.
+// An ExpiryTombstone is signed when the note is created.
+func (n *Note) SignedAt() int64 {
+	switch {
+	case n.expiryTombstone():
+		return n.CreatedAt
+	case n.DeletedAt != 0:
+		return n.DeletedAt
+	case n.UpdatedAt != 0:
+		return n.UpdatedAt
+	default:
+		return n.CreatedAt
 	}
+}
 
-	// create the note
-	resp, err := db.Create(gin.H{
-		"id":   note.ID.String(),
-		"data": note.Data,
-		"uid":  note.UID.String(),
-	}, nil)
+// createNote signs the note with signature, stores it in the store of its owner and adds it to their index. An
+// expiring note has to carry its ExpirySignature.
+func createNote(db orbitdb.Stores, index Index, note *Note, signature []byte) (*Note, error) {
+	note.Signature = base64.StdEncoding.EncodeToString(signature)
 
-	defer func(db *orbitdb.Database) {
-		err := db.Close()
-		if err != nil {
-			log.Printf("Could not close note database %v\n", note)
-		}
-	}(db)
+	if note.ExpiresAt != 0 && note.ExpirySignature == "" {
+		return nil, ErrNoExpirySignature
+	}
 
+	own, err := db.UserNotes.Get(note.UID.String())
 	if err != nil {
-		log.Println("Failed to create note")
+		log.Println("Failed to open the notes of the user")
 		return nil, err
 	}
 
-	// extract the note ID from the response
-	_id := resp["_id"].(string)
+	// the id is chosen by the client, a note cannot replace another one
+	for _, store := range []orbitdb.Store{own, db.Notes} {
+		if _, err := store.Read(note.ID.String()); err == nil {
+			return nil, ErrNoteExists
+		}
+	}
 
-	newID, err := uuid.Parse(_id)
+	// the store verifies the signature
+	err = notes(own).CreateWithKey(note.ID.String(), note)
 
 	if err != nil {
-		log.Println("Failed to parse note id")
+		log.Println("Failed to create note")
 		return nil, err
 	}
 
-	// update the user notes
-	_, err = user.UpdateNotes(uid.String(), newID.String())
+	// add the note to the index of the user
+	err = index.Add(note.UID, note.ID, note.CreatedAt, note.ExpiresAt)
 
 	if err != nil {
 		log.Println("Failed to update user notes")
 		return nil, err
 	}
 
-	// return a new note
-	return &Note{
-		ID:   newID,
-		UID:  uid,
-		Data: note.Data,
-	}, nil
+	return note, nil
 }
 
-// GetNote returns a note from the ODB
-func GetNote(id uuid.UUID) (*Note, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// storeOf returns the store holding the note with the id of the user uid: their own store, or the store of the
+// unsigned notes of older versions, which is reported as shared
+func storeOf(db orbitdb.Stores, uid, id uuid.UUID) (store orbitdb.Store, shared bool, err error) {
+	own, err := db.UserNotes.Get(uid.String())
+	if err != nil {
+		log.Println("Failed to open the notes of the user")
+		return nil, false, err
+	}
+
+	if _, err := own.Read(id.String()); err == nil {
+		return own, false, nil
+	}
 
-	db, err := orbitdb.OpenDatabase(ctx, "default")
+	return db.Notes, true, nil
+}
 
+// GetNote returns a note of the user uid from the ODB
+func GetNote(db orbitdb.Stores, uid, id uuid.UUID) (*Note, error) {
+	store, _, err := storeOf(db, uid, id)
 	if err != nil {
-		log.Println("Failed to open note database")
 		return nil, err
 	}
 
-	defer func(db *orbitdb.Database) {
-		err := db.Close()
-		if err != nil {
-			log.Printf("Could not close note database %v\n", id)
-		}
-	}(db)
+	return getNote(store, id)
+}
 
+// getNote returns a note from store
+func getNote(store orbitdb.Store, id uuid.UUID) (*Note, error) {
 	// get the note
-	resp, err := db.Read(id.String())
+	n, err := notes(store).Get(id.String())
 
+	if errors.Is(err, orbitdb.ErrInvalidDocument) {
+		log.Println("Failed to parse note")
+		return nil, err
+	}
 	if err != nil {
 		log.Println("Failed to get note")
 		return nil, err
 	}
 
-	// parse the ODB format to a note
-	item, err := orbitdb.UnmarshalItem(resp["data"].(string))
+	if n.Deleted() && !n.expiryTombstone() {
+		return nil, ErrNoteDeleted
+	}
+
+	// expired notes are hidden until the reaper replaces them by their tombstone
+	if n.Expired(time.Now()) {
+		return nil, ErrNoteExpired
+	}
 
+	return n, nil
+}
+
+// ListNotes returns up to limit notes of the user with the id uid, in the order they were created and
+// starting after cursor. It also returns the cursor of the next page, which is empty on the last page.
+// Notes which cannot be read, e.g. because they have not been replicated yet, are skipped, and the page is
+// filled up with the following ones.
+func ListNotes(db orbitdb.Stores, index Index, uid uuid.UUID, limit int, cursor string) ([]*Note, string, error) {
+	if limit == 0 {
+		limit = orbitdb.DefaultLimit
+	}
+	if limit > orbitdb.MaxLimit {
+		limit = orbitdb.MaxLimit
+	}
+
+	notes := make([]*Note, 0)
+	for {
+		// the remaining notes of the page, all of them for a negative limit
+		remaining := limit
+		if limit > 0 {
+			remaining = limit - len(notes)
+		}
+
+		entries, next, err := index.Page(uid, remaining, cursor)
+		if err != nil {
+			log.Println("Failed to read the note index")
+			return nil, "", err
+		}
+
+		for _, entry := range entries {
+			n, err := GetNote(db, uid, entry.ID)
+			if err == ErrNoteExpired || err == ErrNoteDeleted {
+				continue
+			}
+			if err != nil {
+				log.Printf("Skipping missing note %s\n", entry.ID)
+				continue
+			}
+
+			notes = append(notes, n)
+		}
+
+		if next == "" || len(notes) == limit {
+			return notes, next, nil
+		}
+		cursor = next
+	}
+}
+
+// UpdateNote replaces the text of an existing note of the user uid at updatedAt in unix milliseconds. An encrypted
+// note becomes a plaintext note. signature is the Digest of the updated note signed by the user.
+func UpdateNote(db orbitdb.Stores, uid, id uuid.UUID, text string, updatedAt int64, signature []byte) (*Note, error) {
+	return updateNote(db, uid, id, updatedAt, signature, func(n *Note) {
+		n.Data = text
+		n.Envelope = nil
+	})
+}
+
+// UpdateEncryptedNote replaces the content of an existing note of the user uid with an envelope
+func UpdateEncryptedNote(db orbitdb.Stores, uid, id uuid.UUID, envelope Envelope, updatedAt int64, signature []byte) (*Note, error) {
+	return updateNote(db, uid, id, updatedAt, signature, func(n *Note) {
+		n.Data = ""
+		n.Envelope = &envelope
+	})
+}
+
+// updateNote applies change to a text note at updatedAt, signs it with signature and saves it. Unsigned notes of
+// older versions are moved into the store of the user.
+func updateNote(db orbitdb.Stores, uid, id uuid.UUID, updatedAt int64, signature []byte, change func(n *Note)) (*Note, error) {
+	store, shared, err := storeOf(db, uid, id)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getNote(store, id)
 	if err != nil {
 		return nil, err
 	}
 
-	inferred := item.(map[string]interface{})
-	uid, err := uuid.Parse(inferred["uid"].(string))
+	if n.UID != uid {
+		return nil, fmt.Errorf("user does not own note")
+	}
+
+	if n.Blob != nil {
+		return nil, fmt.Errorf("note %s is a file and has no text", id)
+	}
+
+	change(n)
+	n.UpdatedAt = updatedAt
+	n.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	if shared {
+		err = moveNote(db, n)
+	} else {
+		err = notes(store).Put(id.String(), n)
+	}
 
 	if err != nil {
-		log.Println("Failed to parse note uid")
+		log.Println("Failed to update note")
 		return nil, err
 	}
 
-	note := &Note{
-		ID:   id,
-		UID:  uid,
-		Data: inferred["data"].(string),
+	return n, nil
+}
+
+// moveNote saves a signed note of older versions in the store of its owner and deletes it from the store of
+// the unsigned notes
+func moveNote(db orbitdb.Stores, n *Note) error {
+	own, err := db.UserNotes.Get(n.UID.String())
+	if err != nil {
+		return err
 	}
 
-	return note, nil
+	if err := notes(own).CreateWithKey(n.ID.String(), n); err != nil {
+		return err
+	}
+
+	return db.Notes.Delete(n.ID.String())
+}
+
+// DeleteNote deletes a note of the user uid and removes it from their index. A note in their store is replaced by
+// its Tombstone, deleted at deletedAt; signature is the Digest of the tombstone signed by the user. Unsigned notes
+// of older versions are deleted right away.
+func DeleteNote(db orbitdb.Stores, index Index, uid, id uuid.UUID, deletedAt int64, signature []byte) error {
+	store, shared, err := storeOf(db, uid, id)
+	if err != nil {
+		return err
+	}
+
+	if shared {
+		return deleteNote(store, index, id)
+	}
+
+	n, err := getNote(store, id)
+	if err != nil {
+		return err
+	}
+
+	tombstone := n.Tombstone(deletedAt)
+	tombstone.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	// the store verifies the signature
+	if err := notes(store).Put(id.String(), tombstone); err != nil {
+		log.Println("Failed to delete note")
+		return err
+	}
+
+	return removeIndexed(index, id)
+}
+
+// deleteNote removes a note from store and from the index of its owner
+func deleteNote(store orbitdb.Store, index Index, id uuid.UUID) error {
+	err := store.Delete(id.String())
+	if err != nil {
+		log.Println("Failed to delete note")
+		return err
+	}
+
+	return removeIndexed(index, id)
+}
+
+// removeIndexed removes a note from the index, unless it has been removed already
+func removeIndexed(index Index, id uuid.UUID) error {
+	if !index.Contains(id) {
+		return nil
+	}
+
+	err := index.Remove(id)
+	if err != nil {
+		log.Println("Failed to update user notes")
+		return err
+	}
+
+	return nil
 }
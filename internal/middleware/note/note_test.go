@@ -1,16 +1,70 @@
 package note
 
 import (
-	"context"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"github.com/docker/distribution/uuid"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"testing"
+	"time"
 )
 
+// draft returns a new text note of the user uid, as drafted by their client
+func draft(uid uuid.UUID, text string, expiresAt int64) Note {
+	return Note{ID: uuid.Generate(), UID: uid, Data: text, CreatedAt: time.Now().UnixMilli(), ExpiresAt: expiresAt}
+}
+
+// expiring adds the signature of the expiry of n, made with sign, as the client does for notes which expire
+func expiring(n Note, sign func(n Note) []byte) Note {
+	n.ExpirySignature = base64.StdEncoding.EncodeToString(sign(*n.ExpiryTombstone()))
+	return n
+}
+
+// edited returns the text note n with a new text at updatedAt, as signed by the client updating it
+func edited(n Note, text string, updatedAt int64) Note {
+	n.Data, n.Envelope, n.UpdatedAt = text, nil, updatedAt
+	return n
+}
+
+// newKey generates an Ed25519 key pair, returning the private key and the PEM encoded public key
+func newKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+
+	return priv, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// newTestUser creates a user with an Ed25519 key in db. It returns the user and a function signing their notes.
+func newTestUser(t *testing.T, db orbitdb.Stores) (user.User, func(n Note) []byte) {
+	priv, publicKey := newKey(t)
+	u, err := user.NewUser(db, publicKey, false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	return u, func(n Note) []byte {
+		signature, err := Sign(priv, &n)
+		if err != nil {
+			t.Fatalf("Error signing note: %v", err)
+		}
+		return signature
+	}
+}
+
 func TestNewNotes(t *testing.T) {
 	//var currentNote *Note
 
@@ -23,24 +77,32 @@ func TestNewNotes(t *testing.T) {
 
 	PublicKey := string(pubkPEM)
 
-	cancelFunc, err := orbitdb.InitializeOrbitDB("http://localhost:5001", t.TempDir())
-
-	if err != nil {
-		t.Fatalf("Error initializing OrbitDB: %v", err)
-	}
-	defer cancelFunc()
-	_, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	db := orbitdb.NewMemoryStores()
+	VerifyUserNotes(db)
+	index := NewIndex(orbitdb.NewMemoryStore())
 
 	item := "Lorem Ipsum"
-	tUser, err := user.NewUser(PublicKey, false)
+	tUser, err := user.NewUser(db, PublicKey, false)
 
 	if err != nil {
 		t.Fatalf("Error creating tUser: %v", err)
 	}
 
+	// sign signs a note with the key of tUser
+	sign := func(n Note) []byte {
+		signature, err := Sign(privateK, &n)
+		if err != nil {
+			t.Fatalf("Error signing note: %v", err)
+		}
+		return signature
+	}
+	// create creates a signed note
+	create := func(n Note) (*Note, error) {
+		return NewNote(db, index, n, sign(n))
+	}
+
 	t.Run("Create a note", func(t *testing.T) {
-		note, err := NewNote(item, tUser.ID)
+		note, err := create(draft(tUser.ID, item, 0))
 
 		if err != nil {
 			t.Fatalf("Error creating note: %v", err)
@@ -54,13 +116,13 @@ func TestNewNotes(t *testing.T) {
 	})
 
 	t.Run("Get a note", func(t *testing.T) {
-		tNote, err := NewNote(item, tUser.ID)
+		tNote, err := create(draft(tUser.ID, item, 0))
 
 		if err != nil {
 			t.Fatalf("Error creating note: %v", err)
 		}
 
-		note, err := GetNote(tNote.ID)
+		note, err := GetNote(db, tUser.ID, tNote.ID)
 
 		if err != nil {
 			t.Fatalf("Error getting note: %v", err)
@@ -70,4 +132,262 @@ func TestNewNotes(t *testing.T) {
 			t.Fatalf("Error getting note: %v", err)
 		}
 	})
+
+	t.Run("List the notes of a user", func(t *testing.T) {
+		owner, err := user.NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+
+		first, _ := create(draft(owner.ID, "first", 0))
+		// creation times have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+		second, _ := create(draft(owner.ID, "second", 0))
+
+		notes, _, err := ListNotes(db, index, owner.ID, 0, "")
+		if err != nil {
+			t.Fatalf("Error listing notes: %v", err)
+		}
+
+		if len(notes) != 2 {
+			t.Fatalf("Expected 2 notes, got %d", len(notes))
+		}
+
+		if notes[0].ID != first.ID || notes[1].ID != second.ID {
+			t.Errorf("Expected notes in creation order")
+		}
+	})
+
+	t.Run("Fill a page after missing notes", func(t *testing.T) {
+		owner, err := user.NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+
+		// an index entry of a note which has not been replicated yet
+		_ = index.Add(owner.ID, uuid.Generate(), 1, 0)
+		first, _ := create(draft(owner.ID, "first", 0))
+		time.Sleep(2 * time.Millisecond)
+		second, _ := create(draft(owner.ID, "second", 0))
+
+		notes, next, err := ListNotes(db, index, owner.ID, 1, "")
+		if err != nil {
+			t.Fatalf("Error listing notes: %v", err)
+		}
+		if len(notes) != 1 || notes[0].ID != first.ID || next == "" {
+			t.Fatalf("Expected the first note and a next page, got %d notes and %q", len(notes), next)
+		}
+
+		notes, next, _ = ListNotes(db, index, owner.ID, 1, next)
+		if len(notes) != 1 || notes[0].ID != second.ID || next != "" {
+			t.Errorf("Expected the second note on the last page, got %d notes and %q", len(notes), next)
+		}
+	})
+
+	t.Run("Update a note", func(t *testing.T) {
+		tNote, err := create(draft(tUser.ID, item, 0))
+		if err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+
+		updatedAt := time.Now().UnixMilli()
+		_, err = UpdateNote(db, tUser.ID, tNote.ID, "updated", updatedAt, sign(edited(*tNote, "updated", updatedAt)))
+		if err != nil {
+			t.Fatalf("Error updating note: %v", err)
+		}
+
+		note, err := GetNote(db, tUser.ID, tNote.ID)
+		if err != nil {
+			t.Fatalf("Error getting note: %v", err)
+		}
+
+		if note.Data != "updated" || note.UID != tUser.ID {
+			t.Errorf("Expected the note to be updated, got %v", note)
+		}
+	})
+
+	t.Run("Store an encrypted note", func(t *testing.T) {
+		envelope, err := SealEnvelope([]byte(item), []crypto.PublicKey{&privateK.PublicKey})
+		if err != nil {
+			t.Fatalf("Error sealing envelope: %v", err)
+		}
+
+		encrypted := draft(tUser.ID, "", 0)
+		encrypted.Envelope = envelope
+		tNote, err := create(encrypted)
+		if err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+
+		note, err := GetNote(db, tUser.ID, tNote.ID)
+		if err != nil {
+			t.Fatalf("Error getting note: %v", err)
+		}
+
+		if note.Data != "" || note.Envelope == nil {
+			t.Fatalf("Expected an encrypted note, got %v", note)
+		}
+
+		plaintext, err := note.Envelope.Open(privateK)
+		if err != nil || string(plaintext) != item {
+			t.Errorf("Expected the stored envelope to decrypt to %s, got %s %v", item, plaintext, err)
+		}
+
+		updatedAt := time.Now().UnixMilli()
+		updated, err := UpdateNote(db, tUser.ID, tNote.ID, "in the clear", updatedAt, sign(edited(*tNote, "in the clear", updatedAt)))
+		if err != nil || updated.Envelope != nil {
+			t.Errorf("Expected a plaintext note after updating the text, got %v %v", updated, err)
+		}
+	})
+
+	t.Run("Delete a note", func(t *testing.T) {
+		tNote, err := create(draft(tUser.ID, item, 0))
+		if err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+
+		deletedAt := time.Now().UnixMilli()
+		forged := sign(*tNote.Tombstone(deletedAt + 1))
+		if err := DeleteNote(db, index, tUser.ID, tNote.ID, deletedAt, forged); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v for a tombstone signed at another time, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		err = DeleteNote(db, index, tUser.ID, tNote.ID, deletedAt, sign(*tNote.Tombstone(deletedAt)))
+		if err != nil {
+			t.Fatalf("Error deleting note: %v", err)
+		}
+
+		if _, err := GetNote(db, tUser.ID, tNote.ID); err != ErrNoteDeleted {
+			t.Errorf("Expected %v, got %v", ErrNoteDeleted, err)
+		}
+
+		// the signed note cannot be brought back
+		own, _ := db.UserNotes.Get(tUser.ID.String())
+		if err := notes(own).Put(tNote.ID.String(), tNote); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+		if err := own.Delete(tNote.ID.String()); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		entries, _ := index.List(tUser.ID)
+		for _, entry := range entries {
+			if entry.ID == tNote.ID {
+				t.Errorf("Expected the note to be removed from the index")
+			}
+		}
+	})
+
+	t.Run("Reject notes with the id of another note", func(t *testing.T) {
+		tNote, _ := create(draft(tUser.ID, item, 0))
+
+		again := draft(tUser.ID, "replaced", 0)
+		again.ID = tNote.ID
+		if _, err := create(again); err != ErrNoteExists {
+			t.Errorf("Expected %v, got %v", ErrNoteExists, err)
+		}
+	})
+
+	t.Run("Reject notes not signed by their owner", func(t *testing.T) {
+		other, _ := newTestUser(t, db)
+
+		// signed for another user
+		_, err := create(draft(other.ID, item, 0))
+		if !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		// signed for another expiry
+		forged := draft(tUser.ID, item, 0)
+		expiring := forged
+		expiring.ExpiresAt = time.Now().Add(time.Hour).UnixMilli()
+		_, err = NewNote(db, index, forged, sign(expiring))
+		if !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		// signed for another content
+		tNote, _ := create(draft(tUser.ID, item, 0))
+		updatedAt := time.Now().UnixMilli()
+		_, err = UpdateNote(db, tUser.ID, tNote.ID, "forged", updatedAt, sign(*tNote))
+		if !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+	})
+
+	t.Run("Reject expiring notes without a valid expiry signature", func(t *testing.T) {
+		n := draft(tUser.ID, item, time.Now().Add(time.Hour).UnixMilli())
+		if _, err := create(n); !errors.Is(err, ErrNoExpirySignature) {
+			t.Errorf("Expected %v, got %v", ErrNoExpirySignature, err)
+		}
+
+		// signed for another expiry
+		other := n
+		other.ExpiresAt = time.Now().Add(2 * time.Hour).UnixMilli()
+		n.ExpirySignature = expiring(other, sign).ExpirySignature
+		if _, err := create(n); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		if _, err := create(expiring(n, sign)); err != nil {
+			t.Errorf("Expected the note to be created, got %v", err)
+		}
+	})
+
+	t.Run("Accept notes signed before the key was rotated", func(t *testing.T) {
+		oldKey, oldPEM := newKey(t)
+		rotating, err := user.NewUser(db, oldPEM, false)
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+		uid := rotating.ID.String()
+
+		// signed before the rotation, but written afterwards
+		before := draft(rotating.ID, item, 0)
+		before.CreatedAt = time.Now().Add(-2 * time.Second).UnixMilli()
+		signed, _ := Sign(oldKey, &before)
+
+		_, newPEM := newKey(t)
+		issued, _ := user.IssueNonce(db, uid)
+		now := time.Now().Unix()
+		handover, _ := user.SignRotation(oldKey, issued.Nonce, newPEM, now)
+		if _, _, err := user.RotateKey(db, uid, uid, newPEM, now, handover); err != nil {
+			t.Fatalf("Error rotating key: %v", err)
+		}
+
+		if _, err := NewNote(db, index, before, signed); err != nil {
+			t.Errorf("Expected the note signed before the rotation to be accepted, got %v", err)
+		}
+
+		after := draft(rotating.ID, item, 0)
+		after.CreatedAt = time.Now().Add(2 * time.Second).UnixMilli()
+		signed, _ = Sign(oldKey, &after)
+		if _, err := NewNote(db, index, after, signed); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("Expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+	})
+
+	t.Run("Move a note of an older version into the store of its owner", func(t *testing.T) {
+		old := &Note{ID: uuid.Generate(), UID: tUser.ID, Data: item, CreatedAt: 1}
+		if err := notes(db.Notes).CreateWithKey(old.ID.String(), old); err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+
+		if found, err := GetNote(db, tUser.ID, old.ID); err != nil || found.Signature != "" {
+			t.Fatalf("Expected the unsigned note, got %v %v", found, err)
+		}
+
+		updatedAt := time.Now().UnixMilli()
+		if _, err := UpdateNote(db, tUser.ID, old.ID, "signed", updatedAt, sign(edited(*old, "signed", updatedAt))); err != nil {
+			t.Fatalf("Error updating note: %v", err)
+		}
+
+		own, _ := db.UserNotes.Get(tUser.ID.String())
+		if _, err := own.Read(old.ID.String()); err != nil {
+			t.Errorf("Expected the note in the store of its owner: %v", err)
+		}
+		if _, err := db.Notes.Read(old.ID.String()); err == nil {
+			t.Errorf("Expected the note to be removed from the store of older notes")
+		}
+	})
 }
@@ -0,0 +1,140 @@
+package note
+
+import (
+	"context"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"time"
+)
+
+// UploadTTL is how long an uploaded file is kept for a note to claim it
+var UploadTTL = time.Hour
+
+// Reap purges the notes that expired before now, in the store of older versions and the open stores of the users,
+// which it does not open itself. Notes of older versions are deleted, the signed notes of the users are replaced by
+// the ExpiryTombstone their owner signed with them. Notes without one, which were signed before expiry signatures,
+// stay in their store, hidden. The notes leave the index of their owner and their files are released in blobs, as
+// are the files of deleted notes and the uploads older than UploadTTL. A note that cannot be purged is logged and
+// tried again on the next sweep, the sweep goes on with the others. It returns the number of purged notes and the
+// first error.
+func Reap(db orbitdb.Stores, index Index, blobs *orbitdb.CountedBlobStore, now time.Time) (int, error) {
+	purged := 0
+	var first error
+
+	// the stores of the users are opened once the users arrive, see user.OpenNoteStores
+	stores := append([]orbitdb.Store{db.Notes}, db.UserNotes.All()...)
+
+	for _, store := range stores {
+		n, err := reapStore(store, index, blobs, now)
+		purged += n
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	if blobs != nil {
+		// uploads are only kept for a while, whether a note claimed their file or not
+		if _, err := blobs.ReleaseUploads(context.Background(), now.Add(-UploadTTL)); err != nil {
+			log.Printf("Failed to release uploads: %v\n", err)
+		}
+	}
+
+	return purged, first
+}
+
+// reapStore purges the notes of store that expired before now and releases the files of deleted notes. It returns
+// the number of purged notes and the first error.
+func reapStore(store orbitdb.Store, index Index, blobs *orbitdb.CountedBlobStore, now time.Time) (int, error) {
+	purged := 0
+	var first error
+
+	for _, n := range allNotes(store) {
+		if !n.Expired(now) && !n.Deleted() {
+			continue
+		}
+
+		removed, err := purgeNote(store, index, n)
+		if err != nil {
+			log.Printf("Failed to purge note %s: %v\n", n.ID, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		if n.Blob != nil && blobs != nil {
+			// the note is gone, a file that cannot be released only wastes space. Files shared with other notes
+			// are kept for them, files released before stay released.
+			if err := blobs.Release(context.Background(), n.Blob.CID, n.ID.String()); err != nil {
+				log.Printf("Failed to remove file %s: %v\n", n.Blob.CID, err)
+			}
+		}
+
+		if removed && !n.Deleted() {
+			purged++
+		}
+	}
+
+	return purged, first
+}
+
+// purgeNote removes a note from the index and deletes it from store. In the store of a user, an expired note is
+// replaced by its signed ExpiryTombstone instead. It reports whether the note had not been purged before.
+func purgeNote(store orbitdb.Store, index Index, n *Note) (bool, error) {
+	if _, owned := store.(orbitdb.OwnerStore); !owned {
+		return true, deleteNote(store, index, n.ID)
+	}
+
+	removed := index.Contains(n.ID)
+
+	if !n.Deleted() && n.ExpirySignature != "" {
+		tombstone := n.ExpiryTombstone()
+		tombstone.Signature = n.ExpirySignature
+
+		// the store verifies the signature
+		if err := notes(store).Put(n.ID.String(), tombstone); err != nil {
+			return false, err
+		}
+		removed = true
+	}
+
+	return removed, removeIndexed(index, n.ID)
+}
+
+// StartReaper runs Reap every interval until the returned function is called
+func StartReaper(db orbitdb.Stores, index Index, blobs *orbitdb.CountedBlobStore, interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				purged, err := Reap(db, index, blobs, now)
+				if err != nil {
+					log.Printf("Error purging expired notes: %v\n", err)
+				}
+				if purged > 0 {
+					log.Printf("Purged %d expired notes\n", purged)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// allNotes returns the notes in db, skipping documents of other types
+func allNotes(db orbitdb.Store) []*Note {
+	return notes(db).All()
+}
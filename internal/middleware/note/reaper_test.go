@@ -0,0 +1,249 @@
+package note
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"strings"
+	"testing"
+	"time"
+)
+
+// undeletableStore is a store whose documents cannot be deleted
+type undeletableStore struct {
+	*orbitdb.MemoryStore
+}
+
+func (undeletableStore) Delete(key string) error {
+	return errors.New("read-only store")
+}
+
+func TestReap(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+	VerifyUserNotes(db)
+	index := NewIndex(orbitdb.NewMemoryStore())
+	blobs := orbitdb.NewMemoryCountedBlobStore()
+	owner, sign := newTestUser(t, db)
+	uid := owner.ID
+	now := time.Now()
+
+	// create creates a signed note, with the signature of its expiry if it expires
+	create := func(n Note) *Note {
+		if n.ExpiresAt != 0 {
+			n = expiring(n, sign)
+		}
+		created, err := NewNote(db, index, n, sign(n))
+		if err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+		return created
+	}
+	// createBlob creates a signed note of a file, which claims the file
+	createBlob := func(cid string, expiresAt int64) *Note {
+		n := draft(uid, "", expiresAt)
+		n.Blob = &Blob{CID: cid, SHA256: "hash"}
+		if err := blobs.Claim(context.Background(), cid, n.ID.String()); err != nil {
+			t.Fatalf("Error claiming file: %v", err)
+		}
+		return create(n)
+	}
+
+	cid, _, err := blobs.Add(context.Background(), strings.NewReader("one-time code"))
+	if err != nil {
+		t.Fatalf("Error adding blob: %v", err)
+	}
+
+	expired := create(draft(uid, "password", now.Add(-time.Second).UnixMilli()))
+	expiredBlob := createBlob(cid, now.Add(-time.Second).UnixMilli())
+	later := create(draft(uid, "later", now.Add(24*time.Hour).UnixMilli()))
+	kept := create(draft(uid, "kept", 0))
+	own, _ := db.UserNotes.Get(uid.String())
+
+	t.Run("should hide expired notes before they are purged", func(t *testing.T) {
+		if _, err := GetNote(db, uid, expired.ID); err != ErrNoteExpired {
+			t.Errorf("expected %v, got %v", ErrNoteExpired, err)
+		}
+
+		notes, _, err := ListNotes(db, index, uid, 10, "")
+		if err != nil {
+			t.Fatalf("Error listing notes: %v", err)
+		}
+		ids := map[uuid.UUID]bool{}
+		for _, n := range notes {
+			ids[n.ID] = true
+		}
+		if len(notes) != 2 || !ids[later.ID] || !ids[kept.ID] {
+			t.Errorf("expected only the notes that did not expire, got %v", notes)
+		}
+	})
+
+	t.Run("should purge expired notes, their index entries and files", func(t *testing.T) {
+		// the upload of the file has expired as well
+		purged, err := Reap(db, index, blobs, now.Add(UploadTTL+time.Second))
+		if err != nil {
+			t.Fatalf("Error purging notes: %v", err)
+		}
+		if purged != 2 {
+			t.Errorf("expected 2 purged notes, got %d", purged)
+		}
+
+		// the notes are replaced by the tombstones their owner signed, their content is gone
+		for _, id := range []uuid.UUID{expired.ID, expiredBlob.ID} {
+			if index.Contains(id) {
+				t.Errorf("expected note %s to leave the index", id)
+			}
+			if _, err := GetNote(db, uid, id); err != ErrNoteExpired {
+				t.Errorf("expected %v, got %v", ErrNoteExpired, err)
+			}
+			if stored, err := notes(own).Get(id.String()); err != nil || !stored.Deleted() || stored.Data != "" {
+				t.Errorf("expected note %s to be replaced by its tombstone, got %+v %v", id, stored, err)
+			}
+		}
+
+		entries, _ := index.List(uid)
+		if len(entries) != 2 {
+			t.Errorf("expected 2 index entries, got %d", len(entries))
+		}
+
+		if _, err := blobs.Get(context.Background(), cid); err == nil {
+			t.Errorf("expected the file to be removed")
+		}
+
+		if purged, _ := Reap(db, index, blobs, now.Add(UploadTTL+time.Second)); purged != 0 {
+			t.Errorf("expected purged notes not to be counted again, got %d", purged)
+		}
+	})
+
+	t.Run("should keep expired notes without an expiry signature hidden", func(t *testing.T) {
+		// a note signed before expiry signatures
+		n := draft(uid, "unsigned expiry", now.Add(-time.Second).UnixMilli())
+		n.Signature = base64.StdEncoding.EncodeToString(sign(n))
+		if err := notes(own).CreateWithKey(n.ID.String(), &n); err != nil {
+			t.Fatalf("Error creating note: %v", err)
+		}
+		_ = index.Add(uid, n.ID, n.CreatedAt, n.ExpiresAt)
+
+		if purged, err := Reap(db, index, blobs, now); err != nil || purged != 1 {
+			t.Errorf("expected 1 purged note, got %d %v", purged, err)
+		}
+		if stored, err := notes(own).Get(n.ID.String()); err != nil || stored.Deleted() {
+			t.Errorf("expected the note to stay, got %+v %v", stored, err)
+		}
+		if _, err := GetNote(db, uid, n.ID); err != ErrNoteExpired {
+			t.Errorf("expected %v, got %v", ErrNoteExpired, err)
+		}
+	})
+
+	t.Run("should not replace notes by their expiry tombstone before they expire", func(t *testing.T) {
+		tombstone := later.ExpiryTombstone()
+		tombstone.Signature = later.ExpirySignature
+		if err := notes(own).Put(later.ID.String(), tombstone); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		// nor another note with the same id
+		replaced := create(draft(uid, "replaced", now.Add(-time.Second).UnixMilli()))
+		forged := *replaced
+		forged.CreatedAt = now.Add(-time.Hour).UnixMilli()
+		tombstone = forged.ExpiryTombstone()
+		tombstone.Signature = base64.StdEncoding.EncodeToString(sign(*tombstone))
+		if err := notes(own).Put(replaced.ID.String(), tombstone); !errors.Is(err, orbitdb.ErrNotOwner) {
+			t.Errorf("expected %v, got %v", orbitdb.ErrNotOwner, err)
+		}
+
+		if purged, err := Reap(db, index, blobs, now); err != nil || purged != 1 {
+			t.Errorf("expected the note to be replaced by its own tombstone, got %d %v", purged, err)
+		}
+	})
+
+	t.Run("should release the files of deleted notes", func(t *testing.T) {
+		deleted, _, _ := blobs.Add(context.Background(), strings.NewReader("deleted"))
+		n := createBlob(deleted, 0)
+
+		// a tombstone replicated from the node that deleted the note
+		deletedAt := time.Now().UnixMilli()
+		tombstone := n.Tombstone(deletedAt)
+		tombstone.Signature = base64.StdEncoding.EncodeToString(sign(*tombstone))
+		if err := notes(own).Put(n.ID.String(), tombstone); err != nil {
+			t.Fatalf("Error deleting note: %v", err)
+		}
+
+		purged, err := Reap(db, index, blobs, now.Add(UploadTTL+time.Second))
+		if err != nil || purged != 0 {
+			t.Errorf("expected the deleted note not to be counted, got %d %v", purged, err)
+		}
+		if index.Contains(n.ID) {
+			t.Errorf("expected the deleted note to leave the index")
+		}
+		if _, err := blobs.Get(context.Background(), deleted); err == nil {
+			t.Errorf("expected the file of the deleted note to be removed")
+		}
+	})
+
+	t.Run("should purge on a schedule", func(t *testing.T) {
+		soon := create(draft(uid, "soon", time.Now().Add(10*time.Millisecond).UnixMilli()))
+
+		stop := StartReaper(db, index, blobs, 20*time.Millisecond)
+		defer stop()
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if !index.Contains(soon.ID) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("expected the note to be purged by the reaper")
+	})
+
+	t.Run("should go on after a note cannot be purged", func(t *testing.T) {
+		gone := create(draft(uid, "gone", now.Add(-time.Second).UnixMilli()))
+
+		// a copy of the note in the store of older versions cannot be deleted
+		legacy := undeletableStore{orbitdb.NewMemoryStore()}
+		raw, _ := own.Read(gone.ID.String())
+		item, _ := orbitdb.UnmarshalItem(raw["data"].(string))
+		_, _ = legacy.Create(item, &orbitdb.DatabaseCreateOptions{ID: gone.ID.String()})
+
+		stores := db
+		stores.Notes = legacy
+
+		purged, err := Reap(stores, index, blobs, now)
+		if err == nil {
+			t.Errorf("expected the error of the note that could not be purged")
+		}
+		if purged != 1 {
+			t.Errorf("expected 1 purged note, got %d", purged)
+		}
+		if index.Contains(gone.ID) {
+			t.Errorf("expected the note of the user to be purged")
+		}
+	})
+
+	t.Run("should not open the stores of users", func(t *testing.T) {
+		idle, _ := newTestUser(t, db)
+
+		if _, err := Reap(db, index, blobs, now); err != nil {
+			t.Fatalf("Error purging notes: %v", err)
+		}
+		if _, ok := db.UserNotes.Lookup(idle.ID.String()); ok {
+			t.Errorf("expected the store of the user not to be opened")
+		}
+	})
+
+	t.Run("should keep files shared with other notes", func(t *testing.T) {
+		shared, _, _ := blobs.Add(context.Background(), strings.NewReader("shared"))
+
+		createBlob(shared, now.Add(-time.Second).UnixMilli())
+		createBlob(shared, 0)
+
+		if _, err := Reap(db, index, blobs, now.Add(UploadTTL+time.Second)); err != nil {
+			t.Fatalf("Error purging notes: %v", err)
+		}
+		if _, err := blobs.Get(context.Background(), shared); err != nil {
+			t.Errorf("expected the file of the other note to be kept, got %v", err)
+		}
+	})
+}
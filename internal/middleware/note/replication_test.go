@@ -0,0 +1,119 @@
+package note
+
+import (
+	"context"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+// eventually waits until found returns true
+func eventually(t *testing.T, what string, found func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !found() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not replicated", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestReplicatedNotes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, firstNode, err := orbitdb.NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), []string{"/ip4/127.0.0.1/tcp/0"})
+	if err != nil {
+		t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+	}
+	second, secondNode, err := orbitdb.NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), []string{"/ip4/127.0.0.1/tcp/0"})
+	if err != nil {
+		t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+	}
+	defer func() {
+		_ = firstNode.Close()
+		_ = secondNode.Close()
+	}()
+	defer func() {
+		if err := orbitdb.CloseDatabases(); err != nil {
+			t.Errorf("Error closing databases: %s", err)
+		}
+	}()
+
+	a := orbitdb.NewClientRegistry(ctx, first)
+	b := orbitdb.NewClientRegistry(ctx, second)
+
+	status, err := a.Status(ctx)
+	if err != nil {
+		t.Fatalf("Error reading the status of the first node: %s", err)
+	}
+	if err := a.Replicate(orbitdb.ReplicationConfig{Writers: []string{second.Identity().ID}}); err != nil {
+		t.Fatalf("Error setting up the replication: %s", err)
+	}
+	err = b.Replicate(orbitdb.ReplicationConfig{Peers: status.Addresses, Writers: []string{first.Identity().ID}})
+	if err != nil {
+		t.Fatalf("Error setting up the replication: %s", err)
+	}
+
+	// openNode opens the stores and the note index of a node as the server does
+	openNode := func(registry *orbitdb.Registry) (orbitdb.Stores, Index) {
+		stores, err := orbitdb.OpenStores(registry)
+		if err != nil {
+			t.Fatalf("Error opening the stores: %s", err)
+		}
+		VerifyUserNotes(stores)
+
+		indexDB, err := registry.OpenShared("note-index")
+		if err != nil {
+			t.Fatalf("Error opening the note index: %s", err)
+		}
+
+		stop := user.OpenNoteStores(stores)
+		t.Cleanup(stop)
+		return stores, NewIndex(indexDB)
+	}
+	storesA, indexA := openNode(a)
+	storesB, indexB := openNode(b)
+
+	priv, publicKey := newKey(t)
+	registered, err := user.NewUser(storesA, publicKey, false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	uid := registered.ID.String()
+
+	n := draft(registered.ID, "written on the first node", 0)
+	signature, _ := Sign(priv, &n)
+	if _, err := NewNote(storesA, indexA, n, signature); err != nil {
+		t.Fatalf("Error creating note: %v", err)
+	}
+
+	t.Run("should log in on the second node", func(t *testing.T) {
+		eventually(t, "the user", func() bool {
+			_, err := user.Find(storesB, uid)
+			return err == nil
+		})
+
+		issued, err := user.IssueNonce(storesB, uid)
+		if err != nil {
+			t.Fatalf("Error issuing nonce: %v", err)
+		}
+		login, _ := user.SignNonce(priv, issued.Nonce)
+		if _, _, err := user.AuthenticateDevice(storesB, uid, "", login); err != nil {
+			t.Errorf("Expected the user to log in on the second node, got %v", err)
+		}
+	})
+
+	t.Run("should see the note of the first node", func(t *testing.T) {
+		eventually(t, "the note", func() bool {
+			found, err := GetNote(storesB, registered.ID, n.ID)
+			return err == nil && found.Data == n.Data
+		})
+
+		eventually(t, "the index entry", func() bool {
+			listed, _, err := ListNotes(storesB, indexB, registered.ID, -1, "")
+			return err == nil && len(listed) == 1
+		})
+	})
+}
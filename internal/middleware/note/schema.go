@@ -0,0 +1,38 @@
+package note
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+)
+
+// Schema is the format of the note documents
+var Schema = orbitdb.RegisterSchema(&orbitdb.Schema{
+	Name: "note",
+	// notes have an owner and data, users have a public key
+	Match: func(doc map[string]interface{}) bool {
+		_, hasUID := doc["uid"]
+		_, hasData := doc["data"]
+		_, hasPublicKey := doc["publicKey"]
+		return hasUID && hasData && !hasPublicKey
+	},
+	Migrations: []orbitdb.Migration{
+		{
+			Description: "remove the id field, which is not the key of the note",
+			Up: func(key string, doc map[string]interface{}) error {
+				delete(doc, "id")
+				return nil
+			},
+		},
+	},
+})
+
+// IndexSchema is the format of the documents of the note index
+var IndexSchema = orbitdb.RegisterSchema(&orbitdb.Schema{
+	Name: "note-index",
+	// index entries reference a note, but have no data
+	Match: func(doc map[string]interface{}) bool {
+		_, hasID := doc["id"]
+		_, hasUID := doc["uid"]
+		_, hasData := doc["data"]
+		return hasID && hasUID && !hasData
+	},
+})
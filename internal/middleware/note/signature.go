@@ -0,0 +1,170 @@
+package note
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"strconv"
+	"time"
+)
+
+// signaturePrefix separates note signatures from the other signatures of a device
+const signaturePrefix = "asteroid-note-v3"
+
+// ErrUnsigned is returned for notes without a signature
+var ErrUnsigned = errors.New("note is not signed")
+
+// Canonical returns the signed encoding of the note. Each field is written as its length in bytes, a colon and the
+// field, numbers in decimal: the id, uid, createdAt, expiresAt and data of the note; the mimeType, size, filename
+// and sha256 of its file; the version, algorithm, nonce and ciphertext of its envelope, followed by the number of
+// wrapped keys and the keyId, algorithm and wrappedKey of each one; the updatedAt of a changed note and the
+// deletedAt of a tombstone. The fields of a missing file or envelope are empty. The cid of the file is left out,
+// since the client signs a file before it knows where a node stores it; the file is bound by its sha256 and size,
+// which are checked whenever it is read.
+func (n *Note) Canonical() []byte {
+	var b bytes.Buffer
+	field := func(value string) {
+		b.WriteString(strconv.Itoa(len(value)))
+		b.WriteByte(':')
+		b.WriteString(value)
+	}
+	number := func(value int64) {
+		field(strconv.FormatInt(value, 10))
+	}
+
+	field(n.ID.String())
+	field(n.UID.String())
+	number(n.CreatedAt)
+	number(n.ExpiresAt)
+	field(n.Data)
+
+	blob := n.Blob
+	if blob == nil {
+		blob = &Blob{}
+	}
+	field(blob.MimeType)
+	number(blob.Size)
+	field(blob.Filename)
+	field(blob.SHA256)
+
+	envelope := n.Envelope
+	if envelope == nil {
+		envelope = &Envelope{}
+	}
+	number(int64(envelope.Version))
+	field(envelope.Algorithm)
+	field(envelope.Nonce)
+	field(envelope.Ciphertext)
+	number(int64(len(envelope.Keys)))
+	for _, key := range envelope.Keys {
+		field(key.KeyID)
+		field(key.Algorithm)
+		field(key.WrappedKey)
+	}
+
+	number(n.UpdatedAt)
+	number(n.DeletedAt)
+
+	return b.Bytes()
+}
+
+// Digest is the digest the owner of a note signs: the SHA-256 hash of "asteroid-note-v3" and the Canonical
+// encoding of the note. It is signed like a nonce, see user.SignatureScheme.
+func (n *Note) Digest() []byte {
+	hash := sha256.New()
+	hash.Write([]byte(signaturePrefix))
+	hash.Write(n.Canonical())
+	return hash.Sum(nil)
+}
+
+// Sign signs the note with the private key of a device of its owner, see Note.Digest
+func Sign(key crypto.Signer, n *Note) ([]byte, error) {
+	return user.SignDigest(key, n.Digest())
+}
+
+// Verify checks the signature of the note against the keys of its owner u, starting from registeredKey, which were
+// valid when the note was signed, see user.User.TrustedKeys
+func (n *Note) Verify(u user.User, registeredKey string) error {
+	if n.Signature == "" {
+		return ErrUnsigned
+	}
+
+	if n.UID != u.ID {
+		return fmt.Errorf("note %s is not owned by user %s", n.ID, u.ID)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(n.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %s", err.Error())
+	}
+
+	return u.VerifyDigestAt(registeredKey, n.Digest(), signature, n.SignedAt())
+}
+
+// Verifier returns the verifier of the note stores of the users in db. A store accepts the notes of its owner
+// signed by a key they had at that time, starting from the registered key of the store; the devices and key
+// changes replicated in db only count with their signatures. A deleted note stays deleted, its tombstone is not
+// replaced. The ExpirySignature of a note is checked as well, and an ExpiryTombstone only replaces the note it was
+// signed with.
+func Verifier(db orbitdb.Stores) orbitdb.EntryVerifier {
+	return func(owner, registeredKey string, doc orbitdb.Document) error {
+		n, err := notes(db.Notes).DecodeDocument(doc)
+		if err != nil {
+			return err
+		}
+
+		if n.UID.String() != owner {
+			return fmt.Errorf("note %s is not owned by user %s", n.ID, owner)
+		}
+
+		// the tombstone is signed in advance, it is only written once the note expired
+		if n.expiryTombstone() && n.ExpiresAt > time.Now().UnixMilli() {
+			return fmt.Errorf("note %s has not expired yet", n.ID)
+		}
+
+		if own, ok := db.UserNotes.Lookup(owner); ok {
+			stored, err := notes(own).Get(n.ID.String())
+			if err == nil && stored.Deleted() && !n.Deleted() {
+				return ErrNoteDeleted
+			}
+			// the signature of an expiry tombstone is made when the note is created, so it cannot replace a later
+			// note with the same id
+			if err == nil && !stored.Deleted() && n.expiryTombstone() && n.Signature != stored.ExpirySignature {
+				return fmt.Errorf("note %s was not signed with this expiry", n.ID)
+			}
+		}
+
+		// without the user, only the registered key is known
+		u, err := user.Find(db, owner)
+		if err != nil {
+			u = user.User{ID: n.UID}
+		}
+
+		if err := n.Verify(u, registeredKey); err != nil {
+			return err
+		}
+
+		if n.Deleted() || n.ExpiresAt == 0 || n.ExpirySignature == "" {
+			return nil
+		}
+
+		tombstone := n.ExpiryTombstone()
+		tombstone.Signature = n.ExpirySignature
+		if err := tombstone.Verify(u, registeredKey); err != nil {
+			return fmt.Errorf("invalid expiry signature: %w", err)
+		}
+		return nil
+	}
+}
+
+// VerifyUserNotes makes the note stores of the users in db accept only the notes signed by their owner. It is
+// called once, before the stores are opened.
+func VerifyUserNotes(db orbitdb.Stores) {
+	db.UserNotes.Verify = Verifier(db)
+	db.UserNotes.Key = user.RegisteredKeys(db)
+}
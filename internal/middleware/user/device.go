@@ -0,0 +1,466 @@
+package user
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// revocationPrefix separates revocation signatures from the other signatures of a device
+const revocationPrefix = "asteroid-revoke-v1"
+
+// Device is a public key of a user, e.g. of a laptop or a phone. The key the user registered with is the device
+// with the id of the user.
+type Device struct {
+	ID uuid.UUID `json:"id"`
+	// UID is the id of the user of the device
+	UID          uuid.UUID `json:"uid"`
+	Name         string    `json:"name"`
+	PublicKey    string    `json:"publicKey"`
+	KeyAlgorithm string    `json:"keyAlgorithm"`
+	CreatedAt    int64     `json:"createdAt"`
+	// RevokedAt is the signed time the device was revoked in unix seconds, 0 while it is active
+	RevokedAt int64 `json:"revokedAt"`
+	// RotatedAt is the time the key of the device was last rotated in unix seconds, 0 if it never was
+	RotatedAt int64 `json:"rotatedAt"`
+	// Endorsement is the signature of the device that added this one, nil for the registered key and for devices
+	// added with a token until an existing device endorses them
+	Endorsement *Endorsement `json:"endorsement,omitempty"`
+	// EndorsedAt is the time a device added with a token was endorsed in unix seconds, 0 for the other devices
+	EndorsedAt int64 `json:"endorsedAt,omitempty"`
+	// Revocation is the RevocationDigest signed by a device of the user, nil while the device is active
+	Revocation *Endorsement `json:"revocation,omitempty"`
+}
+
+// Endorsement is a digest signed by a device of the user, e.g. the DeviceDigest of the first key of a device. Peers
+// check it before they trust the change it signs, see TrustedKeys.
+type Endorsement struct {
+	// Nonce is the nonce of the user the digest was made of, base64 encoded
+	Nonce string `json:"nonce"`
+	// Signature is the signed digest, base64 encoded
+	Signature string `json:"signature"`
+}
+
+// plainDevice is a Device without its JSON methods
+type plainDevice Device
+
+// MarshalJSON stores the ids of the device as strings
+func (d Device) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainDevice
+		ID  string `json:"id"`
+		UID string `json:"uid"`
+	}{plainDevice(d), d.ID.String(), d.UID.String()})
+}
+
+// UnmarshalJSON parses the ids of the device. Devices embedded in older user documents have no uid.
+func (d *Device) UnmarshalJSON(b []byte) error {
+	raw := struct {
+		*plainDevice
+		ID  string `json:"id"`
+		UID string `json:"uid"`
+	}{plainDevice: (*plainDevice)(d)}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(raw.ID)
+	if err != nil {
+		return fmt.Errorf("invalid device id %q: %v", raw.ID, err)
+	}
+	d.ID = id
+
+	if raw.UID != "" {
+		uid, err := uuid.Parse(raw.UID)
+		if err != nil {
+			return fmt.Errorf("invalid device uid %q: %v", raw.UID, err)
+		}
+		d.UID = uid
+	}
+	return nil
+}
+
+// Decoded checks a device read from the devices store under the key
+func (d *Device) Decoded(key string) error {
+	if d.ID.String() != key {
+		return fmt.Errorf("device %s is stored under %s", d.ID, key)
+	}
+	if d.UID == (uuid.UUID{}) {
+		return fmt.Errorf("device %s has no user", key)
+	}
+	if d.PublicKey == "" {
+		return fmt.Errorf("device %s has no public key", key)
+	}
+	return nil
+}
+
+// devices returns the repository of the devices in db
+func devices(db orbitdb.Store) orbitdb.Repository[Device, *Device] {
+	return orbitdb.NewRepository[Device](db, DeviceSchema)
+}
+
+// devicesOf returns the devices of the user with the id uid, the primary device with the id of the user first
+func devicesOf(db orbitdb.Stores, uid uuid.UUID) []Device {
+	found := make([]Device, 0)
+	for _, d := range devices(db.Devices).All() {
+		if d.UID == uid {
+			found = append(found, *d)
+		}
+	}
+
+	sort.SliceStable(found, func(a, b int) bool {
+		if found[a].ID == uid || found[b].ID == uid {
+			return found[a].ID == uid
+		}
+		if found[a].CreatedAt != found[b].CreatedAt {
+			return found[a].CreatedAt < found[b].CreatedAt
+		}
+		return found[a].ID.String() < found[b].ID.String()
+	})
+
+	return found
+}
+
+var (
+	// ErrDeviceNotFound is returned for device ids the user does not have
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrDeviceRevoked is returned for devices that have been revoked
+	ErrDeviceRevoked = errors.New("device has been revoked")
+	// ErrLastDevice is returned when revoking the only active device of a user
+	ErrLastDevice = errors.New("the last active device cannot be revoked")
+	// ErrDuplicateKey is returned when adding a public key the user already has
+	ErrDuplicateKey = errors.New("public key is already registered")
+	// ErrInvalidSignature is returned when a change is not signed by an active device of the user
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Active reports whether the device has not been revoked
+func (d Device) Active() bool {
+	return d.RevokedAt == 0
+}
+
+// KeyID returns the KeyID of the public key of the device
+func (d Device) KeyID() (string, error) {
+	pub, _, err := ParsePublicKey(d.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	return KeyID(pub)
+}
+
+// ActiveDevices returns the devices of the user which have not been revoked
+func (u User) ActiveDevices() []Device {
+	active := make([]Device, 0, len(u.Devices))
+	for _, d := range u.Devices {
+		if d.Active() {
+			active = append(active, d)
+		}
+	}
+	return active
+}
+
+// Device returns the device of the user with the given id
+func (u User) Device(id string) (*Device, error) {
+	for i := range u.Devices {
+		if u.Devices[i].ID.String() == id {
+			return &u.Devices[i], nil
+		}
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// VerifyDevice checks the signature of the current nonce against the active device deviceID, or against all
+// active devices if deviceID is empty. It returns the device that made the signature.
+func (u User) VerifyDevice(deviceID string, signature []byte) (*Device, error) {
+	nonce, err := base64.StdEncoding.DecodeString(u.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode nonce: %s", err.Error())
+	}
+
+	return u.verifyDevice(deviceID, nonce, signature)
+}
+
+// verifyDevice checks the signature of digest against the active device deviceID, or all active devices
+func (u User) verifyDevice(deviceID string, digest, signature []byte) (*Device, error) {
+	if deviceID != "" {
+		d, err := u.Device(deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if !d.Active() {
+			return nil, ErrDeviceRevoked
+		}
+
+		pub, _, err := ParsePublicKey(d.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := verifySignature(pub, digest, signature); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	for _, d := range u.ActiveDevices() {
+		pub, _, err := ParsePublicKey(d.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		if verifySignature(pub, digest, signature) == nil {
+			found, _ := u.Device(d.ID.String())
+			return found, nil
+		}
+	}
+
+	return nil, fmt.Errorf("signature does not match any active device")
+}
+
+// DeviceDigest is the digest an existing device signs to add the public key of a new device: the SHA-256 hash
+// of the decoded current nonce of the user followed by the PEM encoded public key. It is signed like a nonce,
+// see SignatureScheme.
+func DeviceDigest(nonce, publicKey string) ([]byte, error) {
+	rawNonce, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode nonce: %s", err.Error())
+	}
+
+	hash := sha256.New()
+	hash.Write(rawNonce)
+	hash.Write([]byte(publicKey))
+	return hash.Sum(nil), nil
+}
+
+// SignDevice signs the public key of a new device with the private key of an existing one, see DeviceDigest
+func SignDevice(key crypto.Signer, nonce, publicKey string) ([]byte, error) {
+	digest, err := DeviceDigest(nonce, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return SignDigest(key, digest)
+}
+
+// Endorsed reports whether peers trust the key of the device, see TrustedKeys. The registered key is trusted as the
+// key of the store of the user, other devices need an Endorsement.
+func (d Device) Endorsed() bool {
+	return d.ID == d.UID || d.Endorsement != nil
+}
+
+// AddDevice adds the public key of a new device to the user with the id uid on the authority of a token of the
+// user. The device can log in right away, but since peers cannot check a token, they only accept the notes it
+// signs once an existing device endorsed it with AddSignedDevice.
+func AddDevice(db orbitdb.Stores, uid, name, publicKey string) (*User, *Device, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return addDevice(db, &u, name, publicKey, nil)
+}
+
+// AddSignedDevice adds the public key of a new device to the user with the id uid, or endorses the active device
+// with that key if it was added with a token. signature is DeviceDigest signed by the active device signerID, or
+// any active device if it is empty. The nonce is consumed.
+func AddSignedDevice(db orbitdb.Stores, uid, name, publicKey, signerID string, signature []byte) (*User, *Device, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := u.CheckNonce(db.Node); err != nil {
+		return nil, nil, err
+	}
+
+	digest, err := DeviceDigest(u.Nonce, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := u.verifyDevice(signerID, digest, signature); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+
+	endorsement := &Endorsement{Nonce: u.Nonce, Signature: base64.StdEncoding.EncodeToString(signature)}
+
+	// consume the nonce
+	u.Nonce = ""
+	u.NonceExpiresAt = 0
+
+	for i := range u.Devices {
+		if d := &u.Devices[i]; d.PublicKey == publicKey && d.Active() && !d.Endorsed() {
+			return endorseDevice(db, &u, d, endorsement)
+		}
+	}
+
+	return addDevice(db, &u, name, publicKey, endorsement)
+}
+
+// endorseDevice records the endorsement of the device d of u, which was added with a token, and saves u
+func endorseDevice(db orbitdb.Stores, u *User, d *Device, endorsement *Endorsement) (*User, *Device, error) {
+	now := time.Now().UTC().Unix()
+	d.Endorsement = endorsement
+	d.EndorsedAt = now
+	u.UpdatedAt = now
+
+	if err := devices(db.Devices).Put(d.ID.String(), d); err != nil {
+		log.Println("Could not endorse device")
+		return nil, nil, err
+	}
+
+	if err := Save(db, u); err != nil {
+		log.Println("Could not save user")
+		return nil, nil, err
+	}
+
+	return u, d, nil
+}
+
+// addDevice validates the public key, adds it to u with its endorsement and saves u
+func addDevice(db orbitdb.Stores, u *User, name, publicKey string, endorsement *Endorsement) (*User, *Device, error) {
+	_, algorithm, err := ParsePublicKey(publicKey)
+	if err != nil {
+		log.Println("Invalid public key")
+		return nil, nil, err
+	}
+
+	for _, d := range u.Devices {
+		if d.PublicKey == publicKey {
+			return nil, nil, ErrDuplicateKey
+		}
+	}
+
+	now := time.Now().UTC().Unix()
+	u.Devices = append(u.Devices, Device{
+		ID:           uuid.Generate(),
+		UID:          u.ID,
+		Name:         name,
+		PublicKey:    publicKey,
+		KeyAlgorithm: algorithm,
+		CreatedAt:    now,
+		Endorsement:  endorsement,
+	})
+	u.UpdatedAt = now
+
+	d := &u.Devices[len(u.Devices)-1]
+	if err := devices(db.Devices).CreateWithKey(d.ID.String(), d); err != nil {
+		log.Println("Could not save device")
+		return nil, nil, err
+	}
+
+	if err := Save(db, u); err != nil {
+		log.Println("Could not save user")
+		return nil, nil, err
+	}
+
+	return u, &u.Devices[len(u.Devices)-1], nil
+}
+
+// RevocationDigest is the digest a device signs to revoke the device deviceID at the time revokedAt in unix
+// seconds: the SHA-256 hash of "asteroid-revoke-v1", the decoded current nonce of the user, the id of the device
+// and the time in decimal. It is signed like a nonce, see SignatureScheme.
+func RevocationDigest(nonce, deviceID string, revokedAt int64) ([]byte, error) {
+	rawNonce, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode nonce: %s", err.Error())
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(revocationPrefix))
+	hash.Write(rawNonce)
+	hash.Write([]byte(deviceID))
+	hash.Write([]byte(strconv.FormatInt(revokedAt, 10)))
+	return hash.Sum(nil), nil
+}
+
+// SignRevocation signs the revocation of the device deviceID at revokedAt with the private key of a device of the
+// user, see RevocationDigest
+func SignRevocation(key crypto.Signer, nonce, deviceID string, revokedAt int64) ([]byte, error) {
+	digest, err := RevocationDigest(nonce, deviceID, revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return SignDigest(key, digest)
+}
+
+// RevokeDevice revokes the device deviceID of the user with the id uid at revokedAt in unix seconds. signature
+// is the RevocationDigest signed by the active device signerID, or any active device if it is empty, e.g. the
+// revoked one. The nonce is consumed. The key can no longer log in or receive encrypted notes, and peers reject
+// the notes it signs after revokedAt.
+func RevokeDevice(db orbitdb.Stores, uid, deviceID, signerID string, revokedAt int64, signature []byte) (*User, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := u.Device(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Active() {
+		return nil, ErrDeviceRevoked
+	}
+
+	if len(u.ActiveDevices()) == 1 {
+		return nil, ErrLastDevice
+	}
+
+	if revokedAt < d.CreatedAt || revokedAt < d.RotatedAt {
+		return nil, fmt.Errorf("device %s cannot be revoked before its last change", deviceID)
+	}
+
+	if err := u.CheckNonce(db.Node); err != nil {
+		return nil, err
+	}
+
+	digest, err := RevocationDigest(u.Nonce, d.ID.String(), revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := u.verifyDevice(signerID, digest, signature); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+
+	d.RevokedAt = revokedAt
+	d.Revocation = &Endorsement{Nonce: u.Nonce, Signature: base64.StdEncoding.EncodeToString(signature)}
+	u.UpdatedAt = time.Now().UTC().Unix()
+
+	// consume the nonce
+	u.Nonce = ""
+	u.NonceExpiresAt = 0
+
+	if err := devices(db.Devices).Put(d.ID.String(), d); err != nil {
+		log.Println("Could not revoke device")
+		return nil, err
+	}
+
+	if err := Save(db, &u); err != nil {
+		log.Println("Could not save user")
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,148 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+func TestDevices(t *testing.T) {
+	laptop, _ := rsa.GenerateKey(rand.Reader, 2048)
+	laptopPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&laptop.PublicKey),
+	}))
+
+	phone, phonePEM := newKey(t)
+	_, tabletPEM := newKey(t)
+
+	db := orbitdb.NewMemoryStores()
+	u, err := NewUser(db, laptopPEM, false)
+	if err != nil {
+		t.Fatalf("error creating the user %v\n", err)
+	}
+	uid := u.ID.String()
+
+	var phoneID string
+
+	t.Run("should have the registered key as first device", func(t *testing.T) {
+		found, err := Find(db, uid)
+		if err != nil {
+			t.Fatalf("error finding the user %v\n", err)
+		}
+
+		if len(found.Devices) != 1 || found.Devices[0].ID != u.ID || found.Devices[0].PublicKey != laptopPEM {
+			t.Errorf("expected the registered key as device, got %+v", found.Devices)
+		}
+	})
+
+	t.Run("should add a device", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignDevice(laptop, issued.Nonce, phonePEM)
+		_, device, err := AddSignedDevice(db, uid, "phone", phonePEM, uid, sign)
+		if err != nil {
+			t.Fatalf("error adding the device %v\n", err)
+		}
+
+		if device.KeyAlgorithm != KeyAlgorithmEd25519 || device.Name != "phone" {
+			t.Errorf("unexpected device %+v", device)
+		}
+		phoneID = device.ID.String()
+
+		issued, _ = IssueNonce(db, uid)
+		sign, _ = SignDevice(laptop, issued.Nonce, phonePEM)
+		if _, _, err := AddSignedDevice(db, uid, "again", phonePEM, uid, sign); !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("expected %v, got %v", ErrDuplicateKey, err)
+		}
+
+		found, _ := Find(db, uid)
+		if keys, _ := found.Keys(); len(keys) != 2 {
+			t.Errorf("expected the keys of both devices, got %v", keys)
+		}
+	})
+
+	t.Run("should log in with any active device", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignNonce(phone, issued.Nonce)
+
+		_, device, err := AuthenticateDevice(db, uid, "", sign)
+		if err != nil {
+			t.Fatalf("error authenticating %v\n", err)
+		}
+		if device.ID.String() != phoneID {
+			t.Errorf("expected the phone to log in, got %s", device.ID)
+		}
+
+		issued, _ = IssueNonce(db, uid)
+		sign, _ = SignNonce(phone, issued.Nonce)
+		if _, _, err := AuthenticateDevice(db, uid, uid, sign); err == nil {
+			t.Errorf("expected the signature of another device to be rejected")
+		}
+	})
+
+	t.Run("should add a device signed by an existing one", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+
+		wrong, _ := SignDevice(phone, issued.Nonce, phonePEM)
+		if _, _, err := AddSignedDevice(db, uid, "tablet", tabletPEM, phoneID, wrong); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+		}
+
+		sign, _ := SignDevice(phone, issued.Nonce, tabletPEM)
+		if _, _, err := AddSignedDevice(db, uid, "tablet", tabletPEM, phoneID, sign); err != nil {
+			t.Fatalf("error adding the device %v\n", err)
+		}
+
+		if _, _, err := AddSignedDevice(db, uid, "tablet", tabletPEM, phoneID, sign); !errors.Is(err, ErrNonceUsed) {
+			t.Errorf("expected the nonce to be consumed, got %v", err)
+		}
+	})
+
+	t.Run("should revoke devices but the last one", func(t *testing.T) {
+		now := time.Now().Unix()
+
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignRevocation(phone, issued.Nonce, uid, now)
+		if _, err := RevokeDevice(db, uid, phoneID, phoneID, now, sign); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected the revocation of another device to be rejected, got %v", err)
+		}
+
+		// a device may revoke itself
+		sign, _ = SignRevocation(phone, issued.Nonce, phoneID, now)
+		revoked, err := RevokeDevice(db, uid, phoneID, phoneID, now, sign)
+		if err != nil {
+			t.Fatalf("error revoking the device %v\n", err)
+		}
+		if d, _ := revoked.Device(phoneID); d.RevokedAt != now || d.Revocation == nil {
+			t.Errorf("expected the signed revocation, got %+v", d)
+		}
+
+		issued, _ = IssueNonce(db, uid)
+		sign, _ = SignNonce(phone, issued.Nonce)
+		if _, _, err := AuthenticateDevice(db, uid, phoneID, sign); !errors.Is(err, ErrDeviceRevoked) {
+			t.Errorf("expected %v, got %v", ErrDeviceRevoked, err)
+		}
+
+		issued, _ = IssueNonce(db, uid)
+		sign, _ = SignRevocation(laptop, issued.Nonce, uid, now)
+		if _, err := RevokeDevice(db, uid, uid, uid, now, sign); err != nil {
+			t.Fatalf("error revoking the device %v\n", err)
+		}
+
+		found, _ := Find(db, uid)
+		if active := found.ActiveDevices(); len(active) != 1 {
+			t.Fatalf("expected the tablet to be left, got %+v", active)
+		} else if _, err := RevokeDevice(db, uid, active[0].ID.String(), "", now, nil); !errors.Is(err, ErrLastDevice) {
+			t.Errorf("expected %v, got %v", ErrLastDevice, err)
+		}
+
+		if _, err := RevokeDevice(db, uid, "unknown", "", now, nil); !errors.Is(err, ErrDeviceNotFound) {
+			t.Errorf("expected %v, got %v", ErrDeviceNotFound, err)
+		}
+	})
+}
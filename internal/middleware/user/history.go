@@ -0,0 +1,224 @@
+package user
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"sort"
+)
+
+// KeyPeriod is a key of a user and the time it could sign, in unix milliseconds
+type KeyPeriod struct {
+	PublicKey string
+	From      int64
+	// Until is the end of the period, 0 while the key is valid
+	Until int64
+}
+
+// ValidAt reports whether the key could sign at the time at in unix milliseconds
+func (p KeyPeriod) ValidAt(at int64) bool {
+	return p.From <= at && (p.Until == 0 || at < p.Until)
+}
+
+// Kinds of a keyEvent, in the order they apply within the same second
+const (
+	keyAdded = iota
+	keyRotated
+	keyRevoked
+)
+
+// keyEvent is a change of the keys of a user at the time at in unix milliseconds
+type keyEvent struct {
+	at     int64
+	kind   int
+	device Device
+	change KeyChange
+}
+
+// RegisteredKey returns the key the user registered with, the first key of the device with the id of the user
+func (u User) RegisteredKey() string {
+	for _, c := range u.KeyHistory {
+		if c.DeviceID == u.ID {
+			return c.OldPublicKey
+		}
+	}
+	return u.PublicKey
+}
+
+// TrustedKeys returns the keys of the user with the time each one could sign. They start from registeredKey and
+// follow the devices added with an Endorsement and the keys rotated with a signature, each made by a key valid at
+// that time. Changes without such a signature are left out, so a peer rewriting the users or devices it replicates
+// cannot add keys of its own.
+//
+// A signed revocation ends the period of the key of its device at the signed time, as a rotation ends the period of
+// the old key. The end of a key cannot be moved without breaking its signature, and a key whose end was dropped or
+// changed is not trusted at all: that of a revoked device without a valid revocation, and that of a device whose
+// rotations do not lead to its current key, e.g. since an entry of the key history was deleted. Only a peer
+// reverting a device together with its key history goes unnoticed, which the writers of the shared stores are
+// trusted not to do.
+func (u User) TrustedKeys(registeredKey string) []KeyPeriod {
+	periods := []KeyPeriod{{PublicKey: registeredKey}}
+	// the index of the current period of each device
+	current := map[uuid.UUID]int{u.ID: 0}
+	// the indexes of the periods whose end was dropped or changed
+	distrusted := make(map[int]bool)
+
+	events := make([]keyEvent, 0, len(u.Devices)+len(u.KeyHistory))
+	for _, d := range u.Devices {
+		if d.ID != u.ID && d.Endorsement != nil {
+			// a device added with a token is trusted from its endorsement on
+			at := d.CreatedAt
+			if d.EndorsedAt > at {
+				at = d.EndorsedAt
+			}
+			events = append(events, keyEvent{at: at * 1000, kind: keyAdded, device: d})
+		}
+		if !d.Active() {
+			events = append(events, keyEvent{at: d.RevokedAt * 1000, kind: keyRevoked, device: d})
+		}
+	}
+	for _, c := range u.KeyHistory {
+		events = append(events, keyEvent{at: c.ChangedAt * 1000, kind: keyRotated, change: c})
+	}
+
+	sort.SliceStable(events, func(a, b int) bool {
+		if events[a].at != events[b].at {
+			return events[a].at < events[b].at
+		}
+		return events[a].kind < events[b].kind
+	})
+
+	for _, e := range events {
+		// times are kept in seconds, a key stays valid until the end of the second it is replaced in
+		end := e.at + 1000
+
+		switch e.kind {
+		case keyAdded:
+			key := u.firstKey(e.device)
+			digest, err := DeviceDigest(e.device.Endorsement.Nonce, key)
+			if err != nil || !signedAt(trusted(periods, distrusted), e.at, digest, e.device.Endorsement.Signature) {
+				continue
+			}
+
+			periods = append(periods, KeyPeriod{PublicKey: key, From: e.at})
+			current[e.device.ID] = len(periods) - 1
+		case keyRotated:
+			i, ok := current[e.change.DeviceID]
+			if !ok || distrusted[i] || !periods[i].ValidAt(e.at) || periods[i].PublicKey != e.change.OldPublicKey {
+				continue
+			}
+
+			// only the device itself hands over to its next key
+			digest, err := RotationDigest(e.change.Nonce, e.change.NewPublicKey, e.change.ChangedAt)
+			if err != nil || !signedAt(periods[i:i+1], e.at, digest, e.change.Signature) {
+				continue
+			}
+
+			periods[i].Until = end
+			periods = append(periods, KeyPeriod{PublicKey: e.change.NewPublicKey, From: e.at})
+			current[e.change.DeviceID] = len(periods) - 1
+		case keyRevoked:
+			i, ok := current[e.device.ID]
+			if !ok || periods[i].Until != 0 {
+				continue
+			}
+
+			// any key of the user valid at that time may revoke the device, including its own
+			revocation := e.device.Revocation
+			if revocation == nil {
+				distrusted[i] = true
+				continue
+			}
+			digest, err := RevocationDigest(revocation.Nonce, e.device.ID.String(), e.device.RevokedAt)
+			if err != nil || !signedAt(trusted(periods, distrusted), e.at, digest, revocation.Signature) {
+				distrusted[i] = true
+				continue
+			}
+
+			periods[i].Until = end
+		}
+	}
+
+	// the rotations of each device lead to its current key, the registered one is mirrored by the user
+	keys := make(map[uuid.UUID]string, len(u.Devices)+1)
+	if u.PublicKey != "" {
+		keys[u.ID] = u.PublicKey
+	}
+	for _, d := range u.Devices {
+		keys[d.ID] = d.PublicKey
+	}
+	for id, key := range keys {
+		if i, ok := current[id]; ok && periods[i].PublicKey != key {
+			distrusted[i] = true
+		}
+	}
+
+	return trusted(periods, distrusted)
+}
+
+// trusted returns the periods without the distrusted ones
+func trusted(periods []KeyPeriod, distrusted map[int]bool) []KeyPeriod {
+	kept := make([]KeyPeriod, 0, len(periods))
+	for i, p := range periods {
+		if !distrusted[i] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// firstKey returns the key the device was added with, before its rotations
+func (u User) firstKey(d Device) string {
+	for _, c := range u.KeyHistory {
+		if c.DeviceID == d.ID {
+			return c.OldPublicKey
+		}
+	}
+	return d.PublicKey
+}
+
+// signedAt reports whether one of the keys of periods which were valid at the time at made the base64 signature
+// of digest
+func signedAt(periods []KeyPeriod, at int64, digest []byte, signature string) bool {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range periods {
+		if !p.ValidAt(at) {
+			continue
+		}
+
+		pub, _, err := ParsePublicKey(p.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		if verifySignature(pub, digest, raw) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyDigestAt checks the signature of a 32 byte digest, e.g. of a note, made at the time at in unix
+// milliseconds, against the TrustedKeys of the user starting from registeredKey which were valid then
+func (u User) VerifyDigestAt(registeredKey string, digest, signature []byte, at int64) error {
+	if !signedAt(u.TrustedKeys(registeredKey), at, digest, base64.StdEncoding.EncodeToString(signature)) {
+		return fmt.Errorf("signature does not match a key of the user at %d", at)
+	}
+	return nil
+}
+
+// RegisteredKeys returns the lookup of the registered keys of the users in db, see orbitdb.UserStores
+func RegisteredKeys(db orbitdb.Stores) func(owner string) (string, error) {
+	return func(owner string) (string, error) {
+		u, err := Find(db, owner)
+		if err != nil {
+			return "", err
+		}
+		return u.RegisteredKey(), nil
+	}
+}
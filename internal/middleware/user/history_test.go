@@ -0,0 +1,172 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/docker/distribution/uuid"
+	"testing"
+)
+
+func TestTrustedKeys(t *testing.T) {
+	laptop, laptopPEM := newKey(t)
+	phone, phonePEM := newKey(t)
+	nextPhone, nextPhonePEM := newKey(t)
+	_, forgedPEM := newKey(t)
+
+	// endorse signs the first key of a device with the key signer
+	endorse := func(signer ed25519.PrivateKey, publicKey string) *Endorsement {
+		nonce, _ := GenerateNonce()
+		sign, _ := SignDevice(signer, nonce, publicKey)
+		return &Endorsement{Nonce: nonce, Signature: base64.StdEncoding.EncodeToString(sign)}
+	}
+
+	// signedBy checks a digest signed by key at the time at in unix seconds
+	digest := sha256.Sum256([]byte("note"))
+	signedBy := func(u User, key ed25519.PrivateKey, at int64) error {
+		sign, _ := SignDigest(key, digest[:])
+		return u.VerifyDigestAt(laptopPEM, digest[:], sign, at*1000)
+	}
+
+	uid := uuid.Generate()
+	phoneID := uuid.Generate()
+
+	nonce, _ := GenerateNonce()
+	rotation, _ := SignRotation(phone, nonce, nextPhonePEM, 300)
+	revocationNonce, _ := GenerateNonce()
+	revocation, _ := SignRevocation(laptop, revocationNonce, phoneID.String(), 400)
+
+	u := User{
+		ID:        uid,
+		PublicKey: laptopPEM,
+		Devices: []Device{
+			{ID: uid, PublicKey: laptopPEM, CreatedAt: 100},
+			{ID: phoneID, PublicKey: nextPhonePEM, CreatedAt: 200, RevokedAt: 400, Endorsement: endorse(laptop, phonePEM),
+				Revocation: &Endorsement{Nonce: revocationNonce, Signature: base64.StdEncoding.EncodeToString(revocation)}},
+		},
+		KeyHistory: []KeyChange{{
+			DeviceID:     phoneID,
+			OldPublicKey: phonePEM,
+			NewPublicKey: nextPhonePEM,
+			Nonce:        nonce,
+			Signature:    base64.StdEncoding.EncodeToString(rotation),
+			ChangedAt:    300,
+		}},
+	}
+
+	t.Run("should accept the registered key", func(t *testing.T) {
+		if err := signedBy(u, laptop, 150); err != nil {
+			t.Errorf("expected the registered key to be valid, got %v", err)
+		}
+	})
+
+	t.Run("should accept the keys of endorsed devices while they were valid", func(t *testing.T) {
+		if err := signedBy(u, phone, 250); err != nil {
+			t.Errorf("expected the first key of the phone to be valid, got %v", err)
+		}
+		if err := signedBy(u, phone, 150); err == nil {
+			t.Errorf("expected the key of the phone to be invalid before it was added")
+		}
+		if err := signedBy(u, phone, 350); err == nil {
+			t.Errorf("expected the key of the phone to be invalid after its rotation")
+		}
+
+		if err := signedBy(u, nextPhone, 350); err != nil {
+			t.Errorf("expected the rotated key of the phone to be valid, got %v", err)
+		}
+		if err := signedBy(u, nextPhone, 250); err == nil {
+			t.Errorf("expected the rotated key to be invalid before the rotation")
+		}
+		if err := signedBy(u, nextPhone, 450); err == nil {
+			t.Errorf("expected the key of the phone to be invalid after its revocation")
+		}
+	})
+
+	t.Run("should ignore devices without a valid endorsement", func(t *testing.T) {
+		forged := u
+		forged.Devices = append([]Device{}, u.Devices...)
+		// unsigned, signed by a key not valid yet and signed for another key
+		forged.Devices = append(forged.Devices,
+			Device{ID: uuid.Generate(), PublicKey: forgedPEM, CreatedAt: 200},
+			Device{ID: uuid.Generate(), PublicKey: forgedPEM, CreatedAt: 200, Endorsement: endorse(nextPhone, forgedPEM)},
+			Device{ID: uuid.Generate(), PublicKey: forgedPEM, CreatedAt: 500, Endorsement: endorse(laptop, phonePEM)},
+		)
+
+		for _, p := range forged.TrustedKeys(laptopPEM) {
+			if p.PublicKey == forgedPEM {
+				t.Errorf("expected the forged key not to be trusted, got %+v", p)
+			}
+		}
+	})
+
+	t.Run("should ignore rotations not signed by the old key", func(t *testing.T) {
+		forged := u
+		forged.KeyHistory = append([]KeyChange{}, u.KeyHistory...)
+		forged.KeyHistory[0].NewPublicKey = forgedPEM
+
+		for _, p := range forged.TrustedKeys(laptopPEM) {
+			if p.PublicKey == forgedPEM {
+				t.Errorf("expected the forged key not to be trusted, got %+v", p)
+			}
+		}
+	})
+
+	t.Run("should not trust keys whose end was dropped or changed", func(t *testing.T) {
+		// a revocation moved to a later time, or without its signature
+		for _, revocation := range []*Endorsement{u.Devices[1].Revocation, nil} {
+			changed := u
+			changed.Devices = append([]Device{}, u.Devices...)
+			changed.Devices[1].RevokedAt = 500
+			changed.Devices[1].Revocation = revocation
+
+			if err := signedBy(changed, nextPhone, 350); err == nil {
+				t.Errorf("expected the key of a device with a changed revocation not to be trusted")
+			}
+			if err := signedBy(changed, laptop, 350); err != nil {
+				t.Errorf("expected the other keys to stay valid, got %v", err)
+			}
+		}
+
+		// the rotation of the phone is dropped, so the phone is back to its first key
+		dropped := u
+		dropped.KeyHistory = nil
+		dropped.Devices = append([]Device{}, u.Devices...)
+		dropped.Devices[1].PublicKey = phonePEM
+		dropped.Devices[1].Revocation = nil
+		dropped.Devices[1].RevokedAt = 0
+		if err := signedBy(dropped, phone, 250); err != nil {
+			t.Errorf("expected the first key of the phone to stay valid, got %v", err)
+		}
+
+		// a rotation of the registered key is dropped, while the user keeps the new key
+		rotatedNonce, _ := GenerateNonce()
+		rotatedSign, _ := SignRotation(laptop, rotatedNonce, forgedPEM, 350)
+		rotated := u
+		rotated.PublicKey = forgedPEM
+		rotated.Devices = append([]Device{{ID: uid, PublicKey: forgedPEM, CreatedAt: 100, RotatedAt: 350}}, u.Devices[1:]...)
+		rotated.KeyHistory = append([]KeyChange{}, u.KeyHistory...)
+		rotated.KeyHistory = append(rotated.KeyHistory, KeyChange{
+			DeviceID:     uid,
+			OldPublicKey: laptopPEM,
+			NewPublicKey: forgedPEM,
+			Nonce:        rotatedNonce,
+			Signature:    base64.StdEncoding.EncodeToString(rotatedSign),
+			ChangedAt:    350,
+		})
+		if err := signedBy(rotated, laptop, 340); err != nil {
+			t.Errorf("expected the registered key to be valid before its rotation, got %v", err)
+		}
+
+		rotated.KeyHistory = rotated.KeyHistory[:1]
+		if err := signedBy(rotated, laptop, 450); err == nil {
+			t.Errorf("expected the registered key not to be trusted without its rotation")
+		}
+	})
+
+	t.Run("should start from the key the user registered with", func(t *testing.T) {
+		rotated := User{ID: uid, PublicKey: nextPhonePEM, KeyHistory: []KeyChange{{DeviceID: uid, OldPublicKey: laptopPEM}}}
+		if key := rotated.RegisteredKey(); key != laptopPEM {
+			t.Errorf("expected the registered key, got %s", key)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Supported algorithms of user public keys
+const (
+	KeyAlgorithmRSA       = "RSA"
+	KeyAlgorithmEd25519   = "Ed25519"
+	KeyAlgorithmECDSAP256 = "ECDSA-P256"
+	KeyAlgorithmECDSAP384 = "ECDSA-P384"
+)
+
+// SignatureScheme identifies the way logins are signed. The nonce of a challenge is base64-decoded to its
+// 32 raw bytes, which are signed as if they were a SHA-256 digest:
+//
+//   - RSA: RSASSA-PSS with SHA-256, the salt is as long as the hash
+//   - Ed25519: a plain Ed25519 signature of the 32 bytes
+//   - ECDSA: an ASN.1 DER encoded signature of the 32 bytes
+//
+// The signature is sent base64 encoded. SignNonce implements the scheme for clients.
+const SignatureScheme = "asteroid-nonce-v1"
+
+// ErrUnsupportedScheme is returned for logins signed with another scheme than SignatureScheme
+var ErrUnsupportedScheme = errors.New("unsupported signature scheme, use " + SignatureScheme)
+
+// CheckScheme returns an error if scheme is not SignatureScheme. An empty scheme defaults to SignatureScheme.
+func CheckScheme(scheme string) error {
+	if scheme != "" && scheme != SignatureScheme {
+		return ErrUnsupportedScheme
+	}
+	return nil
+}
+
+// SignNonce signs the base64 encoded nonce of a challenge with the private key, following SignatureScheme
+func SignNonce(key crypto.Signer, nonce string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode nonce: %s", err.Error())
+	}
+
+	return SignDigest(key, digest)
+}
+
+// SignDigest signs a 32 byte digest with the private key, following SignatureScheme, e.g. the digest of a note
+func SignDigest(key crypto.Signer, digest []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest, &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		})
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, digest), nil
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, k, digest)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// ParsePublicKey parses a PEM encoded public key and returns it together with its algorithm.
+// It accepts PKIX/SPKI "PUBLIC KEY" blocks holding an Ed25519, ECDSA P-256/P-384 or RSA key,
+// and PKCS #1 "RSA PUBLIC KEY" blocks.
+func ParsePublicKey(publicKey string) (crypto.PublicKey, string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, "", fmt.Errorf("failed to parse PEM block containing the public key")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse DER encoded public key: %s", err.Error())
+		}
+		return pub, KeyAlgorithmRSA, nil
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse DER encoded public key: %s", err.Error())
+		}
+		return classifyPublicKey(pub)
+	default:
+		return nil, "", fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// KeyID identifies a public key by the base64url encoded SHA-256 hash of its PKIX encoding. Encrypted notes
+// address the keys of their recipients with it.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+// classifyPublicKey returns the algorithm of a parsed PKIX public key
+func classifyPublicKey(pub interface{}) (crypto.PublicKey, string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return key, KeyAlgorithmRSA, nil
+	case ed25519.PublicKey:
+		return key, KeyAlgorithmEd25519, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return key, KeyAlgorithmECDSAP256, nil
+		case elliptic.P384():
+			return key, KeyAlgorithmECDSAP384, nil
+		default:
+			return nil, "", fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// verifySignature checks the signature of digest, the decoded nonce, against the public key as described
+// by SignatureScheme
+func verifySignature(pub crypto.PublicKey, digest, signature []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(key, crypto.SHA256, digest, signature, nil)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
@@ -0,0 +1,216 @@
+package user
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+)
+
+// pkixPEM encodes a public key as a PEM "PUBLIC KEY" block
+func pkixPEM(t *testing.T, pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("error marshalling the public key %v\n", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}))
+}
+
+// newKey generates an Ed25519 key pair, returning the private key and the PEM encoded public key
+func newKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating the key %v\n", err)
+	}
+
+	return priv, pkixPEM(t, pub)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	rsaK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edK, _ := ed25519.GenerateKey(rand.Reader)
+	p256K, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384K, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p224K, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&rsaK.PublicKey),
+	}))
+
+	valid := []struct {
+		name      string
+		publicKey string
+		algorithm string
+	}{
+		{"RSA PKCS #1", pkcs1, KeyAlgorithmRSA},
+		{"RSA PKIX", pkixPEM(t, &rsaK.PublicKey), KeyAlgorithmRSA},
+		{"Ed25519", pkixPEM(t, edK.Public()), KeyAlgorithmEd25519},
+		{"ECDSA P-256", pkixPEM(t, &p256K.PublicKey), KeyAlgorithmECDSAP256},
+		{"ECDSA P-384", pkixPEM(t, &p384K.PublicKey), KeyAlgorithmECDSAP384},
+	}
+
+	for _, tc := range valid {
+		t.Run("should parse "+tc.name+" keys", func(t *testing.T) {
+			_, algorithm, err := ParsePublicKey(tc.publicKey)
+			if err != nil {
+				t.Fatalf("error parsing the key %v\n", err)
+			}
+
+			if algorithm != tc.algorithm {
+				t.Errorf("expected algorithm %s, got %s", tc.algorithm, algorithm)
+			}
+		})
+	}
+
+	t.Run("should reject unsupported curves", func(t *testing.T) {
+		_, _, err := ParsePublicKey(pkixPEM(t, &p224K.PublicKey))
+		if err == nil {
+			t.Errorf("P-224 key should be rejected")
+		}
+	})
+
+	t.Run("should reject malformed keys", func(t *testing.T) {
+		_, _, err := ParsePublicKey("not a key")
+		if err == nil {
+			t.Errorf("malformed key should be rejected")
+		}
+
+		private := string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaK),
+		}))
+		_, _, err = ParsePublicKey(private)
+		if err == nil {
+			t.Errorf("private key should be rejected")
+		}
+	})
+}
+
+func TestVerifyKeyAlgorithms(t *testing.T) {
+	_, edK, _ := ed25519.GenerateKey(rand.Reader)
+	p256K, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384K, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	keys := []struct {
+		name string
+		key  crypto.Signer
+		// sign signs the decoded nonce
+		sign func(nonce []byte) ([]byte, error)
+	}{
+		{"Ed25519", edK, func(nonce []byte) ([]byte, error) {
+			return ed25519.Sign(edK, nonce), nil
+		}},
+		{"ECDSA P-256", p256K, func(nonce []byte) ([]byte, error) {
+			return ecdsa.SignASN1(rand.Reader, p256K, nonce)
+		}},
+		{"ECDSA P-384", p384K, func(nonce []byte) ([]byte, error) {
+			return ecdsa.SignASN1(rand.Reader, p384K, nonce)
+		}},
+	}
+
+	db := orbitdb.NewMemoryStores()
+
+	for _, tc := range keys {
+		t.Run("should authenticate a user with an "+tc.name+" key", func(t *testing.T) {
+			u, err := NewUser(db, pkixPEM(t, tc.key.Public()), false)
+			if err != nil {
+				t.Fatalf("error creating the user %v\n", err)
+			}
+
+			nonce, _ := base64.StdEncoding.DecodeString(u.Nonce)
+			sign, err := tc.sign(nonce)
+			if err != nil {
+				t.Fatalf("error signing the nonce %v\n", err)
+			}
+
+			_, err = Authenticate(db, u.ID.String(), sign)
+			if err != nil {
+				t.Errorf("error authenticating the user %v\n", err)
+			}
+		})
+
+		t.Run("should reject a wrong "+tc.name+" signature", func(t *testing.T) {
+			u, err := NewUser(db, pkixPEM(t, tc.key.Public()), false)
+			if err != nil {
+				t.Fatalf("error creating the user %v\n", err)
+			}
+
+			other := sha256.Sum256([]byte("not the nonce"))
+			sign, err := tc.sign(other[:])
+			if err != nil {
+				t.Fatalf("error signing %v\n", err)
+			}
+
+			err = u.VerifyUser(sign)
+			if err == nil {
+				t.Errorf("signature of another message should be rejected")
+			}
+		})
+	}
+
+	t.Run("should reject users with unsupported keys", func(t *testing.T) {
+		_, err := NewUser(db, "-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n", false)
+		if err == nil {
+			t.Errorf("user with an invalid key should not be created")
+		}
+	})
+}
+
+func TestSignNonce(t *testing.T) {
+	rsaK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edK, _ := ed25519.GenerateKey(rand.Reader)
+	p256K, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	db := orbitdb.NewMemoryStores()
+
+	for _, key := range []crypto.Signer{rsaK, edK, p256K} {
+		t.Run("should sign nonces the server verifies", func(t *testing.T) {
+			u, err := NewUser(db, pkixPEM(t, key.Public()), false)
+			if err != nil {
+				t.Fatalf("error creating the user %v\n", err)
+			}
+
+			sign, err := SignNonce(key, u.Nonce)
+			if err != nil {
+				t.Fatalf("error signing the nonce %v\n", err)
+			}
+
+			err = u.VerifyUser(sign)
+			if err != nil {
+				t.Errorf("signature of %s key not accepted %v\n", u.KeyAlgorithm, err)
+			}
+		})
+	}
+
+	t.Run("should reject nonces which are not base64 encoded", func(t *testing.T) {
+		_, err := SignNonce(rsaK, "not a nonce!")
+		if err == nil {
+			t.Errorf("invalid nonce should be rejected")
+		}
+	})
+
+	t.Run("should only accept the documented scheme", func(t *testing.T) {
+		if err := CheckScheme(""); err != nil {
+			t.Errorf("empty scheme should default to %s", SignatureScheme)
+		}
+		if err := CheckScheme(SignatureScheme); err != nil {
+			t.Errorf("%s should be accepted", SignatureScheme)
+		}
+		if err := CheckScheme("rsa-pkcs1v15"); err != ErrUnsupportedScheme {
+			t.Errorf("unknown scheme should be rejected")
+		}
+	})
+}
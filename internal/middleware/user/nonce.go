@@ -0,0 +1,111 @@
+package user
+
+import (
+	"errors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"sync"
+	"time"
+)
+
+// NonceTTL is the time a nonce stays valid after it has been issued
+var NonceTTL = 5 * time.Minute
+
+var (
+	// ErrNonceUsed is returned when a nonce has already been used for a login
+	ErrNonceUsed = errors.New("nonce already used, request a new challenge")
+	// ErrNonceExpired is returned when a nonce is older than NonceTTL
+	ErrNonceExpired = errors.New("nonce expired, request a new challenge")
+	// ErrNonceOtherNode is returned when a nonce was issued by another node
+	ErrNonceOtherNode = errors.New("nonce issued by another node, request a new challenge")
+)
+
+// userLock serializes changes of user documents, so a nonce cannot be used by two logins at once and
+// concurrent changes do not overwrite each other. It only holds within this process: the nodes replicating the
+// users cannot see the logins of the others in time, so a nonce is only accepted by the node which issued it.
+var userLock sync.Mutex
+
+// CheckNonce returns an error if the nonce of the user cannot be used for a login on the node
+func (u User) CheckNonce(node string) error {
+	if u.Nonce == "" {
+		return ErrNonceUsed
+	}
+
+	if u.NonceNode != node {
+		return ErrNonceOtherNode
+	}
+
+	if time.Now().UTC().Unix() > u.NonceExpiresAt {
+		return ErrNonceExpired
+	}
+
+	return nil
+}
+
+// IssueNonce generates a fresh nonce for the user with the id uid and persists it.
+// Any previously issued nonce becomes invalid.
+func IssueNonce(db orbitdb.Stores, uid string) (*User, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.RefreshNonce(db.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	err = Save(db, &u)
+	if err != nil {
+		log.Println("Could not save nonce")
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// Authenticate verifies the signature of the current nonce of the user with the id uid against all active devices.
+// On success, the nonce is consumed and cannot be used again.
+func Authenticate(db orbitdb.Stores, uid string, signature []byte) (*User, error) {
+	u, _, err := AuthenticateDevice(db, uid, "", signature)
+	return u, err
+}
+
+// AuthenticateDevice verifies the signature of the current nonce of the user with the id uid against the active
+// device deviceID, or all active devices if it is empty. On success, the nonce is consumed and the signing
+// device is returned.
+func AuthenticateDevice(db orbitdb.Stores, uid, deviceID string, signature []byte) (*User, *Device, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = u.CheckNonce(db.Node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	device, err := u.VerifyDevice(deviceID, signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// consume the nonce
+	u.Nonce = ""
+	u.NonceExpiresAt = 0
+
+	err = Save(db, &u)
+	if err != nil {
+		log.Println("Could not consume nonce")
+		return nil, nil, err
+	}
+
+	device, _ = u.Device(device.ID.String())
+	return &u, device, nil
+}
@@ -0,0 +1,157 @@
+package user
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+// signNonce signs the base64 encoded nonce the same way VerifyUser expects it
+func signNonce(t *testing.T, privateK *rsa.PrivateKey, nonce string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		t.Fatalf("error decoding the nonce %v\n", err)
+	}
+
+	sign, err := privateK.Sign(rand.Reader, decoded, &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthAuto,
+		Hash:       crypto.SHA256,
+	})
+	if err != nil {
+		t.Fatalf("error signing the nonce %v\n", err)
+	}
+
+	return sign
+}
+
+func TestNonce(t *testing.T) {
+	privateK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pubkPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&privateK.PublicKey),
+	})
+	PublicKey := string(pubkPEM)
+
+	db := orbitdb.NewMemoryStores()
+
+	t.Run("should issue and persist a new nonce", func(t *testing.T) {
+		user, err := NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+
+		issued, err := IssueNonce(db, user.ID.String())
+		if err != nil {
+			t.Fatalf("error issuing a nonce %v\n", err)
+		}
+
+		if issued.Nonce == user.Nonce {
+			t.Errorf("expected the nonce to rotate")
+		}
+
+		found, err := Find(db, user.ID.String())
+		if err != nil {
+			t.Fatalf("error finding the user %v\n", err)
+		}
+
+		if found.Nonce != issued.Nonce {
+			t.Errorf("expected the new nonce to be persisted")
+		}
+
+		if found.CheckNonce(db.Node) != nil {
+			t.Errorf("expected the new nonce to be valid")
+		}
+	})
+
+	t.Run("should authenticate only once with the same nonce", func(t *testing.T) {
+		user, err := NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+
+		sign := signNonce(t, privateK, user.Nonce)
+
+		_, err = Authenticate(db, user.ID.String(), sign)
+		if err != nil {
+			t.Fatalf("error authenticating the user %v\n", err)
+		}
+
+		_, err = Authenticate(db, user.ID.String(), sign)
+		if err != ErrNonceUsed {
+			t.Errorf("expected %v, got %v", ErrNonceUsed, err)
+		}
+	})
+
+	t.Run("should reject an invalid signature without consuming the nonce", func(t *testing.T) {
+		user, err := NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+
+		_, err = Authenticate(db, user.ID.String(), []byte("invalid"))
+		if err == nil {
+			t.Errorf("expected an invalid signature to be rejected")
+		}
+
+		_, err = Authenticate(db, user.ID.String(), signNonce(t, privateK, user.Nonce))
+		if err != nil {
+			t.Errorf("error authenticating the user %v\n", err)
+		}
+	})
+
+	t.Run("should only accept the nonce on the node which issued it", func(t *testing.T) {
+		user, err := NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+
+		// another node replicating the same stores
+		other := db
+		other.Node = "other"
+		sign := signNonce(t, privateK, user.Nonce)
+
+		_, err = Authenticate(other, user.ID.String(), sign)
+		if err != ErrNonceOtherNode {
+			t.Errorf("expected %v, got %v", ErrNonceOtherNode, err)
+		}
+
+		_, err = Authenticate(db, user.ID.String(), sign)
+		if err != nil {
+			t.Errorf("error authenticating the user %v\n", err)
+		}
+
+		issued, err := IssueNonce(other, user.ID.String())
+		if err != nil {
+			t.Fatalf("error issuing a nonce %v\n", err)
+		}
+
+		_, err = Authenticate(other, user.ID.String(), signNonce(t, privateK, issued.Nonce))
+		if err != nil {
+			t.Errorf("error authenticating the user on the other node %v\n", err)
+		}
+	})
+
+	t.Run("should reject an expired nonce", func(t *testing.T) {
+		user, err := NewUser(db, PublicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+
+		user.NonceExpiresAt = time.Now().UTC().Add(-time.Minute).Unix()
+		err = Save(db, &user)
+		if err != nil {
+			t.Fatalf("error saving the user %v\n", err)
+		}
+
+		_, err = Authenticate(db, user.ID.String(), signNonce(t, privateK, user.Nonce))
+		if err != ErrNonceExpired {
+			t.Errorf("expected %v, got %v", ErrNonceExpired, err)
+		}
+	})
+}
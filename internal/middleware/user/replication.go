@@ -0,0 +1,62 @@
+package user
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+)
+
+// OpenNoteStores opens the note stores of all users of db, and of the users added later, locally or by other
+// peers, so that their notes are replicated. Once the devices or key changes of a user arrive, the notes which were
+// rejected before are retried, see orbitdb.UserStores.Retry. The returned function stops following the users.
+func OpenNoteStores(db orbitdb.Stores) func() {
+	// follow first, so that no user is missed
+	events, stop := db.Users.Watch()
+	deviceEvents, stopDevices := db.Devices.Watch()
+
+	openNotes := func(u User) {
+		if _, err := db.UserNotes.Get(u.ID.String()); err != nil {
+			log.Printf("Cannot open the notes of user %s: %v\n", u.ID, err)
+			return
+		}
+		db.UserNotes.Retry(u.ID.String())
+	}
+
+	for _, u := range All(db) {
+		openNotes(u)
+	}
+
+	go func() {
+		for evt := range events {
+			if evt.Op != orbitdb.OpPut {
+				continue
+			}
+
+			u, err := users(db.Users).DecodeDocument(*evt.Document)
+			if err != nil {
+				// not a user
+				continue
+			}
+			openNotes(*u)
+		}
+	}()
+
+	go func() {
+		for evt := range deviceEvents {
+			if evt.Op != orbitdb.OpPut {
+				continue
+			}
+
+			d, err := devices(db.Devices).DecodeDocument(*evt.Document)
+			if err != nil {
+				// not a device
+				continue
+			}
+			db.UserNotes.Retry(d.UID.String())
+		}
+	}()
+
+	return func() {
+		stop()
+		stopDevices()
+	}
+}
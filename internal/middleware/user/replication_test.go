@@ -0,0 +1,98 @@
+package user
+
+import (
+	"fmt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+func TestOpenNoteStores(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+	db.UserNotes.Key = RegisteredKeys(db)
+	// accepts the documents naming a key of an active device of their owner
+	db.UserNotes.Verify = func(owner, registeredKey string, doc orbitdb.Document) error {
+		u, err := Find(db, owner)
+		if err != nil {
+			return err
+		}
+		for _, d := range u.ActiveDevices() {
+			if d.PublicKey == doc.Data["key"] {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown key")
+	}
+
+	// newUser creates a user with an Ed25519 key
+	newUser := func(t *testing.T) User {
+		_, publicKey := newKey(t)
+		u, err := NewUser(db, publicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+		return u
+	}
+
+	laptop, laptopPEM := newKey(t)
+	existing, err := NewUser(db, laptopPEM, false)
+	if err != nil {
+		t.Fatalf("error creating the user %v\n", err)
+	}
+
+	stop := OpenNoteStores(db)
+	defer stop()
+
+	t.Run("should open the note stores of the existing users", func(t *testing.T) {
+		if _, ok := db.UserNotes.Lookup(existing.ID.String()); !ok {
+			t.Errorf("expected the note store of user %s to be opened", existing.ID)
+		}
+	})
+
+	t.Run("should open the note stores of new users", func(t *testing.T) {
+		added := newUser(t)
+
+		// the users are followed in the background
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, ok := db.UserNotes.Lookup(added.ID.String()); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the note store of user %s to be opened", added.ID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if len(db.UserNotes.All()) != 2 {
+			t.Errorf("expected 2 note stores, got %d", len(db.UserNotes.All()))
+		}
+	})
+
+	t.Run("should retry the notes of a device once it arrives", func(t *testing.T) {
+		uid := existing.ID.String()
+		store, _ := db.UserNotes.Lookup(uid)
+
+		// a note of the phone is replicated before the phone
+		_, phonePEM := newKey(t)
+		db.UserNotes.Hold(uid, orbitdb.Document{ID: "note", Data: map[string]interface{}{"key": phonePEM}})
+
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignDevice(laptop, issued.Nonce, phonePEM)
+		if _, _, err := AddSignedDevice(db, uid, "phone", phonePEM, uid, sign); err != nil {
+			t.Fatalf("error adding the device %v\n", err)
+		}
+
+		// the devices are followed in the background
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, err := store.Read("note"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the note of the phone to be written")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package user
+
+import (
+	"errors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"time"
+)
+
+// Roles of the users, carried in their tokens
+const (
+	// RoleUser is the role of every user
+	RoleUser = "user"
+	// RoleAdmin is the role of the users with IsAdmin
+	RoleAdmin = "admin"
+)
+
+// ErrLastAdmin is returned when demoting the only admin
+var ErrLastAdmin = errors.New("the last admin cannot be demoted")
+
+// Roles returns the roles of the user
+func (u User) Roles() []string {
+	if u.IsAdmin {
+		return []string{RoleUser, RoleAdmin}
+	}
+	return []string{RoleUser}
+}
+
+// HasRole reports whether the user has the role
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns every user of db, skipping the other documents of the store
+func All(db orbitdb.Stores) []User {
+	all := users(db.Users).All()
+
+	found := make([]User, 0, len(all))
+	for _, u := range all {
+		found = append(found, *u)
+	}
+	return found
+}
+
+// SetAdmin promotes the user with the id uid to an admin or demotes them. Tokens issued before carry the old
+// roles, the Authorizator checks them against the user.
+func SetAdmin(db orbitdb.Stores, uid string, isAdmin bool) (*User, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.IsAdmin == isAdmin {
+		return &u, nil
+	}
+
+	if !isAdmin {
+		admins := 0
+		for _, other := range All(db) {
+			if other.IsAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return nil, ErrLastAdmin
+		}
+	}
+
+	u.IsAdmin = isAdmin
+	u.UpdatedAt = time.Now().UTC().Unix()
+
+	if err := Save(db, &u); err != nil {
+		log.Println("Could not change the role of the user")
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,58 @@
+package user
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+
+	// newUser creates a user with an Ed25519 key
+	newUser := func(t *testing.T) User {
+		_, publicKey := newKey(t)
+		u, err := NewUser(db, publicKey, false)
+		if err != nil {
+			t.Fatalf("error creating the user %v\n", err)
+		}
+		return u
+	}
+
+	first, second := newUser(t), newUser(t)
+
+	// other documents of the store are not users
+	_, _ = db.Users.Create(map[string]interface{}{"uid": first.ID.String(), "data": "note"}, nil)
+
+	t.Run("should list all users", func(t *testing.T) {
+		if users := All(db); len(users) != 2 {
+			t.Errorf("expected 2 users, got %d", len(users))
+		}
+	})
+
+	t.Run("should promote a user to an admin", func(t *testing.T) {
+		if first.HasRole(RoleAdmin) || !first.HasRole(RoleUser) {
+			t.Errorf("expected new users to have only the user role, got %v", first.Roles())
+		}
+
+		promoted, err := SetAdmin(db, first.ID.String(), true)
+		if err != nil {
+			t.Fatalf("error promoting the user %v\n", err)
+		}
+
+		found, _ := Find(db, first.ID.String())
+		if !promoted.HasRole(RoleAdmin) || !found.IsAdmin {
+			t.Errorf("expected the user to be an admin, got %v", found.Roles())
+		}
+	})
+
+	t.Run("should keep the last admin", func(t *testing.T) {
+		if _, err := SetAdmin(db, first.ID.String(), false); err != ErrLastAdmin {
+			t.Errorf("expected %v, got %v", ErrLastAdmin, err)
+		}
+
+		_, _ = SetAdmin(db, second.ID.String(), true)
+		if _, err := SetAdmin(db, first.ID.String(), false); err != nil {
+			t.Errorf("expected the demotion to succeed with another admin, got %v", err)
+		}
+	})
+}
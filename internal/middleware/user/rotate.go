@@ -0,0 +1,185 @@
+package user
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"strconv"
+	"time"
+)
+
+// rotationPrefix separates rotation signatures from the other signatures of a device
+const rotationPrefix = "asteroid-rotate-v2"
+
+// KeyChange is an entry of the key history of a user, recording the handover from one key of a device to the next
+type KeyChange struct {
+	DeviceID     uuid.UUID `json:"deviceId"`
+	OldKeyID     string    `json:"oldKeyId"`
+	OldPublicKey string    `json:"oldPublicKey"`
+	NewKeyID     string    `json:"newKeyId"`
+	NewPublicKey string    `json:"newPublicKey"`
+	// Nonce is the nonce of the user the RotationDigest was made of, base64 encoded
+	Nonce string `json:"nonce"`
+	// Signature is the RotationDigest signed with the old key, base64 encoded
+	Signature string `json:"signature"`
+	// ChangedAt is the signed time of the handover in unix seconds
+	ChangedAt int64 `json:"changedAt"`
+}
+
+// plainKeyChange is a KeyChange without its JSON methods
+type plainKeyChange KeyChange
+
+// MarshalJSON stores the device id of the change as string
+func (c KeyChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainKeyChange
+		DeviceID string `json:"deviceId"`
+	}{plainKeyChange(c), c.DeviceID.String()})
+}
+
+// UnmarshalJSON parses the device id of the change
+func (c *KeyChange) UnmarshalJSON(b []byte) error {
+	raw := struct {
+		*plainKeyChange
+		DeviceID string `json:"deviceId"`
+	}{plainKeyChange: (*plainKeyChange)(c)}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(raw.DeviceID)
+	if err != nil {
+		return fmt.Errorf("invalid device id %q: %v", raw.DeviceID, err)
+	}
+	c.DeviceID = id
+	return nil
+}
+
+// RotationDigest is the digest the current key of a device signs to hand over to a new key at the time changedAt
+// in unix seconds: the SHA-256 hash of "asteroid-rotate-v2", the decoded current nonce of the user, the PEM encoded
+// new public key and the time in decimal. It is signed like a nonce, see SignatureScheme.
+func RotationDigest(nonce, publicKey string, changedAt int64) ([]byte, error) {
+	rawNonce, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode nonce: %s", err.Error())
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(rotationPrefix))
+	hash.Write(rawNonce)
+	hash.Write([]byte(publicKey))
+	hash.Write([]byte(strconv.FormatInt(changedAt, 10)))
+	return hash.Sum(nil), nil
+}
+
+// SignRotation signs the new public key of a device and the time of the handover with its current private key,
+// see RotationDigest
+func SignRotation(key crypto.Signer, nonce, publicKey string, changedAt int64) ([]byte, error) {
+	digest, err := RotationDigest(nonce, publicKey, changedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return SignDigest(key, digest)
+}
+
+// RotateKey replaces the key of the active device deviceID of the user with the id uid at changedAt in unix
+// seconds. signature is the RotationDigest signed with the current key of the device. The nonce is consumed,
+// tokens of the old key are rejected from then on and the change is added to the key history.
+func RotateKey(db orbitdb.Stores, uid, deviceID, publicKey string, changedAt int64, signature []byte) (*User, *KeyChange, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := u.CheckNonce(db.Node); err != nil {
+		return nil, nil, err
+	}
+
+	newPub, algorithm, err := ParsePublicKey(publicKey)
+	if err != nil {
+		log.Println("Invalid public key")
+		return nil, nil, err
+	}
+
+	for _, d := range u.Devices {
+		if d.PublicKey == publicKey {
+			return nil, nil, ErrDuplicateKey
+		}
+	}
+
+	digest, err := RotationDigest(u.Nonce, publicKey, changedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	device, err := u.verifyDevice(deviceID, digest, signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+
+	if changedAt < device.CreatedAt || changedAt < device.RotatedAt {
+		return nil, nil, fmt.Errorf("the key of device %s cannot be replaced before its last change", deviceID)
+	}
+
+	oldPub, _, err := ParsePublicKey(device.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldKeyID, err := KeyID(oldPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	newKeyID, err := KeyID(newPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	change := KeyChange{
+		DeviceID:     device.ID,
+		OldKeyID:     oldKeyID,
+		OldPublicKey: device.PublicKey,
+		NewKeyID:     newKeyID,
+		NewPublicKey: publicKey,
+		Nonce:        u.Nonce,
+		Signature:    base64.StdEncoding.EncodeToString(signature),
+		ChangedAt:    changedAt,
+	}
+
+	// the registered key mirrors the first device
+	if device.PublicKey == u.PublicKey {
+		u.PublicKey = publicKey
+		u.KeyAlgorithm = algorithm
+	}
+
+	device.PublicKey = publicKey
+	device.KeyAlgorithm = algorithm
+	device.RotatedAt = changedAt
+
+	u.KeyHistory = append(u.KeyHistory, change)
+	u.UpdatedAt = time.Now().UTC().Unix()
+
+	// the nonce was signed by the old key
+	u.Nonce = ""
+	u.NonceExpiresAt = 0
+
+	if err := devices(db.Devices).Put(device.ID.String(), device); err != nil {
+		log.Println("Could not rotate key")
+		return nil, nil, err
+	}
+
+	if err := Save(db, &u); err != nil {
+		log.Println("Could not save user")
+		return nil, nil, err
+	}
+
+	return &u, &change, nil
+}
@@ -0,0 +1,84 @@
+package user
+
+import (
+	"errors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	oldKey, oldPEM := newKey(t)
+	newPriv, newPEM := newKey(t)
+
+	db := orbitdb.NewMemoryStores()
+	u, err := NewUser(db, oldPEM, false)
+	if err != nil {
+		t.Fatalf("error creating the user %v\n", err)
+	}
+	uid := u.ID.String()
+
+	now := time.Now().Unix()
+
+	t.Run("should reject a handover not signed by the old key", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignRotation(newPriv, issued.Nonce, newPEM, now)
+
+		if _, _, err := RotateKey(db, uid, uid, newPEM, now, sign); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+		}
+
+		// a signature for adding a device is not a handover
+		sign, _ = SignDevice(oldKey, issued.Nonce, newPEM)
+		if _, _, err := RotateKey(db, uid, uid, newPEM, now, sign); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+		}
+
+		// the time is signed as well
+		sign, _ = SignRotation(oldKey, issued.Nonce, newPEM, now)
+		if _, _, err := RotateKey(db, uid, uid, newPEM, now+1, sign); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+		}
+	})
+
+	t.Run("should swap the key and record the handover", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignRotation(oldKey, issued.Nonce, newPEM, now)
+
+		rotated, change, err := RotateKey(db, uid, uid, newPEM, now, sign)
+		if err != nil {
+			t.Fatalf("error rotating the key %v\n", err)
+		}
+
+		if rotated.PublicKey != newPEM || rotated.Nonce != "" || rotated.UpdatedAt < u.UpdatedAt {
+			t.Errorf("expected the new key and no nonce, got %+v", rotated)
+		}
+
+		found, _ := Find(db, uid)
+		device, _ := found.Device(uid)
+		if device.PublicKey != newPEM || device.RotatedAt != now {
+			t.Errorf("expected the device to have the new key, got %+v", device)
+		}
+
+		if len(found.KeyHistory) != 1 || found.KeyHistory[0].OldPublicKey != oldPEM || found.KeyHistory[0] != *change {
+			t.Errorf("expected the handover in the key history, got %+v", found.KeyHistory)
+		}
+
+		if _, _, err := RotateKey(db, uid, uid, oldPEM, now, sign); !errors.Is(err, ErrNonceUsed) {
+			t.Errorf("expected the nonce to be consumed, got %v", err)
+		}
+	})
+
+	t.Run("should only log in with the new key", func(t *testing.T) {
+		issued, _ := IssueNonce(db, uid)
+		sign, _ := SignNonce(oldKey, issued.Nonce)
+		if _, err := Authenticate(db, uid, sign); err == nil {
+			t.Errorf("expected the old key to be rejected")
+		}
+
+		sign, _ = SignNonce(newPriv, issued.Nonce)
+		if _, err := Authenticate(db, uid, sign); err != nil {
+			t.Errorf("expected the new key to log in, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package user
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"sync"
+)
+
+// moveLock serializes moving the embedded devices of users, which happens on read
+var moveLock sync.Mutex
+
+// Schema is the format of the user documents
+var Schema = orbitdb.RegisterSchema(&orbitdb.Schema{
+	Name: "user",
+	// users carry a public key, but unlike devices no uid
+	Match: func(doc map[string]interface{}) bool {
+		_, hasPublicKey := doc["publicKey"]
+		_, hasUID := doc["uid"]
+		return hasPublicKey && !hasUID
+	},
+	Migrations: []orbitdb.Migration{
+		{
+			Description: "add the key algorithm and the registered key as primary device",
+			Up:          addPrimaryDevice,
+		},
+		{
+			// they are moved to the devices store when the user is read, see moveDevices
+			Description: "keep the devices as embedded devices until they are moved to the devices store",
+			Up: func(key string, doc map[string]interface{}) error {
+				if devices, _ := doc["devices"].([]interface{}); len(devices) > 0 {
+					doc["embeddedDevices"] = devices
+				}
+				delete(doc, "devices")
+				return nil
+			},
+		},
+	},
+})
+
+// DeviceSchema is the format of the documents of the devices store
+var DeviceSchema = orbitdb.RegisterSchema(&orbitdb.Schema{
+	Name: "device",
+	// devices were only embedded in the user documents before they had a type
+	Match: func(doc map[string]interface{}) bool {
+		return false
+	},
+})
+
+// addPrimaryDevice upgrades users created before other key algorithms and devices existed. They have an RSA
+// key, which becomes their only device.
+func addPrimaryDevice(key string, doc map[string]interface{}) error {
+	if algorithm, _ := doc["keyAlgorithm"].(string); algorithm == "" {
+		doc["keyAlgorithm"] = KeyAlgorithmRSA
+	}
+
+	if devices, _ := doc["devices"].([]interface{}); len(devices) == 0 {
+		doc["devices"] = []interface{}{map[string]interface{}{
+			"id":           key,
+			"name":         "primary",
+			"publicKey":    doc["publicKey"],
+			"keyAlgorithm": doc["keyAlgorithm"],
+			"createdAt":    doc["createdAt"],
+		}}
+	}
+
+	return nil
+}
+
+// MoveDevices moves the devices embedded in the user documents of older versions to the devices store and saves
+// the upgraded users, see moveDevices. Users are upgraded when they are read as well, MoveDevices upgrades the users
+// which are not read. It returns the number of upgraded users and can be run repeatedly.
+func MoveDevices(db orbitdb.Stores) (int, error) {
+	moved := 0
+
+	for _, u := range users(db.Users).All() {
+		if len(u.EmbeddedDevices) == 0 {
+			continue
+		}
+
+		if err := moveDevices(db, u); err != nil {
+			log.Printf("Could not move the devices of user %s\n", u.ID)
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, nil
+}
+
+// moveDevices saves the embedded devices of the user u in the devices store, unless they are there already, then
+// saves u without them
+func moveDevices(db orbitdb.Stores, u *User) error {
+	moveLock.Lock()
+	defer moveLock.Unlock()
+
+	for _, d := range u.EmbeddedDevices {
+		d.UID = u.ID
+
+		// already moved
+		if _, err := db.Devices.Read(d.ID.String()); err == nil {
+			continue
+		}
+
+		if err := devices(db.Devices).CreateWithKey(d.ID.String(), &d); err != nil {
+			return err
+		}
+	}
+
+	u.EmbeddedDevices = nil
+	return Save(db, u)
+}
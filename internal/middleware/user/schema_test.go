@@ -0,0 +1,125 @@
+package user
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+)
+
+// readOnlyStore is a store nothing can be written to
+type readOnlyStore struct {
+	*orbitdb.MemoryStore
+}
+
+func (readOnlyStore) Create(item interface{}, options *orbitdb.DatabaseCreateOptions) (map[string]interface{}, error) {
+	return nil, errors.New("read-only store")
+}
+
+func TestMoveDevices(t *testing.T) {
+	db := orbitdb.NewMemoryStores()
+	uid, phoneID := uuid.New().String(), uuid.New().String()
+	publicKey := "key"
+
+	// user creates a user document of the second version with embedded devices
+	user := func(db orbitdb.Stores) {
+		_, err := db.Users.Create(map[string]interface{}{
+			"publicKey":              publicKey,
+			"keyAlgorithm":           KeyAlgorithmRSA,
+			"createdAt":              1,
+			orbitdb.SchemaVersionKey: 2,
+			"devices": []interface{}{
+				map[string]interface{}{"id": uid, "name": "primary", "publicKey": publicKey, "createdAt": 1},
+				map[string]interface{}{"id": phoneID, "name": "phone", "publicKey": publicKey, "createdAt": 2,
+					"revokedAt": 3},
+			},
+		}, &orbitdb.DatabaseCreateOptions{ID: uid})
+		if err != nil {
+			t.Fatalf("error creating the user, %v\n", err)
+		}
+	}
+
+	t.Run("should move the devices when the user is read", func(t *testing.T) {
+		db := orbitdb.NewMemoryStores()
+		user(db)
+
+		found, err := Find(db, uid)
+		if err != nil {
+			t.Fatalf("error finding the user, %v\n", err)
+		}
+		if len(found.Devices) != 2 || found.Devices[0].ID.String() != uid || found.Devices[1].Active() {
+			t.Errorf("expected the primary and the revoked device, got %+v\n", found.Devices)
+		}
+
+		if _, err := db.Devices.Read(phoneID); err != nil {
+			t.Errorf("expected the device in the devices store, got %v", err)
+		}
+
+		raw, _ := db.Users.Read(uid)
+		item, _ := orbitdb.UnmarshalItem(raw["data"].(string))
+		doc := item.(map[string]interface{})
+		if _, ok := doc["embeddedDevices"]; ok || orbitdb.DocumentVersion(doc) != Schema.Version() {
+			t.Errorf("expected the user to be upgraded, got %v", doc)
+		}
+	})
+
+	t.Run("should read the embedded devices if they cannot be moved", func(t *testing.T) {
+		db := orbitdb.NewMemoryStores()
+		user(db)
+		db.Devices = readOnlyStore{orbitdb.NewMemoryStore()}
+
+		found, err := Find(db, uid)
+		if err != nil {
+			t.Fatalf("error finding the user, %v\n", err)
+		}
+		if len(found.Devices) != 2 || found.Devices[1].UID != found.ID {
+			t.Errorf("expected the embedded devices, got %+v\n", found.Devices)
+		}
+	})
+
+	t.Run("should move the devices of users which are not read", func(t *testing.T) {
+		user(db)
+
+		moved, err := MoveDevices(db)
+		if err != nil || moved != 1 {
+			t.Fatalf("expected 1 moved user, got %d, %v\n", moved, err)
+		}
+
+		found, err := Find(db, uid)
+		if err != nil {
+			t.Fatalf("error finding the user, %v\n", err)
+		}
+
+		if len(found.Devices) != 2 || found.Devices[0].ID.String() != uid || found.Devices[1].Active() {
+			t.Errorf("expected the primary and the revoked device, got %+v\n", found.Devices)
+		}
+	})
+
+	t.Run("should not move the devices twice", func(t *testing.T) {
+		moved, err := MoveDevices(db)
+		if err != nil || moved != 0 {
+			t.Errorf("expected no moved users, got %d, %v\n", moved, err)
+		}
+	})
+
+	t.Run("should move the registered key of the first version", func(t *testing.T) {
+		id := uuid.New().String()
+		_, err := db.Users.Create(map[string]interface{}{"publicKey": publicKey, "createdAt": 1},
+			&orbitdb.DatabaseCreateOptions{ID: id})
+		if err != nil {
+			t.Fatalf("error creating the user, %v\n", err)
+		}
+
+		if moved, err := MoveDevices(db); err != nil || moved != 1 {
+			t.Fatalf("expected 1 moved user, got %d, %v\n", moved, err)
+		}
+
+		found, err := Find(db, id)
+		if err != nil {
+			t.Fatalf("error finding the user, %v\n", err)
+		}
+		if len(found.Devices) != 1 || found.Devices[0].ID.String() != id || found.KeyAlgorithm != KeyAlgorithmRSA {
+			t.Errorf("expected the primary device, got %+v\n", found)
+		}
+	})
+}
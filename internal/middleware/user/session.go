@@ -0,0 +1,88 @@
+package user
+
+import (
+	"fmt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"log"
+	"time"
+)
+
+// RevokedSession is a session that was ended before its tokens expired
+type RevokedSession struct {
+	// ID is the jti claim of the tokens of the session
+	ID string `json:"id"`
+	// ExpiresAt is the time in unix seconds after which no token of the session can be used or refreshed anymore
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// SessionRevoked reports whether tokens of the session id, issued at the SessionVersion version, are revoked
+func (u User) SessionRevoked(id string, version int64) bool {
+	if version < u.SessionVersion {
+		return true
+	}
+
+	for _, s := range u.RevokedSessions {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeSession adds the session id of the user with the id uid to the revoked sessions until expiresAt.
+// Revocations which expired are removed.
+func RevokeSession(db orbitdb.Stores, uid, id string, expiresAt int64) error {
+	if id == "" {
+		return fmt.Errorf("session id is required")
+	}
+
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Unix()
+	revoked := make([]RevokedSession, 0, len(u.RevokedSessions)+1)
+	for _, s := range u.RevokedSessions {
+		if s.ExpiresAt >= now && s.ID != id {
+			revoked = append(revoked, s)
+		}
+	}
+
+	u.RevokedSessions = append(revoked, RevokedSession{ID: id, ExpiresAt: expiresAt})
+	u.UpdatedAt = now
+
+	if err := Save(db, &u); err != nil {
+		log.Println("Could not revoke session")
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAllSessions revokes every token issued to the user with the id uid so far, by increasing its
+// SessionVersion
+func RevokeAllSessions(db orbitdb.Stores, uid string) (*User, error) {
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	u, err := Find(db, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	u.SessionVersion++
+	// the single revocations are covered by the version
+	u.RevokedSessions = nil
+	u.UpdatedAt = time.Now().UTC().Unix()
+
+	if err := Save(db, &u); err != nil {
+		log.Println("Could not revoke sessions")
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,56 @@
+package user
+
+import (
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	_, publicKey := newKey(t)
+
+	db := orbitdb.NewMemoryStores()
+	u, err := NewUser(db, publicKey, false)
+	if err != nil {
+		t.Fatalf("error creating the user %v\n", err)
+	}
+	uid := u.ID.String()
+	later := time.Now().Add(time.Hour).Unix()
+
+	t.Run("should revoke a single session", func(t *testing.T) {
+		if err := RevokeSession(db, uid, "first", later); err != nil {
+			t.Fatalf("error revoking the session %v\n", err)
+		}
+
+		found, _ := Find(db, uid)
+		if !found.SessionRevoked("first", 0) || found.SessionRevoked("second", 0) {
+			t.Errorf("expected only the first session to be revoked, got %+v", found.RevokedSessions)
+		}
+	})
+
+	t.Run("should forget expired revocations", func(t *testing.T) {
+		_ = RevokeSession(db, uid, "expired", time.Now().Add(-time.Hour).Unix())
+		_ = RevokeSession(db, uid, "second", later)
+
+		found, _ := Find(db, uid)
+		if len(found.RevokedSessions) != 2 || found.SessionRevoked("expired", 0) {
+			t.Errorf("expected the expired revocation to be removed, got %+v", found.RevokedSessions)
+		}
+	})
+
+	t.Run("should revoke all sessions of older versions", func(t *testing.T) {
+		revoked, err := RevokeAllSessions(db, uid)
+		if err != nil {
+			t.Fatalf("error revoking the sessions %v\n", err)
+		}
+
+		found, _ := Find(db, uid)
+		if found.SessionVersion != 1 || revoked.SessionVersion != 1 || len(found.RevokedSessions) != 0 {
+			t.Errorf("expected version 1 without single revocations, got %+v", found)
+		}
+
+		if !found.SessionRevoked("third", 0) || found.SessionRevoked("third", 1) {
+			t.Errorf("expected only tokens of version 0 to be revoked")
+		}
+	})
+}
@@ -1,106 +1,118 @@
 package user
 
 import (
-	"context"
-	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/docker/distribution/uuid"
-	"github.com/gin-gonic/gin"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"log"
 	"time"
 )
 
-// User entity, holding a note in the OrbitDB.
+// User entity, holding a note in the OrbitDB. It is stored as JSON, the ID is the key of the document.
 type User struct {
-	ID        uuid.UUID
-	PublicKey string
-	Nonce     string
-	IsAdmin   bool
-	CreatedAt int64
-	UpdatedAt int64
-	Notes     string
+	ID             uuid.UUID `json:"-"`
+	PublicKey      string    `json:"publicKey"`
+	KeyAlgorithm   string    `json:"keyAlgorithm"`
+	Nonce          string    `json:"nonce"`
+	NonceExpiresAt int64     `json:"nonceExpiresAt"`
+	// NonceNode is the node which issued Nonce, only that node accepts it
+	NonceNode string `json:"nonceNode,omitempty"`
+	IsAdmin        bool      `json:"isAdmin"`
+	CreatedAt      int64     `json:"createdAt"`
+	UpdatedAt      int64     `json:"updatedAt"`
+	// Retention is the number of seconds new notes of the user are kept by default, 0 keeps them
+	Retention int64 `json:"retention"`
+	// Devices are the public keys the user can log in with, the first one is PublicKey. They are kept in the
+	// devices store.
+	Devices []Device `json:"-"`
+	// EmbeddedDevices are the devices of a user document of an older version, which are moved to the devices store
+	// when the user is read, see Find
+	EmbeddedDevices []Device `json:"embeddedDevices,omitempty"`
+	// KeyHistory records every key rotation of the devices of the user
+	KeyHistory []KeyChange `json:"keyHistory"`
+	// SessionVersion is increased to revoke all tokens of the user, tokens carry the version they were issued at
+	SessionVersion int64 `json:"sessionVersion"`
+	// RevokedSessions are the sessions ended by a logout, until their tokens expire
+	RevokedSessions []RevokedSession `json:"revokedSessions"`
 }
 
-// init runs at module initialization.
-func init() {
-	log.SetPrefix("[middleware/user/user] ")
+// users returns the repository of the user documents in db
+func users(db orbitdb.Store) orbitdb.Repository[User, *User] {
+	return orbitdb.NewRepository[User](db, Schema)
 }
 
-// NewUser creates a new user entry in the ODB
-func NewUser(publicKey string, isAdmin bool) (User, error) {
-	nonce, err := GenerateNonce()
+// Decoded sets the id of a user document, which has been upgraded to the latest Schema
+func (u *User) Decoded(key string) error {
+	id, err := uuid.Parse(key)
 	if err != nil {
-		log.Println("Failed to generate Nonce")
-		return User{}, err
+		return fmt.Errorf("invalid user id %q: %v", key, err)
 	}
+	u.ID = id
 
-	user := User{
-		ID:        uuid.Generate(),
-		PublicKey: publicKey,
-		// TODO: REGENERATE NONCE EVERY TIME AN AUTH SUCCESSFULLY HAPPENS
-		// base64 encoded nonce
-		Nonce:     nonce,
-		IsAdmin:   isAdmin,
-		CreatedAt: time.Now().UTC().Unix(),
-		UpdatedAt: time.Now().UTC().Unix(),
-		Notes:     "",
+	if u.PublicKey == "" {
+		return fmt.Errorf("user %s has no public key", key)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	return nil
+}
 
-	db, err := orbitdb.OpenDatabase(ctx, "default")
+// init runs at module initialization.
+func init() {
+	log.SetPrefix("[middleware/user/user] ")
+}
 
+// NewUser creates a new user entry in the ODB. The public key has to be in a format ParsePublicKey accepts.
+func NewUser(db orbitdb.Stores, publicKey string, isAdmin bool) (User, error) {
+	_, algorithm, err := ParsePublicKey(publicKey)
 	if err != nil {
-		log.Println("Could not open user database")
+		log.Println("Invalid public key")
 		return User{}, err
 	}
 
-	defer func(db *orbitdb.Database) {
-		err := db.Close()
-		if err != nil {
-			log.Printf("Could not close user database %v\n", user)
-		}
-	}(db)
-
-	resp, err := db.Create(gin.H{
-		"id":        user.ID.String(),
-		"publicKey": user.PublicKey,
-		"nonce":     user.Nonce,
-		"isAdmin":   user.IsAdmin,
-		"createdAt": user.CreatedAt,
-		"updatedAt": user.UpdatedAt,
-	}, nil)
-
+	nonce, err := GenerateNonce()
 	if err != nil {
-		log.Println("Could not create user")
+		log.Println("Failed to generate Nonce")
 		return User{}, err
 	}
 
-	_id := resp["_id"].(string)
-
-	newID, err := uuid.Parse(_id)
+	id := uuid.Generate()
+	user := User{
+		PublicKey:    publicKey,
+		KeyAlgorithm: algorithm,
+		// base64 encoded nonce, valid for the first login
+		Nonce:          nonce,
+		NonceExpiresAt: time.Now().UTC().Add(NonceTTL).Unix(),
+		NonceNode:      db.Node,
+		IsAdmin:        isAdmin,
+		CreatedAt:      time.Now().UTC().Unix(),
+		UpdatedAt:      time.Now().UTC().Unix(),
+	}
+
+	// the registered key is the first device
+	user.Devices = []Device{{
+		ID:           id,
+		UID:          id,
+		Name:         "primary",
+		PublicKey:    publicKey,
+		KeyAlgorithm: algorithm,
+		CreatedAt:    user.CreatedAt,
+	}}
+
+	if err := users(db.Users).CreateWithKey(id.String(), &user); err != nil {
+		log.Println("Could not create user")
+		return User{}, err
+	}
 
-	if err != nil {
-		log.Println("Could not parse UUID")
+	if err := devices(db.Devices).CreateWithKey(id.String(), &user.Devices[0]); err != nil {
+		log.Println("Could not create the primary device")
 		return User{}, err
 	}
 
-	return User{
-		ID:        newID,
-		PublicKey: user.PublicKey,
-		Nonce:     user.Nonce,
-		IsAdmin:   user.IsAdmin,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	}, nil
+	return user, nil
 }
 
 // GenerateNonce generates a SHA256 with the size of 64 bits. The user signs this nonce in order
@@ -122,185 +134,99 @@ func GenerateNonce() (string, error) {
 	return base64.StdEncoding.EncodeToString(msgHash.Sum(nil)), nil
 }
 
-// RefreshNonce updates the user nonce
-func (u User) RefreshNonce() error {
+// RefreshNonce replaces the user nonce with a new one, valid for NonceTTL and only on the node issuing it. Use
+// Save to persist it.
+func (u *User) RefreshNonce(node string) error {
 	nonce, err := GenerateNonce()
 	if err != nil {
 		log.Println("Failed to generate Nonce")
 		return err
 	}
 	u.Nonce = nonce
+	u.NonceExpiresAt = time.Now().UTC().Add(NonceTTL).Unix()
+	u.NonceNode = node
 	return nil
 }
 
 // VerifyUser takes a signature to verify the user and
-// 	returns an error if the signature is invalid
+// 	returns an error if the signature is invalid for all active devices
 func (u User) VerifyUser(signature []byte) error {
+	_, err := u.VerifyDevice("", signature)
+	return err
+}
 
-	block, _ := pem.Decode([]byte(u.PublicKey))
-	if block == nil {
-		return fmt.Errorf("failed to parse PEM block containing the public key")
-	}
-
-	pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+// Keys returns the public keys of the active devices of the user by their KeyID, mapped to their algorithm
+func (u User) Keys() (map[string]string, error) {
+	keys := make(map[string]string)
 
-	if err != nil {
-		return fmt.Errorf("failed to parse DER encoded public key: %s\n", err.Error())
-	}
+	for _, d := range u.ActiveDevices() {
+		pub, algorithm, err := ParsePublicKey(d.PublicKey)
+		if err != nil {
+			return nil, err
+		}
 
-	nonce, err := base64.StdEncoding.DecodeString(u.Nonce)
+		keyID, err := KeyID(pub)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		return fmt.Errorf("failed to decode nonce: %s\n", err.Error())
+		keys[keyID] = algorithm
 	}
 
-	return rsa.VerifyPSS(pub, crypto.SHA256, nonce, signature, nil)
+	return keys, nil
 }
 
-// Find finds a user with the corresponding user id.
-func Find(key string) (User, error) {
-	// use a basic context. For production, consider using context.WithTimeout
-	ctx := context.Background()
-
-	// chose the database to operate from
-	db, err := orbitdb.OpenDatabase(ctx, "default")
-
-	if err != nil {
-		log.Println("Unable to open the default database")
-		return User{}, err
+// SetRetention changes the number of seconds new notes of the user are kept, 0 keeps them
+func SetRetention(db orbitdb.Stores, u *User, retention int64) error {
+	if retention < 0 {
+		return fmt.Errorf("retention must not be negative, got %d", retention)
 	}
 
-	// open the document database
-	docs, err := orbitdb.Client.Docs(ctx, db.Address.String(), nil)
+	u.Retention = retention
+	u.UpdatedAt = time.Now().UTC().Unix()
 
-	if err != nil {
-		log.Println("Unable to open the document database")
-		return User{}, err
-	}
+	return Save(db, u)
+}
 
-	// according to
-	// https://github.com/berty/go-orbit-db/blob/07c8fbab7657926d723aaee4ba50c58c88b7959b/tests/persistence_test.go#L24
-	// -1 is infinity
-	//
-	// Loading the database
-	err = docs.Load(ctx, -999)
-	if err != nil {
-		log.Println("Error loading users from database")
+// Find finds a user with the corresponding user id.
+func Find(db orbitdb.Stores, key string) (User, error) {
+	// Query an item from the database, having the key of the user ID.
+	u, err := users(db.Users).Get(key)
+	if errors.Is(err, orbitdb.ErrInvalidDocument) {
+		log.Println("Error parsing user data to appropiate format")
 		return User{}, err
 	}
-
-	// Query an item from the database, having the key of the user ID.
-	get, err := docs.Get(ctx, key, nil)
 	if err != nil {
 		log.Println("Cannot GET user from Database")
 		return User{}, err
 	}
 
-	// Print the user to logs
-	log.Println(get)
-
-	// get should be a list with 1 entry, containing the encoded user
-	if len(get) != 1 {
-		log.Println("Invalid response length")
-		return User{}, err
+	// users of older versions embed their devices, which are moved on the first read
+	if embedded := u.EmbeddedDevices; len(embedded) > 0 {
+		if err := moveDevices(db, u); err != nil {
+			// e.g. on a node which cannot write to the stores, the user keeps them
+			log.Printf("Could not move the devices of user %s: %v\n", u.ID, err)
+			u.EmbeddedDevices = embedded
+		}
 	}
 
-	// type-casting the user
-	var rawUser = get[0].(map[string]interface{})
-
-	// extract the user id
-	id, err := uuid.Parse(rawUser["_id"].(string))
-
-	// extract the data
-	data := rawUser["data"].(string)
-
-	rawUserData, err := orbitdb.UnmarshalItem(data)
-	if err != nil {
-		log.Println("Error parsing user data to appropiate format")
-		return User{}, err
+	u.Devices = devicesOf(db, u.ID)
+	for _, d := range u.EmbeddedDevices {
+		if _, err := u.Device(d.ID.String()); err != nil {
+			d.UID = u.ID
+			u.Devices = append(u.Devices, d)
+		}
 	}
 
-	// finalize parsing the complete User
-	user := parseRawUserData(id, rawUserData.(map[string]interface{}))
-	return *user, nil
+	return *u, nil
 }
 
-// UpdateNotes updates the user notes with a corresponding note id
-func UpdateNotes(uid, noteId string) (*User, error) {
-	// find the existing user
-	u, err := Find(uid)
-	if err != nil {
-		return nil, err
-	}
-
-	// add note to user object
-	u.Notes = u.Notes + ";" + noteId
-
-	// use a basic context. For production, consider using context.WithTimeout
-	ctx := context.Background()
-
-	// chose the database to operate from
-	db, err := orbitdb.OpenDatabase(ctx, "default")
-
-	if err != nil {
-		log.Println("Unable to open the default database")
-		return nil, err
-	}
-
-	// open the document database
-	docs, err := orbitdb.Client.Docs(ctx, db.Address.String(), nil)
-
-	if err != nil {
-		log.Println("Unable to open the document database")
-		return nil, err
-	}
-
-	// according to
-	// https://github.com/berty/go-orbit-db/blob/07c8fbab7657926d723aaee4ba50c58c88b7959b/tests/persistence_test.go#L24
-	// -1 is infinity
-	//
-	// Loading the database
-	err = docs.Load(ctx, -999)
-	if err != nil {
-		log.Println("Error loading users from database")
-		return nil, err
-	}
-
-	// Update the user
-	_, err = db.Update(u.ID.String(), gin.H{
-		"id":        u.ID.String(),
-		"publicKey": u.PublicKey,
-		"nonce":     u.Nonce,
-		"isAdmin":   u.IsAdmin,
-		"createdAt": u.CreatedAt,
-		"updatedAt": u.UpdatedAt,
-		"notes":     u.Notes,
-	})
-
-	if err != nil {
+// Save writes the current state of the user to the database. Changed devices are saved with saveDevice.
+func Save(db orbitdb.Stores, u *User) error {
+	if err := users(db.Users).Put(u.ID.String(), u); err != nil {
 		log.Println("Error updating user")
-		return nil, err
-	}
-
-	return &u, nil
-}
-
-// parseRawUserData completes the parsing of a User and returns a reference
-func parseRawUserData(id uuid.UUID, raw map[string]interface{}) *User {
-	var notes string
-	if raw["notes"] == nil {
-		notes = ""
-	} else {
-		notes = raw["notes"].(string)
+		return err
 	}
 
-	return &User{
-		ID:        id,
-		PublicKey: raw["publicKey"].(string),
-		Nonce:     raw["nonce"].(string),
-		IsAdmin:   raw["isAdmin"].(bool),
-		CreatedAt: int64(raw["createdAt"].(float64)),
-		UpdatedAt: int64(raw["updatedAt"].(float64)),
-		Notes:     notes,
-	}
+	return nil
 }
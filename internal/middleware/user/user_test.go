@@ -1,13 +1,13 @@
 package user
 
 import (
-	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"github.com/google/uuid"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"testing"
@@ -46,16 +46,10 @@ func TestNewUser(t *testing.T) {
 	PublicKey := string(pubkPEM)
 	//PrivateKey := string(&privateK)
 
-	cancelFunc, err := orbitdb.InitializeOrbitDB("http://localhost:5001", t.TempDir())
-	if err != nil {
-		t.Fatalf("Error initializing OrbitDB: %v", err)
-	}
-	defer cancelFunc()
-	_, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	db := orbitdb.NewMemoryStores()
 
 	t.Run("should create a new user", func(t *testing.T) {
-		user, err := NewUser(PublicKey, false)
+		user, err := NewUser(db, PublicKey, false)
 
 		if err != nil {
 			t.Errorf("an error occurred %v\n", err)
@@ -75,20 +69,35 @@ func TestNewUser(t *testing.T) {
 	})
 
 	t.Run("should create a user and find it", func(t *testing.T) {
-		user, err := NewUser(PublicKey, false)
+		user, err := NewUser(db, PublicKey, false)
 		if err != nil {
 			t.Errorf("error creating the user, %v\n", err)
 		}
 
-		resp, err := Find(user.ID.String())
+		resp, err := Find(db, user.ID.String())
 		if err != nil {
 			t.Errorf("error finding the user %v - %v\n", user, resp)
 		}
 	})
 
+	t.Run("should not find a malformed user", func(t *testing.T) {
+		id := uuid.New().String()
+		_, err := db.Users.Create(map[string]interface{}{
+			"publicKey": PublicKey,
+			"isAdmin":   "yes",
+		}, &orbitdb.DatabaseCreateOptions{ID: id})
+		if err != nil {
+			t.Fatalf("error creating the document, %v\n", err)
+		}
+
+		if _, err := Find(db, id); !errors.Is(err, orbitdb.ErrInvalidDocument) {
+			t.Errorf("expected ErrInvalidDocument, got %v\n", err)
+		}
+	})
+
 	t.Run("should verify a user", func(t *testing.T) {
 
-		user, err := NewUser(PublicKey, false)
+		user, err := NewUser(db, PublicKey, false)
 
 		if err != nil {
 			t.Errorf("error creating the user %v\n", err)
@@ -121,11 +130,11 @@ func TestNewUser(t *testing.T) {
 
 	t.Run("should create multiple users and find them", func(t *testing.T) {
 		for i := 0; i < 10; i++ {
-			user, err := NewUser(PublicKey, false)
+			user, err := NewUser(db, PublicKey, false)
 			if err != nil {
 				t.Errorf("error creating user %v\n", err)
 			}
-			resp, err := Find(user.ID.String())
+			resp, err := Find(db, user.ID.String())
 
 			_, err = uuid.Parse(resp.ID.String())
 			if err != nil {
@@ -0,0 +1,395 @@
+package orbitdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	"github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/multiformats/go-multihash"
+	"io"
+	"sync"
+	"time"
+)
+
+// BlobStore keeps binary contents, such as files and images of notes, addressed by their CID
+type BlobStore interface {
+	// Add stores the content of r and returns its CID and size.
+	Add(ctx context.Context, r io.Reader) (string, int64, error)
+	// Get returns the content with the given CID.
+	Get(ctx context.Context, id string) (io.ReadSeekCloser, error)
+	// Remove releases the content with the given CID.
+	Remove(ctx context.Context, id string) error
+}
+
+// IPFSBlobStore adds blobs to IPFS and pins them
+type IPFSBlobStore struct {
+	API icore.CoreAPI
+}
+
+// NewIPFSBlobStore creates a blob store on top of the CoreAPI of an IPFS node, e.g. Client.IPFS()
+func NewIPFSBlobStore(api icore.CoreAPI) *IPFSBlobStore {
+	return &IPFSBlobStore{API: api}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Add adds the content of r to IPFS and pins it
+func (s *IPFSBlobStore) Add(ctx context.Context, r io.Reader) (string, int64, error) {
+	counter := &countingReader{r: r}
+
+	resolved, err := s.API.Unixfs().Add(ctx, files.NewReaderFile(counter), options.Unixfs.Pin(true))
+	if err != nil {
+		return "", 0, err
+	}
+
+	return resolved.Cid().String(), counter.n, nil
+}
+
+// Get returns a seekable reader of the content with the given CID
+func (s *IPFSBlobStore) Get(ctx context.Context, id string) (io.ReadSeekCloser, error) {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := s.API.Unixfs().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := node.(files.File)
+	if !ok {
+		_ = node.Close()
+		return nil, fmt.Errorf("%s is not a file", id)
+	}
+
+	return file, nil
+}
+
+// Remove unpins the content with the given CID, so the IPFS node can garbage collect it
+func (s *IPFSBlobStore) Remove(ctx context.Context, id string) error {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return err
+	}
+
+	return s.API.Pin().Rm(ctx, path.IpfsPath(c))
+}
+
+// MemoryBlobStore is an in-memory BlobStore, used together with MemoryStore
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemoryBlobStore creates an empty in-memory blob store
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{
+		blobs: make(map[string][]byte),
+	}
+}
+
+// Add stores the content of r under its raw CIDv1
+func (m *MemoryBlobStore) Add(ctx context.Context, r io.Reader) (string, int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash, err := multihash.Sum(b, multihash.SHA2_256, -1)
+	if err != nil {
+		return "", 0, err
+	}
+	id := cid.NewCidV1(cid.Raw, hash).String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id] = b
+
+	return id, int64(len(b)), nil
+}
+
+// Get returns the content with the given CID
+func (m *MemoryBlobStore) Get(ctx context.Context, id string) (io.ReadSeekCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", id)
+	}
+
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+// Remove deletes the content with the given CID
+func (m *MemoryBlobStore) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[id]; !ok {
+		return fmt.Errorf("blob %s not found", id)
+	}
+
+	delete(m.blobs, id)
+	return nil
+}
+
+// nopCloser adds a no-op Close to a ReadSeeker
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// ErrBlobNotUploaded is returned for notes of a blob this node holds no reference to
+var ErrBlobNotUploaded = errors.New("file has not been uploaded")
+
+// ErrBlobMismatch is returned for blobs whose content does not match the hash recorded for them
+var ErrBlobMismatch = errors.New("file does not match its hash")
+
+// CountedBlobStore records the references to the blobs of Blobs in Refs. The same content always has the same CID,
+// so several notes can share a blob. An upload references its blob until it expires, so that a note can claim it,
+// and a note until it is released; a blob is only removed from Blobs once its last reference is gone.
+type CountedBlobStore struct {
+	Blobs BlobStore
+	// Refs holds the references per CID. The blobs are pinned by this node, so it is not shared.
+	Refs Store
+
+	mu sync.Mutex
+	// verified maps the CIDs of blobs checked by Verify to their hash
+	verified sync.Map
+}
+
+// blobRefs are the references to a blob: the ids of its notes and the times of its uploads in unix milliseconds
+type blobRefs struct {
+	Notes   []string `json:"notes"`
+	Uploads []int64  `json:"uploads"`
+}
+
+// NewCountedBlobStore records the references to the blobs of blobs in refs
+func NewCountedBlobStore(blobs BlobStore, refs Store) *CountedBlobStore {
+	return &CountedBlobStore{Blobs: blobs, Refs: refs}
+}
+
+// NewMemoryCountedBlobStore creates an empty in-memory blob store, which records its references in memory as well
+func NewMemoryCountedBlobStore() *CountedBlobStore {
+	return NewCountedBlobStore(NewMemoryBlobStore(), NewMemoryStore())
+}
+
+// decodeRefs decodes an entry of Refs
+func decodeRefs(raw interface{}) (string, blobRefs, error) {
+	entry, ok := raw.(map[string]interface{})
+	if !ok {
+		return "", blobRefs{}, fmt.Errorf("unexpected entry %v", raw)
+	}
+
+	id, _ := entry["_id"].(string)
+	data, _ := entry["data"].(string)
+
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", blobRefs{}, err
+	}
+
+	var refs blobRefs
+	if err := json.Unmarshal(b, &refs); err != nil {
+		return "", blobRefs{}, err
+	}
+	return id, refs, nil
+}
+
+// refs returns the references to the blob with the given CID
+func (s *CountedBlobStore) refs(id string) blobRefs {
+	raw, err := s.Refs.Read(id)
+	if err != nil {
+		return blobRefs{}
+	}
+
+	_, refs, err := decodeRefs(raw)
+	if err != nil {
+		return blobRefs{}
+	}
+	return refs
+}
+
+// save stores the references to the blob with the given CID, or removes the blob without references
+func (s *CountedBlobStore) save(ctx context.Context, id string, refs blobRefs) error {
+	if len(refs.Notes) > 0 || len(refs.Uploads) > 0 {
+		_, err := s.Refs.Create(refs, &DatabaseCreateOptions{ID: id})
+		return err
+	}
+
+	if err := s.Refs.Delete(id); err != nil {
+		return err
+	}
+	s.verified.Delete(id)
+	return s.Blobs.Remove(ctx, id)
+}
+
+// Add adds the content of r to Blobs and references it as an upload
+func (s *CountedBlobStore) Add(ctx context.Context, r io.Reader) (string, int64, error) {
+	id, size, err := s.Blobs.Add(ctx, r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := s.refs(id)
+	refs.Uploads = append(refs.Uploads, time.Now().UnixMilli())
+	if err := s.save(ctx, id, refs); err != nil {
+		return "", 0, err
+	}
+
+	return id, size, nil
+}
+
+// Get returns the content with the given CID
+func (s *CountedBlobStore) Get(ctx context.Context, id string) (io.ReadSeekCloser, error) {
+	return s.Blobs.Get(ctx, id)
+}
+
+// Verify checks that the blob with the given CID has the size and the hex encoded SHA-256 hash. Blobs are only
+// read on their first check.
+func (s *CountedBlobStore) Verify(ctx context.Context, id, hash string, size int64) error {
+	expected := fmt.Sprintf("%s:%d", hash, size)
+	if checked, ok := s.verified.Load(id); ok && checked == expected {
+		return nil
+	}
+
+	content, err := s.Blobs.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	sum := sha256.New()
+	read, err := io.Copy(sum, content)
+	if err != nil {
+		return err
+	}
+
+	if read != size || hex.EncodeToString(sum.Sum(nil)) != hash {
+		return fmt.Errorf("%w: %s", ErrBlobMismatch, id)
+	}
+
+	s.verified.Store(id, expected)
+	return nil
+}
+
+// Claim references the blob with the given CID for the note in place of its oldest upload. Only blobs with a
+// reference can be claimed, e.g. uploaded ones.
+func (s *CountedBlobStore) Claim(ctx context.Context, id, note string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := s.refs(id)
+	if len(refs.Notes) == 0 && len(refs.Uploads) == 0 {
+		return fmt.Errorf("%w: %s", ErrBlobNotUploaded, id)
+	}
+
+	for _, n := range refs.Notes {
+		if n == note {
+			return nil
+		}
+	}
+
+	refs.Notes = append(refs.Notes, note)
+	if len(refs.Uploads) > 0 {
+		oldest := 0
+		for i, uploadedAt := range refs.Uploads {
+			if uploadedAt < refs.Uploads[oldest] {
+				oldest = i
+			}
+		}
+		refs.Uploads = append(refs.Uploads[:oldest], refs.Uploads[oldest+1:]...)
+	}
+	return s.save(ctx, id, refs)
+}
+
+// Release drops the reference of the note to the blob with the given CID, and removes the blob with its last
+// reference. Releasing a reference twice, or one this node does not hold, has no effect.
+func (s *CountedBlobStore) Release(ctx context.Context, id, note string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := s.refs(id)
+	kept := make([]string, 0, len(refs.Notes))
+	for _, n := range refs.Notes {
+		if n != note {
+			kept = append(kept, n)
+		}
+	}
+
+	if len(kept) == len(refs.Notes) {
+		return nil
+	}
+
+	refs.Notes = kept
+	return s.save(ctx, id, refs)
+}
+
+// ReleaseUploads drops the references of the uploads before the given time, whether a note claimed their blob or
+// not. It returns the number of removed blobs and the first error.
+func (s *CountedBlobStore) ReleaseUploads(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	var first error
+
+	for _, raw := range s.Refs.ReadAll() {
+		id, refs, err := decodeRefs(raw)
+		if err != nil {
+			continue
+		}
+
+		kept := make([]int64, 0, len(refs.Uploads))
+		for _, uploadedAt := range refs.Uploads {
+			if uploadedAt >= before.UnixMilli() {
+				kept = append(kept, uploadedAt)
+			}
+		}
+
+		if len(kept) == len(refs.Uploads) {
+			continue
+		}
+
+		refs.Uploads = kept
+		if err := s.save(ctx, id, refs); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		if len(refs.Notes) == 0 && len(refs.Uploads) == 0 {
+			removed++
+		}
+	}
+
+	return removed, first
+}
@@ -0,0 +1,181 @@
+package orbitdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBlobStore(t *testing.T) {
+	ctx := context.Background()
+	blobs := NewMemoryBlobStore()
+
+	var id string
+
+	t.Run("should add a blob under its CID", func(t *testing.T) {
+		var size int64
+		var err error
+		id, size, err = blobs.Add(ctx, strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatalf("Error adding blob: %v", err)
+		}
+
+		if size != 11 {
+			t.Errorf("expected size 11, got %d", size)
+		}
+
+		if _, err := cid.Decode(id); err != nil {
+			t.Errorf("expected a valid CID, got %s", id)
+		}
+
+		again, _, _ := blobs.Add(ctx, strings.NewReader("hello world"))
+		if again != id {
+			t.Errorf("expected the same CID for the same content, got %s and %s", id, again)
+		}
+	})
+
+	t.Run("should read and seek a blob", func(t *testing.T) {
+		content, err := blobs.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Error getting blob: %v", err)
+		}
+		defer content.Close()
+
+		if _, err := content.Seek(6, io.SeekStart); err != nil {
+			t.Fatalf("Error seeking blob: %v", err)
+		}
+
+		b, _ := io.ReadAll(content)
+		if string(b) != "world" {
+			t.Errorf("expected world, got %s", b)
+		}
+	})
+
+	t.Run("should remove a blob", func(t *testing.T) {
+		if err := blobs.Remove(ctx, id); err != nil {
+			t.Fatalf("Error removing blob: %v", err)
+		}
+
+		if _, err := blobs.Get(ctx, id); err == nil {
+			t.Errorf("expected the blob to be gone")
+		}
+	})
+}
+
+func TestCountedBlobStore(t *testing.T) {
+	testCountedBlobStore(t, NewCountedBlobStore(NewMemoryBlobStore(), NewMemoryStore()))
+}
+
+func TestDatabaseCountedBlobStore(t *testing.T) {
+	// NOTE: t.TempDir could cause some permission errors on Windows as of Go 1.18.5
+	cancelFunc, err := InitializeEmbeddedOrbitDB(t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Error initializing OrbitDB: %v", err)
+	}
+	defer cancelFunc()
+
+	refs, err := OpenDatabase(context.Background(), "blob-refs-test")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer closeDb(refs, t)
+
+	// the references are keyed by CIDs, which contain no "-"
+	testCountedBlobStore(t, NewCountedBlobStore(NewMemoryBlobStore(), refs))
+}
+
+// testCountedBlobStore runs the tests of CountedBlobStore on blobs, whose Refs are empty
+func testCountedBlobStore(t *testing.T, blobs *CountedBlobStore) {
+	ctx := context.Background()
+
+	t.Run("should keep a shared blob until its last reference is released", func(t *testing.T) {
+		id, _, err := blobs.Add(ctx, strings.NewReader("shared"))
+		if err != nil {
+			t.Fatalf("Error adding blob: %v", err)
+		}
+
+		for _, note := range []string{"first", "second"} {
+			if err := blobs.Claim(ctx, id, note); err != nil {
+				t.Fatalf("Error claiming blob: %v", err)
+			}
+		}
+		if _, err := blobs.ReleaseUploads(ctx, time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("Error releasing uploads: %v", err)
+		}
+
+		// releasing twice has no effect
+		for i := 0; i < 2; i++ {
+			if err := blobs.Release(ctx, id, "first"); err != nil {
+				t.Fatalf("Error releasing blob: %v", err)
+			}
+		}
+		if _, err := blobs.Get(ctx, id); err != nil {
+			t.Errorf("expected the blob to be kept for the other note, got %v", err)
+		}
+
+		if err := blobs.Release(ctx, id, "second"); err != nil {
+			t.Fatalf("Error releasing blob: %v", err)
+		}
+		if _, err := blobs.Get(ctx, id); err == nil {
+			t.Errorf("expected the blob to be gone")
+		}
+	})
+
+	t.Run("should remove a claimed blob with its note", func(t *testing.T) {
+		id, _, _ := blobs.Add(ctx, strings.NewReader("claimed"))
+
+		if err := blobs.Claim(ctx, id, "claiming"); err != nil {
+			t.Fatalf("Error claiming blob: %v", err)
+		}
+		if err := blobs.Release(ctx, id, "claiming"); err != nil {
+			t.Fatalf("Error releasing blob: %v", err)
+		}
+		if _, err := blobs.Get(ctx, id); err == nil {
+			t.Errorf("expected the blob to be gone")
+		}
+	})
+
+	t.Run("should keep uploads until they expire", func(t *testing.T) {
+		id, _, _ := blobs.Add(ctx, strings.NewReader("uploaded"))
+
+		if removed, _ := blobs.ReleaseUploads(ctx, time.Now().Add(-time.Minute)); removed != 0 {
+			t.Errorf("expected the recent upload to be kept, got %d removed", removed)
+		}
+		if removed, _ := blobs.ReleaseUploads(ctx, time.Now().Add(time.Second)); removed != 1 {
+			t.Errorf("expected the upload to be removed, got %d removed", removed)
+		}
+
+		if err := blobs.Claim(ctx, id, "late"); !errors.Is(err, ErrBlobNotUploaded) {
+			t.Errorf("expected %v, got %v", ErrBlobNotUploaded, err)
+		}
+	})
+
+	t.Run("should verify the hash of a blob", func(t *testing.T) {
+		id, size, _ := blobs.Add(ctx, strings.NewReader("hashed"))
+		hash := sha256.Sum256([]byte("hashed"))
+
+		if err := blobs.Verify(ctx, id, hex.EncodeToString(hash[:]), size); err != nil {
+			t.Errorf("expected the blob to match its hash, got %v", err)
+		}
+		if err := blobs.Verify(ctx, id, hex.EncodeToString(hash[:]), size+1); !errors.Is(err, ErrBlobMismatch) {
+			t.Errorf("expected %v, got %v", ErrBlobMismatch, err)
+		}
+	})
+
+	t.Run("should leave blobs without references alone", func(t *testing.T) {
+		id, _, _ := blobs.Blobs.Add(ctx, strings.NewReader("replicated"))
+
+		if err := blobs.Release(ctx, id, "replicated"); err != nil {
+			t.Fatalf("Error releasing blob: %v", err)
+		}
+		if _, err := blobs.Get(ctx, id); err != nil {
+			t.Errorf("expected the blob to be kept, got %v", err)
+		}
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/docker/distribution/uuid"
 	"log"
+	"sync"
 	"time"
 )
 import "context"
@@ -18,6 +19,8 @@ type Database struct {
 	Store   *iface.DocumentStore
 	Name    string
 	Address address.Address
+
+	replication *replication
 }
 
 // DatabaseCreateOptions which handle the creation of a new entry
@@ -36,17 +39,30 @@ var timeout = 10 * time.Duration(time.Second)
 // infinite items to return
 var infinite = -1
 
-// OpenDatabase creates or opens a database
+// open keeps track of the databases which have not been closed yet, see CloseDatabases
+var open = struct {
+	sync.Mutex
+	databases map[*iface.DocumentStore]*Database
+}{databases: make(map[*iface.DocumentStore]*Database)}
+
+// OpenDatabase creates or opens a database and loads its entries. Afterwards, the database follows the writes
+// replicated from other peers, so it does not have to be loaded again. name is either the name of a database of
+// this node or the address of a database of another one.
 func OpenDatabase(ctx context.Context, name string) (*Database, error) {
+	return openDatabase(ctx, Client, name, nil)
+}
+
+// openDatabase creates or opens a database of client with the options and loads its entries
+func openDatabase(ctx context.Context, client iface.OrbitDB, name string, options *iface.CreateDBOptions) (*Database, error) {
 	// Check if the ODB client is initialized
-	if Client == nil {
+	if client == nil {
 		log.Printf("Client is not initialized")
 		return nil, fmt.Errorf("client is not initialized." +
 			" Please run orbitdb.InitializeOrbitDB")
 	}
 
 	// create a new document-DB
-	docs, err := Client.Docs(ctx, name, nil)
+	docs, err := client.Docs(ctx, name, options)
 
 	if err != nil {
 		log.Printf("Could not open/create database: %v", err)
@@ -59,12 +75,49 @@ func OpenDatabase(ctx context.Context, name string) (*Database, error) {
 		return nil, err
 	}
 
-	// return a reference to the document DB
-	return &Database{
-		Name:    name,
+	db := &Database{
+		// the name without the address
+		Name:    docs.DBName(),
 		Store:   &docs,
 		Address: docs.Address(),
-	}, nil
+	}
+
+	err = watchReplication(db)
+	if err != nil {
+		_ = docs.Close()
+		return nil, err
+	}
+
+	open.Lock()
+	open.databases[db.Store] = db
+	open.Unlock()
+
+	// return a reference to the document DB
+	return db, nil
+}
+
+// CloseDatabases closes every database opened with OpenDatabase which has not been closed yet.
+// It returns the first error, but tries to close all databases.
+func CloseDatabases() error {
+	open.Lock()
+	databases := make([]*Database, 0, len(open.databases))
+	for _, db := range open.databases {
+		databases = append(databases, db)
+	}
+	open.Unlock()
+
+	var first error
+	for _, db := range databases {
+		log.Printf("Closing database %s", db.Name)
+		if err := db.Close(); err != nil {
+			log.Printf("Could not close database %s: %v", db.Name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
 }
 
 // MarshalItem parses any matching go-lang object into a base64-encoded json string
@@ -135,13 +188,6 @@ func (d Database) Read(key string) (map[string]interface{}, error) {
 	ctx := context.Background()
 
 	store := *d.Store
-	err := store.Load(ctx, infinite)
-
-	if err != nil {
-		log.Printf("Could not load database: %v", err)
-		return nil, err
-	}
-
 	get, err := store.Get(ctx, key, nil)
 
 	if err != nil {
@@ -166,6 +212,7 @@ func (d Database) Read(key string) (map[string]interface{}, error) {
 	return item.(map[string]interface{}), nil
 }
 
+// ReadAll returns all documents of the database
 func (d Database) ReadAll() []interface{} {
 	ctx := context.Background()
 
@@ -177,7 +224,10 @@ func (d Database) ReadAll() []interface{} {
 	//	return nil
 	//}
 
-	get, err := store.Get(ctx, "-", &iface.DocumentStoreGetOptions{PartialMatches: true})
+	// every key matches, not only the UUIDs containing a "-", e.g. the CIDs of the blob references
+	get, err := store.Query(ctx, func(doc interface{}) (bool, error) {
+		return true, nil
+	})
 
 	if err != nil {
 		log.Printf("Could not read item: %v", err)
@@ -193,11 +243,6 @@ func (d Database) Update(key string, item interface{}) (map[string]interface{},
 	defer cancel()
 
 	store := *d.Store
-	err := store.Load(ctx, infinite)
-	if err != nil {
-		log.Printf("Could not load database: %v", err)
-		return nil, err
-	}
 
 	// find the item to update
 	get, err := store.Get(ctx, key, nil)
@@ -209,7 +254,7 @@ func (d Database) Update(key string, item interface{}) (map[string]interface{},
 
 	if len(get) != 1 {
 		log.Printf("Cannot find exactly one item with key %s", key)
-		return nil, err
+		return nil, fmt.Errorf("cannot find exactly one item with key %s", key)
 	}
 
 	marshalItem, err := MarshalItem(item)
@@ -255,8 +300,25 @@ func (d Database) Delete(key string) error {
 	return nil
 }
 
+// closed returns whether the database has been closed
+func (d Database) closed() bool {
+	open.Lock()
+	defer open.Unlock()
+
+	_, ok := open.databases[d.Store]
+	return !ok
+}
+
 // Close closes the database
 func (d Database) Close() error {
+	open.Lock()
+	delete(open.databases, d.Store)
+	open.Unlock()
+
+	if err := d.replication.close(); err != nil {
+		log.Printf("Could not stop following replication events: %v", err)
+	}
+
 	store := *d.Store
 	return store.Close()
 }
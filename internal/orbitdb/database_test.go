@@ -15,7 +15,7 @@ func closeDb(db *Database, t *testing.T) {
 
 func TestNewDatabase(t *testing.T) {
 	// NOTE: t.TempDir could cause some permission errors on Windows as of Go 1.18.5
-	cancelFunc, err := InitializeOrbitDB("http://localhost:5001", t.TempDir())
+	cancelFunc, err := InitializeEmbeddedOrbitDB(t.TempDir(), t.TempDir(), nil)
 
 	if err != nil {
 		t.Fatalf("Error initializing OrbitDB: %v", err)
@@ -154,4 +154,26 @@ func TestNewDatabase(t *testing.T) {
 			t.Errorf("expected item to be deleted")
 		}
 	})
+
+	t.Run("should close all open databases", func(t *testing.T) {
+		_, err := OpenDatabase(ctx, "close-all-test-1")
+		if err != nil {
+			t.Fatalf("error creating database: %s", err)
+		}
+
+		closed, err := OpenDatabase(ctx, "close-all-test-2")
+		if err != nil {
+			t.Fatalf("error creating database: %s", err)
+		}
+		closeDb(closed, t)
+
+		err = CloseDatabases()
+		if err != nil {
+			t.Errorf("error closing databases: %s", err)
+		}
+
+		if len(open.databases) != 0 {
+			t.Errorf("expected no open databases, got %d", len(open.databases))
+		}
+	})
 }
@@ -0,0 +1,116 @@
+package orbitdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/ipfs/go-ipfs/config"
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/plugin/loader"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	icore "github.com/ipfs/interface-go-ipfs-core"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// the IPFS plugins (e.g. the leveldb/flatfs datastores) can only be injected once per process
+var (
+	pluginsOnce sync.Once
+	pluginsErr  error
+)
+
+// setupPlugins loads and injects the preloaded IPFS plugins
+func setupPlugins(repoPath string) error {
+	pluginsOnce.Do(func() {
+		plugins, err := loader.NewPluginLoader(filepath.Join(repoPath, "plugins"))
+		if err != nil {
+			pluginsErr = fmt.Errorf("error loading plugins: %s", err)
+			return
+		}
+
+		if err := plugins.Initialize(); err != nil {
+			pluginsErr = fmt.Errorf("error initializing plugins: %s", err)
+			return
+		}
+
+		if err := plugins.Inject(); err != nil {
+			pluginsErr = fmt.Errorf("error injecting plugins: %s", err)
+		}
+	})
+
+	return pluginsErr
+}
+
+// initRepo creates a new IPFS repo in repoPath, if there is none yet. The node does not bootstrap, announce
+// or discover peers and only listens on the loopback interface.
+func initRepo(repoPath string) error {
+	if fsrepo.IsInitialized(repoPath) {
+		return nil
+	}
+
+	cfg, err := config.Init(io.Discard, 2048)
+	if err != nil {
+		return err
+	}
+
+	cfg.Bootstrap = nil
+	cfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/0"}
+	cfg.Addresses.API = nil
+	cfg.Addresses.Gateway = nil
+	cfg.Discovery.MDNS.Enabled = false
+
+	return fsrepo.Init(repoPath, cfg)
+}
+
+// createEmbeddedApi starts an IPFS node inside the running process, backed by the repo in repoPath.
+// The node keeps a libp2p host, since OrbitDB needs pubsub, but uses no content routing and only dials the
+// peers it is told to. Unless swarmAddrs is empty, the node listens on them instead of the addresses of the repo.
+func createEmbeddedApi(ctx context.Context, repoPath string, swarmAddrs []string) (icore.CoreAPI, *core.IpfsNode, error) {
+	if err := setupPlugins(repoPath); err != nil {
+		return nil, nil, err
+	}
+
+	if err := initRepo(repoPath); err != nil {
+		log.Printf("Error initializing IPFS repo: %v", err)
+		return nil, nil, err
+	}
+
+	repo, err := fsrepo.Open(repoPath)
+	if err != nil {
+		log.Printf("Error opening IPFS repo: %v", err)
+		return nil, nil, err
+	}
+
+	if len(swarmAddrs) > 0 {
+		if err := repo.SetConfigKey("Addresses.Swarm", swarmAddrs); err != nil {
+			log.Printf("Error setting the swarm addresses: %v", err)
+			_ = repo.Close()
+			return nil, nil, err
+		}
+	}
+
+	node, err := core.NewNode(ctx, &core.BuildCfg{
+		Online:  true,
+		Routing: libp2p.NilRouterOption,
+		Repo:    repo,
+		ExtraOpts: map[string]bool{
+			"pubsub": true,
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating IPFS node: %v", err)
+		return nil, nil, err
+	}
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		log.Printf("Error creating Core API: %v", err)
+		_ = node.Close()
+		return nil, nil, err
+	}
+
+	return api, node, nil
+}
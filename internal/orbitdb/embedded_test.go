@@ -0,0 +1,64 @@
+package orbitdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEmbeddedODBCreation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repoDir := t.TempDir()
+
+	t.Run("should create an OrbitDB instance on an embedded node", func(t *testing.T) {
+		odb, node, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), repoDir, nil)
+
+		if err != nil {
+			t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+		}
+
+		if odb.Identity().ID == "" {
+			t.Errorf("OrbitDB instance has no identity")
+		}
+
+		if !node.IsOnline {
+			t.Errorf("IPFS node should run a libp2p host for pubsub")
+		}
+
+		if err := odb.Close(); err != nil {
+			t.Errorf("Error closing OrbitDB: %s", err)
+		}
+		closeNode(node, t)
+	})
+
+	t.Run("should reopen an existing IPFS repo", func(t *testing.T) {
+		odb, node, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), repoDir, nil)
+
+		if err != nil {
+			t.Fatalf("Error reopening the IPFS repo: %s", err)
+		}
+
+		defer closeNode(node, t)
+
+		if odb.Identity().ID == "" {
+			t.Errorf("OrbitDB instance has no identity")
+		}
+	})
+}
+
+func TestEmbeddedOrbitDBInit(t *testing.T) {
+	t.Run("should initialize the Client global var", func(t *testing.T) {
+		cancel, err := InitializeEmbeddedOrbitDB(t.TempDir(), t.TempDir(), nil)
+
+		if err != nil {
+			t.Fatalf("Error initializing embedded OrbitDB: %s", err)
+		}
+
+		defer cancel()
+
+		if Client == nil {
+			t.Errorf("OrbitDB client is nil")
+		}
+	})
+}
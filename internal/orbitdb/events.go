@@ -0,0 +1,80 @@
+package orbitdb
+
+import (
+	"log"
+	"sync"
+)
+
+// Operations of an Event
+const (
+	OpPut    = "PUT"
+	OpDelete = "DEL"
+)
+
+// eventBuffer is the number of events a slow watcher can fall behind before events are dropped
+const eventBuffer = 256
+
+// Event is a change of a document, written locally or replicated from another peer
+type Event struct {
+	// Op is OpPut or OpDelete
+	Op  string
+	Key string
+	// Document is the decoded document of an OpPut event
+	Document *Document
+}
+
+// broadcaster delivers events to every watcher of a store. The zero value is ready to use.
+type broadcaster struct {
+	mu       sync.Mutex
+	watchers map[chan Event]struct{}
+}
+
+// watch returns a channel receiving the events published from now on, and a function to stop watching
+func (b *broadcaster) watch() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.watchers == nil {
+		b.watchers = make(map[chan Event]struct{})
+	}
+
+	ch := make(chan Event, eventBuffer)
+	b.watchers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.watchers[ch]; ok {
+				delete(b.watchers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// publish sends the event to all watchers without blocking the writer
+func (b *broadcaster) publish(evt Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.watchers {
+		select {
+		case ch <- evt:
+		default:
+			log.Printf("Dropping %s event of %s for a slow watcher", evt.Op, evt.Key)
+		}
+	}
+}
+
+// close stops all watchers
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.watchers {
+		delete(b.watchers, ch)
+		close(ch)
+	}
+}
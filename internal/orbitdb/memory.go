@@ -0,0 +1,133 @@
+package orbitdb
+
+import (
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"sort"
+	"sync"
+)
+
+// MemoryStore is an in-memory Store. It keeps the entries in the same {_id, data} format as
+// Database, but nothing is persisted or replicated. Used for offline development and tests.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	entries map[string]map[string]interface{}
+	events  broadcaster
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]map[string]interface{}),
+	}
+}
+
+// put stores the marshalled item under key and returns a copy of the entry
+func (m *MemoryStore) put(key string, item interface{}) (map[string]interface{}, error) {
+	mItem, err := MarshalItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	m.entries[key] = map[string]interface{}{
+		"_id":  key,
+		"data": mItem,
+	}
+
+	if doc, err := decodeDocument(m.entries[key]); err == nil {
+		m.events.publish(Event{Op: OpPut, Key: key, Document: &doc})
+	}
+
+	return copyEntry(m.entries[key]), nil
+}
+
+// Create creates a new document in the store
+func (m *MemoryStore) Create(item interface{}, options *DatabaseCreateOptions) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := uuid.Generate().String()
+	if options != nil {
+		key = options.ID
+	}
+
+	return m.put(key, item)
+}
+
+// Read reads a document from the store
+func (m *MemoryStore) Read(key string) (map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("more than one item or none are found")
+	}
+
+	return copyEntry(entry), nil
+}
+
+// ReadAll returns all documents of the store, ordered by key
+func (m *MemoryStore) ReadAll() []interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	all := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		all = append(all, copyEntry(m.entries[key]))
+	}
+
+	return all
+}
+
+// Update updates an existing document in the store
+func (m *MemoryStore) Update(key string, item interface{}) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[key]; !ok {
+		return nil, fmt.Errorf("cannot find exactly one item with key %s", key)
+	}
+
+	return m.put(key, item)
+}
+
+// Delete deletes a document from the store
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[key]; !ok {
+		return fmt.Errorf("cannot find exactly one item with key %s", key)
+	}
+
+	delete(m.entries, key)
+	m.events.publish(Event{Op: OpDelete, Key: key})
+	return nil
+}
+
+// Watch returns a channel receiving the following changes of the store
+func (m *MemoryStore) Watch() (<-chan Event, func()) {
+	return m.events.watch()
+}
+
+// Close stops all watchers of the in-memory store
+func (m *MemoryStore) Close() error {
+	m.events.close()
+	return nil
+}
+
+// copyEntry returns a shallow copy, so callers cannot modify the stored entry
+func copyEntry(entry map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(entry))
+	for k, v := range entry {
+		c[k] = v
+	}
+	return c
+}
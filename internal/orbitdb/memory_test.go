@@ -0,0 +1,127 @@
+package orbitdb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	item := map[string]interface{}{"Hi": "mom"}
+
+	t.Run("should create an item and read it", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		resp, err := db.Create(item, nil)
+		if err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+
+		read, err := db.Read(resp["_id"].(string))
+		if err != nil {
+			t.Fatalf("error reading item: %s", err)
+		}
+
+		if !reflect.DeepEqual(read, resp) {
+			t.Errorf("expected read to be equal to write")
+		}
+
+		data, err := UnmarshalItem(read["data"].(string))
+		if err != nil {
+			t.Fatalf("error unmarshalling item: %s", err)
+		}
+
+		if !reflect.DeepEqual(data, item) {
+			t.Errorf("expected %v, got %v", item, data)
+		}
+	})
+
+	t.Run("should create an item with a custom ID", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		resp, err := db.Create(item, &DatabaseCreateOptions{ID: "custom"})
+		if err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+
+		if resp["_id"] != "custom" {
+			t.Errorf("expected ID to be 'custom', got %v", resp["_id"])
+		}
+	})
+
+	t.Run("should update an existing item only", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		resp, _ := db.Create(item, nil)
+		key := resp["_id"].(string)
+
+		updated, err := db.Update(key, map[string]interface{}{"Hi": "dad"})
+		if err != nil {
+			t.Fatalf("error updating item: %s", err)
+		}
+
+		if updated["data"] == resp["data"] {
+			t.Errorf("expected data to change")
+		}
+
+		_, err = db.Update("missing", item)
+		if err == nil {
+			t.Errorf("expected an error updating a missing item")
+		}
+	})
+
+	t.Run("should delete an item", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		resp, _ := db.Create(item, nil)
+		key := resp["_id"].(string)
+
+		err := db.Delete(key)
+		if err != nil {
+			t.Fatalf("error deleting item: %s", err)
+		}
+
+		_, err = db.Read(key)
+		if err == nil {
+			t.Errorf("expected item to be deleted")
+		}
+	})
+
+	t.Run("should return all items", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		for i := 0; i < 3; i++ {
+			_, err := db.Create(item, nil)
+			if err != nil {
+				t.Fatalf("error adding item: %s", err)
+			}
+		}
+
+		if all := db.ReadAll(); len(all) != 3 {
+			t.Errorf("expected 3 items, got %d", len(all))
+		}
+	})
+
+	t.Run("should publish changes to watchers", func(t *testing.T) {
+		db := NewMemoryStore()
+		events, stop := db.Watch()
+
+		resp, _ := db.Create(map[string]interface{}{"createdAt": 42}, nil)
+		key := resp["_id"].(string)
+		_ = db.Delete(key)
+
+		put := <-events
+		if put.Op != OpPut || put.Key != key || put.Document == nil || put.Document.CreatedAt != 42 {
+			t.Errorf("unexpected put event %+v", put)
+		}
+
+		del := <-events
+		if del.Op != OpDelete || del.Key != key {
+			t.Errorf("unexpected delete event %+v", del)
+		}
+
+		stop()
+		if _, ok := <-events; ok {
+			t.Errorf("expected the channel to be closed")
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"berty.tech/go-orbit-db/iface"
 	"context"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
+	"github.com/ipfs/go-ipfs/core"
 	"log"
 	"net/http"
 )
@@ -28,6 +29,7 @@ func createUrlHttpApi(ipfsApiURL string) (*httpapi.HttpApi, error) {
 }
 
 // InitializeOrbitDB initializes a new ODB instance; taking the IPFS-Node API and the store directory into account.
+// The returned function closes Client.
 func InitializeOrbitDB(ipfsApiURL, orbitDbDirectory string) (context.CancelFunc, error) {
 	// A production version could also take more HTTP-API and ODB config options into account.
 	ctx, cancel := context.WithCancel(context.Background())
@@ -38,7 +40,12 @@ func InitializeOrbitDB(ipfsApiURL, orbitDbDirectory string) (context.CancelFunc,
 		return nil, err
 	}
 	Client = odb
-	return cancel, nil
+	return func() {
+		if err := odb.Close(); err != nil {
+			log.Printf("Error closing OrbitDB: %v", err)
+		}
+		cancel()
+	}, nil
 }
 
 // NewOrbitDB creates a OrbitDB instance in memory and returns a reference.
@@ -56,3 +63,49 @@ func NewOrbitDB(ctx context.Context, dbPath, ipfsApiURL string) (iface.OrbitDB,
 
 	return berty.NewOrbitDB(ctx, coreAPI, options)
 }
+
+// InitializeEmbeddedOrbitDB initializes a new ODB instance on top of an IPFS node running inside this process,
+// instead of connecting to an IPFS daemon. The node listens for peers on swarmAddrs, if there are any.
+// The returned function shuts down both.
+func InitializeEmbeddedOrbitDB(ipfsRepoDirectory, orbitDbDirectory string, swarmAddrs []string) (context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	odb, node, err := NewEmbeddedOrbitDB(ctx, orbitDbDirectory, ipfsRepoDirectory, swarmAddrs)
+	if err != nil {
+		log.Print(err)
+		cancel()
+		return nil, err
+	}
+	Client = odb
+	return func() {
+		if err := odb.Close(); err != nil {
+			log.Printf("Error closing OrbitDB: %v", err)
+		}
+		if err := node.Close(); err != nil {
+			log.Printf("Error closing IPFS node: %v", err)
+		}
+		cancel()
+	}, nil
+}
+
+// NewEmbeddedOrbitDB creates a OrbitDB instance on top of an embedded IPFS node, which uses the repo in
+// ipfsRepoPath and listens on swarmAddrs, if there are any. The caller is responsible for closing the returned node.
+func NewEmbeddedOrbitDB(ctx context.Context, dbPath, ipfsRepoPath string, swarmAddrs []string) (iface.OrbitDB, *core.IpfsNode, error) {
+	coreAPI, node, err := createEmbeddedApi(ctx, ipfsRepoPath, swarmAddrs)
+
+	if err != nil {
+		log.Printf("Error creating embedded IPFS node: %v", err)
+		return nil, nil, err
+	}
+
+	options := &berty.NewOrbitDBOptions{
+		Directory: &dbPath,
+	}
+
+	odb, err := berty.NewOrbitDB(ctx, coreAPI, options)
+	if err != nil {
+		_ = node.Close()
+		return nil, nil, err
+	}
+
+	return odb, node, nil
+}
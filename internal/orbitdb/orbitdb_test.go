@@ -3,6 +3,7 @@ package orbitdb
 import (
 	"berty.tech/go-orbit-db/iface"
 	"context"
+	"github.com/ipfs/go-ipfs/core"
 	"testing"
 )
 
@@ -64,7 +65,11 @@ func TestOrbitDBInit(t *testing.T) {
 func TestDocStore(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	odb, _ := NewOrbitDB(ctx, t.TempDir(), IpfsApiURL)
+	odb, node, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+	}
+	defer closeNode(node, t)
 
 	Client = odb
 
@@ -193,6 +198,13 @@ func TestDocStore(t *testing.T) {
 	})
 }
 
+func closeNode(node *core.IpfsNode, t *testing.T) {
+	err := node.Close()
+	if err != nil {
+		t.Errorf("Error closing IPFS node: %s", err)
+	}
+}
+
 func closeDocs(docs iface.DocumentStore, t *testing.T) {
 	err := docs.Close()
 	if err != nil {
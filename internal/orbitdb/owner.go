@@ -0,0 +1,247 @@
+package orbitdb
+
+import (
+	logac "berty.tech/go-ipfs-log/accesscontroller"
+	"berty.tech/go-ipfs-log/identityprovider"
+	"berty.tech/go-orbit-db/accesscontroller"
+	"berty.tech/go-orbit-db/iface"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"go.uber.org/zap"
+)
+
+// OwnerAccessControllerType is the type of the access controller of the stores of a single user
+const OwnerAccessControllerType = "asteroid-owner"
+
+// ErrNotOwner is returned for documents which are not signed by the owner of their store
+var ErrNotOwner = errors.New("document is not signed by the owner of the store")
+
+// EntryVerifier checks that doc, written to the store of the user owner, is signed by one of their keys. The keys
+// start from registeredKey, the key the store was created for.
+type EntryVerifier func(owner, registeredKey string, doc Document) error
+
+// OwnerStore is the store of a single user. Documents are verified before they are written, so a write the
+// access controller of the store would reject fails right away. Documents cannot be deleted, the owner replaces
+// them with a signed tombstone instead.
+type OwnerStore struct {
+	Store
+	Owner string
+	// Key is the registered key of the owner, see EntryVerifier
+	Key    string
+	Verify EntryVerifier
+}
+
+// Create verifies the document, then creates it in the store
+func (s OwnerStore) Create(item interface{}, options *DatabaseCreateOptions) (map[string]interface{}, error) {
+	// the verifier sees the key of the document
+	if options == nil {
+		options = &DatabaseCreateOptions{ID: uuid.Generate().String()}
+	}
+
+	if err := s.check(options.ID, item); err != nil {
+		return nil, err
+	}
+
+	return s.Store.Create(item, options)
+}
+
+// Update verifies the document, then replaces it in the store
+func (s OwnerStore) Update(key string, item interface{}) (map[string]interface{}, error) {
+	if err := s.check(key, item); err != nil {
+		return nil, err
+	}
+
+	return s.Store.Update(key, item)
+}
+
+// Delete is refused, since a deletion cannot be signed by the owner
+func (s OwnerStore) Delete(key string) error {
+	return fmt.Errorf("%w: documents of %s are replaced by a tombstone, not deleted", ErrNotOwner, s.Owner)
+}
+
+// check verifies item as it is stored under key
+func (s OwnerStore) check(key string, item interface{}) error {
+	if s.Verify == nil {
+		return fmt.Errorf("%w: the store of %s has no verifier", ErrNotOwner, s.Owner)
+	}
+
+	data, err := MarshalItem(item)
+	if err != nil {
+		return err
+	}
+
+	doc, err := decodeDocument(map[string]interface{}{"_id": key, "data": data})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotOwner, err)
+	}
+
+	if err := s.Verify(s.Owner, s.Key, doc); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotOwner, err)
+	}
+
+	return nil
+}
+
+// ownerAccessController accepts the entries of the store of a user which are signed by them, see EntryVerifier.
+// It runs for local writes as well as for entries replicated from other peers. Deletions carry no signature and
+// are rejected, so no peer can drop the documents of a user.
+type ownerAccessController struct {
+	owner  string
+	key    string
+	verify EntryVerifier
+	// hold keeps the rejected documents for a later retry, it may be nil
+	hold   func(owner string, doc Document)
+	logger *zap.Logger
+}
+
+// ownerAccessControllerConstructor returns the constructor OrbitDB creates and loads the access controllers of
+// the type OwnerAccessControllerType with. The owner and their key are read from the manifest, see ownerManifest.
+// Documents verify rejects are passed to hold.
+func ownerAccessControllerConstructor(verify EntryVerifier, hold func(owner string, doc Document)) iface.AccessControllerConstructor {
+	return func(ctx context.Context, db iface.BaseOrbitDB, params accesscontroller.ManifestParams, options ...accesscontroller.Option) (accesscontroller.Interface, error) {
+		ac := &ownerAccessController{
+			verify: verify,
+			hold:   hold,
+			logger: zap.NewNop(),
+		}
+
+		// OrbitDB creates a controller without parameters when the type is registered
+		if params != nil {
+			if owners := params.GetAccess("owner"); len(owners) > 0 {
+				ac.owner = owners[0]
+			}
+			if keys := params.GetAccess("key"); len(keys) > 0 {
+				ac.key = keys[0]
+			}
+		}
+
+		for _, o := range options {
+			o(ac)
+		}
+
+		return ac, nil
+	}
+}
+
+// ownerManifest returns the manifest of the access controller of the store of owner, who registered with key.
+// Every peer derives the same manifest, and so the same store address, from the owner and their key. Since the
+// address depends on the manifest, peers cannot change the key the signatures of the store are checked against.
+func ownerManifest(owner, key string) accesscontroller.ManifestParams {
+	return accesscontroller.NewSimpleManifestParams(OwnerAccessControllerType, map[string][]string{
+		"owner": {owner},
+		"key":   {key},
+	})
+}
+
+// ownerOperation is the payload of an entry of a document store
+type ownerOperation struct {
+	Op    string  `json:"op"`
+	Key   *string `json:"key"`
+	Value []byte  `json:"value"`
+	Docs  []struct {
+		Key   string `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"docs"`
+}
+
+// CanAppend checks that the documents written by entry are signed by the owner
+func (a *ownerAccessController) CanAppend(entry logac.LogEntry, _ identityprovider.Interface, _ logac.CanAppendAdditionalContext) error {
+	if a.owner == "" || a.key == "" || a.verify == nil {
+		return fmt.Errorf("%w: the store has no owner", ErrNotOwner)
+	}
+
+	var op ownerOperation
+	if err := json.Unmarshal(entry.GetPayload(), &op); err != nil {
+		return fmt.Errorf("%w: invalid entry: %v", ErrNotOwner, err)
+	}
+
+	switch op.Op {
+	case OpDelete:
+		return fmt.Errorf("%w: documents cannot be deleted", ErrNotOwner)
+	case OpPut:
+		return a.canPut(op.Value)
+	case "PUTALL":
+		for _, doc := range op.Docs {
+			if err := a.canPut(doc.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported operation %s", ErrNotOwner, op.Op)
+	}
+}
+
+// canPut verifies a written {_id, data} document
+func (a *ownerAccessController) canPut(value []byte) error {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(value, &raw); err != nil {
+		return fmt.Errorf("%w: invalid document: %v", ErrNotOwner, err)
+	}
+
+	doc, err := decodeDocument(raw)
+	if err != nil {
+		return fmt.Errorf("%w: invalid document: %v", ErrNotOwner, err)
+	}
+
+	if err := a.verify(a.owner, a.key, doc); err != nil {
+		a.logger.Warn("rejected document", zap.String("owner", a.owner), zap.String("id", doc.ID), zap.Error(err))
+		if a.hold != nil {
+			a.hold(a.owner, doc)
+		}
+		return fmt.Errorf("%w: %v", ErrNotOwner, err)
+	}
+
+	return nil
+}
+
+// Type returns OwnerAccessControllerType
+func (a *ownerAccessController) Type() string {
+	return OwnerAccessControllerType
+}
+
+// GetAuthorizedByRole returns the owner, who is the only one allowed to write
+func (a *ownerAccessController) GetAuthorizedByRole(role string) ([]string, error) {
+	if role == "owner" || role == "write" {
+		return []string{a.owner}, nil
+	}
+	return []string{}, nil
+}
+
+// Grant is not supported, the owner of a store cannot change
+func (a *ownerAccessController) Grant(ctx context.Context, capability string, keyID string) error {
+	return fmt.Errorf("the owner of a store cannot be changed")
+}
+
+// Revoke is not supported, the owner of a store cannot change
+func (a *ownerAccessController) Revoke(ctx context.Context, capability string, keyID string) error {
+	return fmt.Errorf("the owner of a store cannot be changed")
+}
+
+// Load does nothing, the owner is part of the manifest
+func (a *ownerAccessController) Load(ctx context.Context, address string) error {
+	return nil
+}
+
+// Save returns the manifest of the controller
+func (a *ownerAccessController) Save(ctx context.Context) (accesscontroller.ManifestParams, error) {
+	return ownerManifest(a.owner, a.key), nil
+}
+
+// Close does nothing
+func (a *ownerAccessController) Close() error {
+	return nil
+}
+
+// SetLogger sets the logger of rejected documents
+func (a *ownerAccessController) SetLogger(logger *zap.Logger) {
+	a.logger = logger
+}
+
+// Logger returns the logger of rejected documents
+func (a *ownerAccessController) Logger() *zap.Logger {
+	return a.logger
+}
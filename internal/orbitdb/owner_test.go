@@ -0,0 +1,161 @@
+package orbitdb
+
+import (
+	"berty.tech/go-ipfs-log/identityprovider"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"testing"
+)
+
+// testEntry is an oplog entry with a payload
+type testEntry struct {
+	payload []byte
+}
+
+func (e testEntry) GetPayload() []byte {
+	return e.payload
+}
+
+func (e testEntry) GetIdentity() *identityprovider.Identity {
+	return &identityprovider.Identity{ID: "peer"}
+}
+
+// testVerifier accepts the documents of the owner with the registered key "<owner>-key" signed as "by <owner>"
+func testVerifier(owner, registeredKey string, doc Document) error {
+	if doc.Data["signedBy"] != owner || registeredKey != owner+"-key" {
+		return fmt.Errorf("%s is not signed by %s", doc.ID, owner)
+	}
+	return nil
+}
+
+// testKey returns the registered key "<owner>-key" of testVerifier
+func testKey(owner string) (string, error) {
+	return owner + "-key", nil
+}
+
+// testPayload returns the payload of an entry writing the document under key
+func testPayload(t *testing.T, op, key string, doc map[string]interface{}) []byte {
+	var value []byte
+	if doc != nil {
+		data, err := MarshalItem(doc)
+		if err != nil {
+			t.Fatalf("error marshalling document: %s", err)
+		}
+		value, _ = json.Marshal(map[string]interface{}{"_id": key, "data": data})
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"op": op, "key": key, "value": value})
+	return payload
+}
+
+func TestOwnerStore(t *testing.T) {
+	store := OwnerStore{Store: NewMemoryStore(), Owner: "alice", Key: "alice-key", Verify: testVerifier}
+
+	t.Run("should write documents of the owner", func(t *testing.T) {
+		entry, err := store.Create(map[string]interface{}{"signedBy": "alice"}, nil)
+		if err != nil {
+			t.Fatalf("error creating document: %s", err)
+		}
+
+		key := entry["_id"].(string)
+		if _, err := store.Update(key, map[string]interface{}{"signedBy": "alice", "count": 2}); err != nil {
+			t.Errorf("error updating document: %s", err)
+		}
+	})
+
+	t.Run("should refuse to delete documents", func(t *testing.T) {
+		entry, _ := store.Create(map[string]interface{}{"signedBy": "alice"}, nil)
+
+		key := entry["_id"].(string)
+		if err := store.Delete(key); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+		if _, err := store.Read(key); err != nil {
+			t.Errorf("expected the document to be kept: %s", err)
+		}
+	})
+
+	t.Run("should reject documents of others", func(t *testing.T) {
+		_, err := store.Create(map[string]interface{}{"signedBy": "mallory"}, &DatabaseCreateOptions{ID: "key"})
+		if !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+		if _, err := store.Read("key"); err == nil {
+			t.Errorf("expected the document not to be written")
+		}
+	})
+
+	t.Run("should reject documents without a verifier", func(t *testing.T) {
+		unverified := OwnerStore{Store: NewMemoryStore(), Owner: "alice", Key: "alice-key"}
+		if _, err := unverified.Create(map[string]interface{}{"signedBy": "alice"}, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+	})
+}
+
+func TestOwnerAccessController(t *testing.T) {
+	ac := &ownerAccessController{owner: "alice", key: "alice-key", verify: testVerifier, logger: zap.NewNop()}
+
+	t.Run("should accept entries of the owner", func(t *testing.T) {
+		payload := testPayload(t, OpPut, "key", map[string]interface{}{"signedBy": "alice"})
+		if err := ac.CanAppend(testEntry{payload}, nil, nil); err != nil {
+			t.Errorf("expected the entry to be accepted: %s", err)
+		}
+	})
+
+	t.Run("should reject forged entries", func(t *testing.T) {
+		payload := testPayload(t, OpPut, "key", map[string]interface{}{"signedBy": "mallory"})
+		if err := ac.CanAppend(testEntry{payload}, nil, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+
+		garbage := []byte(`{"op":"PUT","value":"` + base64.StdEncoding.EncodeToString([]byte("{")) + `"}`)
+		if err := ac.CanAppend(testEntry{garbage}, nil, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+	})
+
+	t.Run("should reject deletions", func(t *testing.T) {
+		if err := ac.CanAppend(testEntry{testPayload(t, OpDelete, "key", nil)}, nil, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+	})
+
+	t.Run("should read the owner from the manifest", func(t *testing.T) {
+		created, err := ownerAccessControllerConstructor(testVerifier, nil)(context.Background(), nil, nil)
+		if err != nil || created.Type() != OwnerAccessControllerType {
+			t.Fatalf("expected an access controller of type %s, got %v, %v", OwnerAccessControllerType, created, err)
+		}
+
+		// OrbitDB creates a controller without an owner when the type is registered
+		payload := testPayload(t, OpPut, "key", map[string]interface{}{"signedBy": ""})
+		if err := created.CanAppend(testEntry{payload}, nil, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+
+		created, _ = ownerAccessControllerConstructor(testVerifier, nil)(context.Background(), nil, ownerManifest("alice", "alice-key"))
+		payload = testPayload(t, OpPut, "key", map[string]interface{}{"signedBy": "alice"})
+		if err := created.CanAppend(testEntry{payload}, nil, nil); err != nil {
+			t.Errorf("expected the entry to be accepted: %s", err)
+		}
+
+		// another key gives another manifest, and so another store
+		var held []string
+		hold := func(owner string, doc Document) {
+			held = append(held, owner+"/"+doc.ID)
+		}
+		forged, _ := ownerAccessControllerConstructor(testVerifier, hold)(context.Background(), nil, ownerManifest("alice", "mallory-key"))
+		if err := forged.CanAppend(testEntry{payload}, nil, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+
+		// rejected documents are held for a retry
+		if len(held) != 1 || held[0] != "alice/key" {
+			t.Errorf("expected the rejected document to be held, got %v", held)
+		}
+	})
+}
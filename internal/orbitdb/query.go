@@ -0,0 +1,159 @@
+package orbitdb
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLimit is the page size used when a Query has no limit
+const DefaultLimit = 20
+
+// MaxLimit is the largest page size a Query can request
+const MaxLimit = 100
+
+// ErrInvalidCursor is returned for cursors which were not created by Paginate
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query describes a page of documents, ordered by their "createdAt" field
+type Query struct {
+	// Limit is the maximum number of documents of the page. 0 uses DefaultLimit, a negative limit
+	// returns all remaining documents.
+	Limit int
+	// Cursor continues after the last document of a previous page. Empty starts at the first document.
+	Cursor string
+	// Filter is called with the decoded data of every document. Documents are skipped if it returns false.
+	Filter func(data map[string]interface{}) bool
+}
+
+// Document is a decoded entry of a store
+type Document struct {
+	ID        string
+	CreatedAt int64
+	Data      map[string]interface{}
+}
+
+// Page is the result of a Query
+type Page struct {
+	Documents []Document
+	// Next is the cursor of the following page. It is empty on the last page.
+	Next string
+}
+
+// Paginate runs a query against a store. Documents are sorted by "createdAt", ties are ordered by their ID.
+func Paginate(store Store, query Query) (Page, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	var after *Document
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		after = &c
+	}
+
+	docs := make([]Document, 0)
+	for _, raw := range store.ReadAll() {
+		doc, err := decodeDocument(raw)
+		if err != nil {
+			continue
+		}
+
+		if query.Filter != nil && !query.Filter(doc.Data) {
+			continue
+		}
+
+		if after != nil && !less(*after, doc) {
+			continue
+		}
+
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(a, b int) bool {
+		return less(docs[a], docs[b])
+	})
+
+	// last page
+	if limit < 0 || len(docs) <= limit {
+		return Page{Documents: docs}, nil
+	}
+
+	docs = docs[:limit]
+	return Page{
+		Documents: docs,
+		Next:      encodeCursor(docs[len(docs)-1]),
+	}, nil
+}
+
+// less orders documents by creation time and ID
+func less(a, b Document) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+// decodeDocument decodes a raw {_id, data} entry of a store
+func decodeDocument(raw interface{}) (Document, error) {
+	entry, ok := raw.(map[string]interface{})
+	if !ok {
+		return Document{}, fmt.Errorf("unexpected entry %v", raw)
+	}
+
+	id, _ := entry["_id"].(string)
+	data, _ := entry["data"].(string)
+
+	item, err := UnmarshalItem(data)
+	if err != nil {
+		return Document{}, err
+	}
+
+	fields, ok := item.(map[string]interface{})
+	if !ok {
+		return Document{}, fmt.Errorf("unexpected document %v", item)
+	}
+
+	createdAt, _ := fields["createdAt"].(float64)
+
+	return Document{
+		ID:        id,
+		CreatedAt: int64(createdAt),
+		Data:      fields,
+	}, nil
+}
+
+// encodeCursor encodes the position of a document as an opaque cursor
+func encodeCursor(doc Document) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(doc.CreatedAt, 10) + ":" + doc.ID))
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(cursor string) (Document, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Document{}, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return Document{}, ErrInvalidCursor
+	}
+
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Document{}, ErrInvalidCursor
+	}
+
+	return Document{ID: parts[1], CreatedAt: createdAt}, nil
+}
@@ -0,0 +1,91 @@
+package orbitdb
+
+import (
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	db := NewMemoryStore()
+
+	// created out of order, with one tie
+	for _, item := range []map[string]interface{}{
+		{"owner": "a", "createdAt": 3},
+		{"owner": "a", "createdAt": 1},
+		{"owner": "b", "createdAt": 2},
+		{"owner": "a", "createdAt": 2},
+		{"owner": "a", "createdAt": 2},
+	} {
+		if _, err := db.Create(item, nil); err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+	}
+
+	ownerA := func(data map[string]interface{}) bool {
+		return data["owner"] == "a"
+	}
+
+	t.Run("should return filtered documents ordered by createdAt", func(t *testing.T) {
+		page, err := Paginate(db, Query{Limit: -1, Filter: ownerA})
+		if err != nil {
+			t.Fatalf("error paginating: %s", err)
+		}
+
+		if len(page.Documents) != 4 {
+			t.Fatalf("expected 4 documents, got %d", len(page.Documents))
+		}
+
+		for i := 1; i < len(page.Documents); i++ {
+			if page.Documents[i-1].CreatedAt > page.Documents[i].CreatedAt {
+				t.Errorf("expected documents to be ordered by createdAt")
+			}
+		}
+
+		if page.Next != "" {
+			t.Errorf("expected no next cursor on the last page")
+		}
+	})
+
+	t.Run("should visit every document once across pages", func(t *testing.T) {
+		seen := make(map[string]bool)
+		cursor := ""
+
+		for pages := 0; pages < 10; pages++ {
+			page, err := Paginate(db, Query{Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatalf("error paginating: %s", err)
+			}
+
+			for _, doc := range page.Documents {
+				if seen[doc.ID] {
+					t.Errorf("document %s returned twice", doc.ID)
+				}
+				seen[doc.ID] = true
+			}
+
+			if page.Next == "" {
+				break
+			}
+			cursor = page.Next
+		}
+
+		if len(seen) != 5 {
+			t.Errorf("expected 5 documents, got %d", len(seen))
+		}
+	})
+
+	t.Run("should use the default limit and reject invalid cursors", func(t *testing.T) {
+		page, err := Paginate(db, Query{})
+		if err != nil {
+			t.Fatalf("error paginating: %s", err)
+		}
+
+		if len(page.Documents) != 5 {
+			t.Errorf("expected 5 documents, got %d", len(page.Documents))
+		}
+
+		_, err = Paginate(db, Query{Cursor: "not a cursor"})
+		if err != ErrInvalidCursor {
+			t.Errorf("expected %v, got %v", ErrInvalidCursor, err)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package orbitdb
+
+import (
+	"berty.tech/go-orbit-db/accesscontroller"
+	"berty.tech/go-orbit-db/iface"
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// documentStoreType is the OrbitDB store type of the databases
+const documentStoreType = "docstore"
+
+// sharedAddressesStore is the database of this node recording the address each shared database was opened with
+const sharedAddressesStore = "shared-addresses"
+
+// Registry holds the databases of the process. Each database is opened and loaded once, then shared by all
+// requests until it is closed, e.g. by CloseDatabases on shutdown. A closed database is opened again on next use.
+type Registry struct {
+	ctx       context.Context
+	client    iface.OrbitDB
+	mu        sync.Mutex
+	databases map[string]*Database
+	// writers are the identities of the other nodes which may write to the shared databases and addresses the
+	// databases of other nodes to open, see Replicate
+	writers   []string
+	addresses []string
+}
+
+// NewRegistry creates a registry which opens databases of Client with ctx
+func NewRegistry(ctx context.Context) *Registry {
+	return NewClientRegistry(ctx, Client)
+}
+
+// NewClientRegistry creates a registry which opens databases of client with ctx, e.g. for a second node
+func NewClientRegistry(ctx context.Context, client iface.OrbitDB) *Registry {
+	return &Registry{
+		ctx:       ctx,
+		client:    client,
+		databases: make(map[string]*Database),
+	}
+}
+
+// Client returns the OrbitDB instance of the registry
+func (r *Registry) Client() iface.OrbitDB {
+	return r.client
+}
+
+// Open returns the database with the given name, opening it on first use. Only this node can write to it,
+// unless it was opened by its address, see Replicate.
+func (r *Registry) Open(name string) (*Database, error) {
+	return r.open(name, func() (*Database, error) {
+		return openDatabase(r.ctx, r.client, name, nil)
+	})
+}
+
+// OpenShared returns the database with the given name this node and the writers of Replicate can write to,
+// opening it on first use. Nodes with the same writers open the same database. Since the writers are part of its
+// address, a database opened with other writers before is moved into it, see migrateShared.
+func (r *Registry) OpenShared(name string) (*Database, error) {
+	if db, ok := r.lookup(name); ok {
+		return db, nil
+	}
+
+	options := r.sharedOptions()
+	db, err := r.open(name, func() (*Database, error) {
+		return openDatabase(r.ctx, r.client, name, options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.migrateShared(name, db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateShared moves the documents of the database the shared database name was last opened as, if it had
+// another address, into db and records the address of db
+func (r *Registry) migrateShared(name string, db *Database) error {
+	addresses, err := r.Open(sharedAddressesStore)
+	if err != nil {
+		return err
+	}
+
+	current := db.Address.String()
+	previous := ""
+	if raw, err := addresses.Read(name); err == nil {
+		if recorded, err := decodeDocument(raw); err == nil {
+			previous, _ = recorded.Data["address"].(string)
+		}
+	}
+
+	if previous == current {
+		return nil
+	}
+
+	if previous != "" {
+		old, err := openDatabase(r.ctx, r.client, previous, nil)
+		if err != nil {
+			return err
+		}
+
+		moved, err := Move(old, db, nil)
+		if closeErr := old.Close(); closeErr != nil {
+			log.Printf("Could not close %s: %v", previous, closeErr)
+		}
+		if err != nil {
+			log.Println("Failed to move the documents of the previous writers")
+			return err
+		}
+		log.Printf("Moved %d documents of %s from %s", moved, name, previous)
+	}
+
+	_, err = addresses.Create(map[string]interface{}{"address": current}, &DatabaseCreateOptions{ID: name})
+	return err
+}
+
+// OpenOwned returns the database with the given name only the user owner, who registered with key, can write to,
+// opening it on first use
+func (r *Registry) OpenOwned(name, owner, key string) (*Database, error) {
+	return r.open(name, func() (*Database, error) {
+		return openDatabase(r.ctx, r.client, name, &iface.CreateDBOptions{AccessController: ownerManifest(owner, key)})
+	})
+}
+
+// AddressOwned returns the address of the database OpenOwned opens with the given name, without opening it
+func (r *Registry) AddressOwned(name, owner, key string) (string, error) {
+	if db, ok := r.lookup(name); ok {
+		return db.Address.String(), nil
+	}
+
+	onlyHash := true
+	address, err := r.client.DetermineAddress(r.ctx, name, documentStoreType, &iface.DetermineAddressOptions{
+		OnlyHash:         &onlyHash,
+		AccessController: ownerManifest(owner, key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return address.String(), nil
+}
+
+// lookup returns the open database with the given name
+func (r *Registry) lookup(name string) (*Database, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	db, ok := r.databases[name]
+	if !ok || db.closed() {
+		return nil, false
+	}
+	return db, true
+}
+
+// sharedOptions returns the options of the shared databases. Without writers, they are the defaults, so the
+// databases keep the addresses of a single node.
+func (r *Registry) sharedOptions() *iface.CreateDBOptions {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.writers) == 0 {
+		return nil
+	}
+
+	// every node derives the same manifest from the same writers
+	writers := map[string]bool{r.client.Identity().ID: true}
+	for _, id := range r.writers {
+		writers[id] = true
+	}
+
+	write := make([]string, 0, len(writers))
+	for id := range writers {
+		write = append(write, id)
+	}
+	sort.Strings(write)
+
+	return &iface.CreateDBOptions{
+		AccessController: accesscontroller.NewSimpleManifestParams("ipfs", map[string][]string{
+			"write": write,
+		}),
+	}
+}
+
+// open returns the database with the given name, opening it with openDB on first use
+func (r *Registry) open(name string, openDB func() (*Database, error)) (*Database, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if db, ok := r.databases[name]; ok {
+		if !db.closed() {
+			return db, nil
+		}
+
+		// the address keeps the access controller and the replicated address the database was opened with
+		address := db.Address.String()
+		openDB = func() (*Database, error) {
+			return openDatabase(r.ctx, r.client, address, nil)
+		}
+		delete(r.databases, name)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	r.databases[name] = db
+	return db, nil
+}
+
+// Databases returns the open databases of the registry, ordered by name
+func (r *Registry) Databases() []*Database {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	databases := make([]*Database, 0, len(r.databases))
+	for _, db := range r.databases {
+		if !db.closed() {
+			databases = append(databases, db)
+		}
+	}
+
+	sort.Slice(databases, func(a, b int) bool {
+		return databases[a].Name < databases[b].Name
+	})
+
+	return databases
+}
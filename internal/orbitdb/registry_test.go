@@ -0,0 +1,130 @@
+package orbitdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	cancelFunc, err := InitializeEmbeddedOrbitDB(t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Error initializing OrbitDB: %v", err)
+	}
+	defer cancelFunc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := NewRegistry(ctx)
+	defer func() {
+		if err := CloseDatabases(); err != nil {
+			t.Errorf("error closing databases: %s", err)
+		}
+	}()
+
+	t.Run("should open a database only once", func(t *testing.T) {
+		first, err := registry.Open("registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		second, err := registry.Open("registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		if first != second {
+			t.Errorf("expected the same database to be returned")
+		}
+	})
+
+	t.Run("should read writes without reloading", func(t *testing.T) {
+		db, err := registry.Open("registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		created, err := db.Create(map[string]interface{}{"Hi": "mom"}, nil)
+		if err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+
+		_, err = db.Read(created["_id"].(string))
+		if err != nil {
+			t.Errorf("error reading item: %s", err)
+		}
+	})
+
+	t.Run("should list the databases by name", func(t *testing.T) {
+		_, err := registry.Open("another-registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		databases := registry.Databases()
+		if len(databases) != 2 || databases[0].Name != "another-registry-test" {
+			t.Errorf("unexpected databases %v", databases)
+		}
+
+		status := databases[0].Replication()
+		if status.Name != "another-registry-test" || status.Address == "" {
+			t.Errorf("unexpected replication status %+v", status)
+		}
+	})
+
+	t.Run("should open a closed database again", func(t *testing.T) {
+		closed, err := registry.Open("closed-registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+		if err := closed.Close(); err != nil {
+			t.Fatalf("error closing database: %s", err)
+		}
+
+		for _, db := range registry.Databases() {
+			if db == closed {
+				t.Errorf("expected the closed database not to be listed")
+			}
+		}
+
+		reopened, err := registry.Open("closed-registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		if reopened == closed || !reopened.Address.Equals(closed.Address) {
+			t.Errorf("expected the database to be opened again at %s", closed.Address)
+		}
+	})
+
+	t.Run("should move shared databases to the address of new writers", func(t *testing.T) {
+		single, err := registry.OpenShared("shared-registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+		if _, err := single.Create(map[string]interface{}{"Hi": "mom"}, &DatabaseCreateOptions{ID: "kept"}); err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+		for _, db := range registry.Databases() {
+			_ = db.Close()
+		}
+
+		// the node restarts with another writer
+		restarted := NewRegistry(ctx)
+		if err := restarted.Replicate(ReplicationConfig{Writers: []string{"another-node"}}); err != nil {
+			t.Fatalf("error setting up the replication: %s", err)
+		}
+
+		shared, err := restarted.OpenShared("shared-registry-test")
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+		if shared.Address.Equals(single.Address) {
+			t.Fatalf("expected another address for other writers, got %s", shared.Address)
+		}
+
+		if _, err := shared.Read("kept"); err != nil {
+			t.Errorf("expected the documents to be moved: %s", err)
+		}
+	})
+}
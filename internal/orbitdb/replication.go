@@ -0,0 +1,276 @@
+package orbitdb
+
+import (
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-orbit-db/address"
+	"berty.tech/go-orbit-db/stores"
+	"berty.tech/go-orbit-db/stores/operation"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReplicationConfig tells a node which other nodes to replicate
+type ReplicationConfig struct {
+	// Peers are the multiaddrs of the peers to connect, ending with /p2p/<peer id>
+	Peers []string
+	// Addresses are the addresses of the databases to open. A database is used instead of the database of this
+	// node with the same name.
+	Addresses []string
+	// Writers are the OrbitDB identities of the other nodes which may write to the shared databases
+	Writers []string
+}
+
+// NodeStatus describes the peers and the replicated databases of a node
+type NodeStatus struct {
+	// PeerID is the id of the IPFS node
+	PeerID string `json:"peerId"`
+	// Identity is the OrbitDB identity of the node, which other nodes add to their writers
+	Identity string `json:"identity"`
+	// Addresses are the multiaddrs other nodes connect to
+	Addresses []string `json:"addresses"`
+	// Peers are the ids of the connected peers
+	Peers     []string            `json:"peers"`
+	Databases []ReplicationStatus `json:"stores"`
+}
+
+// ReplicationStatus describes the entries a database received from other peers
+type ReplicationStatus struct {
+	Name            string    `json:"name"`
+	Address         string    `json:"address"`
+	Replications    int       `json:"replications"`
+	LogLength       int       `json:"logLength"`
+	LastReplication time.Time `json:"lastReplication"`
+}
+
+// replication tracks the write and replication events of a database
+type replication struct {
+	mu     sync.Mutex
+	status ReplicationStatus
+	sub    event.Subscription
+	events broadcaster
+}
+
+// watchReplication follows the write and replication events of the store of db. OrbitDB updates the document
+// index when entries are replicated, so reads see them without reloading the store.
+func watchReplication(db *Database) error {
+	store := *db.Store
+
+	sub, err := store.EventBus().Subscribe([]interface{}{
+		new(stores.EventWrite),
+		new(stores.EventReplicated),
+	})
+	if err != nil {
+		log.Printf("Could not subscribe to replication events: %v", err)
+		return err
+	}
+
+	r := &replication{
+		sub: sub,
+		status: ReplicationStatus{
+			Name:    db.Name,
+			Address: db.Address.String(),
+		},
+	}
+	db.replication = r
+
+	go func() {
+		for e := range sub.Out() {
+			switch evt := e.(type) {
+			case stores.EventWrite:
+				r.publish(evt.Entry)
+			case stores.EventReplicated:
+				r.mu.Lock()
+				r.status.Replications++
+				r.status.LogLength = evt.LogLength
+				r.status.LastReplication = time.Now().UTC()
+				r.mu.Unlock()
+
+				log.Printf("Replicated %d entries into %s", len(evt.Entries), db.Name)
+
+				for _, entry := range evt.Entries {
+					r.publish(entry)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// publish sends the documents changed by an oplog entry to the watchers
+func (r *replication) publish(entry ipfslog.Entry) {
+	op, err := operation.ParseOperation(entry)
+	if err != nil {
+		log.Printf("Could not parse operation: %v", err)
+		return
+	}
+
+	switch op.GetOperation() {
+	case OpDelete:
+		if op.GetKey() != nil {
+			r.events.publish(Event{Op: OpDelete, Key: *op.GetKey()})
+		}
+	case OpPut:
+		r.publishPut(op.GetValue())
+	case "PUTALL":
+		for _, value := range op.GetDocs() {
+			r.publishPut(value)
+		}
+	}
+}
+
+// publishPut sends a written {_id, data} document to the watchers
+func (r *replication) publishPut(value []byte) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(value, &raw); err != nil {
+		log.Printf("Could not unmarshal document: %v", err)
+		return
+	}
+
+	doc, err := decodeDocument(raw)
+	if err != nil {
+		log.Printf("Could not decode document: %v", err)
+		return
+	}
+
+	r.events.publish(Event{Op: OpPut, Key: doc.ID, Document: &doc})
+}
+
+// Replication returns the replication status of the database
+func (d Database) Replication() ReplicationStatus {
+	if d.replication == nil {
+		return ReplicationStatus{Name: d.Name}
+	}
+
+	d.replication.mu.Lock()
+	defer d.replication.mu.Unlock()
+	return d.replication.status
+}
+
+// Watch returns a channel receiving the following local and replicated changes of the database
+func (d Database) Watch() (<-chan Event, func()) {
+	return d.replication.events.watch()
+}
+
+// close stops following the replication events
+func (r *replication) close() error {
+	if r == nil {
+		return nil
+	}
+	r.events.close()
+	return r.sub.Close()
+}
+
+// Replicate connects the peers of cfg and keeps its addresses and writers for OpenStores. It has to be called
+// before the stores are opened. Peers which cannot be reached are skipped, they connect to this node once they
+// start.
+func (r *Registry) Replicate(cfg ReplicationConfig) error {
+	for _, addr := range cfg.Addresses {
+		if _, err := address.Parse(addr); err != nil {
+			return fmt.Errorf("invalid store address %s: %v", addr, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.writers = cfg.Writers
+	r.addresses = cfg.Addresses
+	r.mu.Unlock()
+
+	for _, addr := range cfg.Peers {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return fmt.Errorf("invalid peer %s: %v", addr, err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.ctx, timeout)
+		err = r.client.IPFS().Swarm().Connect(ctx, *info)
+		cancel()
+		if err != nil {
+			log.Printf("Could not connect to peer %s: %v", addr, err)
+			continue
+		}
+		log.Printf("Connected to peer %s", info.ID)
+	}
+
+	return nil
+}
+
+// openReplicated opens the databases of the addresses of Replicate. Later opens of their names return them.
+func (r *Registry) openReplicated() error {
+	r.mu.Lock()
+	addresses := r.addresses
+	r.mu.Unlock()
+
+	for _, addr := range addresses {
+		parsed, err := address.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid store address %s: %v", addr, err)
+		}
+
+		db, err := r.open(parsed.GetPath(), func() (*Database, error) {
+			return openDatabase(r.ctx, r.client, addr, nil)
+		})
+		if err != nil {
+			return err
+		}
+		if !db.Address.Equals(parsed) {
+			return fmt.Errorf("store %s was opened before %s", db.Address, addr)
+		}
+		log.Printf("Replicating %s", addr)
+	}
+
+	return nil
+}
+
+// Status returns the identity, the connected peers and the replication status of the databases of the node.
+// Without a registry, e.g. for stores kept in memory, nothing is replicated.
+func (r *Registry) Status(ctx context.Context) (NodeStatus, error) {
+	status := NodeStatus{
+		Addresses: []string{},
+		Peers:     []string{},
+		Databases: []ReplicationStatus{},
+	}
+	if r == nil {
+		return status, nil
+	}
+
+	status.Identity = r.client.Identity().ID
+
+	ipfs := r.client.IPFS()
+	self, err := ipfs.Key().Self(ctx)
+	if err != nil {
+		log.Printf("Could not read the peer id: %v", err)
+		return status, err
+	}
+	status.PeerID = self.ID().String()
+
+	addrs, err := ipfs.Swarm().LocalAddrs(ctx)
+	if err != nil {
+		log.Printf("Could not read the listen addresses: %v", err)
+		return status, err
+	}
+	for _, addr := range addrs {
+		status.Addresses = append(status.Addresses, fmt.Sprintf("%s/p2p/%s", addr, status.PeerID))
+	}
+
+	conns, err := ipfs.Swarm().Peers(ctx)
+	if err != nil {
+		log.Printf("Could not read the peers: %v", err)
+		return status, err
+	}
+	for _, conn := range conns {
+		status.Peers = append(status.Peers, conn.ID().String())
+	}
+
+	for _, db := range r.Databases() {
+		status.Databases = append(status.Databases, db.Replication())
+	}
+
+	return status, nil
+}
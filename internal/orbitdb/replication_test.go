@@ -0,0 +1,174 @@
+package orbitdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// eventually waits until found returns true
+func eventually(t *testing.T, what string, found func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !found() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not replicated", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the identities of both nodes have to be known before their shared stores are opened
+	first, firstNode, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), []string{"/ip4/127.0.0.1/tcp/0"})
+	if err != nil {
+		t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+	}
+	second, secondNode, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), []string{"/ip4/127.0.0.1/tcp/0"})
+	if err != nil {
+		t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+	}
+	defer closeNode(firstNode, t)
+	defer closeNode(secondNode, t)
+	defer func() {
+		if err := CloseDatabases(); err != nil {
+			t.Errorf("error closing databases: %s", err)
+		}
+	}()
+
+	a := NewClientRegistry(ctx, first)
+	b := NewClientRegistry(ctx, second)
+
+	status, err := a.Status(ctx)
+	if err != nil || len(status.Addresses) == 0 {
+		t.Fatalf("expected the listen addresses of the first node, got %+v, %v", status, err)
+	}
+
+	if err := a.Replicate(ReplicationConfig{Writers: []string{second.Identity().ID}}); err != nil {
+		t.Fatalf("error setting up the replication: %s", err)
+	}
+	err = b.Replicate(ReplicationConfig{Peers: status.Addresses, Writers: []string{first.Identity().ID}})
+	if err != nil {
+		t.Fatalf("error setting up the replication: %s", err)
+	}
+
+	storesA, err := OpenStores(a)
+	if err != nil {
+		t.Fatalf("error opening the stores: %s", err)
+	}
+	storesB, err := OpenStores(b)
+	if err != nil {
+		t.Fatalf("error opening the stores: %s", err)
+	}
+	storesA.UserNotes.Verify, storesA.UserNotes.Key = testVerifier, testKey
+	storesB.UserNotes.Verify, storesB.UserNotes.Key = testVerifier, testKey
+
+	t.Run("should connect the peers", func(t *testing.T) {
+		status, err := b.Status(ctx)
+		if err != nil || len(status.Peers) != 1 {
+			t.Errorf("expected one connected peer, got %+v, %v", status, err)
+		}
+	})
+
+	t.Run("should share the users store", func(t *testing.T) {
+		usersA, usersB := storesA.Users.(*Database), storesB.Users.(*Database)
+		if !usersA.Address.Equals(usersB.Address) {
+			t.Fatalf("expected the same users store, got %s and %s", usersA.Address, usersB.Address)
+		}
+
+		if _, err := storesA.Users.Create(map[string]interface{}{"name": "alice"}, &DatabaseCreateOptions{ID: "alice"}); err != nil {
+			t.Fatalf("error creating document: %s", err)
+		}
+		eventually(t, "the user of the first node", func() bool {
+			_, err := storesB.Users.Read("alice")
+			return err == nil
+		})
+
+		// both nodes are writers
+		if _, err := storesB.Users.Create(map[string]interface{}{"name": "bob"}, &DatabaseCreateOptions{ID: "bob"}); err != nil {
+			t.Fatalf("error creating document: %s", err)
+		}
+		eventually(t, "the user of the second node", func() bool {
+			_, err := storesA.Users.Read("bob")
+			return err == nil
+		})
+
+		replicated := false
+		for _, db := range a.Databases() {
+			if db.Name == UsersStore && db.Replication().Replications > 0 {
+				replicated = true
+			}
+		}
+		if !replicated {
+			t.Errorf("expected the replication to be counted")
+		}
+	})
+
+	t.Run("should share the note stores of users", func(t *testing.T) {
+		notesB, err := storesB.UserNotes.Get("alice")
+		if err != nil {
+			t.Fatalf("error opening store: %s", err)
+		}
+
+		addressA, _ := storesA.UserNotes.Address("alice")
+		addressB, _ := storesB.UserNotes.Address("alice")
+		if addressA == "" || addressA != addressB {
+			t.Fatalf("expected the same note store, got %s and %s", addressA, addressB)
+		}
+
+		if _, err := notesB.Create(map[string]interface{}{"signedBy": "alice"}, &DatabaseCreateOptions{ID: "note"}); err != nil {
+			t.Fatalf("error creating note: %s", err)
+		}
+
+		notesA, _ := storesA.UserNotes.Get("alice")
+		eventually(t, "the note of the second node", func() bool {
+			_, err := notesA.Read("note")
+			return err == nil
+		})
+
+		// forged notes are neither written nor replicated
+		_, err = notesB.Create(map[string]interface{}{"signedBy": "mallory"}, &DatabaseCreateOptions{ID: "forged"})
+		if !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+	})
+
+	t.Run("should open replicated stores by their address", func(t *testing.T) {
+		third, thirdNode, err := NewEmbeddedOrbitDB(ctx, t.TempDir(), t.TempDir(), []string{"/ip4/127.0.0.1/tcp/0"})
+		if err != nil {
+			t.Fatalf("Error creating embedded OrbitDB instance: %s", err)
+		}
+		defer closeNode(thirdNode, t)
+
+		// a node which is not a writer replicates the stores of the others by their address, all of them together
+		users := storesA.Users.(*Database).Address.String()
+		devices := storesA.Devices.(*Database).Address.String()
+		notes := storesA.Notes.(*Database).Address.String()
+		c := NewClientRegistry(ctx, third)
+		err = c.Replicate(ReplicationConfig{Peers: status.Addresses, Addresses: []string{users, devices, notes}})
+		if err != nil {
+			t.Fatalf("error setting up the replication: %s", err)
+		}
+
+		storesC, err := OpenStores(c)
+		if err != nil {
+			t.Fatalf("error opening the stores: %s", err)
+		}
+		defer func() {
+			for _, db := range c.Databases() {
+				_ = db.Close()
+			}
+		}()
+
+		if storesC.Users.(*Database).Address.String() != users || storesC.Devices.(*Database).Address.String() != devices {
+			t.Fatalf("expected the stores of the first node, got %s", storesC.Users.(*Database).Address)
+		}
+		eventually(t, "the users of the first node", func() bool {
+			_, err := storesC.Users.Read("alice")
+			return err == nil
+		})
+	})
+}
@@ -0,0 +1,196 @@
+package orbitdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidDocument is returned for documents which cannot be decoded into the type of a Repository
+var ErrInvalidDocument = errors.New("invalid document")
+
+// Entity is the pointer type of the documents of a Repository
+type Entity[T any] interface {
+	*T
+	// Decoded is called after a document was decoded from the entry with the key. It sets the id, fills in the
+	// defaults of older documents and returns an error if a required field is missing or invalid.
+	Decoded(key string) error
+}
+
+// Repository stores documents of type T as JSON in a Store, e.g. Repository[user.User, *user.User]. Documents
+// of other types or with fields of the wrong type are returned as ErrInvalidDocument.
+type Repository[T any, P Entity[T]] struct {
+	Store Store
+	// Schema versions the documents, they are written with its latest version and upgraded when read.
+	// Documents are not versioned if it is nil.
+	Schema *Schema
+}
+
+// NewRepository creates a repository of the documents of type T with the schema in store
+func NewRepository[T any, P Entity[T]](store Store, schema *Schema) Repository[T, P] {
+	return Repository[T, P]{Store: store, Schema: schema}
+}
+
+// Create stores a new document under a generated key and returns the key. item is decoded with the key.
+func (r Repository[T, P]) Create(item P) (string, error) {
+	return r.create(item, nil)
+}
+
+// CreateWithKey stores a new document under key
+func (r Repository[T, P]) CreateWithKey(key string, item P) error {
+	_, err := r.create(item, &DatabaseCreateOptions{ID: key})
+	return err
+}
+
+// create stores a new document with the options of the store
+func (r Repository[T, P]) create(item P, options *DatabaseCreateOptions) (string, error) {
+	doc, err := r.document(item)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := r.Store.Create(doc, options)
+	if err != nil {
+		return "", err
+	}
+
+	key, _ := entry["_id"].(string)
+	if err := item.Decoded(key); err != nil {
+		return "", fmt.Errorf("%w %s: %v", ErrInvalidDocument, key, err)
+	}
+
+	return key, nil
+}
+
+// Get returns the document stored under key
+func (r Repository[T, P]) Get(key string) (P, error) {
+	entry, err := r.Store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Decode(entry)
+}
+
+// Put replaces the document stored under key
+func (r Repository[T, P]) Put(key string, item P) error {
+	doc, err := r.document(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Store.Update(key, doc)
+	return err
+}
+
+// document returns the fields of item, with the type and latest version of the schema
+func (r Repository[T, P]) document(item P) (map[string]interface{}, error) {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	if r.Schema != nil {
+		doc[SchemaVersionKey] = r.Schema.Version()
+		doc[TypeKey] = r.Schema.Name
+	}
+
+	return doc, nil
+}
+
+// Delete removes the document stored under key
+func (r Repository[T, P]) Delete(key string) error {
+	return r.Store.Delete(key)
+}
+
+// All returns every document of the store which decodes into T, skipping the others
+func (r Repository[T, P]) All() []P {
+	items := make([]P, 0)
+
+	for _, raw := range r.Store.ReadAll() {
+		entry, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if item, err := r.Decode(entry); err == nil {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Decode decodes a raw {_id, data} entry of the store
+func (r Repository[T, P]) Decode(entry map[string]interface{}) (P, error) {
+	key, _ := entry["_id"].(string)
+	data, ok := entry["data"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w %s: no data", ErrInvalidDocument, key)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidDocument, key, err)
+	}
+
+	return r.decode(key, b)
+}
+
+// DecodeDocument decodes a document of Paginate or of an Event
+func (r Repository[T, P]) DecodeDocument(doc Document) (P, error) {
+	b, err := json.Marshal(doc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidDocument, doc.ID, err)
+	}
+
+	return r.decode(doc.ID, b)
+}
+
+// decode unmarshals the JSON of the document stored under key, upgrading older documents to the latest
+// version of the schema
+func (r Repository[T, P]) decode(key string, b []byte) (P, error) {
+	if r.Schema != nil {
+		var err error
+		if b, err = r.upgrade(key, b); err != nil {
+			return nil, fmt.Errorf("%w %s: %v", ErrInvalidDocument, key, err)
+		}
+	}
+
+	item := P(new(T))
+	if err := json.Unmarshal(b, item); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidDocument, key, err)
+	}
+
+	if err := item.Decoded(key); err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidDocument, key, err)
+	}
+
+	return item, nil
+}
+
+// upgrade checks that the JSON of the document stored under key has the schema of the repository and
+// migrates it to the latest version
+func (r Repository[T, P]) upgrade(key string, b []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	if !r.Schema.Matches(doc) {
+		return nil, fmt.Errorf("not a %s", r.Schema.Name)
+	}
+
+	changed, err := r.Schema.Upgrade(key, doc)
+	if err != nil || !changed {
+		return b, err
+	}
+
+	return json.Marshal(doc)
+}
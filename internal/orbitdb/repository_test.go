@@ -0,0 +1,117 @@
+package orbitdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testItem is a document of the repository tests
+type testItem struct {
+	Key   string `json:"-"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Decoded requires a name
+func (i *testItem) Decoded(key string) error {
+	if i.Name == "" {
+		return fmt.Errorf("item has no name")
+	}
+	i.Key = key
+	return nil
+}
+
+func TestRepository(t *testing.T) {
+	t.Run("should create an item and get it", func(t *testing.T) {
+		items := NewRepository[testItem](NewMemoryStore(), nil)
+
+		item := &testItem{Name: "first", Count: 1}
+		key, err := items.Create(item)
+		if err != nil {
+			t.Fatalf("error creating item: %s", err)
+		}
+		if item.Key != key {
+			t.Errorf("expected the key %s to be set, got %s", key, item.Key)
+		}
+
+		read, err := items.Get(key)
+		if err != nil {
+			t.Fatalf("error reading item: %s", err)
+		}
+		if *read != *item {
+			t.Errorf("expected %v, got %v", item, read)
+		}
+	})
+
+	t.Run("should put an item under its key", func(t *testing.T) {
+		items := NewRepository[testItem](NewMemoryStore(), nil)
+
+		if err := items.CreateWithKey("custom", &testItem{Name: "first"}); err != nil {
+			t.Fatalf("error creating item: %s", err)
+		}
+		if err := items.Put("custom", &testItem{Name: "first", Count: 2}); err != nil {
+			t.Fatalf("error updating item: %s", err)
+		}
+
+		read, err := items.Get("custom")
+		if err != nil {
+			t.Fatalf("error reading item: %s", err)
+		}
+		if read.Count != 2 {
+			t.Errorf("expected the count 2, got %d", read.Count)
+		}
+	})
+
+	t.Run("should reject documents of another type", func(t *testing.T) {
+		db := NewMemoryStore()
+		items := NewRepository[testItem](db, nil)
+
+		wrongType, _ := db.Create(map[string]interface{}{"name": "first", "count": "one"}, nil)
+		missing, _ := db.Create(map[string]interface{}{"other": true}, nil)
+
+		for _, resp := range []map[string]interface{}{wrongType, missing} {
+			_, err := items.Get(resp["_id"].(string))
+			if !errors.Is(err, ErrInvalidDocument) {
+				t.Errorf("expected ErrInvalidDocument, got %v", err)
+			}
+		}
+	})
+
+	t.Run("should list only the items", func(t *testing.T) {
+		db := NewMemoryStore()
+		items := NewRepository[testItem](db, nil)
+
+		_, _ = db.Create(map[string]interface{}{"other": true}, nil)
+		_, _ = items.Create(&testItem{Name: "first"})
+		_, _ = items.Create(&testItem{Name: "second"})
+
+		if all := items.All(); len(all) != 2 {
+			t.Errorf("expected 2 items, got %d", len(all))
+		}
+	})
+
+	t.Run("should decode a document of an event", func(t *testing.T) {
+		items := NewRepository[testItem](NewMemoryStore(), nil)
+
+		item, err := items.DecodeDocument(Document{ID: "custom", Data: map[string]interface{}{"name": "first"}})
+		if err != nil {
+			t.Fatalf("error decoding document: %s", err)
+		}
+		if item.Key != "custom" || item.Name != "first" {
+			t.Errorf("unexpected item %v", item)
+		}
+	})
+
+	t.Run("should delete an item", func(t *testing.T) {
+		items := NewRepository[testItem](NewMemoryStore(), nil)
+
+		key, _ := items.Create(&testItem{Name: "first"})
+		if err := items.Delete(key); err != nil {
+			t.Fatalf("error deleting item: %s", err)
+		}
+		if _, err := items.Get(key); err == nil {
+			t.Errorf("expected the item to be deleted")
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package orbitdb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// SchemaVersionKey is the field of every document holding the version of its schema
+const SchemaVersionKey = "schemaVersion"
+
+// TypeKey is the field of every document holding the name of its schema
+const TypeKey = "type"
+
+// ErrNewerSchema is returned for documents written by a newer version of the server, e.g. replicated from
+// an upgraded peer
+var ErrNewerSchema = errors.New("document has a newer schema version")
+
+// Migration upgrades the documents of a Schema by one version
+type Migration struct {
+	// Description is reported by the migrate command
+	Description string
+	// Up changes the fields of the document stored under key in place
+	Up func(key string, doc map[string]interface{}) error
+}
+
+// Schema is the format of one type of documents. Documents without a schema version have version 1, the
+// format before versions were stored. Each migration upgrades them by one version.
+type Schema struct {
+	Name string
+	// Match reports whether a document without a type has this schema, e.g. in the mixed default store of
+	// older versions
+	Match func(doc map[string]interface{}) bool
+	// Migrations upgrade version 1 to 2, 2 to 3 and so on
+	Migrations []Migration
+}
+
+// Version returns the latest version of the schema
+func (s *Schema) Version() int {
+	return 1 + len(s.Migrations)
+}
+
+// Matches reports whether doc has this schema, by its type or, if it has none, by Match
+func (s *Schema) Matches(doc map[string]interface{}) bool {
+	if t, ok := doc[TypeKey]; ok {
+		return t == s.Name
+	}
+	return s.Match == nil || s.Match(doc)
+}
+
+// Upgrade applies the migrations doc is missing and sets its schema version and type. It reports whether doc
+// was changed and returns ErrNewerSchema for documents of a version it does not know.
+func (s *Schema) Upgrade(key string, doc map[string]interface{}) (bool, error) {
+	version := DocumentVersion(doc)
+	if version > s.Version() {
+		return false, fmt.Errorf("%w: %s %s has version %d, the latest is %d",
+			ErrNewerSchema, s.Name, key, version, s.Version())
+	}
+	if version == s.Version() && doc[TypeKey] == s.Name {
+		return false, nil
+	}
+
+	for _, m := range s.Migrations[version-1:] {
+		if err := m.Up(key, doc); err != nil {
+			return false, fmt.Errorf("migrating %s %s (%s): %v", s.Name, key, m.Description, err)
+		}
+	}
+	doc[SchemaVersionKey] = s.Version()
+	doc[TypeKey] = s.Name
+
+	return true, nil
+}
+
+// DocumentVersion returns the schema version of doc, 1 if it has none
+func DocumentVersion(doc map[string]interface{}) int {
+	switch v := doc[SchemaVersionKey].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 1
+	}
+}
+
+var (
+	schemasMu sync.Mutex
+	schemas   = make(map[string]*Schema)
+)
+
+// RegisterSchema adds s to the schemas upgraded by Migrate and returns it. Schemas are registered once, by the
+// package of their documents.
+func RegisterSchema(s *Schema) *Schema {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	if _, ok := schemas[s.Name]; ok {
+		log.Panicf("Schema %s is registered twice\n", s.Name)
+	}
+	schemas[s.Name] = s
+
+	return s
+}
+
+// Schemas returns the registered schemas, ordered by name
+func Schemas() []*Schema {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	found := make([]*Schema, 0, len(schemas))
+	for _, s := range schemas {
+		found = append(found, s)
+	}
+
+	sort.Slice(found, func(a, b int) bool {
+		return found[a].Name < found[b].Name
+	})
+
+	return found
+}
+
+// MigrationReport counts the documents of a store visited by Migrate
+type MigrationReport struct {
+	Total int
+	// Done documents have been visited so far
+	Done int
+	// Migrated documents were rewritten to the latest version of their schema
+	Migrated int
+	// Unknown documents match none of the schemas
+	Unknown int
+	// Failed documents could not be upgraded, e.g. as they have a newer version
+	Failed int
+}
+
+// Migrate rewrites the documents of store to the latest version of their schema, the first of schemas which
+// matches them. progress is called after each document with the report so far, if it is not nil.
+func Migrate(store Store, schemas []*Schema, progress func(report MigrationReport)) (MigrationReport, error) {
+	all := store.ReadAll()
+	report := MigrationReport{Total: len(all)}
+
+	for _, raw := range all {
+		entry, _ := raw.(map[string]interface{})
+		key, _ := entry["_id"].(string)
+
+		err := migrateEntry(store, schemas, key, entry, &report)
+		if err != nil {
+			return report, err
+		}
+		report.Done++
+
+		if progress != nil {
+			progress(report)
+		}
+	}
+
+	return report, nil
+}
+
+// migrateEntry upgrades the raw {_id, data} entry stored under key, counting it in report. Only errors of
+// the store are returned.
+func migrateEntry(store Store, schemas []*Schema, key string, entry map[string]interface{}, report *MigrationReport) error {
+	data, _ := entry["data"].(string)
+	item, err := UnmarshalItem(data)
+	doc, ok := item.(map[string]interface{})
+	if err != nil || !ok {
+		report.Unknown++
+		return nil
+	}
+
+	for _, s := range schemas {
+		if !s.Matches(doc) {
+			continue
+		}
+
+		changed, err := s.Upgrade(key, doc)
+		if err != nil {
+			log.Printf("Cannot migrate %s: %v\n", key, err)
+			report.Failed++
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+
+		if _, err := store.Update(key, doc); err != nil {
+			log.Printf("Could not save %s %s\n", s.Name, key)
+			return err
+		}
+		report.Migrated++
+		return nil
+	}
+
+	report.Unknown++
+	return nil
+}
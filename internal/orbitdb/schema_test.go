@@ -0,0 +1,136 @@
+package orbitdb
+
+import (
+	"errors"
+	"testing"
+)
+
+// testSchema renames the field "title" to "name"
+var testSchema = &Schema{
+	Name: "test",
+	Match: func(doc map[string]interface{}) bool {
+		_, ok := doc["other"]
+		return !ok
+	},
+	Migrations: []Migration{
+		{
+			Description: "rename title to name",
+			Up: func(key string, doc map[string]interface{}) error {
+				doc["name"] = doc["title"]
+				delete(doc, "title")
+				return nil
+			},
+		},
+	},
+}
+
+func TestSchema(t *testing.T) {
+	t.Run("should upgrade documents without a version", func(t *testing.T) {
+		doc := map[string]interface{}{"title": "first"}
+
+		changed, err := testSchema.Upgrade("key", doc)
+		if err != nil {
+			t.Fatalf("error upgrading document: %s", err)
+		}
+		if !changed || doc["name"] != "first" || DocumentVersion(doc) != 2 {
+			t.Errorf("expected the document to be upgraded, got %v", doc)
+		}
+	})
+
+	t.Run("should not change documents of the latest version", func(t *testing.T) {
+		doc := map[string]interface{}{"name": "first", SchemaVersionKey: float64(2), TypeKey: "test"}
+
+		changed, err := testSchema.Upgrade("key", doc)
+		if err != nil || changed {
+			t.Errorf("expected the document to be unchanged, got %v, %v", changed, err)
+		}
+	})
+
+	t.Run("should reject documents of a newer version", func(t *testing.T) {
+		doc := map[string]interface{}{"name": "first", SchemaVersionKey: float64(3)}
+
+		if _, err := testSchema.Upgrade("key", doc); !errors.Is(err, ErrNewerSchema) {
+			t.Errorf("expected ErrNewerSchema, got %v", err)
+		}
+	})
+
+	t.Run("should match documents by their type", func(t *testing.T) {
+		if !testSchema.Matches(map[string]interface{}{"other": true, TypeKey: "test"}) {
+			t.Errorf("expected a document of the type to match")
+		}
+		if testSchema.Matches(map[string]interface{}{"name": "first", TypeKey: "other"}) {
+			t.Errorf("expected a document of another type not to match")
+		}
+	})
+
+	t.Run("should reject documents of another type when reading them", func(t *testing.T) {
+		db := NewMemoryStore()
+		items := NewRepository[testItem](db, testSchema)
+
+		resp, _ := db.Create(map[string]interface{}{"name": "first", TypeKey: "other"}, nil)
+
+		if _, err := items.Get(resp["_id"].(string)); !errors.Is(err, ErrInvalidDocument) {
+			t.Errorf("expected ErrInvalidDocument, got %v", err)
+		}
+	})
+
+	t.Run("should upgrade documents when reading them", func(t *testing.T) {
+		db := NewMemoryStore()
+		items := NewRepository[testItem](db, testSchema)
+
+		resp, _ := db.Create(map[string]interface{}{"title": "first"}, nil)
+
+		item, err := items.Get(resp["_id"].(string))
+		if err != nil {
+			t.Fatalf("error reading item: %s", err)
+		}
+		if item.Name != "first" {
+			t.Errorf("expected the name first, got %s", item.Name)
+		}
+	})
+
+	t.Run("should write the latest version", func(t *testing.T) {
+		db := NewMemoryStore()
+		items := NewRepository[testItem](db, testSchema)
+
+		key, _ := items.Create(&testItem{Name: "first"})
+		resp, _ := db.Read(key)
+
+		doc, err := UnmarshalItem(resp["data"].(string))
+		if err != nil {
+			t.Fatalf("error unmarshalling item: %s", err)
+		}
+		if DocumentVersion(doc.(map[string]interface{})) != 2 {
+			t.Errorf("expected version 2, got %v", doc)
+		}
+	})
+
+	t.Run("should migrate a store", func(t *testing.T) {
+		db := NewMemoryStore()
+
+		_, _ = db.Create(map[string]interface{}{"title": "first"}, nil)
+		_, _ = db.Create(map[string]interface{}{"name": "second", SchemaVersionKey: 2, TypeKey: "test"}, nil)
+		_, _ = db.Create(map[string]interface{}{"name": "third", SchemaVersionKey: 3}, nil)
+		_, _ = db.Create(map[string]interface{}{"other": true}, nil)
+
+		calls := 0
+		report, err := Migrate(db, []*Schema{testSchema}, func(MigrationReport) {
+			calls++
+		})
+		if err != nil {
+			t.Fatalf("error migrating store: %s", err)
+		}
+
+		expected := MigrationReport{Total: 4, Done: 4, Migrated: 1, Unknown: 1, Failed: 1}
+		if report != expected {
+			t.Errorf("expected %+v, got %+v", expected, report)
+		}
+		if calls != 4 {
+			t.Errorf("expected 4 progress reports, got %d", calls)
+		}
+
+		if all := NewRepository[testItem](db, testSchema).All(); len(all) != 2 {
+			t.Errorf("expected 2 items of the latest version, got %d", len(all))
+		}
+	})
+}
@@ -0,0 +1,20 @@
+package orbitdb
+
+// Store is the storage backend the middleware and route modules operate on. Database (an OrbitDB
+// document store) and MemoryStore implement it, so the API can also run without an IPFS node.
+type Store interface {
+	// Create creates a new document and returns the stored entry.
+	Create(item interface{}, options *DatabaseCreateOptions) (map[string]interface{}, error)
+	// Read returns the entry stored under key.
+	Read(key string) (map[string]interface{}, error)
+	// ReadAll returns every entry of the store.
+	ReadAll() []interface{}
+	// Update replaces the document stored under key and returns the stored entry.
+	Update(key string, item interface{}) (map[string]interface{}, error)
+	// Delete removes the entry stored under key.
+	Delete(key string) error
+	// Watch returns a channel receiving every following change of the store, and a function to stop watching.
+	Watch() (<-chan Event, func())
+	// Close releases the store.
+	Close() error
+}
@@ -0,0 +1,350 @@
+package orbitdb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Names of the stores of the entity types, each opened as its own OrbitDB database
+const (
+	UsersStore   = "users"
+	NotesStore   = "notes"
+	DevicesStore = "devices"
+)
+
+// UserNotesPrefix is the prefix of the names of the note stores of the users, followed by their id
+const UserNotesPrefix = "notes-"
+
+// MaxHeld is the number of rejected documents of a user which are kept for UserStores.Retry
+var MaxHeld = 256
+
+// Stores are the stores of the entity types. Each one only holds documents of its type.
+type Stores struct {
+	Users Store
+	// Notes holds the unsigned notes of older versions, new notes are kept in UserNotes
+	Notes   Store
+	Devices Store
+	// UserNotes are the note stores of the users, which only accept notes signed by their owner
+	UserNotes *UserStores
+	// Registry holds the OrbitDB databases of the stores, it is nil for stores kept in memory
+	Registry *Registry
+	// Node is the OrbitDB identity of this node, it is empty for stores kept in memory
+	Node string
+}
+
+// NewMemoryStores creates empty in-memory stores
+func NewMemoryStores() Stores {
+	return Stores{
+		Users:   NewMemoryStore(),
+		Notes:   NewMemoryStore(),
+		Devices: NewMemoryStore(),
+		UserNotes: NewUserStores(func(owner, key string) (Store, error) {
+			return NewMemoryStore(), nil
+		}),
+	}
+}
+
+// OpenStores opens the databases of the entity types in registry. The databases of the addresses of
+// Registry.Replicate are opened first and used instead of the databases with the same name. The others are
+// shared with the writers of Registry.Replicate.
+func OpenStores(registry *Registry) (Stores, error) {
+	stores := Stores{Registry: registry, Node: registry.Client().Identity().ID}
+
+	stores.UserNotes = NewUserStores(func(owner, key string) (Store, error) {
+		db, err := registry.OpenOwned(UserNotesPrefix+owner, owner, key)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+	stores.UserNotes.Locate = func(owner, key string) (string, error) {
+		return registry.AddressOwned(UserNotesPrefix+owner, owner, key)
+	}
+
+	// replicated note stores of users are checked as well
+	err := registry.Client().RegisterAccessControllerType(
+		ownerAccessControllerConstructor(stores.UserNotes.verify, stores.UserNotes.Hold),
+	)
+	if err != nil {
+		return Stores{}, err
+	}
+
+	if err := registry.openReplicated(); err != nil {
+		return Stores{}, err
+	}
+
+	// users, notes and devices refer to each other, a store which is not replicated stays empty on this node
+	var replicated, local []string
+	for _, name := range []string{UsersStore, NotesStore, DevicesStore} {
+		if _, ok := registry.lookup(name); ok {
+			replicated = append(replicated, name)
+		} else {
+			local = append(local, name)
+		}
+	}
+	if len(replicated) > 0 && len(local) > 0 {
+		log.Printf("Replicating the %v stores, but not the %v stores of the other nodes", replicated, local)
+	}
+
+	for name, store := range map[string]*Store{
+		UsersStore:   &stores.Users,
+		NotesStore:   &stores.Notes,
+		DevicesStore: &stores.Devices,
+	} {
+		db, err := registry.OpenShared(name)
+		if err != nil {
+			return Stores{}, err
+		}
+		*store = db
+	}
+
+	return stores, nil
+}
+
+// UserStores are the stores of single users, each opened on first use. They only accept documents Verify
+// accepts, see OwnerStore. Replicated documents which are rejected, e.g. since the device they were signed with
+// has not been replicated yet, are held until Retry.
+type UserStores struct {
+	// Verify checks the documents written to the stores, it has to be set before they are written to
+	Verify EntryVerifier
+	// Key returns the registered key of a user, which is part of the address of their store. It has to be set
+	// before the stores are opened.
+	Key func(owner string) (string, error)
+	// Locate returns the address of the store of a user without opening it, nil for stores kept in memory
+	Locate func(owner, key string) (string, error)
+
+	open    func(owner, key string) (Store, error)
+	mu      sync.Mutex
+	opening sync.Mutex
+	stores  map[string]OwnerStore
+	held    map[string]map[string]Document
+	onOpen  []func(owner string, store Store)
+}
+
+// NewUserStores creates the stores of single users, which are opened with open and the registered key of the user
+func NewUserStores(open func(owner, key string) (Store, error)) *UserStores {
+	return &UserStores{
+		open:   open,
+		stores: make(map[string]OwnerStore),
+		held:   make(map[string]map[string]Document),
+	}
+}
+
+// verify checks a document with Verify
+func (s *UserStores) verify(owner, registeredKey string, doc Document) error {
+	if s.Verify == nil {
+		return fmt.Errorf("documents of %s cannot be verified", owner)
+	}
+	return s.Verify(owner, registeredKey, doc)
+}
+
+// key returns the registered key of the user owner with Key
+func (s *UserStores) key(owner string) (string, error) {
+	if s.Key == nil {
+		return "", fmt.Errorf("the key of %s is not known", owner)
+	}
+	return s.Key(owner)
+}
+
+// Get returns the store of the user owner, opening it on first use
+func (s *UserStores) Get(owner string) (Store, error) {
+	if store, ok := s.Lookup(owner); ok {
+		return store, nil
+	}
+
+	s.opening.Lock()
+	defer s.opening.Unlock()
+
+	// opened while waiting
+	if store, ok := s.Lookup(owner); ok {
+		return store, nil
+	}
+
+	key, err := s.key(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := s.open(owner, key)
+	if err != nil {
+		return nil, err
+	}
+	store := OwnerStore{Store: db, Owner: owner, Key: key, Verify: s.verify}
+
+	// a document written to the store replaces its held version
+	events, _ := db.Watch()
+	go func() {
+		for evt := range events {
+			if evt.Op == OpPut {
+				s.settle(owner, evt.Key)
+			}
+		}
+	}()
+
+	// the store is returned once the callbacks follow it
+	for _, f := range s.onOpen {
+		f(owner, store)
+	}
+
+	s.mu.Lock()
+	s.stores[owner] = store
+	s.mu.Unlock()
+
+	return store, nil
+}
+
+// Lookup returns the store of the user owner if it has been opened
+func (s *UserStores) Lookup(owner string) (Store, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	store, ok := s.stores[owner]
+	return store, ok
+}
+
+// All returns the opened stores, ordered by their owner
+func (s *UserStores) All() []Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owners := make([]string, 0, len(s.stores))
+	for owner := range s.stores {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	all := make([]Store, 0, len(owners))
+	for _, owner := range owners {
+		all = append(all, s.stores[owner])
+	}
+	return all
+}
+
+// OnOpen calls f with every opened store and every store opened later
+func (s *UserStores) OnOpen(f func(owner string, store Store)) {
+	s.opening.Lock()
+	defer s.opening.Unlock()
+
+	s.mu.Lock()
+	opened := make(map[string]OwnerStore, len(s.stores))
+	for owner, store := range s.stores {
+		opened[owner] = store
+	}
+	s.mu.Unlock()
+
+	for owner, store := range opened {
+		f(owner, store)
+	}
+
+	s.onOpen = append(s.onOpen, f)
+}
+
+// Hold keeps a replicated document of the user owner which was rejected, so that Retry can write it later. Only
+// the latest version of a document is kept, and up to MaxHeld documents per user.
+func (s *UserStores) Hold(owner string, doc Document) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.held[owner]
+	if !ok {
+		held = make(map[string]Document)
+		s.held[owner] = held
+	}
+
+	if _, ok := held[doc.ID]; !ok && len(held) >= MaxHeld {
+		return
+	}
+	held[doc.ID] = doc
+}
+
+// settle drops the held document with the id key of the user owner
+func (s *UserStores) settle(owner, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.held[owner], key)
+	if len(s.held[owner]) == 0 {
+		delete(s.held, owner)
+	}
+}
+
+// Held returns the number of held documents of the user owner
+func (s *UserStores) Held(owner string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.held[owner])
+}
+
+// Retry writes the held documents of the user owner to their store, e.g. once the keys they were signed with
+// have been replicated. Documents which are still rejected stay held.
+func (s *UserStores) Retry(owner string) {
+	store, ok := s.Lookup(owner)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	held := s.held[owner]
+	delete(s.held, owner)
+	s.mu.Unlock()
+
+	for _, doc := range held {
+		if _, err := store.Create(doc.Data, &DatabaseCreateOptions{ID: doc.ID}); err != nil {
+			s.Hold(owner, doc)
+		}
+	}
+}
+
+// Address returns the OrbitDB address of the store of the user owner, which peers open to replicate it. The
+// store is not opened. It is empty for stores kept in memory.
+func (s *UserStores) Address(owner string) (string, error) {
+	if store, ok := s.Lookup(owner); ok {
+		if db, ok := store.(OwnerStore).Store.(*Database); ok {
+			return db.Address.String(), nil
+		}
+	}
+
+	if s.Locate == nil {
+		return "", nil
+	}
+
+	key, err := s.key(owner)
+	if err != nil {
+		return "", err
+	}
+	return s.Locate(owner, key)
+}
+
+// Move moves the documents of the store from, which have the schema, to the store to. A nil schema moves all
+// documents. Documents already in to are not replaced. It returns the number of moved documents.
+func Move(from, to Store, schema *Schema) (int, error) {
+	moved := 0
+
+	for _, raw := range from.ReadAll() {
+		entry, _ := raw.(map[string]interface{})
+		key, _ := entry["_id"].(string)
+		data, _ := entry["data"].(string)
+
+		item, err := UnmarshalItem(data)
+		doc, ok := item.(map[string]interface{})
+		if err != nil || !ok || (schema != nil && !schema.Matches(doc)) {
+			continue
+		}
+
+		if _, err := to.Read(key); err != nil {
+			if _, err := to.Create(doc, &DatabaseCreateOptions{ID: key}); err != nil {
+				return moved, err
+			}
+		}
+
+		if err := from.Delete(key); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	return moved, nil
+}
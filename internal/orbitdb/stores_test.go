@@ -0,0 +1,172 @@
+package orbitdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	t.Run("should move the documents of a schema", func(t *testing.T) {
+		from, to := NewMemoryStore(), NewMemoryStore()
+
+		first, _ := from.Create(map[string]interface{}{"title": "first"}, nil)
+		other, _ := from.Create(map[string]interface{}{"other": true}, nil)
+
+		moved, err := Move(from, to, testSchema)
+		if err != nil {
+			t.Fatalf("error moving documents: %s", err)
+		}
+		if moved != 1 {
+			t.Errorf("expected 1 moved document, got %d", moved)
+		}
+
+		if _, err := to.Read(first["_id"].(string)); err != nil {
+			t.Errorf("expected the document in the new store: %s", err)
+		}
+		if _, err := from.Read(first["_id"].(string)); err == nil {
+			t.Errorf("expected the document to be removed from the old store")
+		}
+		if _, err := from.Read(other["_id"].(string)); err != nil {
+			t.Errorf("expected the other document to stay: %s", err)
+		}
+	})
+
+	t.Run("should not replace documents already moved", func(t *testing.T) {
+		from, to := NewMemoryStore(), NewMemoryStore()
+
+		_, _ = from.Create(map[string]interface{}{"title": "old"}, &DatabaseCreateOptions{ID: "key"})
+		_, _ = to.Create(map[string]interface{}{"name": "new", SchemaVersionKey: 2}, &DatabaseCreateOptions{ID: "key"})
+
+		if _, err := Move(from, to, testSchema); err != nil {
+			t.Fatalf("error moving documents: %s", err)
+		}
+
+		item, err := NewRepository[testItem](to, testSchema).Get("key")
+		if err != nil || item.Name != "new" {
+			t.Errorf("expected the moved document to be kept, got %v, %v", item, err)
+		}
+	})
+
+	t.Run("should open the store of a user once", func(t *testing.T) {
+		opened := 0
+		stores := NewUserStores(func(owner, key string) (Store, error) {
+			opened++
+			return NewMemoryStore(), nil
+		})
+		stores.Verify, stores.Key = testVerifier, testKey
+
+		var followed []string
+		stores.OnOpen(func(owner string, store Store) {
+			followed = append(followed, owner)
+		})
+
+		alice, err := stores.Get("alice")
+		if err != nil {
+			t.Fatalf("error opening store: %s", err)
+		}
+		if _, err := alice.Create(map[string]interface{}{"signedBy": "alice"}, &DatabaseCreateOptions{ID: "key"}); err != nil {
+			t.Fatalf("error creating document: %s", err)
+		}
+
+		again, _ := stores.Get("alice")
+		if _, err := again.Read("key"); err != nil || opened != 1 {
+			t.Errorf("expected the same store, opened %d times: %v", opened, err)
+		}
+
+		if _, ok := stores.Lookup("bob"); ok {
+			t.Errorf("expected the store of bob not to be opened")
+		}
+		_, _ = stores.Get("bob")
+
+		// callbacks registered later see the opened stores
+		var late []string
+		stores.OnOpen(func(owner string, store Store) {
+			late = append(late, owner)
+		})
+
+		if len(followed) != 2 || len(late) != 2 || len(stores.All()) != 2 {
+			t.Errorf("expected 2 stores, got %v, %v, %d", followed, late, len(stores.All()))
+		}
+
+		if address, err := stores.Address("alice"); err != nil || address != "" {
+			t.Errorf("expected no address for a store in memory, got %s, %v", address, err)
+		}
+
+		stores.Locate = func(owner, key string) (string, error) {
+			return "/orbitdb/" + owner + "/" + key, nil
+		}
+		if address, err := stores.Address("carol"); err != nil || address != "/orbitdb/carol/carol-key" {
+			t.Errorf("expected the address of the store, got %s, %v", address, err)
+		}
+		if _, ok := stores.Lookup("carol"); ok || opened != 2 {
+			t.Errorf("expected the store of carol not to be opened")
+		}
+	})
+
+	t.Run("should not open the stores of users without a registered key", func(t *testing.T) {
+		stores := NewMemoryStores()
+
+		if _, err := stores.UserNotes.Get("alice"); err == nil {
+			t.Errorf("expected the store to need the key of its owner")
+		}
+	})
+
+	t.Run("should write held documents once they are accepted", func(t *testing.T) {
+		stores := NewMemoryStores()
+		stores.UserNotes.Key = testKey
+
+		// the key of bob is not known yet
+		known := map[string]bool{}
+		stores.UserNotes.Verify = func(owner, registeredKey string, doc Document) error {
+			if !known[owner] {
+				return fmt.Errorf("unknown user %s", owner)
+			}
+			return testVerifier(owner, registeredKey, doc)
+		}
+
+		store, _ := stores.UserNotes.Get("bob")
+		stores.UserNotes.Hold("bob", Document{ID: "held", Data: map[string]interface{}{"signedBy": "bob"}})
+		stores.UserNotes.Hold("bob", Document{ID: "replaced", Data: map[string]interface{}{"signedBy": "bob"}})
+
+		stores.UserNotes.Retry("bob")
+		if held := stores.UserNotes.Held("bob"); held != 2 {
+			t.Errorf("expected the rejected documents to stay held, got %d", held)
+		}
+
+		known["bob"] = true
+		if _, err := store.Create(map[string]interface{}{"signedBy": "bob", "version": 2}, &DatabaseCreateOptions{ID: "replaced"}); err != nil {
+			t.Fatalf("error creating document: %s", err)
+		}
+
+		// the written version settles the held one
+		for deadline := time.Now().Add(time.Second); stores.UserNotes.Held("bob") != 1 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+
+		stores.UserNotes.Retry("bob")
+		if _, err := store.Read("held"); err != nil {
+			t.Errorf("expected the held document to be written: %s", err)
+		}
+
+		// a newer version is not replaced by the held one
+		raw, _ := store.Read("replaced")
+		if replaced, err := decodeDocument(raw); err != nil || replaced.Data["version"] != float64(2) {
+			t.Errorf("expected the newer version to be kept, got %v, %v", replaced, err)
+		}
+		if held := stores.UserNotes.Held("bob"); held != 0 {
+			t.Errorf("expected no held documents, got %d", held)
+		}
+	})
+
+	t.Run("should not write to the stores of users without a verifier", func(t *testing.T) {
+		stores := NewMemoryStores()
+		stores.UserNotes.Key = testKey
+
+		store, _ := stores.UserNotes.Get("alice")
+		if _, err := store.Create(map[string]interface{}{"signedBy": "alice"}, nil); !errors.Is(err, ErrNotOwner) {
+			t.Errorf("expected %v, got %v", ErrNotOwner, err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package orbitdb
+
+import (
+	"sort"
+	"sync"
+)
+
+// View is an in-memory view of the documents of a store, grouped into partitions, e.g. by their owner, and
+// ordered like Paginate. It is loaded once and follows the local and replicated changes of the store, so a page
+// only reads the documents of its partition instead of the whole store.
+type View struct {
+	store     Store
+	partition func(doc Document) (string, bool)
+
+	mu    sync.RWMutex
+	parts map[string][]Document
+	// docs maps the keys of the documents in the view to their partition
+	docs map[string]string
+	stop func()
+}
+
+// NewView loads the documents of store into a view. partition returns the partition of a document, documents
+// without one are left out.
+func NewView(store Store, partition func(doc Document) (string, bool)) *View {
+	v := &View{
+		store:     store,
+		partition: partition,
+		parts:     make(map[string][]Document),
+		docs:      make(map[string]string),
+	}
+
+	// follow first, so that no change is missed
+	events, stop := store.Watch()
+	v.stop = stop
+
+	v.mu.Lock()
+	for _, raw := range store.ReadAll() {
+		if doc, err := decodeDocument(raw); err == nil {
+			v.insert(doc)
+		}
+	}
+	v.mu.Unlock()
+
+	go func() {
+		for evt := range events {
+			v.Refresh(evt.Key)
+		}
+	}()
+
+	return v
+}
+
+// Refresh reads the document with key from the store again. Writers call it right after a change, so that it
+// is visible at once; the view also refreshes on its own once the change is published.
+func (v *View) Refresh(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// the store is read under the lock, so an older read cannot overwrite a newer one
+	raw, err := v.store.Read(key)
+	v.remove(key)
+	if err != nil {
+		return
+	}
+
+	if doc, err := decodeDocument(raw); err == nil {
+		v.insert(doc)
+	}
+}
+
+// insert adds doc to its partition, keeping the order
+func (v *View) insert(doc Document) {
+	part, ok := v.partition(doc)
+	if !ok {
+		return
+	}
+	if _, ok := v.docs[doc.ID]; ok {
+		v.remove(doc.ID)
+	}
+
+	docs := v.parts[part]
+	i := sort.Search(len(docs), func(i int) bool {
+		return less(doc, docs[i])
+	})
+
+	docs = append(docs, Document{})
+	copy(docs[i+1:], docs[i:])
+	docs[i] = doc
+
+	v.parts[part] = docs
+	v.docs[doc.ID] = part
+}
+
+// remove removes the document with key from its partition
+func (v *View) remove(key string) {
+	part, ok := v.docs[key]
+	if !ok {
+		return
+	}
+	delete(v.docs, key)
+
+	docs := v.parts[part]
+	for i := range docs {
+		if docs[i].ID == key {
+			docs = append(docs[:i], docs[i+1:]...)
+			break
+		}
+	}
+
+	if len(docs) == 0 {
+		delete(v.parts, part)
+		return
+	}
+	v.parts[part] = docs
+}
+
+// Page runs a query against the documents of a partition, like Paginate does against a whole store.
+// The filter of the query is applied before the limit, so only the last page is short.
+func (v *View) Page(part string, query Query) (Page, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	docs := v.parts[part]
+
+	start := 0
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		start = sort.Search(len(docs), func(i int) bool {
+			return less(after, docs[i])
+		})
+	}
+
+	page := Page{Documents: make([]Document, 0)}
+	for _, doc := range docs[start:] {
+		if query.Filter != nil && !query.Filter(doc.Data) {
+			continue
+		}
+
+		// another document follows a full page
+		if limit >= 0 && len(page.Documents) == limit {
+			page.Next = encodeCursor(page.Documents[limit-1])
+			break
+		}
+
+		page.Documents = append(page.Documents, doc)
+	}
+
+	return page, nil
+}
+
+// Count returns the number of documents of a partition which filter accepts, all of them if it is nil
+func (v *View) Count(part string, filter func(data map[string]interface{}) bool) int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if filter == nil {
+		return len(v.parts[part])
+	}
+
+	count := 0
+	for _, doc := range v.parts[part] {
+		if filter(doc.Data) {
+			count++
+		}
+	}
+	return count
+}
+
+// Counts returns the number of documents per partition which filter accepts, all of them if it is nil
+func (v *View) Counts(filter func(data map[string]interface{}) bool) map[string]int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	counts := make(map[string]int, len(v.parts))
+	for part, docs := range v.parts {
+		for _, doc := range docs {
+			if filter == nil || filter(doc.Data) {
+				counts[part]++
+			}
+		}
+	}
+	return counts
+}
+
+// Close stops following the changes of the store
+func (v *View) Close() {
+	v.stop()
+}
@@ -0,0 +1,92 @@
+package orbitdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestView(t *testing.T) {
+	db := NewMemoryStore()
+
+	// created out of order, with one tie
+	for _, item := range []map[string]interface{}{
+		{"owner": "a", "createdAt": 3},
+		{"owner": "a", "createdAt": 1},
+		{"owner": "b", "createdAt": 2},
+		{"owner": "a", "createdAt": 2, "hidden": true},
+		{"owner": "a", "createdAt": 2},
+		{"createdAt": 2},
+	} {
+		if _, err := db.Create(item, nil); err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+	}
+
+	view := NewView(db, func(doc Document) (string, bool) {
+		owner, ok := doc.Data["owner"].(string)
+		return owner, ok
+	})
+	defer view.Close()
+
+	visible := func(data map[string]interface{}) bool {
+		return data["hidden"] != true
+	}
+
+	t.Run("should page through a partition after filtering", func(t *testing.T) {
+		first, err := view.Page("a", Query{Limit: 2, Filter: visible})
+		if err != nil {
+			t.Fatalf("error paginating: %s", err)
+		}
+		if len(first.Documents) != 2 || first.Next == "" {
+			t.Fatalf("expected a full first page, got %+v", first)
+		}
+		if first.Documents[0].CreatedAt != 1 || first.Documents[1].CreatedAt != 2 {
+			t.Errorf("expected documents ordered by createdAt, got %+v", first.Documents)
+		}
+
+		second, err := view.Page("a", Query{Limit: 2, Cursor: first.Next, Filter: visible})
+		if err != nil {
+			t.Fatalf("error paginating: %s", err)
+		}
+		if len(second.Documents) != 1 || second.Documents[0].CreatedAt != 3 || second.Next != "" {
+			t.Errorf("expected the last document on the last page, got %+v", second)
+		}
+
+		if _, err := view.Page("a", Query{Cursor: "not a cursor"}); err != ErrInvalidCursor {
+			t.Errorf("expected %v, got %v", ErrInvalidCursor, err)
+		}
+	})
+
+	t.Run("should count the documents of a partition", func(t *testing.T) {
+		if count := view.Count("a", visible); count != 3 {
+			t.Errorf("expected 3 documents, got %d", count)
+		}
+		if count := view.Count("b", nil); count != 1 {
+			t.Errorf("expected 1 document, got %d", count)
+		}
+
+		counts := view.Counts(visible)
+		if len(counts) != 2 || counts["a"] != 3 || counts["b"] != 1 {
+			t.Errorf("expected the counts of both partitions, got %v", counts)
+		}
+	})
+
+	t.Run("should follow the changes of the store", func(t *testing.T) {
+		_, _ = db.Create(map[string]interface{}{"owner": "c", "createdAt": 1}, &DatabaseCreateOptions{ID: "key"})
+		view.Refresh("key")
+		if count := view.Count("c", nil); count != 1 {
+			t.Fatalf("expected the refreshed document, got %d", count)
+		}
+
+		_ = db.Delete("key")
+
+		// the view refreshes itself once the deletion is published
+		deadline := time.Now().Add(time.Second)
+		for view.Count("c", nil) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the deleted document to be removed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"net/http"
+)
+
+// Admin is the route module for the endpoints of admins
+type Admin struct {
+	DB     orbitdb.Stores
+	Index  note.Index
+	RGroup *gin.RouterGroup
+}
+
+// InitAdmin takes the current gin-instance, ODB, note index and the admin middleware of InitAuth to create the
+// /admin routes
+func InitAdmin(router *gin.Engine, db orbitdb.Stores, index note.Index, admin gin.HandlerFunc) *Admin {
+	group := router.Group("/admin", admin)
+
+	a := &Admin{
+		DB:     db,
+		Index:  index,
+		RGroup: group,
+	}
+	group.GET("/users", a.ListUsers)
+	group.PUT("/users/:id/role", a.SetRole)
+	group.GET("/replication", a.Replication)
+
+	return a
+}
+
+// ListUsers is a GET endpoint at /admin/users, listing all users
+func (a Admin) ListUsers(context *gin.Context) {
+	// the notes of all users are counted at once
+	counts := a.Index.Counts()
+
+	found := user.All(a.DB)
+	list := make([]gin.H, 0, len(found))
+	for i := range found {
+		list = append(list, a.response(&found[i], counts[found[i].ID.String()]))
+	}
+
+	context.JSON(http.StatusOK, gin.H{"users": list})
+}
+
+// response returns a user as admins see it: without the nonce, which only the user needs to log in
+func (a Admin) response(usr *user.User, noteCount int) gin.H {
+	response := Users{DB: a.DB, Index: a.Index}.countedResponse(usr, noteCount)
+	delete(response, "nonce")
+	return response
+}
+
+// roleReq is the request body for changing the role of a user
+type roleReq struct {
+	Admin *bool `json:"admin" binding:"required"`
+}
+
+// SetRole is a PUT endpoint at /admin/users/:id/role, promoting a user to an admin or demoting them
+func (a Admin) SetRole(context *gin.Context) {
+	var body roleReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changed, err := user.SetAdmin(a.DB, context.Param("id"), *body.Admin)
+	if errors.Is(err, user.ErrLastAdmin) {
+		context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	noteCount, _ := a.Index.Count(changed.ID)
+	context.JSON(http.StatusOK, a.response(changed, noteCount))
+}
+
+// Replication is a GET endpoint at /admin/replication, showing the identity and the peers of the node and the
+// replication status of its stores. Nothing is replicated for stores kept in memory.
+func (a Admin) Replication(context *gin.Context) {
+	status, err := a.DB.Registry.Status(context.Request.Context())
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	context.JSON(http.StatusOK, status)
+}
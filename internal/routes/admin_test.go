@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/docker/distribution/uuid"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"net/http"
+	"testing"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	index := note.NewIndex(orbitdb.NewMemoryStore())
+	InitAuth(r, db, index, note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+
+	// newAccount creates a user and logs them in
+	newAccount := func(t *testing.T) (string, string) {
+		privateK, _ := rsa.GenerateKey(rand.Reader, 2048)
+		usr, err := user.NewUser(db, string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PUBLIC KEY",
+			Bytes: x509.MarshalPKCS1PublicKey(&privateK.PublicKey),
+		})), false)
+		if err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+
+		signature := login(t, r, usr.ID.String(), privateK)
+		w := performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+		var resp struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return usr.ID.String(), resp.Token
+	}
+
+	adminID, userToken := newAccount(t)
+	otherID, otherToken := newAccount(t)
+
+	t.Run("should reject users without the admin role", func(t *testing.T) {
+		w := performAuthRequest(r, "GET", "/admin/users", userToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		// the role has to be in the token, not only on the user
+		_, _ = user.SetAdmin(db, adminID, true)
+		w = performAuthRequest(r, "GET", "/admin/users", userToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	// the refreshed token carries the admin role
+	w := performAuthRequest(r, "GET", "/refresh_token", userToken, nil)
+	var refreshed struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &refreshed)
+	adminToken := refreshed.Token
+
+	t.Run("should let admins list the users", func(t *testing.T) {
+		other, _ := uuid.Parse(otherID)
+		_ = index.Add(other, uuid.Generate(), 1000, 0)
+
+		w := performAuthRequest(r, "GET", "/admin/users", adminToken, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp struct {
+			Users []map[string]interface{} `json:"users"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Users) != 2 {
+			t.Fatalf("Expected 2 users, got %v", w.Body)
+		}
+
+		for _, u := range resp.Users {
+			if _, ok := u["nonce"]; ok {
+				t.Errorf("Expected the nonce to be left out, got %v", u)
+			}
+
+			expected := 0.0
+			if u["_id"] == otherID {
+				expected = 1
+			}
+			if u["noteCount"] != expected {
+				t.Errorf("Expected %v notes, got %v", expected, u["noteCount"])
+			}
+		}
+	})
+
+	t.Run("should promote and demote users", func(t *testing.T) {
+		w := performAuthRequest(r, "PUT", "/admin/users/"+otherID+"/role", adminToken, gin.H{"admin": true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "PUT", "/admin/users/"+adminID+"/role", adminToken, gin.H{"admin": false})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		// the token still carries the role, but the user lost it
+		w = performAuthRequest(r, "GET", "/admin/users", adminToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		// the old token of the promoted user has no admin role yet
+		w = performAuthRequest(r, "PUT", "/admin/users/"+otherID+"/role", otherToken, gin.H{"admin": false})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("should keep the last admin", func(t *testing.T) {
+		w := performAuthRequest(r, "GET", "/refresh_token", otherToken, nil)
+		_ = json.Unmarshal(w.Body.Bytes(), &refreshed)
+
+		w = performAuthRequest(r, "PUT", "/admin/users/"+otherID+"/role", refreshed.Token, gin.H{"admin": false})
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusConflict, w.Code, w.Body)
+		}
+	})
+
+	t.Run("should show the replication status", func(t *testing.T) {
+		w := performAuthRequest(r, "GET", "/admin/replication", userToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		w = performAuthRequest(r, "GET", "/admin/replication", refreshed.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		// stores kept in memory are not replicated
+		var resp orbitdb.NodeStatus
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Peers == nil || len(resp.Databases) != 0 {
+			t.Errorf("Expected no replicated stores, got %+v", resp)
+		}
+	})
+}
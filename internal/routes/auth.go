@@ -2,11 +2,12 @@ package routes
 
 import (
 	"github.com/gin-gonic/gin"
-	cors "github.com/itsjamie/gin-cors"
 	jwt2 "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"log"
-	"time"
+	"net/http"
 )
 
 // init auth middleware module
@@ -14,12 +15,21 @@ func init() {
 	log.SetPrefix("[routes/auth] ")
 }
 
-// InitAuth takes the current gin-instance and ODB to create the corresponding protected routes
-func InitAuth(router *gin.Engine, db *orbitdb.Database) {
-	authMiddleware, err := jwt2.AsteroidJWTMiddleware()
+// Auth is the route module for the unprotected authentication endpoints
+type Auth struct {
+	DB   orbitdb.Stores
+	Keys *jwt2.KeySet
+}
+
+// InitAuth takes the current gin-instance, ODB, note index, note feed, blob store and token settings to create
+// the corresponding protected routes, including the /admin routes. It returns the auth middleware for protecting
+// other routes.
+func InitAuth(router *gin.Engine, db orbitdb.Stores, index note.Index, feed *note.Feed, blobs *orbitdb.CountedBlobStore,
+	config jwt2.Config) gin.HandlerFunc {
+	authMiddleware, err := jwt2.AsteroidJWTMiddleware(db, config)
 	if err != nil {
 		log.Fatal("Error creating auth middleware")
-		return
+		return nil
 	}
 
 	// init auth middleware
@@ -27,12 +37,21 @@ func InitAuth(router *gin.Engine, db *orbitdb.Database) {
 
 	if err != nil {
 		log.Fatal("Error initializing auth middleware" + err.Error())
-		return
+		return nil
 	}
 
 	// Auth management
 	router.POST("/login", authMiddleware.LoginHandler)
 	router.GET("/refresh_token", authMiddleware.RefreshHandler)
+	router.POST("/logout", authMiddleware.MiddlewareFunc(), authMiddleware.LogoutHandler)
+	router.POST("/sessions/revoke-all", authMiddleware.MiddlewareFunc(), authMiddleware.RevokeAllHandler)
+
+	// admin-only routes need the admin role in the token and on the user
+	InitAdmin(router, db, index, authMiddleware.Require(user.RoleAdmin))
+
+	a := Auth{DB: db, Keys: authMiddleware.Keys}
+	router.GET("/auth/challenge", a.Challenge)
+	router.GET("/.well-known/jwks.json", a.JWKS)
 
 	// attach protected routes
 	auth := router.Group("/notes")
@@ -42,19 +61,55 @@ func InitAuth(router *gin.Engine, db *orbitdb.Database) {
 		// protecting the /notes endpoint
 		notes := Notes{
 			DB:     db,
+			Index:  index,
+			Feed:   feed,
+			Blobs:  blobs,
 			RGroup: auth,
 		}
 		auth.POST("/", notes.Create)
+		auth.POST("/files", notes.Upload)
+		auth.GET("/", notes.List)
+		auth.GET("/stream", notes.Stream)
 		auth.GET("/:id", notes.Find)
+		auth.GET("/:id/content", notes.Content)
+		auth.PUT("/:id", notes.Update)
+		auth.DELETE("/:id", notes.Delete)
 	}
 
-	auth.Use(cors.Middleware(cors.Config{
-			Origins:         "*",
-			Methods:         "GET, PUT, POST, DELETE",
-			RequestHeaders:  "Origin, Authorization, Content-Type",
-			ExposedHeaders:  "",
-			MaxAge:          50 * time.Second,
-			Credentials:     false,
-			ValidateHeaders: false,
-		}))
+	return authMiddleware.MiddlewareFunc()
+}
+
+// Challenge is a GET endpoint at /auth/challenge?id=, issuing a fresh nonce for the user to sign.
+// The nonce is valid for a single login within user.NonceTTL.
+func (a Auth) Challenge(c *gin.Context) {
+	id := c.Query("id")
+
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id is required",
+		})
+		return
+	}
+
+	u, err := user.IssueNonce(a.DB, id)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":        u.ID.String(),
+		"nonce":     u.Nonce,
+		"expiresAt": u.NonceExpiresAt,
+	})
+}
+
+// JWKS is a GET endpoint at /.well-known/jwks.json, publishing the public keys the tokens are signed with, so other
+// services can verify them. Tokens name their key in the kid header.
+func (a Auth) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, a.Keys.JWKS())
 }
@@ -0,0 +1,257 @@
+package routes
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	jwt2 "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testJWTConfig is the token configuration of the route tests
+var testJWTConfig = jwt2.Config{
+	Secret:     []byte("test secret key, do not use in production"),
+	Timeout:    time.Hour,
+	MaxRefresh: time.Hour,
+}
+
+// login requests a challenge for the user and signs it with privateK
+func login(t *testing.T, r http.Handler, id string, privateK *rsa.PrivateKey) string {
+	w := performRequest(r, "GET", "/auth/challenge?id="+id, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+	}
+
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil {
+		t.Fatalf("Error parsing challenge: %v", err)
+	}
+
+	sign, err := user.SignNonce(privateK, challenge.Nonce)
+	if err != nil {
+		t.Fatalf("Error signing nonce: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(sign)
+}
+
+func TestAuthRoutes(t *testing.T) {
+	r := setupRouter()
+
+	privateK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pubkPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&privateK.PublicKey),
+	})
+
+	db := orbitdb.NewMemoryStores()
+	InitAuth(r, db, note.NewIndex(orbitdb.NewMemoryStore()), note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+
+	usr, err := user.NewUser(db, string(pubkPEM), false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	t.Run("should require an id for a challenge", func(t *testing.T) {
+		w := performRequest(r, "GET", "/auth/challenge", nil)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("should log in with a signed challenge only once", func(t *testing.T) {
+		signature := login(t, r, usr.ID.String(), privateK)
+
+		w := performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a replayed login to fail with %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("should invalidate older challenges", func(t *testing.T) {
+		signature := login(t, r, usr.ID.String(), privateK)
+		_ = login(t, r, usr.ID.String(), privateK)
+
+		w := performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := jwt2.LoadKeys([]string{filepath.Join(dir, "jwt.pem")}, jwt2.AlgorithmEdDSA)
+	if err != nil {
+		t.Fatalf("Error generating the signing key: %v", err)
+	}
+
+	config := testJWTConfig
+	config.Keys = keys
+
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	index := note.NewIndex(orbitdb.NewMemoryStore())
+	InitAuth(r, db, index, note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), config)
+
+	token := newSession(t, r, db)
+
+	t.Run("should verify tokens with the published keys", func(t *testing.T) {
+		w := performRequest(r, "GET", "/.well-known/jwks.json", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d", http.StatusOK, w.Code)
+		}
+
+		var jwks struct {
+			Keys []struct {
+				Kid string `json:"kid"`
+				Alg string `json:"alg"`
+				X   string `json:"x"`
+			} `json:"keys"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &jwks)
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != jwt2.AlgorithmEdDSA {
+			t.Fatalf("Expected one EdDSA key, got %v", w.Body)
+		}
+
+		// verify like another service would, knowing nothing but the key set
+		_, err := jwt.Parse(token, func(parsed *jwt.Token) (interface{}, error) {
+			if parsed.Header["kid"] != jwks.Keys[0].Kid {
+				return nil, fmt.Errorf("unknown kid %v", parsed.Header["kid"])
+			}
+			x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+			return ed25519.PublicKey(x), err
+		})
+		if err != nil {
+			t.Errorf("Expected the token to verify with the published key, got %v", err)
+		}
+	})
+
+	t.Run("should accept tokens of the previous key after a rollover", func(t *testing.T) {
+		rolled, err := jwt2.LoadKeys([]string{filepath.Join(dir, "next.pem"), filepath.Join(dir, "jwt.pem")}, jwt2.AlgorithmRS256)
+		if err != nil {
+			t.Fatalf("Error generating the next signing key: %v", err)
+		}
+		config.Keys = rolled
+
+		r := setupRouter()
+		InitAuth(r, db, index, note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), config)
+
+		w := performAuthRequest(r, "GET", "/notes/", token, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "GET", "/refresh_token", token, nil)
+		var refreshed struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &refreshed)
+
+		parsed, err := jwt.Parse(refreshed.Token, rolled.Verify)
+		if err != nil || parsed.Header["kid"] != rolled.Keys[0].ID {
+			t.Errorf("Expected the refreshed token to be signed by the next key, got %v", err)
+		}
+	})
+}
+
+func TestSessionRoutes(t *testing.T) {
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	InitAuth(r, db, note.NewIndex(orbitdb.NewMemoryStore()), note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+
+	privateK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	usr, err := user.NewUser(db, string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&privateK.PublicKey),
+	})), false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	// newToken logs the user in once more
+	newToken := func(t *testing.T) string {
+		signature := login(t, r, usr.ID.String(), privateK)
+		w := performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+
+		var resp struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Token
+	}
+
+	t.Run("should end only the session of the logout", func(t *testing.T) {
+		token, other := newToken(t), newToken(t)
+
+		w := performAuthRequest(r, "GET", "/refresh_token", token, nil)
+		var refreshed struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &refreshed)
+
+		w = performAuthRequest(r, "POST", "/logout", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		// the refreshed token belongs to the same session
+		for _, revoked := range []string{token, refreshed.Token} {
+			if w := performAuthRequest(r, "GET", "/notes/", revoked, nil); w.Code != http.StatusForbidden {
+				t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+			}
+		}
+
+		if w := performAuthRequest(r, "GET", "/refresh_token", token, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a revoked token not to be refreshed, got %d", w.Code)
+		}
+
+		if w := performAuthRequest(r, "GET", "/notes/", other, nil); w.Code != http.StatusOK {
+			t.Errorf("Expected the other session to be valid, got %d", w.Code)
+		}
+	})
+
+	t.Run("should end all sessions and keep the revocations", func(t *testing.T) {
+		token, other := newToken(t), newToken(t)
+
+		w := performAuthRequest(r, "POST", "/sessions/revoke-all", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		// a restarted server reads the revocations from the store
+		restarted := setupRouter()
+		InitAuth(restarted, db, note.NewIndex(orbitdb.NewMemoryStore()), note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+
+		for _, revoked := range []string{token, other} {
+			if w := performAuthRequest(restarted, "GET", "/notes/", revoked, nil); w.Code != http.StatusForbidden {
+				t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+			}
+		}
+
+		if w := performAuthRequest(restarted, "GET", "/notes/", newToken(t), nil); w.Code != http.StatusOK {
+			t.Errorf("Expected a new login to be valid, got %d", w.Code)
+		}
+	})
+}
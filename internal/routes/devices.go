@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	jwt2 "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"net/http"
+	"strings"
+)
+
+// addDeviceReq is the request body for adding a device
+type addDeviceReq struct {
+	// PublicKey is the PEM encoded public key of the new device
+	PublicKey string `json:"publicKey" binding:"required"`
+	Name      string `json:"name"`
+	// Signature is user.DeviceDigest signed by the existing device SignerID, base64 encoded. Without it, the
+	// device is added with the token of the request.
+	Signature string `json:"signature"`
+	SignerID  string `json:"signerId"`
+}
+
+// optionalAuth runs auth only for requests carrying a token, so handlers can accept other proofs as well
+func optionalAuth(auth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		auth(c)
+	}
+}
+
+// AddDevice is a POST endpoint at /users/:id/devices, adding the public key of a new device. It is authorized by
+// a signature of an existing device over the current nonce and the new key, which peers check as well before they
+// accept notes of the new device, or by a token of the user. A device added with a token can log in, but its notes
+// are only accepted once it is added again with a signature, which endorses it.
+func (u Users) AddDevice(context *gin.Context) {
+	id := context.Param("id")
+
+	var body addDeviceReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	publicKey := strings.ReplaceAll(body.PublicKey, "\r", "")
+
+	_, hasToken := context.Get(jwt2.IdentityKey)
+	if hasToken && !sameUser(context, id) {
+		return
+	}
+
+	var usr *user.User
+	var device *user.Device
+	var err error
+
+	switch {
+	case body.Signature != "":
+		signature, decodeErr := base64.StdEncoding.DecodeString(body.Signature)
+		if decodeErr != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": decodeErr.Error()})
+			return
+		}
+		usr, device, err = user.AddSignedDevice(u.DB, id, body.Name, publicKey, body.SignerID, signature)
+	case hasToken:
+		usr, device, err = user.AddDevice(u.DB, id, body.Name, publicKey)
+	default:
+		context.JSON(http.StatusUnauthorized, gin.H{"error": "a signature of an existing device or a token is required"})
+		return
+	}
+
+	switch {
+	case errors.Is(err, user.ErrInvalidSignature), errors.Is(err, user.ErrNonceUsed), errors.Is(err, user.ErrNonceExpired),
+		errors.Is(err, user.ErrNonceOtherNode):
+		context.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, user.ErrDuplicateKey):
+		context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"_id":    usr.ID.String(),
+		"device": deviceResponse(device),
+	})
+}
+
+// ListDevices is a GET endpoint at /users/:id/devices, listing the devices of the authenticated user
+func (u Users) ListDevices(context *gin.Context) {
+	id := context.Param("id")
+	if !sameUser(context, id) {
+		return
+	}
+
+	find, err := user.Find(u.DB, id)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	devices := make([]gin.H, 0, len(find.Devices))
+	for i := range find.Devices {
+		devices = append(devices, deviceResponse(&find.Devices[i]))
+	}
+
+	context.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+// revokeDeviceReq is the request body for revoking a device
+type revokeDeviceReq struct {
+	// SignerID is the id of the device which signed the revocation, any active device if it is empty
+	SignerID string `json:"signerId"`
+	// RevokedAt is the time of the revocation in unix seconds
+	RevokedAt int64 `json:"revokedAt" binding:"required"`
+	// Signature is user.RevocationDigest signed by an active device, base64 encoded
+	Signature string `json:"signature" binding:"required"`
+}
+
+// RevokeDevice is a DELETE endpoint at /users/:id/devices/:deviceId, revoking a device of the authenticated user.
+// The revocation is signed by a device together with its time, so peers can check when the key ended. Its tokens
+// are rejected from then on.
+func (u Users) RevokeDevice(context *gin.Context) {
+	id := context.Param("id")
+	if !sameUser(context, id) {
+		return
+	}
+
+	var body revokeDeviceReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkClock(context, "revokedAt", body.RevokedAt*1000) {
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(body.Signature)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	usr, err := user.RevokeDevice(u.DB, id, context.Param("deviceId"), body.SignerID, body.RevokedAt, signature)
+	switch {
+	case errors.Is(err, user.ErrDeviceNotFound):
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, user.ErrInvalidSignature), errors.Is(err, user.ErrNonceUsed), errors.Is(err, user.ErrNonceExpired),
+		errors.Is(err, user.ErrNonceOtherNode):
+		context.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, _ := usr.Device(context.Param("deviceId"))
+	context.JSON(http.StatusOK, gin.H{"device": deviceResponse(device)})
+}
+
+// rotateKeyReq is the request body for rotating the key of a device
+type rotateKeyReq struct {
+	// PublicKey is the PEM encoded new public key
+	PublicKey string `json:"publicKey" binding:"required"`
+	// ChangedAt is the time of the handover in unix seconds
+	ChangedAt int64 `json:"changedAt" binding:"required"`
+	// Signature is user.RotationDigest signed with the current key of the device, base64 encoded
+	Signature string `json:"signature" binding:"required"`
+}
+
+// RotateKey is a PUT endpoint at /users/:id/devices/:deviceId/key, replacing the key of a device. The handover is
+// signed with the current key over the current nonce and the new key, so a token is not needed. The key the user
+// registered with is the device with the id of the user.
+func (u Users) RotateKey(context *gin.Context) {
+	var body rotateKeyReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkClock(context, "changedAt", body.ChangedAt*1000) {
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(body.Signature)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	publicKey := strings.ReplaceAll(body.PublicKey, "\r", "")
+	usr, change, err := user.RotateKey(u.DB, context.Param("id"), context.Param("deviceId"), publicKey, body.ChangedAt, signature)
+
+	switch {
+	case errors.Is(err, user.ErrInvalidSignature), errors.Is(err, user.ErrNonceUsed), errors.Is(err, user.ErrNonceExpired),
+		errors.Is(err, user.ErrNonceOtherNode):
+		context.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, user.ErrDuplicateKey):
+		context.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, _ := usr.Device(change.DeviceID.String())
+	context.JSON(http.StatusOK, gin.H{
+		"device": deviceResponse(device),
+		"change": keyChangeResponse(*change),
+	})
+}
+
+// KeyHistory is a GET endpoint at /users/:id/keys, listing the key rotations of the authenticated user
+func (u Users) KeyHistory(context *gin.Context) {
+	id := context.Param("id")
+	if !sameUser(context, id) {
+		return
+	}
+
+	find, err := user.Find(u.DB, id)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	history := make([]gin.H, 0, len(find.KeyHistory))
+	for _, change := range find.KeyHistory {
+		history = append(history, keyChangeResponse(change))
+	}
+
+	context.JSON(http.StatusOK, gin.H{"keys": history})
+}
+
+// keyChangeResponse returns a JSON-parsed version of the user.KeyChange object
+func keyChangeResponse(c user.KeyChange) gin.H {
+	return gin.H{
+		"deviceId":     c.DeviceID.String(),
+		"oldKeyId":     c.OldKeyID,
+		"oldPublicKey": c.OldPublicKey,
+		"newKeyId":     c.NewKeyID,
+		"newPublicKey": c.NewPublicKey,
+		"nonce":        c.Nonce,
+		"signature":    c.Signature,
+		"changedAt":    c.ChangedAt,
+	}
+}
+
+// sameUser checks that the token belongs to the user with the given id. On failure, it responds with an error
+// and returns false.
+func sameUser(context *gin.Context, id string) bool {
+	tokenUser := getUserFromJWT(context)
+	if tokenUser == nil {
+		return false
+	}
+
+	if tokenUser.ID != id {
+		context.JSON(http.StatusForbidden, gin.H{"error": "users can only manage their own account"})
+		return false
+	}
+
+	return true
+}
+
+// deviceResponse returns a JSON-parsed version of the user.Device object
+func deviceResponse(d *user.Device) gin.H {
+	keyID, _ := d.KeyID()
+
+	return gin.H{
+		"id":           d.ID.String(),
+		"name":         d.Name,
+		"publicKey":    d.PublicKey,
+		"keyAlgorithm": d.KeyAlgorithm,
+		"keyId":        keyID,
+		"createdAt":    d.CreatedAt,
+		"revokedAt":    d.RevokedAt,
+		"rotatedAt":    d.RotatedAt,
+		"endorsed":     d.Endorsed(),
+	}
+}
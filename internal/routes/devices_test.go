@@ -0,0 +1,289 @@
+package routes
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newKey generates an Ed25519 key pair, returning the private key and the PEM encoded public key
+func newKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+
+	return priv, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestDeviceRoutes(t *testing.T) {
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	note.VerifyUserNotes(db)
+	index := note.NewIndex(orbitdb.NewMemoryStore())
+	auth := InitAuth(r, db, index, note.NewFeed(db), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+	InitUsers(r, db, index, auth)
+
+	laptop, _ := rsa.GenerateKey(rand.Reader, 2048)
+	usr, err := user.NewUser(db, string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&laptop.PublicKey),
+	})), false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	uid := usr.ID.String()
+
+	// loginDevice logs in with the key of a device and returns the token
+	loginDevice := func(t *testing.T, key ed25519.PrivateKey, deviceID string) string {
+		w := performRequest(r, "GET", "/auth/challenge?id="+uid, nil)
+		var challenge struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &challenge)
+
+		sign, _ := user.SignNonce(key, challenge.Nonce)
+		w = performRequest(r, "POST", "/login", gin.H{
+			"id":        uid,
+			"signature": base64.StdEncoding.EncodeToString(sign),
+			"deviceId":  deviceID,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Token
+	}
+
+	// endorse signs a new key with the key of the device signerID over a fresh nonce
+	endorse := func(key crypto.Signer, signerID, publicKey string, body gin.H) gin.H {
+		w := performRequest(r, "GET", "/auth/challenge?id="+uid, nil)
+		var challenge struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &challenge)
+
+		sign, _ := user.SignDevice(key, challenge.Nonce, publicKey)
+		body["publicKey"] = publicKey
+		body["signature"] = base64.StdEncoding.EncodeToString(sign)
+		body["signerId"] = signerID
+		return body
+	}
+
+	// revoke signs the revocation of the device deviceID with the key of the device signerID over a fresh nonce
+	revoke := func(key crypto.Signer, signerID, deviceID string) gin.H {
+		w := performRequest(r, "GET", "/auth/challenge?id="+uid, nil)
+		var challenge struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &challenge)
+
+		now := time.Now().Unix()
+		sign, _ := user.SignRevocation(key, challenge.Nonce, deviceID, now)
+		return gin.H{"signerId": signerID, "revokedAt": now, "signature": base64.StdEncoding.EncodeToString(sign)}
+	}
+
+	signature := login(t, r, uid, laptop)
+	w := performRequest(r, "POST", "/login", gin.H{"id": uid, "signature": signature})
+	var session struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &session)
+
+	phone, phonePEM := newKey(t)
+	var phoneID, phoneToken string
+
+	t.Run("should add a device with a token", func(t *testing.T) {
+		w := performAuthRequest(r, "POST", "/users/"+uid+"/devices", session.Token, gin.H{"publicKey": phonePEM, "name": "phone"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp struct {
+			Device struct {
+				ID       string `json:"id"`
+				Endorsed bool   `json:"endorsed"`
+			} `json:"device"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		phoneID = resp.Device.ID
+		if resp.Device.Endorsed {
+			t.Errorf("Expected a device added with a token not to be endorsed, got %v", w.Body)
+		}
+
+		phoneToken = loginDevice(t, phone, phoneID)
+
+		// notes of the phone are only accepted once it is endorsed
+		phoneNotes := signer{t: t, db: db, uid: usr.ID, key: phone}
+		w = performAuthRequest(r, "POST", "/notes/", phoneToken, phoneNotes.create(gin.H{"note": "from the phone"}))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the note of an unendorsed device to be rejected, but was %d. %v", w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "POST", "/users/"+uid+"/devices", session.Token, endorse(laptop, uid, phonePEM, gin.H{}))
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK || resp.Device.ID != phoneID || !resp.Device.Endorsed {
+			t.Fatalf("Expected the phone to be endorsed, got %d %v", w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "POST", "/notes/", phoneToken, phoneNotes.create(gin.H{"note": "from the phone"}))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected the note of the endorsed device, but was %d. %v", w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "POST", "/users/"+uid+"/devices", session.Token, endorse(laptop, uid, phonePEM, gin.H{}))
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	t.Run("should add a device signed by an existing device", func(t *testing.T) {
+		_, tabletPEM := newKey(t)
+
+		w := performRequest(r, "POST", "/users/"+uid+"/devices", gin.H{"publicKey": tabletPEM})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+
+		w = performRequest(r, "POST", "/users/"+uid+"/devices", endorse(phone, phoneID, tabletPEM, gin.H{"name": "tablet"}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+	})
+
+	t.Run("should list the devices of the user only", func(t *testing.T) {
+		w := performAuthRequest(r, "GET", "/users/"+uid+"/devices", phoneToken, nil)
+		var resp struct {
+			Devices []struct {
+				Name string `json:"name"`
+			} `json:"devices"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK || len(resp.Devices) != 3 {
+			t.Errorf("Expected 3 devices, got %d %v", w.Code, w.Body)
+		}
+
+		otherToken := newSession(t, r, db)
+		w = performAuthRequest(r, "GET", "/users/"+uid+"/devices", otherToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("should reject the tokens of a revoked device", func(t *testing.T) {
+		w := performAuthRequest(r, "DELETE", "/users/"+uid+"/devices/"+phoneID, session.Token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a signed revocation to be required, but was %d", w.Code)
+		}
+
+		other := revoke(phone, phoneID, uid)
+		w = performAuthRequest(r, "DELETE", "/users/"+uid+"/devices/"+phoneID, session.Token, other)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a revocation of another device to be rejected, but was %d", w.Code)
+		}
+
+		w = performAuthRequest(r, "DELETE", "/users/"+uid+"/devices/"+phoneID, session.Token, revoke(laptop, uid, phoneID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/", phoneToken, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/", session.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusOK, w.Code)
+		}
+
+		w = performAuthRequest(r, "DELETE", "/users/"+uid+"/devices/unknown", session.Token, revoke(laptop, uid, "unknown"))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("should rotate a key with a signed handover", func(t *testing.T) {
+		newLaptop, newLaptopPEM := newKey(t)
+
+		w := performRequest(r, "GET", "/auth/challenge?id="+uid, nil)
+		var challenge struct {
+			Nonce string `json:"nonce"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &challenge)
+
+		now := time.Now().Unix()
+		sign, _ := user.SignRotation(laptop, challenge.Nonce, newLaptopPEM, now)
+		w = performRequest(r, "PUT", "/users/"+uid+"/devices/"+uid+"/key", gin.H{
+			"publicKey": newLaptopPEM,
+			"changedAt": now - 3600,
+			"signature": base64.StdEncoding.EncodeToString(sign),
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a backdated handover to be rejected, but was %d", w.Code)
+		}
+
+		w = performRequest(r, "PUT", "/users/"+uid+"/devices/"+uid+"/key", gin.H{
+			"publicKey": newLaptopPEM,
+			"changedAt": now,
+			"signature": base64.StdEncoding.EncodeToString(sign),
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performRequest(r, "PUT", "/users/"+uid+"/devices/"+uid+"/key", gin.H{
+			"publicKey": newLaptopPEM,
+			"changedAt": now,
+			"signature": base64.StdEncoding.EncodeToString(sign),
+		})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected a replayed handover to be rejected, got %d", w.Code)
+		}
+
+		// the token of the old key
+		w = performAuthRequest(r, "GET", "/notes/", session.Token, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		token := loginDevice(t, newLaptop, uid)
+		w = performAuthRequest(r, "GET", "/users/"+uid+"/keys", token, nil)
+		var history struct {
+			Keys []struct {
+				DeviceID string `json:"deviceId"`
+			} `json:"keys"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &history)
+		if w.Code != http.StatusOK || len(history.Keys) != 1 || history.Keys[0].DeviceID != uid {
+			t.Errorf("Expected the rotation in the key history, got %d %v", w.Code, w.Body)
+		}
+
+		w = performRequest(r, "GET", "/users/"+uid, nil)
+		if !strings.Contains(w.Body.String(), strings.ReplaceAll(newLaptopPEM, "\n", "\\n")) {
+			t.Errorf("Expected the user to have the new key, got %v", w.Body)
+		}
+	})
+}
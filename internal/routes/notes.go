@@ -1,26 +1,65 @@
 package routes
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/docker/distribution/uuid"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	jwt2 "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"io"
+	"log"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // Notes is a reference to the notes database
 type Notes struct {
-	DB     *orbitdb.Database
+	DB     orbitdb.Stores
+	Index  note.Index
+	Feed   *note.Feed
+	Blobs  *orbitdb.CountedBlobStore
 	RGroup *gin.RouterGroup
 }
 
-// createReq is the request body for creating a new note
+// MaxBlobSize is the largest file in bytes that can be uploaded as a note
+var MaxBlobSize int64 = 32 << 20
+
+// MaxClockSkew is how far the time a note is created, changed or deleted at may be from the time of the server
+var MaxClockSkew = 5 * time.Minute
+
+// createReq is the request body for creating a new note, either as plaintext, as an envelope encrypted on the
+// client or as an uploaded file. Notes of a file can also be sent as multipart/form-data, with the file in the
+// field "file" and the other fields as form fields.
 type createReq struct {
-	Note string `json:"note" binding:"required"`
+	// ID and CreatedAt, in unix milliseconds, are chosen by the client, since they are signed
+	ID        string         `json:"id" form:"id" binding:"required"`
+	CreatedAt int64          `json:"createdAt" form:"createdAt" binding:"required"`
+	Note      string         `json:"note" form:"-"`
+	Envelope  *note.Envelope `json:"envelope" form:"-"`
+	// Blob is a file uploaded to /notes/files, as described by the response
+	Blob *note.Blob `json:"blob" form:"-"`
+	// TTL is the number of seconds the note is kept, ExpiresAt the time it expires in unix milliseconds.
+	// Without both, the retention of the user applies. Both count from CreatedAt.
+	TTL       int64 `json:"ttl" form:"ttl"`
+	ExpiresAt int64 `json:"expiresAt" form:"expiresAt"`
+	// Signature is the note.Note.Digest of the note signed by a device of the user, base64 encoded
+	Signature string `json:"signature" form:"signature" binding:"required"`
+	// ExpirySignature is the Digest of the note.Note.ExpiryTombstone signed like the note, required if it expires
+	ExpirySignature string `json:"expirySignature" form:"expirySignature"`
 }
 
-// Create uses the request body to create a new note on authenticated routes
+// Create uses the request body to create a new note on authenticated routes. A note of a multipart/form-data
+// request holds the file of the field "file", described by its Content-Type, filename, size and SHA-256 hash.
 func (n Notes) Create(c *gin.Context) {
 	// get user from JWT
 	user := getUserFromJWT(c)
@@ -29,34 +68,345 @@ func (n Notes) Create(c *gin.Context) {
 		return
 	}
 
+	// convert uid to uuid
+	uid, err := uuid.Parse(user.ID)
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// get request body
 	var body createReq
-	if err := c.ShouldBindJSON(&body); err != nil {
+	multipart := c.ContentType() == "multipart/form-data"
+	if multipart {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBlobSize+1<<20)
+		err = c.ShouldBindWith(&body, binding.FormMultipart)
+	} else {
+		err = c.ShouldBindJSON(&body)
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// convert uid to uuid
-	uid, err := uuid.Parse(user.ID)
-
+	id, err := uuid.Parse(body.ID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if !checkClock(c, "createdAt", body.CreatedAt) {
+		return
+	}
+
+	// the client signs the type it sent the file with, so it is not sniffed
+	if multipart {
+		blob, ok := n.addFile(c, false)
+		if !ok {
+			return
+		}
+		body.Blob = blob
+	}
+
+	if !n.checkContent(c, user.ID, body.Note, body.Envelope, body.Blob) {
+		return
+	}
+
+	signature, ok := decodeSignature(c, body.Signature)
+	if !ok {
+		return
+	}
+
+	expiresAt, ok := n.expiry(c, user.ID, body.CreatedAt, body.TTL, body.ExpiresAt)
+	if !ok {
+		return
+	}
+
+	// the tombstone of an expiring note is written once it expires
+	if expiresAt != 0 {
+		if _, ok := decodeSignature(c, body.ExpirySignature); !ok {
+			return
+		}
+	}
+
+	// the note holds its file from the start, so that the upload can expire
+	if body.Blob != nil {
+		if err := n.Blobs.Claim(c.Request.Context(), body.Blob.CID, id.String()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// create note
-	newNote, err := note.NewNote(body.Note, uid)
+	newNote, err := note.NewNote(n.DB, n.Index, note.Note{
+		ID:              id,
+		UID:             uid,
+		Data:            body.Note,
+		CreatedAt:       body.CreatedAt,
+		Blob:            body.Blob,
+		Envelope:        body.Envelope,
+		ExpiresAt:       expiresAt,
+		ExpirySignature: body.ExpirySignature,
+	}, signature)
+
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		// a rejected note releases its file, a note with the same id keeps holding it
+		if body.Blob != nil && !errors.Is(err, note.ErrNoteExists) {
+			if err := n.Blobs.Release(c.Request.Context(), body.Blob.CID, id.String()); err != nil {
+				log.Printf("Failed to release file %s: %v\n", body.Blob.CID, err)
+			}
+		}
+		noteError(c, err)
 		return
 	}
 
 	// response
-	c.JSON(http.StatusOK, gin.H{
-		"id":   newNote.ID.String(),
-		"uid":  newNote.UID.String(),
-		"note": newNote.Data, // Optional for production: Add encryption
-	})
+	c.JSON(http.StatusOK, noteResponse(newNote))
+}
+
+// checkClock checks that the signed time at, in unix milliseconds, is within MaxClockSkew of the time of the
+// server. Notes are verified against the keys valid at the time they were signed. On failure, it responds with an
+// error and returns false.
+func checkClock(c *gin.Context, name string, at int64) bool {
+	if skew := time.Since(time.UnixMilli(at)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("%s must be within %s of the time of the server", name, MaxClockSkew),
+		})
+		return false
+	}
+	return true
+}
+
+// decodeSignature decodes the base64 signature of a note. On failure, it responds with an error and returns false.
+func decodeSignature(c *gin.Context, raw string) ([]byte, bool) {
+	signature, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(signature) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "signature must be base64 encoded"})
+		return nil, false
+	}
+	return signature, true
+}
+
+// noteError responds with the error of writing a note, notes with an invalid signature are unauthorized
+func noteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, orbitdb.ErrNotOwner):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, note.ErrNoteExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// expiry returns the expiry of a new note created at createdAt in unix milliseconds, from ttl in seconds or
+// expiresAt, or from the retention of the user with the id uid. 0 means that the note does not expire. On invalid
+// values, it responds with an error and returns false.
+func (n Notes) expiry(c *gin.Context, uid string, createdAt, ttl, expiresAt int64) (int64, bool) {
+	switch {
+	case ttl != 0 && expiresAt != 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either ttl or expiresAt can be set"})
+		return 0, false
+	case ttl < 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be positive"})
+		return 0, false
+	case ttl > 0:
+		return createdAt + ttl*1000, true
+	case expiresAt != 0 && expiresAt <= time.Now().UnixMilli():
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return 0, false
+	case expiresAt != 0:
+		return expiresAt, true
+	}
+
+	usr, err := user.Find(n.DB, uid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+
+	if usr.Retention > 0 {
+		return createdAt + usr.Retention*1000, true
+	}
+
+	return 0, true
+}
+
+// checkContent checks that a request has either the text, the envelope or the file of a note, that the envelope
+// is encrypted for the keys of the user with the id uid and that the file has been uploaded as described. On
+// failure, it responds with an error and returns false.
+func (n Notes) checkContent(c *gin.Context, uid, text string, envelope *note.Envelope, blob *note.Blob) bool {
+	contents := 0
+	for _, set := range []bool{text != "", envelope != nil, blob != nil} {
+		if set {
+			contents++
+		}
+	}
+	if contents != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either note, envelope or blob is required"})
+		return false
+	}
+
+	if blob != nil {
+		if blob.CID == "" || blob.SHA256 == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "blob requires the cid and sha256 of an uploaded file"})
+			return false
+		}
+
+		if err := n.Blobs.Verify(c.Request.Context(), blob.CID, blob.SHA256, blob.Size); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		return true
+	}
+
+	if envelope == nil {
+		return true
+	}
+
+	usr, err := user.Find(n.DB, uid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	keys, err := usr.Keys()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	if err := envelope.Validate(keys); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// Upload adds the file of a multipart/form-data request in the field "file" to the blob store. It responds with
+// the description of the file, which a note signs and sends as its "blob" within note.UploadTTL.
+func (n Notes) Upload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBlobSize+1<<20)
+
+	blob, ok := n.addFile(c, true)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, blob)
+}
+
+// addFile adds the file of the field "file" of a multipart/form-data request to the blob store as an upload and
+// returns its description. The MIME type is the Content-Type of the file, sniffed from its content if sniff is set
+// and the type is missing or generic. On failure, it responds with an error and returns false.
+func (n Notes) addFile(c *gin.Context, sniff bool) (*note.Blob, bool) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if header.Size > MaxBlobSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("file must not be larger than %d bytes", MaxBlobSize),
+		})
+		return nil, false
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	defer file.Close()
+
+	mimeType := header.Header.Get("Content-Type")
+	if sniff {
+		mimeType, err = detectMimeType(mimeType, file)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+	} else if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	hash := sha256.New()
+	cid, size, err := n.Blobs.Add(c.Request.Context(), io.TeeReader(file, hash))
+	if err != nil {
+		log.Printf("Failed to add file: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	return &note.Blob{
+		CID:      cid,
+		MimeType: mimeType,
+		Size:     size,
+		Filename: filepath.Base(header.Filename),
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+	}, true
+}
+
+// detectMimeType returns the MIME type sent by the client, or sniffs it from the content of file
+func detectMimeType(declared string, file io.ReadSeeker) (string, error) {
+	if declared != "" && declared != "application/octet-stream" {
+		return declared, nil
+	}
+
+	head := make([]byte, 512)
+	read, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:read]), nil
+}
+
+// Content is a GET endpoint at /notes/:id/content, returning the file of a note, or the text of a text note.
+// Range requests are supported.
+func (n Notes) Content(context *gin.Context) {
+	find := n.ownedNote(context)
+	if find == nil {
+		return
+	}
+
+	if find.Blob == nil {
+		context.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(find.Data))
+		return
+	}
+
+	// the file of a note replicated from another node may not match the hash its owner signed
+	err := n.Blobs.Verify(context.Request.Context(), find.Blob.CID, find.Blob.SHA256, find.Blob.Size)
+	if errors.Is(err, orbitdb.ErrBlobMismatch) {
+		log.Printf("File %s does not match its note %s\n", find.Blob.CID, find.ID)
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	content, err := n.Blobs.Get(context.Request.Context(), find.Blob.CID)
+	if err != nil {
+		log.Printf("Failed to get file %s: %v\n", find.Blob.CID, err)
+		context.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer content.Close()
+
+	context.Header("Content-Type", find.Blob.MimeType)
+	context.Header("ETag", `"`+find.Blob.CID+`"`)
+	if find.Blob.Filename != "" {
+		context.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": find.Blob.Filename,
+		}))
+	}
+
+	http.ServeContent(context.Writer, context.Request, find.Blob.Filename, time.UnixMilli(find.CreatedAt), content)
 }
 
 // getUserFromJWT gets the user from the JWT. It's a helper function.
@@ -74,14 +424,186 @@ func getUserFromJWT(context *gin.Context) *jwt2.User {
 
 // Find returns a note by id on authenticated routes.
 func (n Notes) Find(context *gin.Context) {
+	find := n.ownedNote(context)
+	if find == nil {
+		return
+	}
+
+	// respond
+	context.JSON(http.StatusOK, noteResponse(find))
+}
+
+// List returns a page of notes of the authenticated user, e.g. /notes/?limit=20&cursor=...
+func (n Notes) List(context *gin.Context) {
 	// get user from JWT
 	user := getUserFromJWT(context)
 
 	if user == nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "unable to find user in token"})
 		return
 	}
 
+	limit, cursor, ok := pagination(context)
+	if !ok {
+		return
+	}
+
+	uid, err := uuid.Parse(user.ID)
+
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	notes, next, err := note.ListNotes(n.DB, n.Index, uid, limit, cursor)
+
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, 0, len(notes))
+	for _, nt := range notes {
+		response = append(response, noteResponse(nt))
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"notes": response,
+		"next":  next,
+	})
+}
+
+// pagination reads the ?limit= and ?cursor= query parameters of list endpoints.
+// On invalid parameters, it responds with an error and returns false.
+func pagination(context *gin.Context) (int, string, bool) {
+	limit := orbitdb.DefaultLimit
+
+	if rawLimit := context.Query("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+
+		if err != nil || parsed < 1 || parsed > orbitdb.MaxLimit {
+			context.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("limit must be between 1 and %d", orbitdb.MaxLimit),
+			})
+			return 0, "", false
+		}
+
+		limit = parsed
+	}
+
+	return limit, context.Query("cursor"), true
+}
+
+// updateReq is the request body for updating a note, either as plaintext or as an envelope
+type updateReq struct {
+	Note     string         `json:"note"`
+	Envelope *note.Envelope `json:"envelope"`
+	// UpdatedAt is the time of the change in unix milliseconds, chosen by the client since it is signed
+	UpdatedAt int64 `json:"updatedAt" binding:"required"`
+	// Signature signs the updated note, see createReq
+	Signature string `json:"signature" binding:"required"`
+}
+
+type deleteReq struct {
+	// DeletedAt is the time of the deletion in unix milliseconds
+	DeletedAt int64 `json:"deletedAt" binding:"required"`
+	// Signature is the note.Note.Digest of the tombstone of the note signed by a device of the user, base64 encoded
+	Signature string `json:"signature" binding:"required"`
+}
+
+// Update replaces the text or envelope of a note owned by the authenticated user.
+func (n Notes) Update(context *gin.Context) {
+	find := n.ownedNote(context)
+	if find == nil {
+		return
+	}
+
+	// get request body
+	var body updateReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkClock(context, "updatedAt", body.UpdatedAt) {
+		return
+	}
+
+	if !n.checkContent(context, find.UID.String(), body.Note, body.Envelope, nil) {
+		return
+	}
+
+	signature, ok := decodeSignature(context, body.Signature)
+	if !ok {
+		return
+	}
+
+	var updated *note.Note
+	var err error
+	if body.Envelope != nil {
+		updated, err = note.UpdateEncryptedNote(n.DB, find.UID, find.ID, *body.Envelope, body.UpdatedAt, signature)
+	} else {
+		updated, err = note.UpdateNote(n.DB, find.UID, find.ID, body.Note, body.UpdatedAt, signature)
+	}
+
+	if err != nil {
+		noteError(context, err)
+		return
+	}
+
+	context.JSON(http.StatusOK, noteResponse(updated))
+}
+
+// Delete removes a note owned by the authenticated user.
+func (n Notes) Delete(context *gin.Context) {
+	find := n.ownedNote(context)
+	if find == nil {
+		return
+	}
+
+	var body deleteReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkClock(context, "deletedAt", body.DeletedAt) {
+		return
+	}
+
+	signature, ok := decodeSignature(context, body.Signature)
+	if !ok {
+		return
+	}
+
+	err := note.DeleteNote(n.DB, n.Index, find.UID, find.ID, body.DeletedAt, signature)
+
+	if err != nil {
+		noteError(context, err)
+		return
+	}
+
+	// the note is gone, a file that cannot be released only wastes space
+	if find.Blob != nil {
+		if err := n.Blobs.Release(context.Request.Context(), find.Blob.CID, find.ID.String()); err != nil {
+			log.Printf("Failed to remove file %s: %v\n", find.Blob.CID, err)
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"id": find.ID.String(),
+	})
+}
+
+// ownedNote reads the note with the id of the url and checks that the authenticated user owns it.
+// On failure, it responds with an error and returns nil.
+func (n Notes) ownedNote(context *gin.Context) *note.Note {
+	// get user from JWT
+	user := getUserFromJWT(context)
+
+	if user == nil {
+		return nil
+	}
+
 	// get note id from url
 	id := context.Param("id")
 
@@ -89,7 +611,7 @@ func (n Notes) Find(context *gin.Context) {
 		context.JSON(http.StatusBadRequest, gin.H{
 			"error": "id is required",
 		})
-		return
+		return nil
 	}
 
 	// parse node id
@@ -99,26 +621,69 @@ func (n Notes) Find(context *gin.Context) {
 		context.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
-		return
+		return nil
+	}
+
+	uid, err := uuid.Parse(user.ID)
+
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return nil
 	}
 
-	// note result from database
-	find, err := note.GetNote(noteID)
-	// note owner ID
-	nodeUID := find.UID.String()
+	// note result from the store of the user, or from the notes of older versions
+	find, err := note.GetNote(n.DB, uid, noteID)
+
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return nil
+	}
 
 	// check if user is the owner of the note
-	if nodeUID != user.ID {
+	if find.UID.String() != user.ID {
 		context.JSON(http.StatusBadRequest, gin.H{
 			"error": "user does not own note",
 		})
-		return
+		return nil
 	}
 
-	// respond
-	context.JSON(http.StatusOK, gin.H{
-		"id":   find.ID.String(),
-		"uid":  nodeUID,
-		"note": find.Data,
-	})
+	return find
+}
+
+// noteResponse returns a JSON-parsed version of the note.Note object.
+func noteResponse(n *note.Note) gin.H {
+	resp := gin.H{
+		"id":        n.ID.String(),
+		"uid":       n.UID.String(),
+		"note":      n.Data,
+		"createdAt": n.CreatedAt,
+	}
+
+	if n.Blob != nil {
+		resp["cid"] = n.Blob.CID
+		resp["mimeType"] = n.Blob.MimeType
+		resp["size"] = n.Blob.Size
+		resp["filename"] = n.Blob.Filename
+		if n.Blob.SHA256 != "" {
+			resp["sha256"] = n.Blob.SHA256
+		}
+	}
+
+	if n.Envelope != nil {
+		resp["envelope"] = n.Envelope
+	}
+
+	if n.ExpiresAt != 0 {
+		resp["expiresAt"] = n.ExpiresAt
+	}
+
+	if n.Signature != "" {
+		resp["signature"] = n.Signature
+	}
+
+	return resp
 }
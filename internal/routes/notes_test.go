@@ -1 +1,701 @@
 package routes
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"github.com/gin-gonic/gin"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// performAuthRequest sends an optional JSON body with the JWT as bearer token
+func performAuthRequest(r http.Handler, method, path, token string, body gin.H) *httptest.ResponseRecorder {
+	var req *http.Request
+
+	if body == nil {
+		req, _ = http.NewRequest(method, path, nil)
+	} else {
+		bd, err := json.Marshal(body)
+		if err != nil {
+			panic(err)
+		}
+		req, _ = http.NewRequest(method, path, bytes.NewBuffer(bd))
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// newSession creates a user and returns a valid JWT for it
+func newSession(t *testing.T, r http.Handler, db orbitdb.Stores) string {
+	token, _ := newSigningSession(t, r, db)
+	return token
+}
+
+// signer signs the notes of the user of a test session, as their client does
+type signer struct {
+	t   *testing.T
+	db  orbitdb.Stores
+	uid uuid.UUID
+	key crypto.Signer
+}
+
+// sign returns the base64 signature of a note
+func (s signer) sign(n note.Note) string {
+	signature, err := note.Sign(s.key, &n)
+	if err != nil {
+		s.t.Fatalf("Error signing note: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// create completes the body of a new note with an id, the creation time and its signature. The note expires after
+// its ttl, at its expiresAt or after the retention of the user, with the signature of its expiry.
+func (s signer) create(body gin.H) gin.H {
+	n := note.Note{ID: uuid.Generate(), UID: s.uid, CreatedAt: time.Now().UnixMilli()}
+	n.Data, _ = body["note"].(string)
+	n.Envelope, _ = body["envelope"].(*note.Envelope)
+	n.Blob, _ = body["blob"].(*note.Blob)
+
+	if ttl, ok := body["ttl"].(int); ok && ttl > 0 {
+		n.ExpiresAt = n.CreatedAt + int64(ttl)*1000
+	} else if expiresAt, ok := body["expiresAt"].(int64); ok {
+		n.ExpiresAt = expiresAt
+	} else if u, err := user.Find(s.db, s.uid.String()); err == nil && u.Retention > 0 {
+		n.ExpiresAt = n.CreatedAt + u.Retention*1000
+	}
+
+	body["id"], body["createdAt"] = n.ID.String(), n.CreatedAt
+	body["signature"] = s.sign(n)
+	if n.ExpiresAt != 0 {
+		body["expirySignature"] = s.sign(*n.ExpiryTombstone())
+	}
+	return body
+}
+
+// update completes the body of an update of the note with the id with its signature
+func (s signer) update(id string, body gin.H) gin.H {
+	noteID, _ := uuid.Parse(id)
+	n, err := note.GetNote(s.db, s.uid, noteID)
+	if err != nil {
+		s.t.Fatalf("Error reading note: %v", err)
+	}
+
+	n.Data, _ = body["note"].(string)
+	n.Envelope, _ = body["envelope"].(*note.Envelope)
+	n.UpdatedAt = time.Now().UnixMilli()
+
+	body["updatedAt"], body["signature"] = n.UpdatedAt, s.sign(*n)
+	return body
+}
+
+// remove returns the body of the deletion of the note with the id, its tombstone signed by the user
+func (s signer) remove(id string) gin.H {
+	noteID, _ := uuid.Parse(id)
+	n, err := note.GetNote(s.db, s.uid, noteID)
+	if err != nil {
+		s.t.Fatalf("Error reading note: %v", err)
+	}
+
+	deletedAt := time.Now().UnixMilli()
+	return gin.H{"deletedAt": deletedAt, "signature": s.sign(*n.Tombstone(deletedAt))}
+}
+
+// newSigningSession creates a user and returns a valid JWT for it, together with the signer of their notes
+func newSigningSession(t *testing.T, r http.Handler, db orbitdb.Stores) (string, signer) {
+	privateK, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pubkPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&privateK.PublicKey),
+	})
+
+	usr, err := user.NewUser(db, string(pubkPEM), false)
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+
+	signature := login(t, r, usr.ID.String(), privateK)
+	w := performRequest(r, "POST", "/login", gin.H{"id": usr.ID.String(), "signature": signature})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error parsing login response: %v", err)
+	}
+
+	return resp.Token, signer{t: t, db: db, uid: usr.ID, key: privateK}
+}
+
+func TestNoteRoutes(t *testing.T) {
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	note.VerifyUserNotes(db)
+	blobs := orbitdb.NewMemoryCountedBlobStore()
+	InitAuth(r, db, note.NewIndex(orbitdb.NewMemoryStore()), note.NewFeed(db), blobs, testJWTConfig)
+
+	token, owner := newSigningSession(t, r, db)
+	otherToken, other := newSigningSession(t, r, db)
+
+	// createNote creates a note and returns its id
+	createNote := func(t *testing.T, text string) string {
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": text}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.ID
+	}
+
+	t.Run("should list the notes of the caller only", func(t *testing.T) {
+		createNote(t, "first")
+		createNote(t, "second")
+
+		w := performAuthRequest(r, "GET", "/notes/", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp struct {
+			Notes []gin.H `json:"notes"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if len(resp.Notes) != 2 {
+			t.Errorf("Expected 2 notes, got %d", len(resp.Notes))
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/", otherToken, nil)
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if len(resp.Notes) != 0 {
+			t.Errorf("Expected no notes for another user, got %d", len(resp.Notes))
+		}
+	})
+
+	t.Run("should page through the notes with a cursor", func(t *testing.T) {
+		pageToken, pager := newSigningSession(t, r, db)
+		for _, text := range []string{"a", "b", "c"} {
+			w := performAuthRequest(r, "POST", "/notes/", pageToken, pager.create(gin.H{"note": text}))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+			}
+		}
+
+		var resp struct {
+			Notes []struct {
+				Note string `json:"note"`
+			} `json:"notes"`
+			Next string `json:"next"`
+		}
+
+		w := performAuthRequest(r, "GET", "/notes/?limit=2", pageToken, nil)
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if len(resp.Notes) != 2 || resp.Next == "" {
+			t.Fatalf("Expected a first page of 2 notes and a cursor, got %v", w.Body)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/?limit=2&cursor="+resp.Next, pageToken, nil)
+		resp.Next = ""
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if len(resp.Notes) != 1 || resp.Next != "" {
+			t.Errorf("Expected a last page of 1 note, got %v", w.Body)
+		}
+	})
+
+	t.Run("should reject an invalid limit or cursor", func(t *testing.T) {
+		w := performAuthRequest(r, "GET", "/notes/?limit=0", token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/?cursor=%21", token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("should update a note", func(t *testing.T) {
+		id := createNote(t, "draft")
+
+		w := performAuthRequest(r, "PUT", "/notes/"+id, token, owner.update(id, gin.H{"note": "final"}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/"+id, token, nil)
+		var resp struct {
+			Note string `json:"note"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if resp.Note != "final" {
+			t.Errorf("Expected note to be 'final', got %s", resp.Note)
+		}
+	})
+
+	t.Run("should not update or delete notes of another user", func(t *testing.T) {
+		id := createNote(t, "private")
+
+		hijacked := other.create(gin.H{"note": "hijacked"})
+		w := performAuthRequest(r, "PUT", "/notes/"+id, otherToken, gin.H{"note": "hijacked", "updatedAt": time.Now().UnixMilli(), "signature": hijacked["signature"]})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		w = performAuthRequest(r, "DELETE", "/notes/"+id, otherToken, owner.remove(id))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("should delete a note", func(t *testing.T) {
+		id := createNote(t, "temporary")
+
+		w := performAuthRequest(r, "DELETE", "/notes/"+id, token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected an unsigned deletion to be rejected, got %d", w.Code)
+		}
+
+		forged := owner.remove(id)
+		forged["deletedAt"] = forged["deletedAt"].(int64) + 1
+		w = performAuthRequest(r, "DELETE", "/notes/"+id, token, forged)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+
+		w = performAuthRequest(r, "DELETE", "/notes/"+id, token, owner.remove(id))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/"+id, token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected the deleted note to be gone, got %d", w.Code)
+		}
+	})
+
+	// uploadFile uploads content as a multipart file and returns the response
+	uploadFile := func(t *testing.T, filename, contentType string, content []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		part, _ := writer.CreatePart(header)
+		_, _ = part.Write(content)
+		_ = writer.Close()
+
+		req, _ := http.NewRequest("POST", "/notes/files", body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// upload uploads content as a multipart file and returns the description of the file
+	upload := func(t *testing.T, filename, contentType string, content []byte) *note.Blob {
+		w := uploadFile(t, filename, contentType, content)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var blob note.Blob
+		_ = json.Unmarshal(w.Body.Bytes(), &blob)
+		return &blob
+	}
+
+	// createFile uploads content and creates a note of it, it returns the id of the note
+	createFile := func(t *testing.T, filename, contentType string, content []byte) string {
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{
+			"blob": upload(t, filename, contentType, content),
+		}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		return created.ID
+	}
+
+	// releaseUploads drops the references of the uploads, as the reaper does once they expire
+	releaseUploads := func(t *testing.T) {
+		if _, err := blobs.ReleaseUploads(context.Background(), time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("Error releasing uploads: %v", err)
+		}
+	}
+
+	t.Run("should upload a file and serve its content", func(t *testing.T) {
+		content := []byte("%PDF-1.4 not really a document")
+
+		blob := upload(t, "../report.pdf", "", content)
+		hash := sha256.Sum256(content)
+		if blob.CID == "" || blob.Size != int64(len(content)) || blob.Filename != "report.pdf" ||
+			blob.SHA256 != hex.EncodeToString(hash[:]) {
+			t.Errorf("Expected the description of the file, got %+v", blob)
+		}
+		if blob.MimeType != "application/pdf" {
+			t.Errorf("Expected the sniffed MIME type, got %s", blob.MimeType)
+		}
+
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"blob": blob}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var created struct {
+			ID       string `json:"id"`
+			CID      string `json:"cid"`
+			MimeType string `json:"mimeType"`
+			SHA256   string `json:"sha256"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+		if created.CID != blob.CID || created.MimeType != blob.MimeType || created.SHA256 != blob.SHA256 {
+			t.Errorf("Expected the file in the note, got %+v", created)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/"+created.ID+"/content", token, nil)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("Expected the file content, got %d %v", w.Code, w.Body)
+		}
+		if w.Header().Get("Content-Type") != "application/pdf" {
+			t.Errorf("Expected the content type of the file, got %s", w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Content-Disposition") != `attachment; filename=report.pdf` {
+			t.Errorf("Expected the filename, got %s", w.Header().Get("Content-Disposition"))
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/"+created.ID+"/content", otherToken, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		w = performAuthRequest(r, "DELETE", "/notes/"+created.ID, token, owner.remove(created.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+		releaseUploads(t)
+		if _, err := blobs.Get(context.Background(), created.CID); err == nil {
+			t.Errorf("Expected the file to be removed with its note")
+		}
+	})
+
+	t.Run("should keep a file shared by another note", func(t *testing.T) {
+		content := []byte("shared file")
+
+		first := createFile(t, "shared.txt", "text/plain", content)
+		second := createFile(t, "shared.txt", "text/plain", content)
+
+		w := performAuthRequest(r, "DELETE", "/notes/"+first, token, owner.remove(first))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+		releaseUploads(t)
+
+		w = performAuthRequest(r, "GET", "/notes/"+second+"/content", token, nil)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("Expected the file of the other note, got %d %v", w.Code, w.Body)
+		}
+	})
+
+	t.Run("should keep a shared file when a note of it is rejected", func(t *testing.T) {
+		content := []byte("kept file")
+		id := createFile(t, "kept.txt", "text/plain", content)
+
+		// the upload of the same file is shared with the existing note
+		forged := owner.create(gin.H{"blob": upload(t, "kept.txt", "text/plain", content)})
+		forged["signature"] = other.create(gin.H{"note": "forged"})["signature"]
+		w := performAuthRequest(r, "POST", "/notes/", token, forged)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusUnauthorized, w.Code, w.Body)
+		}
+		releaseUploads(t)
+
+		w = performAuthRequest(r, "GET", "/notes/"+id+"/content", token, nil)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("Expected the file of the existing note, got %d %v", w.Code, w.Body)
+		}
+	})
+
+	t.Run("should only create notes of uploaded files matching their hash", func(t *testing.T) {
+		blob := upload(t, "hashed.txt", "text/plain", []byte("hashed"))
+
+		mismatched := *blob
+		mismatched.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"blob": &mismatched}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		releaseUploads(t)
+		w = performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"blob": blob}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a file without upload to be rejected, got %d", w.Code)
+		}
+	})
+
+	t.Run("should serve ranges of a file", func(t *testing.T) {
+		id := createFile(t, "image.png", "image/png", []byte("0123456789"))
+
+		req, _ := http.NewRequest("GET", "/notes/"+id+"/content", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Range", "bytes=2-5")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+			t.Errorf("Expected bytes 2-5, got %d %s", w.Code, w.Body)
+		}
+		if w.Header().Get("Content-Range") != "bytes 2-5/10" || w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("Unexpected headers %v", w.Header())
+		}
+	})
+
+	t.Run("should serve the text of text notes", func(t *testing.T) {
+		id := createNote(t, "plain")
+
+		w := performAuthRequest(r, "GET", "/notes/"+id+"/content", token, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "plain" {
+			t.Errorf("Expected the text, got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("should only accept envelopes for the keys of the user", func(t *testing.T) {
+		stranger, _ := rsa.GenerateKey(rand.Reader, 2048)
+		envelope, err := note.SealEnvelope([]byte("secret"), []crypto.PublicKey{&stranger.PublicKey})
+		if err != nil {
+			t.Fatalf("Error sealing envelope: %v", err)
+		}
+
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"envelope": envelope}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		w = performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "both", "envelope": envelope}))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("should hide notes after they expire", func(t *testing.T) {
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "123456", "ttl": 3600}))
+		var created struct {
+			ID        string `json:"id"`
+			ExpiresAt int64  `json:"expiresAt"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		if w.Code != http.StatusOK || created.ExpiresAt < time.Now().Add(59*time.Minute).UnixMilli() {
+			t.Fatalf("Expected the note to expire in an hour, got %d %v", w.Code, w.Body)
+		}
+
+		expiresAt := time.Now().Add(50 * time.Millisecond).UnixMilli()
+		w = performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "one-time code",
+			"expiresAt": expiresAt}))
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		if w.Code != http.StatusOK || created.ExpiresAt != expiresAt {
+			t.Fatalf("Expected the note to expire at %d, got %d %v", expiresAt, w.Code, w.Body)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		w = performAuthRequest(r, "GET", "/notes/"+created.ID, token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected the expired note to be hidden, got %d", w.Code)
+		}
+	})
+
+	t.Run("should reject notes created at another time or with a taken id", func(t *testing.T) {
+		late := owner.create(gin.H{"note": "late"})
+		late["createdAt"] = time.Now().Add(-time.Hour).UnixMilli()
+		w := performAuthRequest(r, "POST", "/notes/", token, late)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		id := createNote(t, "taken")
+		again := owner.create(gin.H{"note": "again"})
+		again["id"] = id
+		w = performAuthRequest(r, "POST", "/notes/", token, again)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	t.Run("should reject invalid expiries", func(t *testing.T) {
+		for _, body := range []gin.H{
+			owner.create(gin.H{"note": "x", "ttl": -1}),
+			owner.create(gin.H{"note": "x", "expiresAt": time.Now().Add(-time.Minute).UnixMilli()}),
+			owner.create(gin.H{"note": "x", "ttl": 60, "expiresAt": time.Now().Add(time.Minute).UnixMilli()}),
+		} {
+			w := performAuthRequest(r, "POST", "/notes/", token, body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected %v to be rejected, got %d", body, w.Code)
+			}
+		}
+
+		// the tombstone of an expiring note is signed with it
+		unsigned := owner.create(gin.H{"note": "x", "ttl": 60})
+		delete(unsigned, "expirySignature")
+		forged := owner.create(gin.H{"note": "x", "ttl": 60})
+		forged["expirySignature"] = forged["signature"]
+		for code, body := range map[int]gin.H{http.StatusBadRequest: unsigned, http.StatusUnauthorized: forged} {
+			w := performAuthRequest(r, "POST", "/notes/", token, body)
+			if w.Code != code {
+				t.Errorf("Expected %v to be rejected with %d, got %d", body, code, w.Code)
+			}
+		}
+	})
+
+	t.Run("should only accept notes signed by the user", func(t *testing.T) {
+		unsigned := owner.create(gin.H{"note": "unsigned"})
+		delete(unsigned, "signature")
+		w := performAuthRequest(r, "POST", "/notes/", token, unsigned)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusBadRequest, w.Code)
+		}
+
+		w = performAuthRequest(r, "POST", "/notes/", token, other.create(gin.H{"note": "forged"}))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+
+		// the expiry is signed as well
+		extended := owner.create(gin.H{"note": "extended", "ttl": 60})
+		extended["ttl"] = 3600
+		w = performAuthRequest(r, "POST", "/notes/", token, extended)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+
+		id := createNote(t, "signed")
+		signed := owner.update(id, gin.H{"note": "signed"})
+		w = performAuthRequest(r, "PUT", "/notes/"+id, token, gin.H{"note": "changed", "updatedAt": signed["updatedAt"], "signature": signed["signature"]})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+
+		w = performAuthRequest(r, "GET", "/notes/"+id, token, nil)
+		var resp struct {
+			Note      string `json:"note"`
+			Signature string `json:"signature"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Note != "signed" || resp.Signature == "" {
+			t.Errorf("Expected the signed note, got %v", w.Body)
+		}
+	})
+
+	t.Run("should create a note of a file sent with its signed fields", func(t *testing.T) {
+		content := []byte("a file and its note in one request")
+		hash := sha256.Sum256(content)
+
+		// createMultipart sends the file and the signed fields of its note as multipart/form-data
+		createMultipart := func(signed []byte) *httptest.ResponseRecorder {
+			fields := owner.create(gin.H{"blob": &note.Blob{
+				MimeType: "text/plain",
+				Size:     int64(len(signed)),
+				Filename: "both.txt",
+				SHA256:   hex.EncodeToString(hash[:]),
+			}})
+
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			for _, field := range []string{"id", "createdAt", "signature"} {
+				_ = writer.WriteField(field, fmt.Sprint(fields[field]))
+			}
+
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", `form-data; name="file"; filename="both.txt"`)
+			header.Set("Content-Type", "text/plain")
+			part, _ := writer.CreatePart(header)
+			_, _ = part.Write(content)
+			_ = writer.Close()
+
+			req, _ := http.NewRequest("POST", "/notes/", body)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		// signed for a file of another size
+		w := createMultipart(append(content, '!'))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d. %v", http.StatusUnauthorized, w.Code, w.Body)
+		}
+
+		w = createMultipart(content)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var created struct {
+			ID       string `json:"id"`
+			CID      string `json:"cid"`
+			MimeType string `json:"mimeType"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		if created.CID == "" || created.MimeType != "text/plain" {
+			t.Errorf("Expected the file in the note, got %v", w.Body)
+		}
+
+		releaseUploads(t)
+		w = performAuthRequest(r, "GET", "/notes/"+created.ID+"/content", token, nil)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("Expected the file content, got %d %v", w.Code, w.Body)
+		}
+	})
+
+	t.Run("should reject files that are too large", func(t *testing.T) {
+		defer func(size int64) { MaxBlobSize = size }(MaxBlobSize)
+		MaxBlobSize = 4
+
+		w := uploadFile(t, "big.bin", "", []byte("too large"))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+}
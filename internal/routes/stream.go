@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/uuid"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"log"
+	"net/http"
+	"time"
+)
+
+// StreamPath is the route of Stream, the only one taking the token in the query, see jwt.QueryToken
+const StreamPath = "/notes/stream"
+
+// heartbeat is the interval of keep-alive messages on idle streams
+var heartbeat = 15 * time.Second
+
+// upgrader upgrades /notes/stream requests to WebSockets. Clients authenticate with their token, not with
+// cookies, so requests from other origins are accepted.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// Stream is a GET endpoint at /notes/stream, pushing the note events of the user. Requests upgrading to a
+// WebSocket receive JSON messages, all others Server-Sent Events. Reconnecting clients resume with the
+// Last-Event-ID header or the lastEventId query parameter.
+func (n Notes) Stream(c *gin.Context) {
+	user := getUserFromJWT(c)
+	if user == nil {
+		return
+	}
+
+	uid, err := uuid.Parse(user.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	backlog, events, cancel := n.Feed.Subscribe(uid, lastEventID)
+	defer cancel()
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		streamWebSocket(c, backlog, events)
+		return
+	}
+
+	streamSSE(c, backlog, events)
+}
+
+// streamSSE writes the events as Server-Sent Events until the client disconnects or the feed closes
+func streamSSE(c *gin.Context, backlog []note.Event, events <-chan note.Event) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(evt note.Event) error {
+		data, err := json.Marshal(eventResponse(evt))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, data)
+		return err
+	}
+
+	for _, evt := range backlog {
+		if err := write(evt); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := write(evt); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// streamWebSocket sends the events as JSON messages until the client disconnects or the feed closes
+func streamWebSocket(c *gin.Context, backlog []note.Event, events <-chan note.Event) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Could not upgrade to a WebSocket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// the client only sends control messages, reading detects when it disconnects
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, evt := range backlog {
+		if err := conn.WriteJSON(eventResponse(evt)); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeat)); err != nil {
+				return
+			}
+		case evt, ok := <-events:
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "stream closed"))
+				return
+			}
+			if err := conn.WriteJSON(eventResponse(evt)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventResponse is the JSON representation of a note event
+func eventResponse(evt note.Event) gin.H {
+	resp := gin.H{
+		"id":   evt.ID,
+		"type": evt.Type,
+	}
+
+	switch {
+	case evt.Note != nil:
+		resp["note"] = noteResponse(evt.Note)
+	case evt.Type == note.EventDeleted:
+		resp["note"] = gin.H{"id": evt.NoteID.String()}
+	}
+
+	return resp
+}
@@ -0,0 +1,184 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is a parsed Server-Sent Event
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  map[string]interface{}
+}
+
+// readSSE reads the next event of a Server-Sent Events stream, skipping comments
+func readSSE(t *testing.T, reader *bufio.Reader) sseEvent {
+	var evt sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && evt.Event != "":
+			return evt
+		case strings.HasPrefix(line, "id: "):
+			evt.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			evt.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &evt.Data)
+		}
+	}
+}
+
+func TestStreamRoutes(t *testing.T) {
+	r := setupRouter()
+	db := orbitdb.NewMemoryStores()
+	note.VerifyUserNotes(db)
+	feed := note.NewFeed(db)
+	defer feed.Close()
+	InitAuth(r, db, note.NewIndex(orbitdb.NewMemoryStore()), feed, orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	token, owner := newSigningSession(t, r, db)
+
+	// openSSE opens the stream and returns a reader of its body
+	openSSE := func(t *testing.T, lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest("GET", srv.URL+"/notes/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error opening stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	var createdID string
+
+	t.Run("should push note events as Server-Sent Events", func(t *testing.T) {
+		reader, closeStream := openSSE(t, "")
+		defer closeStream()
+
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "copied"}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		evt := readSSE(t, reader)
+		if evt.Event != note.EventCreated || evt.ID == "" {
+			t.Fatalf("Expected a created event, got %+v", evt)
+		}
+
+		n, _ := evt.Data["note"].(map[string]interface{})
+		if n["note"] != "copied" {
+			t.Errorf("Expected the note in the event, got %v", evt.Data)
+		}
+
+		createdID = evt.ID
+	})
+
+	t.Run("should resume from the Last-Event-ID", func(t *testing.T) {
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "while offline"}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		// the feed receives the write asynchronously
+		time.Sleep(50 * time.Millisecond)
+
+		reader, closeStream := openSSE(t, createdID)
+		defer closeStream()
+
+		evt := readSSE(t, reader)
+		n, _ := evt.Data["note"].(map[string]interface{})
+		if evt.Event != note.EventCreated || n["note"] != "while offline" {
+			t.Errorf("Expected the missed event, got %+v", evt)
+		}
+	})
+
+	t.Run("should push note events over a WebSocket", func(t *testing.T) {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/notes/stream?token=" + token
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("Error opening WebSocket: %v", err)
+		}
+		defer conn.Close()
+
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "over websocket"}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+		w = performAuthRequest(r, "DELETE", "/notes/"+created.ID, token, owner.remove(created.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for _, expected := range []string{note.EventCreated, note.EventDeleted} {
+			var evt struct {
+				Type string `json:"type"`
+				Note struct {
+					ID string `json:"id"`
+				} `json:"note"`
+			}
+			if err := conn.ReadJSON(&evt); err != nil {
+				t.Fatalf("Error reading event: %v", err)
+			}
+			if evt.Type != expected || evt.Note.ID != created.ID {
+				t.Errorf("Expected a %s event of %s, got %+v", expected, created.ID, evt)
+			}
+		}
+	})
+
+	t.Run("should require a token", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/notes/stream")
+		if err != nil {
+			t.Fatalf("Error opening stream: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("should only take the token in the query on the stream", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/notes/?token=" + token)
+		if err != nil {
+			t.Fatalf("Error listing notes: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}
@@ -2,14 +2,13 @@ package routes
 
 import (
 	"github.com/gin-gonic/gin"
-	cors "github.com/itsjamie/gin-cors"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
 	"log"
 	"net/http"
 	"os"
 	"strings"
-	"time"
 )
 
 // init runs on module initialization
@@ -19,30 +18,30 @@ func init() {
 
 // Users is the route module struct
 type Users struct {
-	DB     *orbitdb.Database
+	DB     orbitdb.Stores
+	Index  note.Index
 	RGroup *gin.RouterGroup
 }
 
 var users Users
 
-// InitUsers takes the current gin-instance and ODB to create the corresponding routes
-func InitUsers(router *gin.Engine, db *orbitdb.Database) *Users {
+// InitUsers takes the current gin-instance, ODB, note index and the auth middleware of InitAuth to create the
+// corresponding routes
+func InitUsers(router *gin.Engine, db orbitdb.Stores, index note.Index, auth gin.HandlerFunc) *Users {
 	group := router.Group("/users")
-	group.Use(cors.Middleware(cors.Config{
-		Origins:         "*",
-		Methods:         "GET, PUT, POST, DELETE",
-		RequestHeaders:  "Origin, Authorization, Content-Type",
-		ExposedHeaders:  "",
-		MaxAge:          50 * time.Second,
-		Credentials:     false,
-		ValidateHeaders: false,
-	}))
 	users = Users{
 		DB:     db,
+		Index:  index,
 		RGroup: group,
 	}
 	group.POST("/", users.Create)
 	group.GET("/:id", users.Find)
+	group.PUT("/:id/settings", auth, users.Settings)
+	group.POST("/:id/devices", optionalAuth(auth), users.AddDevice)
+	group.GET("/:id/devices", auth, users.ListDevices)
+	group.DELETE("/:id/devices/:deviceId", auth, users.RevokeDevice)
+	group.PUT("/:id/devices/:deviceId/key", users.RotateKey)
+	group.GET("/:id/keys", auth, users.KeyHistory)
 
 	return &users
 }
@@ -59,7 +58,7 @@ func (u Users) Find(context *gin.Context) {
 		return
 	}
 
-	find, err := user.Find(id)
+	find, err := user.Find(u.DB, id)
 
 	if err != nil {
 		context.JSON(400, gin.H{
@@ -71,6 +70,39 @@ func (u Users) Find(context *gin.Context) {
 	context.JSON(200, u.response(&find))
 }
 
+// settingsReq is the request body for changing the settings of a user
+type settingsReq struct {
+	// Retention is the number of seconds new notes are kept, 0 keeps them
+	Retention *int64 `json:"retention" binding:"required"`
+}
+
+// Settings is a PUT endpoint at /users/:id/settings, changing the settings of the authenticated user
+func (u Users) Settings(context *gin.Context) {
+	id := context.Param("id")
+	if !sameUser(context, id) {
+		return
+	}
+
+	var body settingsReq
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	find, err := user.Find(u.DB, id)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := user.SetRetention(u.DB, &find, *body.Retention); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	context.JSON(http.StatusOK, u.response(&find))
+}
+
 // Create is a POST endpoint at /users/ taking a public key in PEM
 // via Form-File-Upload and returning a new users object.
 func (u Users) Create(c *gin.Context) {
@@ -78,7 +110,10 @@ func (u Users) Create(c *gin.Context) {
 	tmpDir := os.TempDir()
 	file, err := c.FormFile("file")
 	if err != nil {
-		log.Fatal(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "file is required",
+		})
+		return
 	}
 
 	log.Println(file.Filename)
@@ -107,16 +142,16 @@ func (u Users) Create(c *gin.Context) {
 		return
 	}
 
-	// contains BEGIN RSA PUBLIC KEY
-	if !strings.HasPrefix(fileContents, "-----BEGIN RSA PUBLIC KEY-----") {
+	// contains a supported public key: PKIX (Ed25519, ECDSA P-256/P-384, RSA) or PKCS #1 (RSA)
+	if _, _, err := user.ParsePublicKey(fileContents); err != nil {
 		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
-			"message": "Malformed file",
+			"message": "Malformed file: " + err.Error(),
 		})
 		return
 	}
 
 	// create user
-	newUser, err := user.NewUser(fileContents, false)
+	newUser, err := user.NewUser(u.DB, fileContents, false)
 	if err != nil {
 		c.JSON(400, gin.H{
 			"error": err.Error(),
@@ -138,14 +173,41 @@ func (u Users) Create(c *gin.Context) {
 }
 
 // response is an object, returning a JSON-parsed version of the user.User object.
-func (_ Users) response(u *user.User) gin.H {
+func (u Users) response(usr *user.User) gin.H {
+	noteCount, err := u.Index.Count(usr.ID)
+	if err != nil {
+		log.Printf("Cannot count the notes of user %s\n", usr.ID)
+	}
+
+	return u.countedResponse(usr, noteCount)
+}
+
+// countedResponse returns a JSON-parsed version of the user object with the number of its notes
+func (u Users) countedResponse(usr *user.User, noteCount int) gin.H {
+	// peers open the store to replicate the notes of the user
+	notesAddress, err := u.DB.UserNotes.Address(usr.ID.String())
+	if err != nil {
+		log.Printf("Cannot determine the address of the notes of user %s\n", usr.ID)
+	}
+
+	// the key id is derived from the key, the key has been validated on creation
+	var keyID string
+	if pub, _, err := user.ParsePublicKey(usr.PublicKey); err == nil {
+		keyID, _ = user.KeyID(pub)
+	}
+
 	return gin.H{
-		"_id":       u.ID.String(),
-		"publicKey": u.PublicKey,
-		"nonce":     u.Nonce,
-		"createdAt": u.CreatedAt,
-		"updatedAt": u.UpdatedAt,
-		"notes":     u.Notes,
+		"_id":          usr.ID.String(),
+		"publicKey":    usr.PublicKey,
+		"keyAlgorithm": usr.KeyAlgorithm,
+		"keyId":        keyID,
+		"nonce":        usr.Nonce,
+		"createdAt":    usr.CreatedAt,
+		"updatedAt":    usr.UpdatedAt,
+		"retention":    usr.Retention,
+		"roles":        usr.Roles(),
+		"noteCount":    noteCount,
+		"notesAddress": notesAddress,
 	}
 }
 
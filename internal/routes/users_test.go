@@ -2,19 +2,23 @@ package routes
 
 import (
 	"bytes"
-	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"github.com/gin-gonic/gin"
+	jwt2 "gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/jwt"
+	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/note"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/middleware/user"
 	"gitlab.gwdg.de/v.mattfeld/asteroid-server/internal/orbitdb"
+	"mime/multipart"
 
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func performRequest(r http.Handler, method, path string, body gin.H) *httptest.ResponseRecorder {
@@ -37,8 +41,37 @@ func performRequest(r http.Handler, method, path string, body gin.H) *httptest.R
 	return w
 }
 
+// performUpload sends contents as the multipart form file "file"
+func performUpload(r http.Handler, path, filename, contents string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = part.Write([]byte(contents))
+	if err != nil {
+		panic(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	req, _ := http.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
 func setupRouter() *gin.Engine {
 	r := gin.New()
+	r.Use(jwt2.QueryToken(StreamPath))
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 
@@ -64,21 +97,12 @@ func TestUserRoutes(t *testing.T) {
 
 	publicKey := string(pubkPEM)
 
-	cancelFunc, err := orbitdb.InitializeOrbitDB("http://localhost:5001", t.TempDir())
-	if err != nil {
-		t.Fatalf("Error initializing OrbitDB: %v", err)
-	}
-	defer cancelFunc()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	userDB, err := orbitdb.OpenDatabase(ctx, "users")
-
-	if err != nil {
-		t.Fatalf("Error opening database: %v", err)
-	}
+	userDB := orbitdb.NewMemoryStores()
+	note.VerifyUserNotes(userDB)
 
-	InitUsers(r, userDB)
+	index := note.NewIndex(orbitdb.NewMemoryStore())
+	auth := InitAuth(r, userDB, index, note.NewFeed(userDB), orbitdb.NewMemoryCountedBlobStore(), testJWTConfig)
+	InitUsers(r, userDB, index, auth)
 
 	t.Run("should test the /ping endpoint", func(t *testing.T) {
 		w := performRequest(r, "GET", "/ping", nil)
@@ -89,7 +113,7 @@ func TestUserRoutes(t *testing.T) {
 	})
 
 	t.Run("should create a user on /", func(t *testing.T) {
-		w := performRequest(r, "POST", "/users/", gin.H{"publicKey": publicKey})
+		w := performUpload(r, "/users/", "public.pem", publicKey)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
@@ -98,8 +122,40 @@ func TestUserRoutes(t *testing.T) {
 		t.Log(w.Body)
 	})
 
+	t.Run("should create a user with an Ed25519 key on /", func(t *testing.T) {
+		_, edPEM := newKey(t)
+
+		w := performUpload(r, "/users/", "public.pem", edPEM)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp["keyAlgorithm"] != user.KeyAlgorithmEd25519 {
+			t.Errorf("Expected key algorithm %s, got %v", user.KeyAlgorithmEd25519, resp["keyAlgorithm"])
+		}
+	})
+
+	t.Run("should reject an unsupported key file", func(t *testing.T) {
+		w := performUpload(r, "/users/", "public.pem", "-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n")
+
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusUnsupportedMediaType, w.Code, w.Body)
+		}
+	})
+
+	t.Run("should reject a request without a key file", func(t *testing.T) {
+		w := performRequest(r, "POST", "/users/", gin.H{"publicKey": publicKey})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusBadRequest, w.Code, w.Body)
+		}
+	})
+
 	t.Run("should get a user on /:id", func(t *testing.T) {
-		usr, err := user.NewUser(publicKey, false)
+		usr, err := user.NewUser(userDB, publicKey, false)
 		if err != nil {
 			t.Fatalf("Error creating user: %v", err)
 		}
@@ -107,7 +163,44 @@ func TestUserRoutes(t *testing.T) {
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected response code to be %d, but was %d. %v\n", http.StatusOK, w.Code, w.Body)
 		}
+		if !strings.Contains(w.Body.String(), `"notesAddress"`) {
+			t.Errorf("Expected the address of the notes of the user, got %v", w.Body)
+		}
 		t.Log(w.Body)
 	})
+	t.Run("should apply the retention of the user to new notes", func(t *testing.T) {
+		token, owner := newSigningSession(t, r, userDB)
+
+		w := performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "kept"}))
+		var created struct {
+			UID       string `json:"uid"`
+			ExpiresAt int64  `json:"expiresAt"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		if created.ExpiresAt != 0 {
+			t.Errorf("Expected notes to be kept without a retention, got %d", created.ExpiresAt)
+		}
+
+		w = performAuthRequest(r, "PUT", "/users/"+created.UID+"/settings", token, gin.H{"retention": 600})
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"retention":600`) {
+			t.Fatalf("Expected the retention to be set, got %d %v", w.Code, w.Body)
+		}
 
+		w = performAuthRequest(r, "POST", "/notes/", token, owner.create(gin.H{"note": "purged"}))
+		_ = json.Unmarshal(w.Body.Bytes(), &created)
+		if created.ExpiresAt < time.Now().Add(9*time.Minute).UnixMilli() {
+			t.Errorf("Expected the note to expire after the retention, got %d", created.ExpiresAt)
+		}
+
+		otherToken := newSession(t, r, userDB)
+		w = performAuthRequest(r, "PUT", "/users/"+created.UID+"/settings", otherToken, gin.H{"retention": 0})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusForbidden, w.Code)
+		}
+
+		w = performAuthRequest(r, "PUT", "/users/"+created.UID+"/settings", "", gin.H{"retention": 0})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected response code to be %d, but was %d", http.StatusUnauthorized, w.Code)
+		}
+	})
 }